@@ -20,6 +20,7 @@ import (
 	"errors"
 	"fmt"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/pmaccamp/machinery/v1/backends/iface"
@@ -205,6 +206,12 @@ func (b *Backend) SetStateFailure(signature *tasks.Signature, err string) error
 	return b.markTaskCompleted(signature, taskState)
 }
 
+// SetStateRevoked updates task state to REVOKED
+func (b *Backend) SetStateRevoked(signature *tasks.Signature) error {
+	taskState := tasks.NewRevokedTaskState(signature)
+	return b.updateState(taskState)
+}
+
 // GetState returns the latest task state. It will only return the status once
 // as the message will get consumed and removed from the queue.
 func (b *Backend) GetState(taskUUID string) (*tasks.TaskState, error) {
@@ -314,7 +321,7 @@ func (b *Backend) markTaskCompleted(signature *tasks.Signature, taskState *tasks
 		return nil
 	}
 
-	queueName := strings.Replace(taskState.TaskUUID, "-", "", -1)
+	queueName := resultQueueName(taskState.TaskUUID)
 
 	resultMessage := &ResultMessage{
 		ID:        taskState.TaskUUID,
@@ -362,6 +369,81 @@ func (b *Backend) markTaskCompleted(signature *tasks.Signature, taskState *tasks
 	return nil
 }
 
+// Subscribe implements iface.Notifier, completions are received by consuming
+// the queue the result message of the task is published to. The message is
+// not acknowledged, so it goes back on the queue for other readers once the
+// subscription is released.
+func (b *Backend) Subscribe(taskUUID string) (<-chan struct{}, func(), error) {
+	conn, channel, err := b.Open(b.GetConfig().Broker, b.GetConfig().TLSConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Declare the queue so a result message published before the consumer
+	// starts is kept rather than dropped
+	queueName := resultQueueName(taskUUID)
+	if _, err := channel.QueueDeclare(
+		queueName, // name
+		false,     // durable
+		false,     // delete when unused
+		false,     // exclusive
+		false,     // no-wait
+		amqp.Table{"x-expires": int32(b.getExpiresIn())},
+	); err != nil {
+		b.Close(channel, conn)
+		return nil, nil, fmt.Errorf("Queue declare error: %s", err)
+	}
+
+	// A single result message is expected, there is nothing to prefetch
+	if err := channel.Qos(1, 0, false); err != nil {
+		b.Close(channel, conn)
+		return nil, nil, fmt.Errorf("Channel qos error: %s", err)
+	}
+
+	deliveries, err := channel.Consume(
+		queueName, // queue
+		"",        // consumer tag
+		false,     // auto-ack
+		false,     // exclusive
+		false,     // no-local
+		false,     // no-wait
+		nil,       // arguments
+	)
+	if err != nil {
+		b.Close(channel, conn)
+		return nil, nil, fmt.Errorf("Queue consume error: %s", err)
+	}
+
+	completed := make(chan struct{}, 1)
+	doneChan := make(chan struct{})
+	go func() {
+		defer close(doneChan)
+
+		// The deliveries channel is closed along with the AMQP channel
+		for range deliveries {
+			// never block, a pending signal is as good as a new one
+			select {
+			case completed <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	var once sync.Once
+	return completed, func() {
+		once.Do(func() {
+			b.Close(channel, conn)
+			<-doneChan
+		})
+	}, nil
+}
+
+// resultQueueName returns the name of the queue the result message of the
+// task is published to, in the format expected by Celery
+func resultQueueName(taskUUID string) string {
+	return strings.Replace(taskUUID, "-", "", -1)
+}
+
 func amqmChordTriggeredQueue(groupUUID string) string {
 	return fmt.Sprintf("%s_chord_triggered", groupUUID)
 }
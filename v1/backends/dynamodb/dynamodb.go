@@ -6,6 +6,7 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
@@ -167,6 +168,12 @@ func (b *Backend) SetStateFailure(signature *tasks.Signature, err string) error
 	return b.updateToFailureStateWithError(taskState)
 }
 
+// SetStateRevoked ...
+func (b *Backend) SetStateRevoked(signature *tasks.Signature) error {
+	taskState := tasks.NewRevokedTaskState(signature)
+	return b.setTaskState(taskState)
+}
+
 // GetState ...
 func (b *Backend) GetState(taskUUID string) (*tasks.TaskState, error) {
 	result, err := b.client.GetItem(&dynamodb.GetItemInput{
@@ -390,11 +397,15 @@ func (b *Backend) setTaskState(taskState *tasks.TaskState) error {
 		TableName:        aws.String(b.cnf.DynamoDB.TaskStatesTable),
 		UpdateExpression: aws.String(exp),
 	}
+	if !taskState.IsRevoked() {
+		input.ConditionExpression = aws.String(notRevokedCondition)
+		expAttributeValues[":revoked"] = &dynamodb.AttributeValue{S: aws.String(tasks.StateRevoked)}
+	}
 
 	_, err := b.client.UpdateItem(input)
 
 	if err != nil {
-		return err
+		return stateUpdateError(err)
 	}
 	return nil
 }
@@ -402,8 +413,17 @@ func (b *Backend) setTaskState(taskState *tasks.TaskState) error {
 func (b *Backend) initTaskState(taskState *tasks.TaskState) error {
 	av, err := dynamodbattribute.MarshalMap(taskState)
 	input := &dynamodb.PutItemInput{
-		Item:      av,
-		TableName: aws.String(b.cnf.DynamoDB.TaskStatesTable),
+		Item:                av,
+		TableName:           aws.String(b.cnf.DynamoDB.TaskStatesTable),
+		ConditionExpression: aws.String(notRevokedCondition),
+		ExpressionAttributeNames: map[string]*string{
+			"#S": aws.String("State"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":revoked": {
+				S: aws.String(tasks.StateRevoked),
+			},
+		},
 	}
 	if err != nil {
 		return err
@@ -411,7 +431,7 @@ func (b *Backend) initTaskState(taskState *tasks.TaskState) error {
 	_, err = b.client.PutItem(input)
 
 	if err != nil {
-		return err
+		return stateUpdateError(err)
 	}
 	return nil
 }
@@ -421,6 +441,7 @@ func (b *Backend) updateToFailureStateWithError(taskState *tasks.TaskState) erro
 		ExpressionAttributeNames: map[string]*string{
 			"#S": aws.String("State"),
 			"#E": aws.String("Error"),
+			"#C": aws.String("ErrorClass"),
 		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":s": {
@@ -429,25 +450,43 @@ func (b *Backend) updateToFailureStateWithError(taskState *tasks.TaskState) erro
 			":e": {
 				S: aws.String(taskState.Error),
 			},
+			":c": {
+				S: aws.String(taskState.ErrorClass),
+			},
 		},
 		Key: map[string]*dynamodb.AttributeValue{
 			"TaskUUID": {
 				S: aws.String(taskState.TaskUUID),
 			},
 		},
-		ReturnValues:     aws.String("UPDATED_NEW"),
-		TableName:        aws.String(b.cnf.DynamoDB.TaskStatesTable),
-		UpdateExpression: aws.String("SET #S = :s, #E = :e"),
+		ReturnValues:        aws.String("UPDATED_NEW"),
+		TableName:           aws.String(b.cnf.DynamoDB.TaskStatesTable),
+		UpdateExpression:    aws.String("SET #S = :s, #E = :e, #C = :c"),
+		ConditionExpression: aws.String(notRevokedCondition),
 	}
+	input.ExpressionAttributeValues[":revoked"] = &dynamodb.AttributeValue{S: aws.String(tasks.StateRevoked)}
 
 	_, err := b.client.UpdateItem(input)
 
 	if err != nil {
-		return err
+		return stateUpdateError(err)
 	}
 	return nil
 }
 
+// notRevokedCondition makes state updates fail for revoked tasks, the state
+// of a revoked task is never replaced
+const notRevokedCondition = "attribute_not_exists(TaskUUID) OR #S <> :revoked"
+
+// stateUpdateError returns tasks.ErrTaskRevoked if the update failed because
+// the task has been revoked
+func stateUpdateError(err error) error {
+	if aerr, ok := err.(awserr.Error); ok && aerr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+		return tasks.ErrTaskRevoked
+	}
+	return err
+}
+
 func (b *Backend) unmarshalGroupMetaGetItemResult(result *dynamodb.GetItemOutput) (*tasks.GroupMeta, error) {
 	if result == nil {
 		err := errors.New("task state is nil")
@@ -4,6 +4,8 @@ import (
 	"bytes"
 	"encoding/json"
 	"fmt"
+	"sync"
+	"time"
 
 	"github.com/pmaccamp/machinery/v1/backends/iface"
 	"github.com/pmaccamp/machinery/v1/common"
@@ -46,14 +48,37 @@ type Backend struct {
 	common.Backend
 	groups map[string][]string
 	tasks  map[string][]byte
+	chords map[string]bool
+	locks  map[string]lock
+	runs   map[string]time.Time
+	// guards the maps above as tasks might be processed concurrently
+	// when used together with the memory broker
+	mu       sync.RWMutex
+	notifier *common.TaskNotifier
+}
+
+// lock is held by its owner until it expires
+type lock struct {
+	owner     string
+	expiresAt time.Time
 }
 
 // New creates EagerBackend instance
 func New() iface.Backend {
+	return NewWithConfig(new(config.Config))
+}
+
+// NewWithConfig creates EagerBackend instance sharing the config of the
+// server, e.g. its claim check store
+func NewWithConfig(cnf *config.Config) iface.Backend {
 	return &Backend{
-		Backend: common.NewBackend(new(config.Config)),
-		groups:  make(map[string][]string),
-		tasks:   make(map[string][]byte),
+		Backend:  common.NewBackend(cnf),
+		groups:   make(map[string][]string),
+		tasks:    make(map[string][]byte),
+		chords:   make(map[string]bool),
+		locks:    make(map[string]lock),
+		runs:     make(map[string]time.Time),
+		notifier: common.NewTaskNotifier(),
 	}
 }
 
@@ -65,12 +90,18 @@ func (b *Backend) InitGroup(groupUUID string, taskUUIDs []string) error {
 		tasks = append(tasks, v)
 	}
 
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	b.groups[groupUUID] = tasks
 	return nil
 }
 
 // GroupCompleted returns true if all tasks in a group finished
 func (b *Backend) GroupCompleted(groupUUID string, groupTaskCount int) (bool, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	tasks, ok := b.groups[groupUUID]
 	if !ok {
 		return false, NewErrGroupNotFound(groupUUID)
@@ -78,7 +109,7 @@ func (b *Backend) GroupCompleted(groupUUID string, groupTaskCount int) (bool, er
 
 	var countSuccessTasks = 0
 	for _, v := range tasks {
-		t, err := b.GetState(v)
+		t, err := b.getState(v)
 		if err != nil {
 			return false, err
 		}
@@ -93,6 +124,9 @@ func (b *Backend) GroupCompleted(groupUUID string, groupTaskCount int) (bool, er
 
 // GroupTaskStates returns states of all tasks in the group
 func (b *Backend) GroupTaskStates(groupUUID string, groupTaskCount int) ([]*tasks.TaskState, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
 	taskUUIDs, ok := b.groups[groupUUID]
 	if !ok {
 		return nil, NewErrGroupNotFound(groupUUID)
@@ -100,7 +134,7 @@ func (b *Backend) GroupTaskStates(groupUUID string, groupTaskCount int) ([]*task
 
 	ret := make([]*tasks.TaskState, 0, groupTaskCount)
 	for _, taskUUID := range taskUUIDs {
-		t, err := b.GetState(taskUUID)
+		t, err := b.getState(taskUUID)
 		if err != nil {
 			return nil, err
 		}
@@ -116,6 +150,14 @@ func (b *Backend) GroupTaskStates(groupUUID string, groupTaskCount int) ([]*task
 // whether the worker should trigger chord (true) or no if it has been triggered
 // already (false)
 func (b *Backend) TriggerChord(groupUUID string) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.chords[groupUUID] {
+		return false, nil
+	}
+
+	b.chords[groupUUID] = true
 	return true, nil
 }
 
@@ -155,25 +197,25 @@ func (b *Backend) SetStateFailure(signature *tasks.Signature, err string) error
 	return b.updateState(state)
 }
 
+// SetStateRevoked updates task state to REVOKED
+func (b *Backend) SetStateRevoked(signature *tasks.Signature) error {
+	taskState := tasks.NewRevokedTaskState(signature)
+	return b.updateState(taskState)
+}
+
 // GetState returns the latest task state
 func (b *Backend) GetState(taskUUID string) (*tasks.TaskState, error) {
-	tasktStateBytes, ok := b.tasks[taskUUID]
-	if !ok {
-		return nil, NewErrTasknotFound(taskUUID)
-	}
+	b.mu.RLock()
+	defer b.mu.RUnlock()
 
-	state := new(tasks.TaskState)
-	decoder := json.NewDecoder(bytes.NewReader(tasktStateBytes))
-	decoder.UseNumber()
-	if err := decoder.Decode(state); err != nil {
-		return nil, fmt.Errorf("Failed to unmarshal task state %v", b)
-	}
-
-	return state, nil
+	return b.getState(taskUUID)
 }
 
 // PurgeState deletes stored task state
 func (b *Backend) PurgeState(taskUUID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	_, ok := b.tasks[taskUUID]
 	if !ok {
 		return NewErrTasknotFound(taskUUID)
@@ -185,15 +227,84 @@ func (b *Backend) PurgeState(taskUUID string) error {
 
 // PurgeGroupMeta deletes stored group meta data
 func (b *Backend) PurgeGroupMeta(groupUUID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
 	_, ok := b.groups[groupUUID]
 	if !ok {
 		return NewErrGroupNotFound(groupUUID)
 	}
 
 	delete(b.groups, groupUUID)
+	delete(b.chords, groupUUID)
+	return nil
+}
+
+// Lock acquires the lock for the owner or extends it if the owner already
+// holds it, it returns false if another owner holds the lock
+func (b *Backend) Lock(key, owner string, ttl time.Duration) (bool, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	now := time.Now()
+	if l, ok := b.locks[key]; ok && l.owner != owner && now.Before(l.expiresAt) {
+		return false, nil
+	}
+
+	b.locks[key] = lock{owner: owner, expiresAt: now.Add(ttl)}
+	return true, nil
+}
+
+// Unlock releases the lock if it is held by the owner
+func (b *Backend) Unlock(key, owner string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if l, ok := b.locks[key]; ok && l.owner == owner {
+		delete(b.locks, key)
+	}
+	return nil
+}
+
+// LastRun returns the time of the last published run of the periodic task
+func (b *Backend) LastRun(name string) (time.Time, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+
+	return b.runs[name], nil
+}
+
+// SetLastRun records the time of the last published run of the periodic task
+func (b *Backend) SetLastRun(name string, run time.Time) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.runs[name] = run
 	return nil
 }
 
+// Subscribe implements iface.Notifier
+func (b *Backend) Subscribe(taskUUID string) (<-chan struct{}, func(), error) {
+	completed, unsubscribe := b.notifier.Subscribe(taskUUID)
+	return completed, unsubscribe, nil
+}
+
+func (b *Backend) getState(taskUUID string) (*tasks.TaskState, error) {
+	tasktStateBytes, ok := b.tasks[taskUUID]
+	if !ok {
+		return nil, NewErrTasknotFound(taskUUID)
+	}
+
+	state := new(tasks.TaskState)
+	decoder := json.NewDecoder(bytes.NewReader(tasktStateBytes))
+	decoder.UseNumber()
+	if err := decoder.Decode(state); err != nil {
+		return nil, fmt.Errorf("Failed to unmarshal task state %v", b)
+	}
+
+	return state, nil
+}
+
 func (b *Backend) updateState(s *tasks.TaskState) error {
 	// simulate the behavior of json marshal/unmarshal
 	msg, err := json.Marshal(s)
@@ -201,6 +312,17 @@ func (b *Backend) updateState(s *tasks.TaskState) error {
 		return fmt.Errorf("Marshal task state error: %v", err)
 	}
 
+	b.mu.Lock()
+	// the state of a revoked task is never replaced
+	if current, err := b.getState(s.TaskUUID); err == nil && current.IsRevoked() && !s.IsRevoked() {
+		b.mu.Unlock()
+		return tasks.ErrTaskRevoked
+	}
 	b.tasks[s.TaskUUID] = msg
+	b.mu.Unlock()
+
+	if s.IsCompleted() {
+		b.notifier.Notify(s.TaskUUID)
+	}
 	return nil
 }
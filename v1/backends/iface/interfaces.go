@@ -1,6 +1,8 @@
 package iface
 
 import (
+	"time"
+
 	"github.com/pmaccamp/machinery/v1/tasks"
 )
 
@@ -19,6 +21,7 @@ type Backend interface {
 	SetStateRetry(signature *tasks.Signature) error
 	SetStateSuccess(signature *tasks.Signature, results []*tasks.TaskResult) error
 	SetStateFailure(signature *tasks.Signature, err string) error
+	SetStateRevoked(signature *tasks.Signature) error
 	GetState(taskUUID string) (*tasks.TaskState, error)
 
 	// Purging stored stored tasks states and group meta data
@@ -26,3 +29,35 @@ type Backend interface {
 	PurgeState(taskUUID string) error
 	PurgeGroupMeta(groupUUID string) error
 }
+
+// Notifier - an optional interface for result backends able to signal when
+// tasks complete, so results can be awaited without polling
+type Notifier interface {
+	// Subscribe returns a channel receiving a value when the task completes
+	// and a function releasing the subscription. Signals are best effort,
+	// one may be missed e.g. while reconnecting.
+	Subscribe(taskUUID string) (<-chan struct{}, func(), error)
+}
+
+// Locker - an optional interface for result backends able to hold locks
+// shared by all processes using the same backend
+type Locker interface {
+	// Lock acquires the lock for the owner or extends it if the owner
+	// already holds it, it returns false if another owner holds the lock.
+	// The lock is released automatically after ttl unless extended.
+	Lock(key, owner string, ttl time.Duration) (bool, error)
+	// Unlock releases the lock before its ttl runs out, it does nothing
+	// unless the lock is held by the owner
+	Unlock(key, owner string) error
+}
+
+// ScheduleStore - an optional interface for result backends able to keep
+// the state of periodic task schedulers sharing the backend
+type ScheduleStore interface {
+	Locker
+	// LastRun returns the time of the last published run of the periodic
+	// task, or the zero time if it has never been published
+	LastRun(name string) (time.Time, error)
+	// SetLastRun records the time of the last published run
+	SetLastRun(name string, run time.Time) error
+}
@@ -3,6 +3,8 @@ package memcache
 import (
 	"bytes"
 	"encoding/json"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/pmaccamp/machinery/v1/backends/iface"
@@ -162,6 +164,12 @@ func (b *Backend) SetStateFailure(signature *tasks.Signature, err string) error
 	return b.updateState(taskState)
 }
 
+// SetStateRevoked updates task state to REVOKED
+func (b *Backend) SetStateRevoked(signature *tasks.Signature) error {
+	taskState := tasks.NewRevokedTaskState(signature)
+	return b.updateState(taskState)
+}
+
 // GetState returns the latest task state
 func (b *Backend) GetState(taskUUID string) (*tasks.TaskState, error) {
 	item, err := b.getClient().Get(taskUUID)
@@ -169,14 +177,7 @@ func (b *Backend) GetState(taskUUID string) (*tasks.TaskState, error) {
 		return nil, err
 	}
 
-	state := new(tasks.TaskState)
-	decoder := json.NewDecoder(bytes.NewReader(item.Value))
-	decoder.UseNumber()
-	if err := decoder.Decode(state); err != nil {
-		return nil, err
-	}
-
-	return state, nil
+	return decodeTaskState(item.Value)
 }
 
 // PurgeState deletes stored task state
@@ -196,11 +197,48 @@ func (b *Backend) updateState(taskState *tasks.TaskState) error {
 		return err
 	}
 
-	return b.getClient().Set(&gomemcache.Item{
+	encoded, err = b.CompressState(encoded)
+	if err != nil {
+		return err
+	}
+
+	client := b.getClient()
+	item := &gomemcache.Item{
 		Key:        taskState.TaskUUID,
 		Value:      encoded,
 		Expiration: b.getExpirationTimestamp(),
-	})
+	}
+	if taskState.IsRevoked() {
+		return client.Set(item)
+	}
+
+	// The state of a revoked task is never replaced, other states are
+	// replaced with compare and swap so a concurrent revocation is kept
+	for {
+		current, err := client.Get(taskState.TaskUUID)
+		if err == gomemcache.ErrCacheMiss {
+			err = client.Add(item)
+			if err == gomemcache.ErrNotStored {
+				continue
+			}
+			return err
+		}
+		if err != nil {
+			return err
+		}
+
+		if state, err := decodeTaskState(current.Value); err == nil && state.IsRevoked() {
+			return tasks.ErrTaskRevoked
+		}
+
+		current.Value = item.Value
+		current.Expiration = item.Expiration
+		err = client.CompareAndSwap(current)
+		if err == gomemcache.ErrCASConflict || err == gomemcache.ErrNotStored {
+			continue
+		}
+		return err
+	}
 }
 
 // lockGroupMeta acquires lock on group meta data
@@ -260,10 +298,8 @@ func (b *Backend) getStates(taskUUIDs ...string) ([]*tasks.TaskState, error) {
 			return nil, err
 		}
 
-		state := new(tasks.TaskState)
-		decoder := json.NewDecoder(bytes.NewReader(item.Value))
-		decoder.UseNumber()
-		if err := decoder.Decode(state); err != nil {
+		state, err := decodeTaskState(item.Value)
+		if err != nil {
 			return nil, err
 		}
 
@@ -273,6 +309,101 @@ func (b *Backend) getStates(taskUUIDs ...string) ([]*tasks.TaskState, error) {
 	return states, nil
 }
 
+// Lock acquires the lock for the owner or extends it if the owner already
+// holds it, it returns false if another owner holds the lock
+func (b *Backend) Lock(key, owner string, ttl time.Duration) (bool, error) {
+	client := b.getClient()
+	expiration := int32(time.Now().Add(ttl).Unix()) + 1
+
+	item, err := client.Get(lockKey(key))
+	if err == gomemcache.ErrCacheMiss {
+		// Add only stores the item if it does not exist yet
+		err = client.Add(&gomemcache.Item{
+			Key:        lockKey(key),
+			Value:      []byte(owner),
+			Expiration: expiration,
+		})
+		if err == gomemcache.ErrNotStored {
+			return false, nil
+		}
+		return err == nil, err
+	}
+	if err != nil {
+		return false, err
+	}
+	if string(item.Value) != owner {
+		return false, nil
+	}
+
+	// The lock is only extended if it has not changed hands since it was read
+	item.Expiration = expiration
+	err = client.CompareAndSwap(item)
+	if err == gomemcache.ErrCASConflict || err == gomemcache.ErrNotStored {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// Unlock releases the lock if it is held by the owner
+func (b *Backend) Unlock(key, owner string) error {
+	client := b.getClient()
+
+	item, err := client.Get(lockKey(key))
+	if err == gomemcache.ErrCacheMiss {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if string(item.Value) != owner {
+		return nil
+	}
+
+	// A negative expiration expires the item right away
+	item.Expiration = -1
+	err = client.CompareAndSwap(item)
+	if err == gomemcache.ErrCASConflict || err == gomemcache.ErrNotStored {
+		return nil
+	}
+	return err
+}
+
+// LastRun returns the time of the last published run of the periodic task
+func (b *Backend) LastRun(name string) (time.Time, error) {
+	item, err := b.getClient().Get(lastRunKey(name))
+	if err == gomemcache.ErrCacheMiss {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	nanos, err := strconv.ParseInt(string(item.Value), 10, 64)
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, nanos), nil
+}
+
+// SetLastRun records the time of the last published run of the periodic task
+func (b *Backend) SetLastRun(name string, run time.Time) error {
+	return b.getClient().Set(&gomemcache.Item{
+		Key:   lastRunKey(name),
+		Value: []byte(strconv.FormatInt(run.UnixNano(), 10)),
+	})
+}
+
+// lockKey returns the key holding the lock
+func lockKey(key string) string {
+	return fmt.Sprintf("lock:%s", key)
+}
+
+// lastRunKey returns the key holding the last run of the periodic task
+func lastRunKey(name string) string {
+	return fmt.Sprintf("schedule_last_run:%s", name)
+}
+
 // getExpirationTimestamp returns expiration timestamp
 func (b *Backend) getExpirationTimestamp() int32 {
 	expiresIn := b.GetConfig().ResultsExpireIn
@@ -290,3 +421,19 @@ func (b *Backend) getClient() *gomemcache.Client {
 	}
 	return b.client
 }
+
+// decodeTaskState unmarshals a stored task state
+func decodeTaskState(value []byte) (*tasks.TaskState, error) {
+	value, err := common.DecompressState(value)
+	if err != nil {
+		return nil, err
+	}
+
+	state := new(tasks.TaskState)
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	decoder.UseNumber()
+	if err := decoder.Decode(state); err != nil {
+		return nil, err
+	}
+	return state, nil
+}
@@ -199,7 +199,13 @@ func (b *Backend) decodeResults(results []*tasks.TaskResult) []*tasks.TaskResult
 
 // SetStateFailure updates task state to FAILURE
 func (b *Backend) SetStateFailure(signature *tasks.Signature, err string) error {
-	update := bson.M{"state": tasks.StateFailure, "error": err}
+	update := bson.M{"state": tasks.StateFailure, "error": err, "error_class": signature.ErrorClass}
+	return b.updateState(signature, update)
+}
+
+// SetStateRevoked updates task state to REVOKED
+func (b *Backend) SetStateRevoked(signature *tasks.Signature) error {
+	update := bson.M{"state": tasks.StateRevoked}
 	return b.updateState(signature, update)
 }
 
@@ -324,9 +330,18 @@ func (b *Backend) updateState(signature *tasks.Signature, update bson.M) error {
 	if err != nil {
 		return err
 	}
+	// The state of a revoked task is never replaced, the upsert does not
+	// match a revoked task and fails to insert a duplicate instead
+	selector := bson.M{"_id": signature.Id}
+	if update["state"] != tasks.StateRevoked {
+		selector["state"] = bson.M{"$ne": tasks.StateRevoked}
+	}
+
 	return op.Do(func() error {
-		update = bson.M{"$set": update}
-		_, err := op.tasksCollection.UpsertId(signature.Id, update)
+		_, err := op.tasksCollection.Upsert(selector, bson.M{"$set": update})
+		if mgo.IsDup(err) {
+			return tasks.ErrTaskRevoked
+		}
 		return err
 	})
 }
@@ -34,6 +34,12 @@ func newBackend() (iface.Backend, error) {
 	return backend, nil
 }
 
+func TestNotNotifier(t *testing.T) {
+	// mgo cannot follow change streams, waiting for results polls the state
+	_, ok := mongo.New(&config.Config{}).(iface.Notifier)
+	assert.False(t, ok)
+}
+
 func TestNew(t *testing.T) {
 	if os.Getenv("MONGODB_URL") == "" {
 		t.Skip("MONGODB_URL is not defined")
@@ -56,7 +62,7 @@ func TestSetStatePending(t *testing.T) {
 	}
 
 	err = backend.SetStatePending(&tasks.Signature{
-		UUID: taskUUIDs[0],
+		Id: taskUUIDs[0],
 	})
 	if assert.NoError(t, err) {
 		taskState, err := backend.GetState(taskUUIDs[0])
@@ -77,7 +83,7 @@ func TestSetStateReceived(t *testing.T) {
 	}
 
 	err = backend.SetStateReceived(&tasks.Signature{
-		UUID: taskUUIDs[0],
+		Id: taskUUIDs[0],
 	})
 	if assert.NoError(t, err) {
 		taskState, err := backend.GetState(taskUUIDs[0])
@@ -98,7 +104,7 @@ func TestSetStateStarted(t *testing.T) {
 	}
 
 	err = backend.SetStateStarted(&tasks.Signature{
-		UUID: taskUUIDs[0],
+		Id: taskUUIDs[0],
 	})
 	if assert.NoError(t, err) {
 		taskState, err := backend.GetState(taskUUIDs[0])
@@ -122,7 +128,7 @@ func TestSetStateSuccess(t *testing.T) {
 	}
 
 	signature := &tasks.Signature{
-		UUID: taskUUIDs[0],
+		Id: taskUUIDs[0],
 	}
 	taskResults := []*tasks.TaskResult{
 		{
@@ -153,7 +159,7 @@ func TestSetStateFailure(t *testing.T) {
 	}
 
 	signature := &tasks.Signature{
-		UUID: taskUUIDs[0],
+		Id: taskUUIDs[0],
 	}
 	err = backend.SetStateFailure(signature, failString)
 	assert.NoError(t, err)
@@ -181,14 +187,14 @@ func TestGroupCompleted(t *testing.T) {
 	}
 
 	signature := &tasks.Signature{
-		UUID: taskUUIDs[0],
+		Id: taskUUIDs[0],
 	}
 	err = backend.SetStateFailure(signature, "Fail is ok")
 	assert.NoError(t, err)
 	taskResultsState[taskUUIDs[0]] = tasks.StateFailure
 
 	signature = &tasks.Signature{
-		UUID: taskUUIDs[1],
+		Id: taskUUIDs[1],
 	}
 	taskResults := []*tasks.TaskResult{
 		{
@@ -201,7 +207,7 @@ func TestGroupCompleted(t *testing.T) {
 	taskResultsState[taskUUIDs[1]] = tasks.StateSuccess
 
 	signature = &tasks.Signature{
-		UUID: taskUUIDs[2],
+		Id: taskUUIDs[2],
 	}
 	err = backend.SetStateSuccess(signature, taskResults)
 	assert.NoError(t, err)
@@ -0,0 +1,496 @@
+package redis
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pmaccamp/machinery/v1/backends/iface"
+	"github.com/pmaccamp/machinery/v1/common"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/log"
+	"github.com/pmaccamp/machinery/v1/tasks"
+)
+
+// Backend represents a Redis result backend
+type Backend struct {
+	common.Backend
+	common.RedisConnector
+	host       string
+	password   string
+	db         int
+	socketPath string // if set, path to a socket file overrides hostname
+
+	pool      *redis.Pool
+	redisOnce sync.Once
+
+	// notifier signals subscribers in this process of tasks whose completion
+	// has been published to completedChannel, pubsub listens to the channel
+	// while there are subscribers
+	notifier *common.TaskNotifier
+	notifyMu sync.Mutex
+	pubsub   *redis.PubSubConn
+}
+
+const (
+	// completedChannel is the channel the UUIDs of completed tasks are published to
+	completedChannel = "machinery_tasks_completed"
+	// lastRunsKey is the hash of the last published runs of periodic tasks
+	lastRunsKey = "machinery_schedule_last_runs"
+)
+
+var (
+	// setStateScript saves the task state unless the task has been revoked,
+	// revocation is marked by a separate key so the state needs no decoding.
+	// It returns 1 if the state has been saved.
+	setStateScript = redis.NewScript(2, `
+		if ARGV[3] == "1" then
+			redis.call("SET", KEYS[2], 1, "EX", ARGV[2])
+		elseif redis.call("EXISTS", KEYS[2]) == 1 then
+			return 0
+		end
+		redis.call("SET", KEYS[1], ARGV[1], "EX", ARGV[2])
+		return 1
+	`)
+	// lockScript acquires a lock which is free or extends a lock held by
+	// the owner, it returns 1 on success
+	lockScript = redis.NewScript(1, `
+		if redis.call("GET", KEYS[1]) == ARGV[1] then
+			return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+		end
+		if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+			return 1
+		end
+		return 0
+	`)
+	// unlockScript deletes a lock if it is held by the owner
+	unlockScript = redis.NewScript(1, `
+		if redis.call("GET", KEYS[1]) == ARGV[1] then
+			return redis.call("DEL", KEYS[1])
+		end
+		return 0
+	`)
+)
+
+// New creates Backend instance
+func New(cnf *config.Config, host, password, socketPath string, db int) iface.Backend {
+	return &Backend{
+		Backend:    common.NewBackend(cnf),
+		host:       host,
+		password:   password,
+		db:         db,
+		socketPath: socketPath,
+		notifier:   common.NewTaskNotifier(),
+	}
+}
+
+// InitGroup creates and saves a group meta data object
+func (b *Backend) InitGroup(groupUUID string, taskUUIDs []string) error {
+	groupMeta := &tasks.GroupMeta{
+		GroupUUID: groupUUID,
+		TaskUUIDs: taskUUIDs,
+		CreatedAt: time.Now().UTC(),
+	}
+
+	encoded, err := json.Marshal(groupMeta)
+	if err != nil {
+		return err
+	}
+
+	conn := b.open()
+	defer conn.Close()
+
+	_, err = conn.Do("SET", groupUUID, encoded, "EX", b.getExpiration())
+	return err
+}
+
+// GroupCompleted returns true if all tasks in a group finished
+func (b *Backend) GroupCompleted(groupUUID string, groupTaskCount int) (bool, error) {
+	groupMeta, err := b.getGroupMeta(groupUUID)
+	if err != nil {
+		return false, err
+	}
+
+	taskStates, err := b.getStates(groupMeta.TaskUUIDs...)
+	if err != nil {
+		return false, err
+	}
+
+	var countSuccessTasks = 0
+	for _, taskState := range taskStates {
+		if taskState.IsCompleted() {
+			countSuccessTasks++
+		}
+	}
+
+	return countSuccessTasks == groupTaskCount, nil
+}
+
+// GroupTaskStates returns states of all tasks in the group
+func (b *Backend) GroupTaskStates(groupUUID string, groupTaskCount int) ([]*tasks.TaskState, error) {
+	groupMeta, err := b.getGroupMeta(groupUUID)
+	if err != nil {
+		return []*tasks.TaskState{}, err
+	}
+
+	return b.getStates(groupMeta.TaskUUIDs...)
+}
+
+// TriggerChord flags chord as triggered in the backend storage to make sure
+// chord is never trigerred multiple times. Returns a boolean flag to indicate
+// whether the worker should trigger chord (true) or no if it has been triggered
+// already (false)
+func (b *Backend) TriggerChord(groupUUID string) (bool, error) {
+	if _, err := b.getGroupMeta(groupUUID); err != nil {
+		return false, err
+	}
+
+	conn := b.open()
+	defer conn.Close()
+
+	// SET with the NX option only succeeds for the first caller, so no matter
+	// how many workers race here, exactly one of them triggers the chord
+	reply, err := conn.Do("SET", chordTriggeredKey(groupUUID), 1, "NX", "EX", b.getExpiration())
+	if err != nil {
+		return false, err
+	}
+
+	return reply != nil, nil
+}
+
+// SetStatePending updates task state to PENDING
+func (b *Backend) SetStatePending(signature *tasks.Signature) error {
+	taskState := tasks.NewPendingTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateReceived updates task state to RECEIVED
+func (b *Backend) SetStateReceived(signature *tasks.Signature) error {
+	taskState := tasks.NewReceivedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateStarted updates task state to STARTED
+func (b *Backend) SetStateStarted(signature *tasks.Signature) error {
+	taskState := tasks.NewStartedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateRetry updates task state to RETRY
+func (b *Backend) SetStateRetry(signature *tasks.Signature) error {
+	taskState := tasks.NewRetryTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateSuccess updates task state to SUCCESS
+func (b *Backend) SetStateSuccess(signature *tasks.Signature, results []*tasks.TaskResult) error {
+	taskState := tasks.NewSuccessTaskState(signature, results)
+	return b.updateState(taskState)
+}
+
+// SetStateFailure updates task state to FAILURE
+func (b *Backend) SetStateFailure(signature *tasks.Signature, err string) error {
+	taskState := tasks.NewFailureTaskState(signature, err)
+	return b.updateState(taskState)
+}
+
+// SetStateRevoked updates task state to REVOKED
+func (b *Backend) SetStateRevoked(signature *tasks.Signature) error {
+	taskState := tasks.NewRevokedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// GetState returns the latest task state
+func (b *Backend) GetState(taskUUID string) (*tasks.TaskState, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	item, err := redis.Bytes(conn.Do("GET", taskUUID))
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeTaskState(item)
+}
+
+// PurgeState deletes stored task state
+func (b *Backend) PurgeState(taskUUID string) error {
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", taskUUID, revokedKey(taskUUID))
+	return err
+}
+
+// PurgeGroupMeta deletes stored group meta data
+func (b *Backend) PurgeGroupMeta(groupUUID string) error {
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := conn.Do("DEL", groupUUID, chordTriggeredKey(groupUUID))
+	return err
+}
+
+// Lock acquires the lock for the owner or extends it if the owner already
+// holds it, it returns false if another owner holds the lock
+func (b *Backend) Lock(key, owner string, ttl time.Duration) (bool, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	return redis.Bool(lockScript.Do(conn, lockKey(key), owner, ttl.Milliseconds()))
+}
+
+// Unlock releases the lock if it is held by the owner
+func (b *Backend) Unlock(key, owner string) error {
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := unlockScript.Do(conn, lockKey(key), owner)
+	return err
+}
+
+// LastRun returns the time of the last published run of the periodic task
+func (b *Backend) LastRun(name string) (time.Time, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	nanos, err := redis.Int64(conn.Do("HGET", lastRunsKey, name))
+	if err == redis.ErrNil {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, nanos), nil
+}
+
+// SetLastRun records the time of the last published run of the periodic task
+func (b *Backend) SetLastRun(name string, run time.Time) error {
+	conn := b.open()
+	defer conn.Close()
+
+	_, err := conn.Do("HSET", lastRunsKey, name, run.UnixNano())
+	return err
+}
+
+// getGroupMeta retrieves group meta data, convenience function to avoid repetition
+func (b *Backend) getGroupMeta(groupUUID string) (*tasks.GroupMeta, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	item, err := redis.Bytes(conn.Do("GET", groupUUID))
+	if err != nil {
+		return nil, err
+	}
+
+	groupMeta := new(tasks.GroupMeta)
+	decoder := json.NewDecoder(bytes.NewReader(item))
+	decoder.UseNumber()
+	if err := decoder.Decode(groupMeta); err != nil {
+		return nil, err
+	}
+
+	return groupMeta, nil
+}
+
+// getStates returns multiple task states
+func (b *Backend) getStates(taskUUIDs ...string) ([]*tasks.TaskState, error) {
+	taskStates := make([]*tasks.TaskState, len(taskUUIDs))
+	if len(taskUUIDs) == 0 {
+		return taskStates, nil
+	}
+
+	conn := b.open()
+	defer conn.Close()
+
+	// conn.Do requires []interface{}... can't pass []string unfortunately
+	taskUUIDInterfaces := make([]interface{}, len(taskUUIDs))
+	for i, taskUUID := range taskUUIDs {
+		taskUUIDInterfaces[i] = taskUUID
+	}
+
+	items, err := redis.ByteSlices(conn.Do("MGET", taskUUIDInterfaces...))
+	if err != nil {
+		return nil, err
+	}
+
+	for i, item := range items {
+		if item == nil {
+			return nil, fmt.Errorf("Task state not found: %s", taskUUIDs[i])
+		}
+
+		taskState, err := decodeTaskState(item)
+		if err != nil {
+			return nil, err
+		}
+		taskStates[i] = taskState
+	}
+
+	return taskStates, nil
+}
+
+// updateState saves current task state
+func (b *Backend) updateState(taskState *tasks.TaskState) error {
+	encoded, err := json.Marshal(taskState)
+	if err != nil {
+		return err
+	}
+
+	encoded, err = b.CompressState(encoded)
+	if err != nil {
+		return err
+	}
+
+	conn := b.open()
+	defer conn.Close()
+
+	saved, err := redis.Bool(setStateScript.Do(
+		conn,
+		taskState.TaskUUID,
+		revokedKey(taskState.TaskUUID),
+		encoded,
+		b.getExpiration(),
+		taskState.IsRevoked(),
+	))
+	if err != nil {
+		return err
+	}
+	if !saved {
+		return tasks.ErrTaskRevoked
+	}
+
+	if taskState.IsCompleted() {
+		_, err = conn.Do("PUBLISH", completedChannel, taskState.TaskUUID)
+	}
+	return err
+}
+
+// Subscribe implements iface.Notifier, completions are received through
+// Redis pub/sub
+func (b *Backend) Subscribe(taskUUID string) (<-chan struct{}, func(), error) {
+	b.notifyMu.Lock()
+	defer b.notifyMu.Unlock()
+
+	if b.pubsub == nil {
+		if err := b.listen(); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	completed, unsubscribe := b.notifier.Subscribe(taskUUID)
+	return completed, func() {
+		unsubscribe()
+
+		b.notifyMu.Lock()
+		defer b.notifyMu.Unlock()
+
+		// stop listening once nobody waits for tasks, the listener closes
+		// the connection when unsubscribed
+		if b.pubsub != nil && b.notifier.Subscribers() == 0 {
+			b.pubsub.Unsubscribe()
+			b.pubsub = nil
+		}
+	}, nil
+}
+
+// listen subscribes to the completed channel and notifies subscribers of the
+// completed tasks in the background until unsubscribed
+func (b *Backend) listen() error {
+	pubsub := &redis.PubSubConn{Conn: b.open()}
+	if err := pubsub.Subscribe(completedChannel); err != nil {
+		pubsub.Close()
+		return err
+	}
+
+	// wait for the subscription so no completion published from now on is missed
+	if _, ok := pubsub.Receive().(redis.Subscription); !ok {
+		pubsub.Close()
+		return fmt.Errorf("Subscribe to %s failed", completedChannel)
+	}
+	b.pubsub = pubsub
+
+	go func() {
+		defer func() {
+			// closing writes to the connection as unsubscribing does, the
+			// lock keeps them apart
+			b.notifyMu.Lock()
+			defer b.notifyMu.Unlock()
+
+			// after an error subscribers fall back to polling, the next
+			// one listens again
+			if b.pubsub == pubsub {
+				b.pubsub = nil
+			}
+			pubsub.Close()
+		}()
+
+		for {
+			switch v := pubsub.ReceiveWithTimeout(0).(type) {
+			case redis.Message:
+				b.notifier.Notify(string(v.Data))
+			case redis.Subscription:
+				if v.Count == 0 {
+					return
+				}
+			case error:
+				log.WARNING.Printf("Receive from %s returned error: %s", completedChannel, v)
+				return
+			}
+		}
+	}()
+	return nil
+}
+
+// getExpiration returns expiration in seconds
+func (b *Backend) getExpiration() int {
+	expiresIn := b.GetConfig().ResultsExpireIn
+	if expiresIn == 0 {
+		// expire results after 1 day by default
+		expiresIn = config.DefaultResultsExpireIn
+	}
+	return expiresIn
+}
+
+// open returns a connection from the pool, the pool is created on first use
+func (b *Backend) open() redis.Conn {
+	b.redisOnce.Do(func() {
+		b.pool = b.NewPool(b.socketPath, b.host, b.password, b.db, b.GetConfig().Redis, b.GetConfig().TLSConfig)
+	})
+
+	return b.pool.Get()
+}
+
+// chordTriggeredKey returns the key flagging the chord of a group as triggered
+func chordTriggeredKey(groupUUID string) string {
+	return fmt.Sprintf("%s:chord_triggered", groupUUID)
+}
+
+// revokedKey returns the key marking the task as revoked
+func revokedKey(taskUUID string) string {
+	return fmt.Sprintf("%s:revoked", taskUUID)
+}
+
+// lockKey returns the key holding the lock
+func lockKey(key string) string {
+	return fmt.Sprintf("lock:%s", key)
+}
+
+// decodeTaskState unmarshals a stored task state
+func decodeTaskState(item []byte) (*tasks.TaskState, error) {
+	item, err := common.DecompressState(item)
+	if err != nil {
+		return nil, err
+	}
+
+	taskState := new(tasks.TaskState)
+	decoder := json.NewDecoder(bytes.NewReader(item))
+	decoder.UseNumber()
+	if err := decoder.Decode(taskState); err != nil {
+		return nil, err
+	}
+	return taskState, nil
+}
@@ -0,0 +1,301 @@
+package redis_test
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pmaccamp/machinery/v1/backends/iface"
+	"github.com/pmaccamp/machinery/v1/backends/redis"
+	"github.com/pmaccamp/machinery/v1/compression"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTaskStateLifecycle(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	backend := redis.New(&config.Config{ResultsExpireIn: 30}, s.Addr(), "", "", 0)
+
+	signature := &tasks.Signature{Id: "task_1", Task: "add"}
+
+	require.NoError(t, backend.SetStatePending(signature))
+	taskState, err := backend.GetState("task_1")
+	require.NoError(t, err)
+	assert.Equal(t, tasks.StatePending, taskState.State)
+	assert.Equal(t, "add", taskState.TaskName)
+	assert.Equal(t, 30*time.Second, s.TTL("task_1"))
+
+	require.NoError(t, backend.SetStateStarted(signature))
+	taskState, err = backend.GetState("task_1")
+	require.NoError(t, err)
+	assert.Equal(t, tasks.StateStarted, taskState.State)
+
+	results := []*tasks.TaskResult{{Type: "int64", Value: 3}}
+	require.NoError(t, backend.SetStateSuccess(signature, results))
+	taskState, err = backend.GetState("task_1")
+	require.NoError(t, err)
+	assert.True(t, taskState.IsSuccess())
+	require.Len(t, taskState.Results, 1)
+	assert.Equal(t, "int64", taskState.Results[0].Type)
+
+	require.NoError(t, backend.SetStateFailure(signature, "boom"))
+	taskState, err = backend.GetState("task_1")
+	require.NoError(t, err)
+	assert.True(t, taskState.IsFailure())
+	assert.Equal(t, "boom", taskState.Error)
+
+	require.NoError(t, backend.PurgeState("task_1"))
+	_, err = backend.GetState("task_1")
+	assert.Error(t, err)
+}
+
+func TestCompressedResults(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	backend := redis.New(&config.Config{
+		Compression: &config.CompressionConfig{Encoding: compression.EncodingGzip, Threshold: 512},
+	}, s.Addr(), "", "", 0)
+
+	signature := &tasks.Signature{Id: "task_1", Task: "echo"}
+
+	// small states are stored uncompressed
+	require.NoError(t, backend.SetStatePending(signature))
+	stored, err := s.Get("task_1")
+	require.NoError(t, err)
+	assert.Equal(t, "", compression.Detect([]byte(stored)))
+
+	results := []*tasks.TaskResult{{Type: "string", Value: strings.Repeat("a", 1024)}}
+	require.NoError(t, backend.SetStateSuccess(signature, results))
+	stored, err = s.Get("task_1")
+	require.NoError(t, err)
+	assert.Equal(t, compression.EncodingGzip, compression.Detect([]byte(stored)))
+
+	taskState, err := backend.GetState("task_1")
+	require.NoError(t, err)
+	require.Len(t, taskState.Results, 1)
+	assert.Equal(t, strings.Repeat("a", 1024), taskState.Results[0].Value)
+}
+
+func TestResultsExpire(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	backend := redis.New(&config.Config{ResultsExpireIn: 10}, s.Addr(), "", "", 0)
+
+	require.NoError(t, backend.SetStatePending(&tasks.Signature{Id: "task_1"}))
+	require.NoError(t, backend.InitGroup("group_1", []string{"task_1"}))
+
+	s.FastForward(11 * time.Second)
+
+	_, err := backend.GetState("task_1")
+	assert.Error(t, err)
+	_, err = backend.GroupCompleted("group_1", 1)
+	assert.Error(t, err)
+}
+
+func TestGroupCompleted(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	backend := redis.New(&config.Config{}, s.Addr(), "", "", 0)
+
+	task1 := &tasks.Signature{Id: "task_1", GroupUUID: "group_1"}
+	task2 := &tasks.Signature{Id: "task_2", GroupUUID: "group_1"}
+
+	require.NoError(t, backend.InitGroup("group_1", []string{"task_1", "task_2"}))
+	assert.Equal(t, time.Duration(config.DefaultResultsExpireIn)*time.Second, s.TTL("group_1"))
+
+	// States have not been saved yet
+	_, err := backend.GroupCompleted("group_1", 2)
+	assert.Error(t, err)
+
+	require.NoError(t, backend.SetStatePending(task1))
+	require.NoError(t, backend.SetStateStarted(task2))
+
+	completed, err := backend.GroupCompleted("group_1", 2)
+	require.NoError(t, err)
+	assert.False(t, completed)
+
+	require.NoError(t, backend.SetStateSuccess(task1, []*tasks.TaskResult{}))
+	require.NoError(t, backend.SetStateFailure(task2, "boom"))
+
+	completed, err = backend.GroupCompleted("group_1", 2)
+	require.NoError(t, err)
+	assert.True(t, completed)
+
+	taskStates, err := backend.GroupTaskStates("group_1", 2)
+	require.NoError(t, err)
+	require.Len(t, taskStates, 2)
+	assert.Equal(t, "task_1", taskStates[0].TaskUUID)
+	assert.True(t, taskStates[0].IsSuccess())
+	assert.Equal(t, "task_2", taskStates[1].TaskUUID)
+	assert.True(t, taskStates[1].IsFailure())
+
+	require.NoError(t, backend.PurgeGroupMeta("group_1"))
+	_, err = backend.GroupCompleted("group_1", 2)
+	assert.Error(t, err)
+}
+
+func TestTriggerChord(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	backend := redis.New(&config.Config{}, s.Addr(), "", "", 0)
+
+	// Group meta must exist before the chord can be triggered
+	_, err := backend.TriggerChord("group_1")
+	assert.Error(t, err)
+
+	require.NoError(t, backend.InitGroup("group_1", []string{"task_1", "task_2"}))
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		triggered int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shouldTrigger, err := backend.TriggerChord("group_1")
+			assert.NoError(t, err)
+			if shouldTrigger {
+				mu.Lock()
+				triggered++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, triggered)
+
+	// Purging the group meta data resets the chord flag as well
+	require.NoError(t, backend.PurgeGroupMeta("group_1"))
+	require.NoError(t, backend.InitGroup("group_1", []string{"task_1", "task_2"}))
+	shouldTrigger, err := backend.TriggerChord("group_1")
+	require.NoError(t, err)
+	assert.True(t, shouldTrigger)
+}
+
+func TestRevokedStateIsKept(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	backend := redis.New(&config.Config{}, s.Addr(), "", "", 0)
+
+	signature := &tasks.Signature{Id: "task_1", Task: "add"}
+	require.NoError(t, backend.SetStateStarted(signature))
+	require.NoError(t, backend.SetStateRevoked(signature))
+
+	assert.Equal(t, tasks.ErrTaskRevoked, backend.SetStateSuccess(signature, nil))
+	assert.Equal(t, tasks.ErrTaskRevoked, backend.SetStatePending(signature))
+	taskState, err := backend.GetState("task_1")
+	require.NoError(t, err)
+	assert.True(t, taskState.IsRevoked())
+
+	// purging the state forgets the revocation
+	require.NoError(t, backend.PurgeState("task_1"))
+	require.NoError(t, backend.SetStatePending(signature))
+}
+
+func TestLock(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	locker := redis.New(&config.Config{}, s.Addr(), "", "", 0).(iface.Locker)
+
+	acquired, err := locker.Lock("key", "owner_1", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = locker.Lock("key", "owner_2", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	// the owner extends its lock
+	s.FastForward(30 * time.Second)
+	acquired, err = locker.Lock("key", "owner_1", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+	s.FastForward(30 * time.Second)
+	acquired, err = locker.Lock("key", "owner_2", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	// the lock expires after its ttl
+	s.FastForward(time.Minute)
+	acquired, err = locker.Lock("key", "owner_2", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	// only the owner releases the lock
+	require.NoError(t, locker.Unlock("key", "owner_1"))
+	acquired, err = locker.Lock("key", "owner_1", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	require.NoError(t, locker.Unlock("key", "owner_2"))
+	acquired, err = locker.Lock("key", "owner_1", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+}
+
+func TestLastRun(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	store := redis.New(&config.Config{}, s.Addr(), "", "", 0).(iface.ScheduleStore)
+
+	lastRun, err := store.LastRun("tick")
+	require.NoError(t, err)
+	assert.True(t, lastRun.IsZero())
+
+	run := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(t, store.SetLastRun("tick", run))
+	lastRun, err = store.LastRun("tick")
+	require.NoError(t, err)
+	assert.True(t, run.Equal(lastRun))
+}
+
+func TestNotifier(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	backend := redis.New(&config.Config{}, s.Addr(), "", "", 0)
+
+	notifier, ok := backend.(iface.Notifier)
+	require.True(t, ok)
+
+	completed, unsubscribe, err := notifier.Subscribe("task_1")
+	require.NoError(t, err)
+
+	signature := &tasks.Signature{Id: "task_1", Task: "add"}
+	require.NoError(t, backend.SetStateStarted(signature))
+	require.NoError(t, backend.SetStateSuccess(&tasks.Signature{Id: "task_2"}, nil))
+	select {
+	case <-completed:
+		t.Fatal("signalled before the task completed")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	require.NoError(t, backend.SetStateSuccess(signature, nil))
+	select {
+	case <-completed:
+	case <-time.After(5 * time.Second):
+		t.Fatal("not signalled when the task completed")
+	}
+
+	// the backend stops listening once the last subscriber leaves
+	unsubscribe()
+	assert.Eventually(t, func() bool {
+		return s.PubSubNumSub("machinery_tasks_completed")["machinery_tasks_completed"] == 0
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -1,11 +1,16 @@
 package result
 
 import (
+	"context"
 	"errors"
 	"reflect"
 	"time"
 
 	"github.com/pmaccamp/machinery/v1/backends/iface"
+	"github.com/pmaccamp/machinery/v1/claimcheck"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/encryption"
+	"github.com/pmaccamp/machinery/v1/log"
 	"github.com/pmaccamp/machinery/v1/tasks"
 )
 
@@ -14,8 +19,18 @@ var (
 	ErrBackendNotConfigured = errors.New("Result backend not configured")
 	// ErrTimeoutReached ...
 	ErrTimeoutReached = errors.New("Timeout reached")
+	// ErrTaskRevoked is returned when the task has been revoked
+	ErrTaskRevoked = tasks.ErrTaskRevoked
 )
 
+// PollInterval is how often GetContext polls the state of tasks in backends
+// not signalling their completion
+var PollInterval = 100 * time.Millisecond
+
+// NotifierFallbackInterval is how often the state of a task is touched while
+// waiting for a backend to signal its completion, in case a signal is missed
+var NotifierFallbackInterval = 5 * time.Second
+
 // AsyncResult represents a task result
 type AsyncResult struct {
 	Signature *tasks.Signature
@@ -72,8 +87,18 @@ func NewChainAsyncResult(tasks []*tasks.Signature, backend iface.Backend) *Chain
 
 // Touch the state and don't wait
 func (asyncResult *AsyncResult) Touch() ([]reflect.Value, error) {
+	taskResults, succeeded, err := asyncResult.touch()
+	if err != nil || !succeeded {
+		return nil, err
+	}
+	return tasks.ReflectTaskResults(taskResults)
+}
+
+// touch touches the state and returns the task results once the task
+// succeeded
+func (asyncResult *AsyncResult) touch() ([]*tasks.TaskResult, bool, error) {
 	if asyncResult.backend == nil {
-		return nil, ErrBackendNotConfigured
+		return nil, false, ErrBackendNotConfigured
 	}
 
 	asyncResult.GetState()
@@ -84,49 +109,132 @@ func (asyncResult *AsyncResult) Touch() ([]reflect.Value, error) {
 	}
 
 	if asyncResult.taskState.IsFailure() {
-		return nil, errors.New(asyncResult.taskState.Error)
+		return nil, false, errors.New(asyncResult.taskState.Error)
+	}
+
+	if asyncResult.taskState.IsRevoked() {
+		return nil, false, ErrTaskRevoked
 	}
 
 	if asyncResult.taskState.IsSuccess() {
-		return tasks.ReflectTaskResults(asyncResult.taskState.Results)
+		results, err := claimcheck.ResolveResults(asyncResult.claimCheckStore(), asyncResult.taskState.Results)
+		if err != nil {
+			return nil, false, err
+		}
+		results, err = encryption.DecryptResults(asyncResult.encryptionKeys(), asyncResult.taskState.TaskUUID, results)
+		if err != nil {
+			return nil, false, err
+		}
+		return results, true, nil
 	}
 
-	return nil, nil
+	return nil, false, nil
 }
 
-// Get returns task results (synchronous blocking call)
-func (asyncResult *AsyncResult) Get(sleepDuration time.Duration) ([]reflect.Value, error) {
-	for {
-		results, err := asyncResult.Touch()
+// claimCheckStore returns the claim check store configured for the backend
+func (asyncResult *AsyncResult) claimCheckStore() claimcheck.Store {
+	cnf := asyncResult.config()
+	if cnf == nil || cnf.ClaimCheck == nil {
+		return nil
+	}
+	return cnf.ClaimCheck.Store
+}
 
-		if results == nil && err == nil {
-			time.Sleep(sleepDuration)
-		} else {
-			return results, err
-		}
+// encryptionKeys returns the encryption keys configured for the backend
+func (asyncResult *AsyncResult) encryptionKeys() map[string][]byte {
+	cnf := asyncResult.config()
+	if cnf == nil || cnf.Encryption == nil {
+		return nil
+	}
+	return cnf.Encryption.Keys
+}
+
+// config returns the config of the backend, if it exposes it
+func (asyncResult *AsyncResult) config() *config.Config {
+	configurable, ok := asyncResult.backend.(interface{ GetConfig() *config.Config })
+	if !ok {
+		return nil
 	}
+	return configurable.GetConfig()
+}
+
+// Get returns task results (synchronous blocking call)
+func (asyncResult *AsyncResult) Get(sleepDuration time.Duration) ([]reflect.Value, error) {
+	return reflectResults(asyncResult.wait(context.Background(), sleepDuration))
 }
 
 // GetWithTimeout returns task results with a timeout (synchronous blocking call)
 func (asyncResult *AsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
-	timeout := time.NewTimer(timeoutDuration)
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutDuration)
+	defer cancel()
+
+	return timeoutReached(reflectResults(asyncResult.wait(ctx, sleepDuration)))
+}
+
+// GetContext returns task results once the task completes or ctx is done
+// (synchronous blocking call). The error is ctx.Err() if ctx is done first.
+func (asyncResult *AsyncResult) GetContext(ctx context.Context) ([]reflect.Value, error) {
+	return reflectResults(asyncResult.wait(ctx, PollInterval))
+}
+
+// Decode decodes task results into the values pointed to by outs once the
+// task completes or ctx is done (synchronous blocking call), see
+// tasks.DecodeTaskResults. The error is ctx.Err() if ctx is done first.
+func (asyncResult *AsyncResult) Decode(ctx context.Context, outs ...interface{}) error {
+	taskResults, err := asyncResult.wait(ctx, PollInterval)
+	if err != nil {
+		return err
+	}
+	return tasks.DecodeTaskResults(taskResults, outs...)
+}
+
+// wait touches the state until the task completes or ctx is done. When the
+// backend signals completed tasks, the state is touched once signalled and
+// every NotifierFallbackInterval in case a signal is missed, otherwise it is
+// polled every sleepDuration.
+func (asyncResult *AsyncResult) wait(ctx context.Context, sleepDuration time.Duration) ([]*tasks.TaskResult, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	// subscribe before touching the state so no completion is missed
+	completed, unsubscribe := asyncResult.subscribe()
+	if unsubscribe != nil {
+		defer unsubscribe()
+		sleepDuration = NotifierFallbackInterval
+	}
 
 	for {
+		taskResults, succeeded, err := asyncResult.touch()
+		if succeeded || err != nil {
+			return taskResults, err
+		}
+
 		select {
-		case <-timeout.C:
-			return nil, ErrTimeoutReached
-		default:
-			results, err := asyncResult.Touch()
-
-			if results == nil && err == nil {
-				time.Sleep(sleepDuration)
-			} else {
-				return results, err
-			}
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-completed:
+		case <-time.After(sleepDuration):
 		}
 	}
 }
 
+// subscribe subscribes to the completion of the task if the backend
+// implements iface.Notifier, the channel is nil otherwise
+func (asyncResult *AsyncResult) subscribe() (<-chan struct{}, func()) {
+	notifier, ok := asyncResult.backend.(iface.Notifier)
+	if !ok {
+		return nil, nil
+	}
+
+	completed, unsubscribe, err := notifier.Subscribe(asyncResult.Signature.Id)
+	if err != nil {
+		log.DEBUG.Printf("Subscribe to task %s failed, polling its state: %s", asyncResult.Signature.Id, err)
+		return nil, nil
+	}
+	return completed, unsubscribe
+}
+
 // GetState returns latest task state
 func (asyncResult *AsyncResult) GetState() *tasks.TaskState {
 	if asyncResult.taskState.IsCompleted() {
@@ -143,114 +251,112 @@ func (asyncResult *AsyncResult) GetState() *tasks.TaskState {
 
 // Get returns results of a chain of tasks (synchronous blocking call)
 func (chainAsyncResult *ChainAsyncResult) Get(sleepDuration time.Duration) ([]reflect.Value, error) {
+	return reflectResults(chainAsyncResult.wait(context.Background(), sleepDuration))
+}
+
+// GetWithTimeout returns results of a chain of tasks with timeout (synchronous blocking call)
+func (chainAsyncResult *ChainAsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutDuration)
+	defer cancel()
+
+	return timeoutReached(reflectResults(chainAsyncResult.wait(ctx, sleepDuration)))
+}
+
+// GetContext returns results of a chain of tasks once the last task completes
+// or ctx is done (synchronous blocking call). The error of the first failed
+// task is returned, or ctx.Err() if ctx is done first.
+func (chainAsyncResult *ChainAsyncResult) GetContext(ctx context.Context) ([]reflect.Value, error) {
+	return reflectResults(chainAsyncResult.wait(ctx, PollInterval))
+}
+
+// Decode decodes results of the last task of a chain into the values pointed
+// to by outs, see AsyncResult.Decode
+func (chainAsyncResult *ChainAsyncResult) Decode(ctx context.Context, outs ...interface{}) error {
+	taskResults, err := chainAsyncResult.wait(ctx, PollInterval)
+	if err != nil {
+		return err
+	}
+	return tasks.DecodeTaskResults(taskResults, outs...)
+}
+
+// wait waits for the tasks of the chain in order
+func (chainAsyncResult *ChainAsyncResult) wait(ctx context.Context, sleepDuration time.Duration) ([]*tasks.TaskResult, error) {
 	if chainAsyncResult.backend == nil {
 		return nil, ErrBackendNotConfigured
 	}
 
 	var (
-		results []reflect.Value
+		results []*tasks.TaskResult
 		err     error
 	)
 
 	for _, asyncResult := range chainAsyncResult.asyncResults {
-		results, err = asyncResult.Get(sleepDuration)
+		results, err = asyncResult.wait(ctx, sleepDuration)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	return results, err
+	return results, nil
 }
 
 // Get returns result of a chord (synchronous blocking call)
 func (chordAsyncResult *ChordAsyncResult) Get(sleepDuration time.Duration) ([]reflect.Value, error) {
+	return reflectResults(chordAsyncResult.wait(context.Background(), sleepDuration))
+}
+
+// GetWithTimeout returns result of a chord with a timeout (synchronous blocking call)
+func (chordAsyncResult *ChordAsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeoutDuration)
+	defer cancel()
+
+	return timeoutReached(reflectResults(chordAsyncResult.wait(ctx, sleepDuration)))
+}
+
+// GetContext returns result of a chord once the callback completes or ctx is
+// done (synchronous blocking call). The error of the first failed group task
+// is returned, or ctx.Err() if ctx is done first.
+func (chordAsyncResult *ChordAsyncResult) GetContext(ctx context.Context) ([]reflect.Value, error) {
+	return reflectResults(chordAsyncResult.wait(ctx, PollInterval))
+}
+
+// Decode decodes results of the callback of a chord into the values pointed
+// to by outs, see AsyncResult.Decode
+func (chordAsyncResult *ChordAsyncResult) Decode(ctx context.Context, outs ...interface{}) error {
+	taskResults, err := chordAsyncResult.wait(ctx, PollInterval)
+	if err != nil {
+		return err
+	}
+	return tasks.DecodeTaskResults(taskResults, outs...)
+}
+
+// wait waits for the group tasks and then for the callback of the chord
+func (chordAsyncResult *ChordAsyncResult) wait(ctx context.Context, sleepDuration time.Duration) ([]*tasks.TaskResult, error) {
 	if chordAsyncResult.backend == nil {
 		return nil, ErrBackendNotConfigured
 	}
 
-	var err error
 	for _, asyncResult := range chordAsyncResult.groupAsyncResults {
-		_, err = asyncResult.Get(sleepDuration)
-		if err != nil {
+		if _, err := asyncResult.wait(ctx, sleepDuration); err != nil {
 			return nil, err
 		}
 	}
 
-	return chordAsyncResult.chordAsyncResult.Get(sleepDuration)
+	return chordAsyncResult.chordAsyncResult.wait(ctx, sleepDuration)
 }
 
-// GetWithTimeout returns results of a chain of tasks with timeout (synchronous blocking call)
-func (chainAsyncResult *ChainAsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
-	if chainAsyncResult.backend == nil {
-		return nil, ErrBackendNotConfigured
-	}
-
-	var (
-		results []reflect.Value
-		err     error
-	)
-
-	timeout := time.NewTimer(timeoutDuration)
-	ln := len(chainAsyncResult.asyncResults)
-	lastResult := chainAsyncResult.asyncResults[ln-1]
-
-	for {
-		select {
-		case <-timeout.C:
-			return nil, ErrTimeoutReached
-		default:
-
-			for _, asyncResult := range chainAsyncResult.asyncResults {
-				_, errcur := asyncResult.Touch()
-				if errcur != nil {
-					return nil, err
-				}
-			}
-
-			results, err = lastResult.Touch()
-			if err != nil {
-				return nil, err
-			}
-			if results != nil {
-				return results, err
-			}
-			time.Sleep(sleepDuration)
-		}
+// reflectResults reflects the task results waited for
+func reflectResults(taskResults []*tasks.TaskResult, err error) ([]reflect.Value, error) {
+	if err != nil {
+		return nil, err
 	}
+	return tasks.ReflectTaskResults(taskResults)
 }
 
-// GetWithTimeout returns result of a chord with a timeout (synchronous blocking call)
-func (chordAsyncResult *ChordAsyncResult) GetWithTimeout(timeoutDuration, sleepDuration time.Duration) ([]reflect.Value, error) {
-	if chordAsyncResult.backend == nil {
-		return nil, ErrBackendNotConfigured
-	}
-
-	var (
-		results []reflect.Value
-		err     error
-	)
-
-	timeout := time.NewTimer(timeoutDuration)
-	for {
-		select {
-		case <-timeout.C:
-			return nil, ErrTimeoutReached
-		default:
-			for _, asyncResult := range chordAsyncResult.groupAsyncResults {
-				_, errcur := asyncResult.Touch()
-				if errcur != nil {
-					return nil, err
-				}
-			}
-
-			results, err = chordAsyncResult.chordAsyncResult.Touch()
-			if err != nil {
-				return nil, nil
-			}
-			if results != nil {
-				return results, err
-			}
-			time.Sleep(sleepDuration)
-		}
+// timeoutReached replaces the error of a wait timed out with ErrTimeoutReached
+func timeoutReached(results []reflect.Value, err error) ([]reflect.Value, error) {
+	if err == context.DeadlineExceeded {
+		return nil, ErrTimeoutReached
 	}
+	return results, err
 }
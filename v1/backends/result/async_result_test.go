@@ -0,0 +1,163 @@
+package result_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/backends/eager"
+	"github.com/pmaccamp/machinery/v1/backends/result"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetWithTimeoutNotified(t *testing.T) {
+	t.Parallel()
+
+	backend := eager.New()
+	signature := &tasks.Signature{Id: "task_1", Task: "add"}
+	require.NoError(t, backend.SetStatePending(signature))
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		backend.SetStateSuccess(signature, []*tasks.TaskResult{{Type: "int64", Value: 3}})
+	}()
+
+	// the eager backend signals completion, so the result does not wait
+	// for the next poll an hour away
+	results, err := result.NewAsyncResult(signature, backend).GetWithTimeout(5*time.Second, time.Hour)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, int64(3), results[0].Interface())
+}
+
+func TestGetWithTimeoutReached(t *testing.T) {
+	t.Parallel()
+
+	backend := eager.New()
+	signature := &tasks.Signature{Id: "task_1", Task: "add"}
+	require.NoError(t, backend.SetStatePending(signature))
+
+	_, err := result.NewAsyncResult(signature, backend).GetWithTimeout(50*time.Millisecond, time.Hour)
+	assert.Equal(t, result.ErrTimeoutReached, err)
+}
+
+func TestGetContext(t *testing.T) {
+	t.Parallel()
+
+	backend := eager.New()
+	signature := &tasks.Signature{Id: "task_1", Task: "add"}
+	require.NoError(t, backend.SetStatePending(signature))
+	asyncResult := result.NewAsyncResult(signature, backend)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := asyncResult.GetContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	_, err = asyncResult.GetContext(ctx)
+	assert.Equal(t, context.Canceled, err)
+
+	require.NoError(t, backend.SetStateFailure(signature, "boom"))
+	_, err = asyncResult.GetContext(context.Background())
+	assert.EqualError(t, err, "boom")
+}
+
+func TestChainGetContext(t *testing.T) {
+	t.Parallel()
+
+	backend := eager.New()
+	signatures := []*tasks.Signature{
+		{Id: "task_1", Task: "add"},
+		{Id: "task_2", Task: "add"},
+	}
+	for _, signature := range signatures {
+		require.NoError(t, backend.SetStatePending(signature))
+	}
+
+	// the first task failing fails the chain
+	require.NoError(t, backend.SetStateFailure(signatures[0], "boom"))
+	_, err := result.NewChainAsyncResult(signatures, backend).GetContext(context.Background())
+	assert.EqualError(t, err, "boom")
+	_, err = result.NewChainAsyncResult(signatures, backend).GetWithTimeout(time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "boom")
+
+	require.NoError(t, backend.SetStateSuccess(signatures[0], nil))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = result.NewChainAsyncResult(signatures, backend).GetContext(ctx)
+	assert.Equal(t, context.DeadlineExceeded, err)
+
+	require.NoError(t, backend.SetStateSuccess(signatures[1], []*tasks.TaskResult{{Type: "int64", Value: 3}}))
+	results, err := result.NewChainAsyncResult(signatures, backend).GetContext(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, int64(3), results[0].Interface())
+}
+
+func TestChordGetContext(t *testing.T) {
+	t.Parallel()
+
+	backend := eager.New()
+	groupTasks := []*tasks.Signature{
+		{Id: "task_1", Task: "add"},
+		{Id: "task_2", Task: "add"},
+	}
+	callback := &tasks.Signature{Id: "task_3", Task: "sum"}
+	for _, signature := range append(groupTasks, callback) {
+		require.NoError(t, backend.SetStatePending(signature))
+	}
+
+	// a group task failing fails the chord
+	require.NoError(t, backend.SetStateSuccess(groupTasks[0], nil))
+	require.NoError(t, backend.SetStateFailure(groupTasks[1], "boom"))
+	_, err := result.NewChordAsyncResult(groupTasks, callback, backend).GetContext(context.Background())
+	assert.EqualError(t, err, "boom")
+	_, err = result.NewChordAsyncResult(groupTasks, callback, backend).GetWithTimeout(time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "boom")
+
+	require.NoError(t, backend.SetStateSuccess(groupTasks[1], nil))
+	_, err = result.NewChordAsyncResult(groupTasks, callback, backend).GetWithTimeout(50*time.Millisecond, 10*time.Millisecond)
+	assert.Equal(t, result.ErrTimeoutReached, err)
+
+	require.NoError(t, backend.SetStateSuccess(callback, []*tasks.TaskResult{{Type: "int64", Value: 6}}))
+	results, err := result.NewChordAsyncResult(groupTasks, callback, backend).GetContext(context.Background())
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, int64(6), results[0].Interface())
+}
+
+func TestDecode(t *testing.T) {
+	t.Parallel()
+
+	type point struct {
+		X, Y int
+	}
+
+	backend := eager.New()
+	signature := &tasks.Signature{Id: "task_1", Task: "move"}
+	require.NoError(t, backend.SetStateSuccess(signature, []*tasks.TaskResult{
+		{Type: "result_test.point", Value: point{X: 1, Y: 2}},
+		{Type: "string", Value: "moved"},
+	}))
+
+	var (
+		p       point
+		message string
+	)
+	asyncResult := result.NewAsyncResult(signature, backend)
+	require.NoError(t, asyncResult.Decode(context.Background(), &p, &message))
+	assert.Equal(t, point{X: 1, Y: 2}, p)
+	assert.Equal(t, "moved", message)
+
+	var number int
+	assert.Error(t, asyncResult.Decode(context.Background(), &number, &message))
+
+	// the task failing is returned as is
+	failed := &tasks.Signature{Id: "task_2", Task: "move"}
+	require.NoError(t, backend.SetStateFailure(failed, "boom"))
+	assert.EqualError(t, result.NewAsyncResult(failed, backend).Decode(context.Background(), &p, &message), "boom")
+}
@@ -0,0 +1,35 @@
+package sql
+
+import (
+	"fmt"
+)
+
+// ErrGroupNotFound ...
+type ErrGroupNotFound struct {
+	groupUUID string
+}
+
+// NewErrGroupNotFound returns new instance of ErrGroupNotFound
+func NewErrGroupNotFound(groupUUID string) ErrGroupNotFound {
+	return ErrGroupNotFound{groupUUID: groupUUID}
+}
+
+// Error implements error interface
+func (e ErrGroupNotFound) Error() string {
+	return fmt.Sprintf("Group not found: %v", e.groupUUID)
+}
+
+// ErrTaskNotFound ...
+type ErrTaskNotFound struct {
+	taskUUID string
+}
+
+// NewErrTaskNotFound returns new instance of ErrTaskNotFound
+func NewErrTaskNotFound(taskUUID string) ErrTaskNotFound {
+	return ErrTaskNotFound{taskUUID: taskUUID}
+}
+
+// Error implements error interface
+func (e ErrTaskNotFound) Error() string {
+	return fmt.Sprintf("Task not found: %v", e.taskUUID)
+}
@@ -0,0 +1,121 @@
+package sql
+
+import (
+	gosql "database/sql"
+)
+
+// migrations holds the schema changes of the backend, migration N brings the
+// schema to version N+1. Only append to this list, never edit applied entries.
+// Statements must be valid for every supported database, and safe to run
+// again in case several workers migrate at the same time.
+var migrations = [][]string{
+	{
+		`CREATE TABLE IF NOT EXISTS task_states (
+			task_uuid  VARCHAR(255) NOT NULL PRIMARY KEY,
+			task_name  VARCHAR(255) NOT NULL DEFAULT '',
+			state      VARCHAR(16) NOT NULL,
+			error      TEXT NOT NULL DEFAULT '',
+			created_at TIMESTAMP NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS task_states_expires_at_idx ON task_states (expires_at)`,
+		`CREATE TABLE IF NOT EXISTS task_results (
+			task_uuid VARCHAR(255) NOT NULL,
+			position  INTEGER NOT NULL,
+			type      VARCHAR(255) NOT NULL,
+			value     TEXT NOT NULL,
+			PRIMARY KEY (task_uuid, position)
+		)`,
+		`CREATE TABLE IF NOT EXISTS group_metas (
+			group_uuid      VARCHAR(255) NOT NULL PRIMARY KEY,
+			chord_triggered INTEGER NOT NULL DEFAULT 0,
+			created_at      TIMESTAMP NOT NULL,
+			expires_at      BIGINT NOT NULL
+		)`,
+		`CREATE INDEX IF NOT EXISTS group_metas_expires_at_idx ON group_metas (expires_at)`,
+		`CREATE TABLE IF NOT EXISTS group_tasks (
+			group_uuid VARCHAR(255) NOT NULL,
+			position   INTEGER NOT NULL,
+			task_uuid  VARCHAR(255) NOT NULL,
+			PRIMARY KEY (group_uuid, position)
+		)`,
+	},
+	{
+		`CREATE TABLE IF NOT EXISTS machinery_locks (
+			lock_key   VARCHAR(255) NOT NULL PRIMARY KEY,
+			expires_at BIGINT NOT NULL
+		)`,
+	},
+	{
+		// Adding a column cannot be made safe to run again in SQLite, so the
+		// error class of failed tasks is kept in a table of its own
+		`CREATE TABLE IF NOT EXISTS task_error_classes (
+			task_uuid   VARCHAR(255) NOT NULL PRIMARY KEY,
+			error_class VARCHAR(16) NOT NULL
+		)`,
+	},
+	{
+		// Locks are held by an owner, replacing the ownerless machinery_locks
+		`CREATE TABLE IF NOT EXISTS machinery_leases (
+			lock_key   VARCHAR(255) NOT NULL PRIMARY KEY,
+			owner      VARCHAR(255) NOT NULL,
+			expires_at BIGINT NOT NULL
+		)`,
+		`DROP TABLE IF EXISTS machinery_locks`,
+		`CREATE TABLE IF NOT EXISTS machinery_schedule_runs (
+			name     VARCHAR(255) NOT NULL PRIMARY KEY,
+			last_run BIGINT NOT NULL
+		)`,
+	},
+}
+
+// migrate brings the database schema up to date
+func (b *Backend) migrate(db *gosql.DB) error {
+	_, err := db.Exec(`CREATE TABLE IF NOT EXISTS machinery_schema_migrations (
+		version    INTEGER NOT NULL PRIMARY KEY,
+		applied_at TIMESTAMP NOT NULL
+	)`)
+	if err != nil {
+		return err
+	}
+
+	var version int
+	err = db.QueryRow(`SELECT COALESCE(MAX(version), 0) FROM machinery_schema_migrations`).Scan(&version)
+	if err != nil {
+		return err
+	}
+
+	for i := version; i < len(migrations); i++ {
+		if err := b.applyMigration(db, i+1, migrations[i]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// applyMigration runs statements of a single migration in a transaction
+func (b *Backend) applyMigration(db *gosql.DB, version int, statements []string) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	for _, statement := range statements {
+		if _, err := tx.Exec(statement); err != nil {
+			return err
+		}
+	}
+
+	_, err = tx.Exec(
+		b.rebind(`INSERT INTO machinery_schema_migrations (version, applied_at) VALUES (?, ?) ON CONFLICT (version) DO NOTHING`),
+		version,
+		now(),
+	)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
@@ -0,0 +1,728 @@
+package sql
+
+import (
+	"bytes"
+	gosql "database/sql"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/backends/iface"
+	"github.com/pmaccamp/machinery/v1/common"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/log"
+	"github.com/pmaccamp/machinery/v1/tasks"
+
+	// database/sql drivers for the supported databases
+	_ "github.com/lib/pq"
+	_ "github.com/mattn/go-sqlite3"
+)
+
+const (
+	// DriverSQLite is the database/sql driver name for SQLite
+	DriverSQLite = "sqlite3"
+	// DriverPostgres is the database/sql driver name for PostgreSQL
+	DriverPostgres = "postgres"
+
+	// expired rows are deleted at most once per cleanupInterval
+	cleanupInterval = time.Minute
+)
+
+// Backend represents a SQL result backend using database/sql
+type Backend struct {
+	common.Backend
+	driverName     string
+	dataSourceName string
+
+	db   *gosql.DB
+	dbMu sync.Mutex
+
+	lastCleanup   time.Time
+	lastCleanupMu sync.Mutex
+}
+
+// New creates Backend instance
+func New(cnf *config.Config, driverName, dataSourceName string) iface.Backend {
+	return &Backend{
+		Backend:        common.NewBackend(cnf),
+		driverName:     driverName,
+		dataSourceName: dataSourceName,
+	}
+}
+
+// InitGroup creates and saves a group meta data object
+func (b *Backend) InitGroup(groupUUID string, taskUUIDs []string) error {
+	db, err := b.connect()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		b.rebind(`INSERT INTO group_metas (group_uuid, chord_triggered, created_at, expires_at) VALUES (?, 0, ?, ?)`),
+		groupUUID,
+		now(),
+		b.getExpiration(),
+	)
+	if err != nil {
+		return err
+	}
+
+	for i, taskUUID := range taskUUIDs {
+		_, err = tx.Exec(
+			b.rebind(`INSERT INTO group_tasks (group_uuid, position, task_uuid) VALUES (?, ?, ?)`),
+			groupUUID,
+			i,
+			taskUUID,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// GroupCompleted returns true if all tasks in a group finished
+func (b *Backend) GroupCompleted(groupUUID string, groupTaskCount int) (bool, error) {
+	groupMeta, err := b.getGroupMeta(groupUUID)
+	if err != nil {
+		return false, err
+	}
+
+	taskStates, err := b.getStates(groupMeta.TaskUUIDs...)
+	if err != nil {
+		return false, err
+	}
+
+	var countSuccessTasks = 0
+	for _, taskState := range taskStates {
+		if taskState.IsCompleted() {
+			countSuccessTasks++
+		}
+	}
+
+	return countSuccessTasks == groupTaskCount, nil
+}
+
+// GroupTaskStates returns states of all tasks in the group
+func (b *Backend) GroupTaskStates(groupUUID string, groupTaskCount int) ([]*tasks.TaskState, error) {
+	groupMeta, err := b.getGroupMeta(groupUUID)
+	if err != nil {
+		return []*tasks.TaskState{}, err
+	}
+
+	return b.getStates(groupMeta.TaskUUIDs...)
+}
+
+// TriggerChord flags chord as triggered in the backend storage to make sure
+// chord is never trigerred multiple times. Returns a boolean flag to indicate
+// whether the worker should trigger chord (true) or no if it has been triggered
+// already (false)
+func (b *Backend) TriggerChord(groupUUID string) (bool, error) {
+	db, err := b.connect()
+	if err != nil {
+		return false, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// The conditional update locks the row, so no matter how many workers
+	// race here, only one of them sees the flag unset and gets to flip it
+	res, err := tx.Exec(
+		b.rebind(`UPDATE group_metas SET chord_triggered = 1 WHERE group_uuid = ? AND chord_triggered = 0 AND expires_at > ?`),
+		groupUUID,
+		time.Now().Unix(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	if affected == 0 {
+		var exists int
+		err = tx.QueryRow(
+			b.rebind(`SELECT COUNT(*) FROM group_metas WHERE group_uuid = ? AND expires_at > ?`),
+			groupUUID,
+			time.Now().Unix(),
+		).Scan(&exists)
+		if err != nil {
+			return false, err
+		}
+		if exists == 0 {
+			return false, NewErrGroupNotFound(groupUUID)
+		}
+
+		log.WARNING.Printf("Chord already triggered for group %s", groupUUID)
+		return false, nil
+	}
+
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+
+	return true, nil
+}
+
+// SetStatePending updates task state to PENDING
+func (b *Backend) SetStatePending(signature *tasks.Signature) error {
+	taskState := tasks.NewPendingTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateReceived updates task state to RECEIVED
+func (b *Backend) SetStateReceived(signature *tasks.Signature) error {
+	taskState := tasks.NewReceivedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateStarted updates task state to STARTED
+func (b *Backend) SetStateStarted(signature *tasks.Signature) error {
+	taskState := tasks.NewStartedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateRetry updates task state to RETRY
+func (b *Backend) SetStateRetry(signature *tasks.Signature) error {
+	taskState := tasks.NewRetryTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// SetStateSuccess updates task state to SUCCESS
+func (b *Backend) SetStateSuccess(signature *tasks.Signature, results []*tasks.TaskResult) error {
+	taskState := tasks.NewSuccessTaskState(signature, results)
+	return b.updateState(taskState)
+}
+
+// SetStateFailure updates task state to FAILURE
+func (b *Backend) SetStateFailure(signature *tasks.Signature, err string) error {
+	taskState := tasks.NewFailureTaskState(signature, err)
+	return b.updateState(taskState)
+}
+
+// SetStateRevoked updates task state to REVOKED
+func (b *Backend) SetStateRevoked(signature *tasks.Signature) error {
+	taskState := tasks.NewRevokedTaskState(signature)
+	return b.updateState(taskState)
+}
+
+// GetState returns the latest task state
+func (b *Backend) GetState(taskUUID string) (*tasks.TaskState, error) {
+	taskStates, err := b.getStates(taskUUID)
+	if err != nil {
+		return nil, err
+	}
+	return taskStates[0], nil
+}
+
+// PurgeState deletes stored task state
+func (b *Backend) PurgeState(taskUUID string) error {
+	db, err := b.connect()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(b.rebind(`DELETE FROM task_results WHERE task_uuid = ?`), taskUUID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(b.rebind(`DELETE FROM task_error_classes WHERE task_uuid = ?`), taskUUID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(b.rebind(`DELETE FROM task_states WHERE task_uuid = ?`), taskUUID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// PurgeGroupMeta deletes stored group meta data
+func (b *Backend) PurgeGroupMeta(groupUUID string) error {
+	db, err := b.connect()
+	if err != nil {
+		return err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(b.rebind(`DELETE FROM group_tasks WHERE group_uuid = ?`), groupUUID); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(b.rebind(`DELETE FROM group_metas WHERE group_uuid = ?`), groupUUID); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// Lock acquires the lock for the owner or extends it if the owner already
+// holds it, it returns false if another owner holds the lock
+func (b *Backend) Lock(key, owner string, ttl time.Duration) (bool, error) {
+	db, err := b.connect()
+	if err != nil {
+		return false, err
+	}
+
+	now := time.Now()
+
+	// A lock which expired or is held by the owner is taken over by updating
+	// it, the update is skipped and no row is affected while another owner
+	// holds the lock
+	res, err := db.Exec(
+		b.rebind(`INSERT INTO machinery_leases (lock_key, owner, expires_at) VALUES (?, ?, ?)
+			ON CONFLICT (lock_key) DO UPDATE SET owner = excluded.owner, expires_at = excluded.expires_at
+			WHERE machinery_leases.owner = excluded.owner OR machinery_leases.expires_at <= ?`),
+		key,
+		owner,
+		now.Add(ttl).UnixNano(),
+		now.UnixNano(),
+	)
+	if err != nil {
+		return false, err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return affected == 1, nil
+}
+
+// Unlock releases the lock if it is held by the owner
+func (b *Backend) Unlock(key, owner string) error {
+	db, err := b.connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(b.rebind(`DELETE FROM machinery_leases WHERE lock_key = ? AND owner = ?`), key, owner)
+	return err
+}
+
+// LastRun returns the time of the last published run of the periodic task
+func (b *Backend) LastRun(name string) (time.Time, error) {
+	db, err := b.connect()
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	var nanos int64
+	err = db.QueryRow(b.rebind(`SELECT last_run FROM machinery_schedule_runs WHERE name = ?`), name).Scan(&nanos)
+	if err == gosql.ErrNoRows {
+		return time.Time{}, nil
+	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	return time.Unix(0, nanos), nil
+}
+
+// SetLastRun records the time of the last published run of the periodic task
+func (b *Backend) SetLastRun(name string, run time.Time) error {
+	db, err := b.connect()
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		b.rebind(`INSERT INTO machinery_schedule_runs (name, last_run) VALUES (?, ?)
+			ON CONFLICT (name) DO UPDATE SET last_run = excluded.last_run`),
+		name,
+		run.UnixNano(),
+	)
+	return err
+}
+
+// getGroupMeta retrieves group meta data, convenience function to avoid repetition
+func (b *Backend) getGroupMeta(groupUUID string) (*tasks.GroupMeta, error) {
+	db, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	groupMeta := &tasks.GroupMeta{GroupUUID: groupUUID, TaskUUIDs: []string{}}
+
+	var chordTriggered int
+	err = db.QueryRow(
+		b.rebind(`SELECT chord_triggered, created_at FROM group_metas WHERE group_uuid = ? AND expires_at > ?`),
+		groupUUID,
+		time.Now().Unix(),
+	).Scan(&chordTriggered, &groupMeta.CreatedAt)
+	if err == gosql.ErrNoRows {
+		return nil, NewErrGroupNotFound(groupUUID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	groupMeta.ChordTriggered = chordTriggered == 1
+
+	rows, err := db.Query(
+		b.rebind(`SELECT task_uuid FROM group_tasks WHERE group_uuid = ? ORDER BY position`),
+		groupUUID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var taskUUID string
+		if err := rows.Scan(&taskUUID); err != nil {
+			return nil, err
+		}
+		groupMeta.TaskUUIDs = append(groupMeta.TaskUUIDs, taskUUID)
+	}
+
+	return groupMeta, rows.Err()
+}
+
+// getStates returns multiple task states in the order of taskUUIDs
+func (b *Backend) getStates(taskUUIDs ...string) ([]*tasks.TaskState, error) {
+	taskStates := make([]*tasks.TaskState, len(taskUUIDs))
+	if len(taskUUIDs) == 0 {
+		return taskStates, nil
+	}
+
+	db, err := b.connect()
+	if err != nil {
+		return nil, err
+	}
+
+	placeholders := strings.TrimSuffix(strings.Repeat("?, ", len(taskUUIDs)), ", ")
+	args := make([]interface{}, 0, len(taskUUIDs)+1)
+	for _, taskUUID := range taskUUIDs {
+		args = append(args, taskUUID)
+	}
+
+	rows, err := db.Query(
+		b.rebind(`SELECT s.task_uuid, s.task_name, s.state, s.error, COALESCE(c.error_class, ''), s.created_at
+			FROM task_states s LEFT JOIN task_error_classes c ON c.task_uuid = s.task_uuid
+			WHERE s.task_uuid IN (`+placeholders+`) AND s.expires_at > ?`),
+		append(args, time.Now().Unix())...,
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	statesByUUID, err := scanStates(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := b.loadResults(db, placeholders, args, statesByUUID); err != nil {
+		return nil, err
+	}
+
+	for i, taskUUID := range taskUUIDs {
+		taskState, ok := statesByUUID[taskUUID]
+		if !ok {
+			return nil, NewErrTaskNotFound(taskUUID)
+		}
+		taskStates[i] = taskState
+	}
+
+	return taskStates, nil
+}
+
+// scanStates reads task states from rows and closes them, so that the
+// connection can be reused straight away
+func scanStates(rows *gosql.Rows) (map[string]*tasks.TaskState, error) {
+	defer rows.Close()
+
+	statesByUUID := make(map[string]*tasks.TaskState)
+	for rows.Next() {
+		var (
+			taskState = new(tasks.TaskState)
+			createdAt nullTime
+		)
+		if err := rows.Scan(&taskState.TaskUUID, &taskState.TaskName, &taskState.State, &taskState.Error, &taskState.ErrorClass, &createdAt); err != nil {
+			return nil, err
+		}
+		taskState.CreatedAt = createdAt.Time
+		statesByUUID[taskState.TaskUUID] = taskState
+	}
+
+	return statesByUUID, rows.Err()
+}
+
+// loadResults fills in results of the given task states
+func (b *Backend) loadResults(db *gosql.DB, placeholders string, args []interface{}, statesByUUID map[string]*tasks.TaskState) error {
+	rows, err := db.Query(
+		b.rebind(`SELECT task_uuid, type, value FROM task_results WHERE task_uuid IN (`+placeholders+`) ORDER BY task_uuid, position`),
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			taskUUID string
+			result   = new(tasks.TaskResult)
+			value    string
+		)
+		if err := rows.Scan(&taskUUID, &result.Type, &value); err != nil {
+			return err
+		}
+
+		decoder := json.NewDecoder(bytes.NewReader([]byte(value)))
+		decoder.UseNumber()
+		if err := decoder.Decode(&result.Value); err != nil {
+			return err
+		}
+
+		if taskState, ok := statesByUUID[taskUUID]; ok {
+			taskState.Results = append(taskState.Results, result)
+		}
+	}
+
+	return rows.Err()
+}
+
+// updateState saves current task state
+func (b *Backend) updateState(taskState *tasks.TaskState) error {
+	db, err := b.connect()
+	if err != nil {
+		return err
+	}
+
+	b.cleanup(db)
+
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	// Only the pending state carries the task name and creation time,
+	// later states must not overwrite them
+	query := `INSERT INTO task_states (task_uuid, task_name, state, error, created_at, expires_at) VALUES (?, ?, ?, ?, ?, ?)
+		ON CONFLICT (task_uuid) DO UPDATE SET state = excluded.state, error = excluded.error, expires_at = excluded.expires_at`
+	var createdAt interface{}
+	if taskState.State == tasks.StatePending {
+		query += `, task_name = excluded.task_name, created_at = excluded.created_at`
+		createdAt = taskState.CreatedAt
+	}
+
+	// The state of a revoked task is never replaced, the update is skipped
+	// and no row is affected
+	if !taskState.IsRevoked() {
+		query += ` WHERE task_states.state <> '` + tasks.StateRevoked + `'`
+	}
+
+	res, err := tx.Exec(
+		b.rebind(query),
+		taskState.TaskUUID,
+		taskState.TaskName,
+		taskState.State,
+		taskState.Error,
+		createdAt,
+		b.getExpiration(),
+	)
+	if err != nil {
+		return err
+	}
+
+	affected, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if affected == 0 {
+		return tasks.ErrTaskRevoked
+	}
+
+	if _, err := tx.Exec(b.rebind(`DELETE FROM task_error_classes WHERE task_uuid = ?`), taskState.TaskUUID); err != nil {
+		return err
+	}
+	if taskState.ErrorClass != "" {
+		_, err = tx.Exec(
+			b.rebind(`INSERT INTO task_error_classes (task_uuid, error_class) VALUES (?, ?)`),
+			taskState.TaskUUID,
+			taskState.ErrorClass,
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(b.rebind(`DELETE FROM task_results WHERE task_uuid = ?`), taskState.TaskUUID); err != nil {
+		return err
+	}
+
+	for i, result := range taskState.Results {
+		value, err := json.Marshal(result.Value)
+		if err != nil {
+			return fmt.Errorf("JSON marshal error: %s", err)
+		}
+
+		_, err = tx.Exec(
+			b.rebind(`INSERT INTO task_results (task_uuid, position, type, value) VALUES (?, ?, ?, ?)`),
+			taskState.TaskUUID,
+			i,
+			result.Type,
+			string(value),
+		)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
+
+// cleanup deletes expired task states and group meta data, it runs at most
+// once per cleanupInterval and errors are only logged
+func (b *Backend) cleanup(db *gosql.DB) {
+	b.lastCleanupMu.Lock()
+	if time.Since(b.lastCleanup) < cleanupInterval {
+		b.lastCleanupMu.Unlock()
+		return
+	}
+	b.lastCleanup = time.Now()
+	b.lastCleanupMu.Unlock()
+
+	if err := b.deleteExpired(db, time.Now().Unix()); err != nil {
+		log.WARNING.Printf("Failed to delete expired results: %s", err)
+	}
+}
+
+// deleteExpired deletes task states and group meta data which expired before now
+func (b *Backend) deleteExpired(db *gosql.DB, now int64) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	statements := []string{
+		`DELETE FROM task_results WHERE task_uuid IN (SELECT task_uuid FROM task_states WHERE expires_at <= ?)`,
+		`DELETE FROM task_error_classes WHERE task_uuid IN (SELECT task_uuid FROM task_states WHERE expires_at <= ?)`,
+		`DELETE FROM task_states WHERE expires_at <= ?`,
+		`DELETE FROM group_tasks WHERE group_uuid IN (SELECT group_uuid FROM group_metas WHERE expires_at <= ?)`,
+		`DELETE FROM group_metas WHERE expires_at <= ?`,
+	}
+	for _, statement := range statements {
+		if _, err := tx.Exec(b.rebind(statement), now); err != nil {
+			return err
+		}
+	}
+
+	// Lock expiration is kept in nanoseconds
+	if _, err := tx.Exec(b.rebind(`DELETE FROM machinery_leases WHERE expires_at <= ?`), now*int64(time.Second)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// getExpiration returns the unix time when results saved now expire
+func (b *Backend) getExpiration() int64 {
+	expiresIn := b.GetConfig().ResultsExpireIn
+	if expiresIn == 0 {
+		// expire results after 1 day by default
+		expiresIn = config.DefaultResultsExpireIn
+	}
+	return time.Now().Unix() + int64(expiresIn)
+}
+
+// connect opens the database and migrates the schema on first use
+func (b *Backend) connect() (*gosql.DB, error) {
+	b.dbMu.Lock()
+	defer b.dbMu.Unlock()
+
+	if b.db != nil {
+		return b.db, nil
+	}
+
+	db, err := gosql.Open(b.driverName, b.dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// SQLite only allows a single writer, sharing one connection avoids
+	// "database is locked" errors and makes in-memory databases usable
+	if b.driverName == DriverSQLite {
+		db.SetMaxOpenConns(1)
+	}
+
+	if err := b.migrate(db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("Migrating %s database failed: %s", b.driverName, err)
+	}
+
+	b.db = db
+	return b.db, nil
+}
+
+// rebind replaces ? placeholders with the ones used by the database driver
+func (b *Backend) rebind(query string) string {
+	if b.driverName != DriverPostgres {
+		return query
+	}
+
+	var (
+		rebound strings.Builder
+		n       int
+	)
+	for _, r := range query {
+		if r == '?' {
+			n++
+			rebound.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		rebound.WriteRune(r)
+	}
+	return rebound.String()
+}
+
+// now returns the current time truncated to what all databases can store
+func now() time.Time {
+	return time.Now().UTC().Truncate(time.Microsecond)
+}
+
+// nullTime scans a nullable timestamp
+type nullTime struct {
+	Time time.Time
+}
+
+// Scan implements the sql.Scanner interface
+func (nt *nullTime) Scan(value interface{}) error {
+	if value == nil {
+		nt.Time = time.Time{}
+		return nil
+	}
+	t, ok := value.(time.Time)
+	if !ok {
+		return fmt.Errorf("Cannot scan %T into time.Time", value)
+	}
+	nt.Time = t
+	return nil
+}
@@ -0,0 +1,293 @@
+package sql_test
+
+import (
+	gosql "database/sql"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/backends/iface"
+	"github.com/pmaccamp/machinery/v1/backends/sql"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// newDataSourceName returns path to a SQLite database in a new temporary
+// directory and a function removing it
+func newDataSourceName(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "machinery")
+	require.NoError(t, err)
+	return filepath.Join(dir, "results.db"), func() { os.RemoveAll(dir) }
+}
+
+func newTestBackend(t *testing.T, cnf *config.Config) (iface.Backend, func()) {
+	dataSourceName, cleanup := newDataSourceName(t)
+	return sql.New(cnf, sql.DriverSQLite, dataSourceName), cleanup
+}
+
+func TestTaskStateLifecycle(t *testing.T) {
+	t.Parallel()
+
+	backend, cleanup := newTestBackend(t, &config.Config{})
+	defer cleanup()
+
+	signature := &tasks.Signature{Id: "task_1", Task: "add"}
+
+	require.NoError(t, backend.SetStatePending(signature))
+	taskState, err := backend.GetState("task_1")
+	require.NoError(t, err)
+	assert.Equal(t, tasks.StatePending, taskState.State)
+	assert.Equal(t, "add", taskState.TaskName)
+	assert.False(t, taskState.CreatedAt.IsZero())
+	createdAt := taskState.CreatedAt
+
+	require.NoError(t, backend.SetStateStarted(signature))
+	taskState, err = backend.GetState("task_1")
+	require.NoError(t, err)
+	assert.Equal(t, tasks.StateStarted, taskState.State)
+	// Later states keep the task name and creation time
+	assert.Equal(t, "add", taskState.TaskName)
+	assert.True(t, createdAt.Equal(taskState.CreatedAt))
+
+	results := []*tasks.TaskResult{
+		{Type: "int64", Value: 3},
+		{Type: "[]string", Value: []string{"foo", "bar"}},
+	}
+	require.NoError(t, backend.SetStateSuccess(signature, results))
+	taskState, err = backend.GetState("task_1")
+	require.NoError(t, err)
+	assert.True(t, taskState.IsSuccess())
+	require.Len(t, taskState.Results, 2)
+	assert.Equal(t, "int64", taskState.Results[0].Type)
+	assert.Equal(t, "[]string", taskState.Results[1].Type)
+
+	values, err := tasks.ReflectTaskResults(taskState.Results)
+	require.NoError(t, err)
+	assert.Equal(t, int64(3), values[0].Interface())
+	assert.Equal(t, []string{"foo", "bar"}, values[1].Interface())
+
+	signature.ErrorClass = tasks.ErrorClassPermanent
+	require.NoError(t, backend.SetStateFailure(signature, "boom"))
+	taskState, err = backend.GetState("task_1")
+	require.NoError(t, err)
+	assert.True(t, taskState.IsFailure())
+	assert.Equal(t, "boom", taskState.Error)
+	assert.Equal(t, tasks.ErrorClassPermanent, taskState.ErrorClass)
+	assert.Len(t, taskState.Results, 0)
+
+	require.NoError(t, backend.PurgeState("task_1"))
+	_, err = backend.GetState("task_1")
+	assert.Equal(t, sql.NewErrTaskNotFound("task_1"), err)
+}
+
+func TestResultsExpire(t *testing.T) {
+	t.Parallel()
+
+	backend, cleanup := newTestBackend(t, &config.Config{ResultsExpireIn: 1})
+	defer cleanup()
+
+	require.NoError(t, backend.SetStatePending(&tasks.Signature{Id: "task_1"}))
+	require.NoError(t, backend.InitGroup("group_1", []string{"task_1"}))
+
+	_, err := backend.GetState("task_1")
+	require.NoError(t, err)
+
+	time.Sleep(2 * time.Second)
+
+	_, err = backend.GetState("task_1")
+	assert.Error(t, err)
+	_, err = backend.GroupCompleted("group_1", 1)
+	assert.Error(t, err)
+}
+
+func TestGroupCompleted(t *testing.T) {
+	t.Parallel()
+
+	backend, cleanup := newTestBackend(t, &config.Config{})
+	defer cleanup()
+
+	task1 := &tasks.Signature{Id: "task_1", GroupUUID: "group_1"}
+	task2 := &tasks.Signature{Id: "task_2", GroupUUID: "group_1"}
+
+	require.NoError(t, backend.InitGroup("group_1", []string{"task_1", "task_2"}))
+
+	// States have not been saved yet
+	_, err := backend.GroupCompleted("group_1", 2)
+	assert.Error(t, err)
+
+	require.NoError(t, backend.SetStatePending(task1))
+	require.NoError(t, backend.SetStateStarted(task2))
+
+	completed, err := backend.GroupCompleted("group_1", 2)
+	require.NoError(t, err)
+	assert.False(t, completed)
+
+	require.NoError(t, backend.SetStateSuccess(task1, []*tasks.TaskResult{}))
+	require.NoError(t, backend.SetStateFailure(task2, "boom"))
+
+	completed, err = backend.GroupCompleted("group_1", 2)
+	require.NoError(t, err)
+	assert.True(t, completed)
+
+	taskStates, err := backend.GroupTaskStates("group_1", 2)
+	require.NoError(t, err)
+	require.Len(t, taskStates, 2)
+	assert.Equal(t, "task_1", taskStates[0].TaskUUID)
+	assert.True(t, taskStates[0].IsSuccess())
+	assert.Equal(t, "task_2", taskStates[1].TaskUUID)
+	assert.True(t, taskStates[1].IsFailure())
+
+	require.NoError(t, backend.PurgeGroupMeta("group_1"))
+	_, err = backend.GroupCompleted("group_1", 2)
+	assert.Equal(t, sql.NewErrGroupNotFound("group_1"), err)
+}
+
+func TestTriggerChord(t *testing.T) {
+	t.Parallel()
+
+	backend, cleanup := newTestBackend(t, &config.Config{})
+	defer cleanup()
+
+	// Group meta must exist before the chord can be triggered
+	_, err := backend.TriggerChord("group_1")
+	assert.Equal(t, sql.NewErrGroupNotFound("group_1"), err)
+
+	require.NoError(t, backend.InitGroup("group_1", []string{"task_1", "task_2"}))
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		triggered int
+	)
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			shouldTrigger, err := backend.TriggerChord("group_1")
+			assert.NoError(t, err)
+			if shouldTrigger {
+				mu.Lock()
+				triggered++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	assert.Equal(t, 1, triggered)
+}
+
+func TestMigrationsAreIdempotent(t *testing.T) {
+	t.Parallel()
+
+	dataSourceName, cleanup := newDataSourceName(t)
+	defer cleanup()
+
+	// Every backend instance migrates the database on first use
+	for i := 0; i < 3; i++ {
+		backend := sql.New(&config.Config{}, sql.DriverSQLite, dataSourceName)
+		taskUUID := fmt.Sprintf("task_%d", i)
+		require.NoError(t, backend.SetStatePending(&tasks.Signature{Id: taskUUID}))
+		_, err := backend.GetState(taskUUID)
+		require.NoError(t, err)
+	}
+
+	// Migrations are safe to run again, as when several workers migrate
+	// the database at the same time
+	db, err := gosql.Open(sql.DriverSQLite, dataSourceName)
+	require.NoError(t, err)
+	defer db.Close()
+	_, err = db.Exec(`DELETE FROM machinery_schema_migrations`)
+	require.NoError(t, err)
+
+	backend := sql.New(&config.Config{}, sql.DriverSQLite, dataSourceName)
+	signature := &tasks.Signature{Id: "task_0", ErrorClass: tasks.ErrorClassPermanent}
+	require.NoError(t, backend.SetStateFailure(signature, "boom"))
+	taskState, err := backend.GetState("task_0")
+	require.NoError(t, err)
+	assert.Equal(t, tasks.ErrorClassPermanent, taskState.ErrorClass)
+}
+
+func TestRevokedStateIsKept(t *testing.T) {
+	t.Parallel()
+
+	backend, cleanup := newTestBackend(t, &config.Config{})
+	defer cleanup()
+
+	signature := &tasks.Signature{Id: "task_1", Task: "add"}
+	require.NoError(t, backend.SetStateStarted(signature))
+	require.NoError(t, backend.SetStateRevoked(signature))
+
+	assert.Equal(t, tasks.ErrTaskRevoked, backend.SetStateSuccess(signature, []*tasks.TaskResult{{Type: "int64", Value: 2}}))
+	assert.Equal(t, tasks.ErrTaskRevoked, backend.SetStateFailure(signature, "error"))
+	taskState, err := backend.GetState("task_1")
+	require.NoError(t, err)
+	assert.True(t, taskState.IsRevoked())
+	assert.Empty(t, taskState.Results)
+}
+
+func TestLock(t *testing.T) {
+	t.Parallel()
+
+	backend, cleanup := newTestBackend(t, &config.Config{})
+	defer cleanup()
+	locker := backend.(iface.Locker)
+
+	acquired, err := locker.Lock("key", "owner_1", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	acquired, err = locker.Lock("key", "owner_2", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	// the owner extends its lock
+	acquired, err = locker.Lock("key", "owner_1", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	// only the owner releases the lock
+	require.NoError(t, locker.Unlock("key", "owner_2"))
+	acquired, err = locker.Lock("key", "owner_2", time.Minute)
+	require.NoError(t, err)
+	assert.False(t, acquired)
+
+	require.NoError(t, locker.Unlock("key", "owner_1"))
+	acquired, err = locker.Lock("key", "owner_1", 50*time.Millisecond)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+
+	// the lock expires after its ttl
+	time.Sleep(100 * time.Millisecond)
+	acquired, err = locker.Lock("key", "owner_2", time.Minute)
+	require.NoError(t, err)
+	assert.True(t, acquired)
+}
+
+func TestLastRun(t *testing.T) {
+	t.Parallel()
+
+	backend, cleanup := newTestBackend(t, &config.Config{})
+	defer cleanup()
+	store := backend.(iface.ScheduleStore)
+
+	lastRun, err := store.LastRun("tick")
+	require.NoError(t, err)
+	assert.True(t, lastRun.IsZero())
+
+	for _, run := range []time.Time{
+		time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC),
+		time.Date(2021, 1, 1, 13, 0, 0, 0, time.UTC),
+	} {
+		require.NoError(t, store.SetLastRun("tick", run))
+		lastRun, err = store.LastRun("tick")
+		require.NoError(t, err)
+		assert.True(t, run.Equal(lastRun))
+	}
+}
@@ -181,9 +181,14 @@ func (b *Broker) Publish(signature *tasks.Signature) error {
 	// Adjust routing key (this decides which queue the message will be published to)
 	b.AdjustRoutingKey(signature)
 
-	msg, err := json.Marshal(signature)
+	msg, contentType, err := b.MarshalSignature(signature)
 	if err != nil {
-		return fmt.Errorf("JSON marshal error: %s", err)
+		return err
+	}
+
+	msg, contentEncoding, err := b.CompressMessage(msg)
+	if err != nil {
+		return err
 	}
 
 	// Check the ETA signature field, if it is set and it is in the future,
@@ -217,10 +222,11 @@ func (b *Broker) Publish(signature *tasks.Signature) error {
 		false,                       // mandatory
 		false,                       // immediate
 		amqp.Publishing{
-			Headers:      amqp.Table(signature.Headers),
-			ContentType:  "application/json",
-			Body:         msg,
-			DeliveryMode: amqp.Persistent,
+			Headers:         amqp.Table(signature.Headers),
+			ContentType:     contentType,
+			ContentEncoding: contentEncoding,
+			Body:            msg,
+			DeliveryMode:    amqp.Persistent,
 		},
 	); err != nil {
 		return err
@@ -292,14 +298,26 @@ func (b *Broker) consumeOne(delivery amqp.Delivery, taskProcessor iface.TaskProc
 
 	var multiple, requeue = false, false
 
-	// Unmarshal message body into signature struct
-	signature := new(tasks.Signature)
-	decoder := json.NewDecoder(bytes.NewReader(delivery.Body))
-	if err := decoder.Decode(signature); err != nil {
+	// Decompress and unmarshal message body into signature struct
+	body, err := b.DecompressMessage(delivery.ContentEncoding, delivery.Body)
+	if err != nil {
+		delivery.Nack(multiple, requeue)
+		return errs.NewErrCouldNotUnmarshaTaskSignature(delivery.Body, err)
+	}
+
+	signature, err := b.UnmarshalSignature(delivery.ContentType, body)
+	if err != nil {
 		delivery.Nack(multiple, requeue)
 		return errs.NewErrCouldNotUnmarshaTaskSignature(delivery.Body, err)
 	}
 
+	// Reject tasks which are not signed by a trusted key
+	if err := b.VerifySignature(signature); err != nil {
+		b.RejectTask(b, signature, err)
+		delivery.Nack(multiple, false)
+		return nil
+	}
+
 	if signature.Expires != nil && signature.Expires.UnixNano() < time.Now().UnixNano() {
 		log.INFO.Printf("Task expired at %s, removing from queue", signature.Expires.String())
 		delivery.Nack(multiple, requeue)
@@ -319,7 +337,7 @@ func (b *Broker) consumeOne(delivery amqp.Delivery, taskProcessor iface.TaskProc
 
 	log.INFO.Printf("Received new message on worker %s: %s", delivery.ConsumerTag, delivery.Body)
 
-	err := taskProcessor.Process(signature)
+	err = taskProcessor.Process(signature)
 	delivery.Ack(multiple)
 	return err
 }
@@ -333,9 +351,14 @@ func (b *Broker) delay(signature *tasks.Signature, delayMs int64) error {
 		return errors.New("Cannot delay task by 0ms")
 	}
 
-	message, err := json.Marshal(signature)
+	message, contentType, err := b.MarshalSignature(signature)
 	if err != nil {
-		return fmt.Errorf("JSON marshal error: %s", err)
+		return err
+	}
+
+	message, contentEncoding, err := b.CompressMessage(message)
+	if err != nil {
+		return err
 	}
 
 	// It's necessary to redeclare the queue each time (to zero its TTL timer).
@@ -374,10 +397,11 @@ func (b *Broker) delay(signature *tasks.Signature, delayMs int64) error {
 		false,                       // mandatory
 		false,                       // immediate
 		amqp.Publishing{
-			Headers:      amqp.Table(signature.Headers),
-			ContentType:  "application/json",
-			Body:         message,
-			DeliveryMode: amqp.Persistent,
+			Headers:         amqp.Table(signature.Headers),
+			ContentType:     contentType,
+			ContentEncoding: contentEncoding,
+			Body:            message,
+			DeliveryMode:    amqp.Persistent,
 		},
 	); err != nil {
 		return err
@@ -386,6 +410,230 @@ func (b *Broker) delay(signature *tasks.Signature, delayMs int64) error {
 	return nil
 }
 
+// PublishDeadLetter places a failed task on the dead letter queue
+func (b *Broker) PublishDeadLetter(deadLetter *tasks.DeadLetter) error {
+	msg, err := json.Marshal(deadLetter)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	conn, channel, err := b.openDeadLetterQueue()
+	if err != nil {
+		return err
+	}
+	defer b.Close(channel, conn)
+
+	confirmsChan, err := confirmDeadLetters(channel)
+	if err != nil {
+		return err
+	}
+
+	return b.publishDeadLetter(channel, confirmsChan, amqp.Publishing{
+		ContentType:  "application/json",
+		Body:         msg,
+		DeliveryMode: amqp.Persistent,
+		MessageId:    deadLetter.ID(),
+	})
+}
+
+// GetDeadLetters returns up to limit tasks from the dead letter queue,
+// oldest first, or all of them if limit is not positive
+func (b *Broker) GetDeadLetters(limit int) ([]*tasks.DeadLetter, error) {
+	deadLetters := make([]*tasks.DeadLetter, 0)
+	err := b.browseDeadLetters(func(deadLetter *tasks.DeadLetter) (bool, bool) {
+		deadLetters = append(deadLetters, deadLetter)
+		return false, limit <= 0 || len(deadLetters) < limit
+	})
+	if err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+// GetDeadLetter returns the task from the dead letter queue
+func (b *Broker) GetDeadLetter(taskUUID string) (*tasks.DeadLetter, error) {
+	var found *tasks.DeadLetter
+	err := b.browseDeadLetters(func(deadLetter *tasks.DeadLetter) (bool, bool) {
+		if deadLetter.ID() == taskUUID {
+			found = deadLetter
+		}
+		return false, found == nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, errs.ErrDeadLetterNotFound
+	}
+	return found, nil
+}
+
+// DeleteDeadLetter removes the task from the dead letter queue
+func (b *Broker) DeleteDeadLetter(taskUUID string) error {
+	found := false
+	err := b.browseDeadLetters(func(deadLetter *tasks.DeadLetter) (bool, bool) {
+		found = deadLetter.ID() == taskUUID
+		return found, !found
+	})
+	if err != nil {
+		return err
+	}
+	if !found {
+		return errs.ErrDeadLetterNotFound
+	}
+	return nil
+}
+
+// browseDeadLetters visits messages of the dead letter queue oldest first,
+// until visit returns false as its second value. AMQP cannot look at
+// messages without taking them off the queue, so the whole queue is
+// rotated: every message is taken off and published again at the tail,
+// unless visit returns true as its first value to remove it. This keeps
+// the order of the queue and does not mark messages as redelivered.
+// Messages are published again before they are acknowledged, so a failure
+// in between duplicates a message rather than losing it. Browsing is best
+// effort, messages taken off by a concurrent browser are not visited.
+func (b *Broker) browseDeadLetters(visit func(deadLetter *tasks.DeadLetter) (remove, more bool)) error {
+	conn, channel, err := b.openDeadLetterQueue()
+	if err != nil {
+		return err
+	}
+	defer b.Close(channel, conn)
+
+	queueState, err := b.InspectQueue(channel, b.GetConfig().DeadLetterQueue)
+	if err != nil {
+		return err
+	}
+
+	confirmsChan, err := confirmDeadLetters(channel)
+	if err != nil {
+		return err
+	}
+
+	// Messages published meanwhile are left alone, they are at the tail
+	// already. A delivery which is not acknowledged goes back on the queue
+	// when the channel closes.
+	more := true
+	for i := 0; i < queueState.Messages; i++ {
+		delivery, ok, err := channel.Get(b.GetConfig().DeadLetterQueue, false)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		remove := false
+		if more {
+			deadLetter := new(tasks.DeadLetter)
+			decoder := json.NewDecoder(bytes.NewReader(delivery.Body))
+			if err := decoder.Decode(deadLetter); err != nil {
+				log.WARNING.Printf("Skipping malformed message in the dead letter queue: %s", err)
+			} else {
+				remove, more = visit(deadLetter)
+			}
+		}
+
+		if !remove {
+			err := b.publishDeadLetter(channel, confirmsChan, amqp.Publishing{
+				Headers:      delivery.Headers,
+				ContentType:  delivery.ContentType,
+				Body:         delivery.Body,
+				DeliveryMode: amqp.Persistent,
+				MessageId:    delivery.MessageId,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		if err := delivery.Ack(false); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// confirmDeadLetters puts the channel into confirm mode and returns the
+// channel receiving the confirmations
+func confirmDeadLetters(channel *amqp.Channel) (chan amqp.Confirmation, error) {
+	if err := channel.Confirm(false); err != nil {
+		return nil, fmt.Errorf("Channel could not be put into confirm mode: %s", err)
+	}
+	return channel.NotifyPublish(make(chan amqp.Confirmation, 1)), nil
+}
+
+// publishDeadLetter publishes the message to the dead letter queue and waits
+// for the confirmation
+func (b *Broker) publishDeadLetter(channel *amqp.Channel, confirmsChan chan amqp.Confirmation, msg amqp.Publishing) error {
+	// Publish through the default exchange, which routes the message
+	// straight to the queue named by the routing key
+	if err := channel.Publish(
+		"",                            // exchange name
+		b.GetConfig().DeadLetterQueue, // routing key
+		false,                         // mandatory
+		false,                         // immediate
+		msg,
+	); err != nil {
+		return err
+	}
+
+	confirmed := <-confirmsChan
+
+	if confirmed.Ack {
+		return nil
+	}
+
+	return fmt.Errorf("Failed delivery of delivery tag: %v", confirmed.DeliveryTag)
+}
+
+// QueueDepth returns the number of tasks ready to be delivered from the queue
+func (b *Broker) QueueDepth(queue string) (int, error) {
+	if queue == "" {
+		queue = b.GetConfig().DefaultQueue
+	}
+
+	conn, channel, err := b.Open(b.GetConfig().Broker, b.GetConfig().TLSConfig)
+	if err != nil {
+		return 0, err
+	}
+	defer b.Close(channel, conn)
+
+	queueState, err := b.InspectQueue(channel, queue)
+	if err != nil {
+		return 0, err
+	}
+	return queueState.Messages, nil
+}
+
+// openDeadLetterQueue opens a channel and declares the dead letter queue.
+// The queue is not bound to the exchange, so tasks are never routed to it.
+func (b *Broker) openDeadLetterQueue() (*amqp.Connection, *amqp.Channel, error) {
+	if b.GetConfig().DeadLetterQueue == "" {
+		return nil, nil, errors.New("Dead letter queue not configured")
+	}
+
+	conn, channel, err := b.Open(b.GetConfig().Broker, b.GetConfig().TLSConfig)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if _, err := channel.QueueDeclare(
+		b.GetConfig().DeadLetterQueue, // name
+		true,                          // durable
+		false,                         // delete when unused
+		false,                         // exclusive
+		false,                         // no-wait
+		nil,                           // arguments
+	); err != nil {
+		b.Close(channel, conn)
+		return nil, nil, fmt.Errorf("Queue declare error: %s", err)
+	}
+
+	return conn, channel, nil
+}
+
 // AdjustRoutingKey makes sure the routing key is correct.
 // If the routing key is an empty string:
 // a) set it to binding key for direct exchange type
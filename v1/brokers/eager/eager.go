@@ -1,8 +1,6 @@
 package eager
 
 import (
-	"bytes"
-	"encoding/json"
 	"errors"
 	"fmt"
 
@@ -43,18 +41,20 @@ func (eagerBroker *Broker) Publish(task *tasks.Signature) error {
 		return errors.New("worker is not assigned in eager-mode")
 	}
 
-	// faking the behavior to marshal input into json
+	// faking the behavior to marshal input with the serializer
 	// and unmarshal it back
-	message, err := json.Marshal(task)
+	message, contentType, err := eagerBroker.MarshalSignature(task)
 	if err != nil {
-		return fmt.Errorf("JSON marshal error: %s", err)
+		return err
 	}
 
-	signature := new(tasks.Signature)
-	decoder := json.NewDecoder(bytes.NewReader(message))
-	decoder.UseNumber()
-	if err := decoder.Decode(signature); err != nil {
-		return fmt.Errorf("JSON unmarshal error: %s", err)
+	signature, err := eagerBroker.UnmarshalSignature(contentType, message)
+	if err != nil {
+		return fmt.Errorf("Unmarshal error: %s", err)
+	}
+
+	if err := eagerBroker.VerifySignature(signature); err != nil {
+		return err
 	}
 
 	// blocking call to the task directly
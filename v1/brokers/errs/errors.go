@@ -1,6 +1,7 @@
 package errs
 
 import (
+	"errors"
 	"fmt"
 )
 
@@ -19,3 +20,7 @@ func (e ErrCouldNotUnmarshaTaskSignature) Error() string {
 func NewErrCouldNotUnmarshaTaskSignature(msg []byte, err error) ErrCouldNotUnmarshaTaskSignature {
 	return ErrCouldNotUnmarshaTaskSignature{msg: msg, reason: err.Error()}
 }
+
+// ErrDeadLetterNotFound is returned when the dead letter queue does not
+// hold the requested task
+var ErrDeadLetterNotFound = errors.New("Dead letter not found")
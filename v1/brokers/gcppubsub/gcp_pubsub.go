@@ -1,9 +1,7 @@
 package gcppubsub
 
 import (
-	"bytes"
 	"context"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"sync"
@@ -17,6 +15,15 @@ import (
 	"github.com/pmaccamp/machinery/v1/tasks"
 )
 
+const (
+	// contentTypeAttribute is the message attribute holding the content type
+	// of the serializer the message was encoded with
+	contentTypeAttribute = "content_type"
+	// contentEncodingAttribute is the message attribute holding the encoding
+	// of compressed messages
+	contentEncodingAttribute = "content_encoding"
+)
+
 // Broker represents an Google Cloud Pub/Sub broker
 type Broker struct {
 	common.Broker
@@ -105,9 +112,19 @@ func (b *Broker) Publish(signature *tasks.Signature) error {
 	// Adjust routing key (this decides which queue the message will be published to)
 	b.AdjustRoutingKey(signature)
 
-	msg, err := json.Marshal(signature)
+	msg, contentType, err := b.MarshalSignature(signature)
 	if err != nil {
-		return fmt.Errorf("JSON marshal error: %s", err)
+		return err
+	}
+
+	msg, contentEncoding, err := b.CompressMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	attributes := map[string]string{contentTypeAttribute: contentType}
+	if contentEncoding != "" {
+		attributes[contentEncodingAttribute] = contentEncoding
 	}
 
 	ctx := context.Background()
@@ -135,7 +152,8 @@ func (b *Broker) Publish(signature *tasks.Signature) error {
 	}
 
 	result := topic.Publish(ctx, &pubsub.Message{
-		Data: msg,
+		Data:       msg,
+		Attributes: attributes,
 	})
 
 	id, err := result.Get(ctx)
@@ -202,15 +220,27 @@ func (b *Broker) consumeOne(delivery *pubsub.Message, taskProcessor iface.TaskPr
 		return errors.New("Received an empty message")
 	}
 
-	sig := new(tasks.Signature)
-	decoder := json.NewDecoder(bytes.NewBuffer(delivery.Data))
-	decoder.UseNumber()
-	if err := decoder.Decode(sig); err != nil {
+	data, err := b.DecompressMessage(delivery.Attributes[contentEncodingAttribute], delivery.Data)
+	if err != nil {
+		delivery.Nack()
+		log.ERROR.Printf("decompress error. the delivery is %v", delivery)
+		return err
+	}
+
+	sig, err := b.UnmarshalSignature(delivery.Attributes[contentTypeAttribute], data)
+	if err != nil {
 		delivery.Nack()
 		log.ERROR.Printf("unmarshal error. the delivery is %v", delivery)
 		return err
 	}
 
+	// Reject tasks which are not signed by a trusted key
+	if err := b.VerifySignature(sig); err != nil {
+		b.RejectTask(b, sig, err)
+		delivery.Ack()
+		return nil
+	}
+
 	// If the task is not registered return an error
 	// and leave the message in the queue
 	if !b.IsTaskRegistered(sig.Task) {
@@ -218,7 +248,7 @@ func (b *Broker) consumeOne(delivery *pubsub.Message, taskProcessor iface.TaskPr
 		return fmt.Errorf("task %s is not registered", sig.Id)
 	}
 
-	err := taskProcessor.Process(sig)
+	err = taskProcessor.Process(sig)
 	if err != nil {
 		delivery.Nack()
 		return err
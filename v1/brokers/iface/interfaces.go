@@ -23,3 +23,24 @@ type TaskProcessor interface {
 	Process(signature *tasks.Signature) error
 	CustomQueue() string
 }
+
+// MultiConsumerBroker - a broker shared by several consumers, e.g. workers
+// of the same server, which can stop them one by one
+type MultiConsumerBroker interface {
+	StopConsumer(consumerTag string)
+}
+
+// QueueDepthBroker - a broker which can report how many tasks are waiting
+// in a queue
+type QueueDepthBroker interface {
+	QueueDepth(queue string) (int, error)
+}
+
+// DeadLetterBroker - a broker which can keep failed tasks in the dead
+// letter queue configured by config.Config.DeadLetterQueue
+type DeadLetterBroker interface {
+	PublishDeadLetter(deadLetter *tasks.DeadLetter) error
+	GetDeadLetters(limit int) ([]*tasks.DeadLetter, error)
+	GetDeadLetter(taskUUID string) (*tasks.DeadLetter, error)
+	DeleteDeadLetter(taskUUID string) error
+}
@@ -0,0 +1,504 @@
+package memory
+
+import (
+	"bytes"
+	"container/heap"
+	"encoding/json"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/brokers/errs"
+	"github.com/pmaccamp/machinery/v1/brokers/iface"
+	"github.com/pmaccamp/machinery/v1/common"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/log"
+	"github.com/pmaccamp/machinery/v1/tasks"
+)
+
+// unregisteredTaskDelay is how long a task not registered with this broker
+// is held back before it is delivered again, so consumers don't spin on it
+const unregisteredTaskDelay = time.Second
+
+// Broker represents an in-memory broker. Unlike the eager broker, messages
+// are kept in real queues and consumed asynchronously by StartConsuming, so
+// ETA, retries, custom queues and concurrency behave as with other brokers.
+// All state lives in the process, so it is only useful when producers and
+// workers share a Server, e.g. in tests.
+type Broker struct {
+	common.Broker
+
+	mu          sync.Mutex
+	queues      map[string][][]byte
+	delayed     delayedTasks
+	deadLetters [][]byte
+	// changed is closed and replaced every time a message is published,
+	// which wakes up all consumers waiting for new messages
+	changed chan struct{}
+
+	// consumers are the running StartConsuming calls, stoppedTags are the
+	// tags of consumers stopped before they started
+	consumers   map[*consumer]struct{}
+	stoppedTags map[string]bool
+}
+
+// consumer is a running StartConsuming call
+type consumer struct {
+	tag      string
+	stopChan chan struct{}
+	doneChan chan struct{}
+}
+
+// New creates new Broker instance
+func New(cnf *config.Config) iface.Broker {
+	return &Broker{
+		Broker:      common.NewBroker(cnf),
+		queues:      make(map[string][][]byte),
+		changed:     make(chan struct{}),
+		consumers:   make(map[*consumer]struct{}),
+		stoppedTags: make(map[string]bool),
+	}
+}
+
+// StartConsuming enters a loop and waits for incoming messages. It can be
+// called concurrently, e.g. by several workers consuming different queues.
+func (b *Broker) StartConsuming(consumerTag string, concurrency int, taskProcessor iface.TaskProcessor) (retry bool, err error) {
+	// Register the consumer under the lock, so StopConsuming either waits
+	// for it or the consumer sees it has been stopped
+	b.mu.Lock()
+	if b.stoppedTags[consumerTag] {
+		delete(b.stoppedTags, consumerTag)
+		b.mu.Unlock()
+		return false, nil
+	}
+	c := &consumer{tag: consumerTag, stopChan: make(chan struct{}), doneChan: make(chan struct{})}
+	b.consumers[c] = struct{}{}
+	b.mu.Unlock()
+
+	defer func() {
+		b.mu.Lock()
+		delete(b.consumers, c)
+		// Once stopped the consumer must not be started again because of
+		// an error processing a task
+		select {
+		case <-c.stopChan:
+			retry, err = false, nil
+		default:
+		}
+		b.mu.Unlock()
+		close(c.doneChan)
+	}()
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	queue := b.getQueue(taskProcessor)
+
+	pool := make(chan struct{}, concurrency)
+	for i := 0; i < concurrency; i++ {
+		pool <- struct{}{}
+	}
+
+	log.INFO.Print("[*] Waiting for messages. To exit press CTRL+C")
+
+	var processingWG sync.WaitGroup
+	err = b.consume(queue, c.stopChan, pool, &processingWG, taskProcessor)
+
+	// Waiting for any tasks being processed to finish
+	processingWG.Wait()
+
+	if err != nil {
+		return true, err
+	}
+
+	return false, nil
+}
+
+// StopConsuming quits the loop of every running consumer and waits for tasks
+// being processed to finish. Messages left in the queues are kept and can be
+// consumed by calling StartConsuming again.
+func (b *Broker) StopConsuming() {
+	b.stopConsumers(func(c *consumer) bool { return true })
+}
+
+// StopConsumer quits the loop of the consumers with the tag and waits for
+// their tasks being processed to finish, other consumers keep consuming. If
+// none is running, the next one started with the tag quits straight away.
+func (b *Broker) StopConsumer(consumerTag string) {
+	if b.stopConsumers(func(c *consumer) bool { return c.tag == consumerTag }) == 0 {
+		b.mu.Lock()
+		b.stoppedTags[consumerTag] = true
+		b.mu.Unlock()
+	}
+}
+
+// stopConsumers stops the running consumers matching the filter and returns
+// how many were stopped
+func (b *Broker) stopConsumers(filter func(c *consumer) bool) int {
+	var stopped []*consumer
+
+	b.mu.Lock()
+	for c := range b.consumers {
+		if !filter(c) {
+			continue
+		}
+		select {
+		case <-c.stopChan:
+		default:
+			close(c.stopChan)
+		}
+		stopped = append(stopped, c)
+	}
+	b.mu.Unlock()
+
+	// Waiting for the consumption to finish
+	for _, c := range stopped {
+		<-c.doneChan
+	}
+	return len(stopped)
+}
+
+// Publish places a new message on the default queue
+func (b *Broker) Publish(signature *tasks.Signature) error {
+	// Adjust routing key (this decides which queue the message will be published to)
+	b.AdjustRoutingKey(signature)
+
+	// The content type is not stored along with the message,
+	// consumers detect it from the message itself
+	msg, _, err := b.MarshalSignature(signature)
+	if err != nil {
+		return err
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	// Check the ETA signature field, if it is set and it is in the future,
+	// delay the task
+	if signature.ETA != nil && signature.ETA.After(time.Now().UTC()) {
+		heap.Push(&b.delayed, &delayedTask{
+			eta:   *signature.ETA,
+			queue: signature.RoutingKey,
+			msg:   msg,
+		})
+	} else {
+		b.queues[signature.RoutingKey] = append(b.queues[signature.RoutingKey], msg)
+	}
+
+	b.notify()
+	return nil
+}
+
+// GetPendingTasks returns a slice of task.Signatures waiting in the queue
+func (b *Broker) GetPendingTasks(queue string) ([]*tasks.Signature, error) {
+	if queue == "" {
+		queue = b.GetConfig().DefaultQueue
+	}
+
+	b.mu.Lock()
+	msgs := b.queues[queue]
+	b.mu.Unlock()
+
+	taskSignatures := make([]*tasks.Signature, len(msgs))
+	for i, msg := range msgs {
+		signature, err := b.UnmarshalSignature("", msg)
+		if err != nil {
+			return nil, err
+		}
+		taskSignatures[i] = signature
+	}
+	return taskSignatures, nil
+}
+
+// QueueDepth returns the number of tasks waiting in the queue, delayed tasks
+// are not counted until they are due
+func (b *Broker) QueueDepth(queue string) (int, error) {
+	if queue == "" {
+		queue = b.GetConfig().DefaultQueue
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return len(b.queues[queue]), nil
+}
+
+// PublishDeadLetter places a failed task on the dead letter queue
+func (b *Broker) PublishDeadLetter(deadLetter *tasks.DeadLetter) error {
+	msg, err := json.Marshal(deadLetter)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.deadLetters = append(b.deadLetters, msg)
+	return nil
+}
+
+// GetDeadLetters returns up to limit tasks from the dead letter queue,
+// oldest first, or all of them if limit is not positive
+func (b *Broker) GetDeadLetters(limit int) ([]*tasks.DeadLetter, error) {
+	b.mu.Lock()
+	msgs := b.deadLetters
+	b.mu.Unlock()
+
+	if limit > 0 && len(msgs) > limit {
+		msgs = msgs[:limit]
+	}
+
+	deadLetters := make([]*tasks.DeadLetter, len(msgs))
+	for i, msg := range msgs {
+		deadLetter, err := decodeDeadLetter(msg)
+		if err != nil {
+			return nil, err
+		}
+		deadLetters[i] = deadLetter
+	}
+	return deadLetters, nil
+}
+
+// GetDeadLetter returns the task from the dead letter queue
+func (b *Broker) GetDeadLetter(taskUUID string) (*tasks.DeadLetter, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	_, deadLetter, err := b.findDeadLetter(taskUUID)
+	return deadLetter, err
+}
+
+// DeleteDeadLetter removes the task from the dead letter queue
+func (b *Broker) DeleteDeadLetter(taskUUID string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	i, _, err := b.findDeadLetter(taskUUID)
+	if err != nil {
+		return err
+	}
+
+	deadLetters := make([][]byte, 0, len(b.deadLetters)-1)
+	deadLetters = append(deadLetters, b.deadLetters[:i]...)
+	b.deadLetters = append(deadLetters, b.deadLetters[i+1:]...)
+	return nil
+}
+
+// findDeadLetter returns the dead letter of the task along with its index,
+// it must be called with b.mu held
+func (b *Broker) findDeadLetter(taskUUID string) (int, *tasks.DeadLetter, error) {
+	for i, msg := range b.deadLetters {
+		deadLetter, err := decodeDeadLetter(msg)
+		if err != nil {
+			return 0, nil, err
+		}
+		if deadLetter.ID() == taskUUID {
+			return i, deadLetter, nil
+		}
+	}
+	return 0, nil, errs.ErrDeadLetterNotFound
+}
+
+// consume takes messages off the queue as long as there is a free slot in
+// the pool and processes them concurrently
+func (b *Broker) consume(queue string, stopChan <-chan struct{}, pool chan struct{}, processingWG *sync.WaitGroup, taskProcessor iface.TaskProcessor) error {
+	errorsChan := make(chan error, cap(pool))
+
+	for {
+		// get worker from pool (blocks until one is available)
+		select {
+		case err := <-errorsChan:
+			return err
+		case <-stopChan:
+			return nil
+		case <-pool:
+		}
+
+		msg, err := b.next(queue, stopChan, errorsChan)
+		if msg == nil {
+			return err
+		}
+
+		processingWG.Add(1)
+
+		// Consume the task inside a goroutine so multiple tasks
+		// can be processed concurrently
+		go func() {
+			defer func() {
+				processingWG.Done()
+				// give worker back to pool
+				pool <- struct{}{}
+			}()
+
+			if err := b.consumeOne(msg, queue, taskProcessor); err != nil {
+				errorsChan <- err
+			}
+		}()
+	}
+}
+
+// consumeOne processes a single message using TaskProcessor
+func (b *Broker) consumeOne(msg []byte, queue string, taskProcessor iface.TaskProcessor) error {
+	signature, err := b.UnmarshalSignature("", msg)
+	if err != nil {
+		return errs.NewErrCouldNotUnmarshaTaskSignature(msg, err)
+	}
+
+	// Reject tasks which are not signed by a trusted key
+	if err := b.VerifySignature(signature); err != nil {
+		b.RejectTask(b, signature, err)
+		return nil
+	}
+
+	if signature.Expires != nil && signature.Expires.UnixNano() < time.Now().UnixNano() {
+		log.INFO.Printf("Task expired at %s, removing from queue", signature.Expires.String())
+		return nil
+	}
+
+	// If the task is not registered, we requeue it with a small delay,
+	// there might be a different worker for it sharing this broker later
+	if !b.IsTaskRegistered(signature.Task) {
+		log.INFO.Printf("Task not registered with this worker. Requeing message: %s", msg)
+
+		b.mu.Lock()
+		defer b.mu.Unlock()
+
+		heap.Push(&b.delayed, &delayedTask{
+			eta:   time.Now().UTC().Add(unregisteredTaskDelay),
+			queue: queue,
+			msg:   msg,
+		})
+		b.notify()
+		return nil
+	}
+
+	log.DEBUG.Printf("Received new message: %s", msg)
+
+	return taskProcessor.Process(signature)
+}
+
+// next blocks until there is a message in the queue and takes it off the
+// queue. It returns a nil message if consuming is stopped or a task failed
+// in the meantime, along with the error of the failed task.
+func (b *Broker) next(queue string, stopChan <-chan struct{}, errorsChan <-chan error) ([]byte, error) {
+	for {
+		select {
+		case <-stopChan:
+			return nil, nil
+		default:
+		}
+
+		b.mu.Lock()
+
+		b.moveDelayedTasks(time.Now().UTC())
+
+		if msgs := b.queues[queue]; len(msgs) > 0 {
+			msg := msgs[0]
+			b.queues[queue] = msgs[1:]
+			b.mu.Unlock()
+			return msg, nil
+		}
+
+		changed := b.changed
+
+		// Wake up when the earliest delayed task becomes due
+		var timer *time.Timer
+		var timerChan <-chan time.Time
+		if len(b.delayed) > 0 {
+			timer = time.NewTimer(time.Until(b.delayed[0].eta))
+			timerChan = timer.C
+		}
+
+		b.mu.Unlock()
+
+		select {
+		case err := <-errorsChan:
+			stopTimer(timer)
+			return nil, err
+		case <-stopChan:
+			stopTimer(timer)
+			return nil, nil
+		case <-changed:
+		case <-timerChan:
+		}
+
+		stopTimer(timer)
+	}
+}
+
+// moveDelayedTasks moves delayed tasks whose ETA has been reached to their
+// destination queue, it must be called with b.mu held
+func (b *Broker) moveDelayedTasks(now time.Time) {
+	moved := false
+	for len(b.delayed) > 0 && !b.delayed[0].eta.After(now) {
+		task := heap.Pop(&b.delayed).(*delayedTask)
+		b.queues[task.queue] = append(b.queues[task.queue], task.msg)
+		moved = true
+	}
+
+	// Tasks might have been moved to a queue consumed by someone else
+	if moved {
+		b.notify()
+	}
+}
+
+// notify wakes up consumers waiting for messages, it must be called with b.mu held
+func (b *Broker) notify() {
+	close(b.changed)
+	b.changed = make(chan struct{})
+}
+
+// stopTimer stops the timer if there is one
+func stopTimer(timer *time.Timer) {
+	if timer != nil {
+		timer.Stop()
+	}
+}
+
+// getQueue returns the name of the queue to consume from
+func (b *Broker) getQueue(taskProcessor iface.TaskProcessor) string {
+	customQueue := taskProcessor.CustomQueue()
+	if customQueue == "" {
+		return b.GetConfig().DefaultQueue
+	}
+	return customQueue
+}
+
+// decodeDeadLetter unmarshals a message into a dead letter
+func decodeDeadLetter(msg []byte) (*tasks.DeadLetter, error) {
+	deadLetter := new(tasks.DeadLetter)
+	decoder := json.NewDecoder(bytes.NewReader(msg))
+	decoder.UseNumber()
+	if err := decoder.Decode(deadLetter); err != nil {
+		return nil, err
+	}
+	return deadLetter, nil
+}
+
+// delayedTask is a message waiting for its ETA
+type delayedTask struct {
+	eta   time.Time
+	queue string
+	msg   []byte
+}
+
+// delayedTasks is a min-heap of delayed tasks ordered by ETA
+type delayedTasks []*delayedTask
+
+func (d delayedTasks) Len() int           { return len(d) }
+func (d delayedTasks) Less(i, j int) bool { return d[i].eta.Before(d[j].eta) }
+func (d delayedTasks) Swap(i, j int)      { d[i], d[j] = d[j], d[i] }
+
+func (d *delayedTasks) Push(x interface{}) {
+	*d = append(*d, x.(*delayedTask))
+}
+
+func (d *delayedTasks) Pop() interface{} {
+	old := *d
+	n := len(old)
+	task := old[n-1]
+	old[n-1] = nil
+	*d = old[:n-1]
+	return task
+}
@@ -0,0 +1,338 @@
+package memory_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/brokers/errs"
+	"github.com/pmaccamp/machinery/v1/brokers/iface"
+	"github.com/pmaccamp/machinery/v1/brokers/memory"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testProcessor struct {
+	queue     string
+	processed chan *tasks.Signature
+	process   func(signature *tasks.Signature) error
+}
+
+func newTestProcessor(queue string) *testProcessor {
+	return &testProcessor{queue: queue, processed: make(chan *tasks.Signature, 100)}
+}
+
+func (p *testProcessor) Process(signature *tasks.Signature) error {
+	var err error
+	if p.process != nil {
+		err = p.process(signature)
+	}
+	p.processed <- signature
+	return err
+}
+
+func (p *testProcessor) CustomQueue() string {
+	return p.queue
+}
+
+func newTestConfig() *config.Config {
+	return &config.Config{
+		DefaultQueue:  "machinery_tasks",
+		NoUnixSignals: true,
+	}
+}
+
+func waitForSignatures(t *testing.T, processed <-chan *tasks.Signature, n int) []*tasks.Signature {
+	signatures := make([]*tasks.Signature, 0, n)
+	timeout := time.After(5 * time.Second)
+	for len(signatures) < n {
+		select {
+		case s := <-processed:
+			signatures = append(signatures, s)
+		case <-timeout:
+			t.Fatalf("Timed out waiting for tasks, got %d of %d", len(signatures), n)
+		}
+	}
+	return signatures
+}
+
+func TestPublishAndGetPendingTasks(t *testing.T) {
+	t.Parallel()
+
+	broker := memory.New(newTestConfig())
+
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_1", Task: "add", Args: []interface{}{1, 2}}))
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_2", Task: "add"}))
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_3", Task: "add", RoutingKey: "custom_queue"}))
+
+	pendingTasks, err := broker.GetPendingTasks("")
+	require.NoError(t, err)
+	require.Len(t, pendingTasks, 2)
+	assert.Equal(t, "task_1", pendingTasks[0].Id)
+	assert.Equal(t, "task_2", pendingTasks[1].Id)
+	assert.Len(t, pendingTasks[0].Args, 2)
+
+	pendingTasks, err = broker.GetPendingTasks("custom_queue")
+	require.NoError(t, err)
+	require.Len(t, pendingTasks, 1)
+	assert.Equal(t, "task_3", pendingTasks[0].Id)
+}
+
+func TestDeadLetters(t *testing.T) {
+	t.Parallel()
+
+	broker := memory.New(newTestConfig()).(iface.DeadLetterBroker)
+
+	for _, id := range []string{"task_1", "task_2", "task_3"} {
+		deadLetter := tasks.NewDeadLetter(&tasks.Signature{Id: id, Task: "add"}, errors.New("failed"), nil)
+		require.NoError(t, broker.PublishDeadLetter(deadLetter))
+	}
+
+	deadLetters, err := broker.GetDeadLetters(2)
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 2)
+	assert.Equal(t, "task_1", deadLetters[0].ID())
+	assert.Equal(t, "task_2", deadLetters[1].ID())
+
+	deadLetter, err := broker.GetDeadLetter("task_2")
+	require.NoError(t, err)
+	assert.Equal(t, "add", deadLetter.Signature.Task)
+	assert.Equal(t, "failed", deadLetter.Error)
+	assert.Equal(t, tasks.ErrorClassTransient, deadLetter.ErrorClass)
+
+	require.NoError(t, broker.DeleteDeadLetter("task_2"))
+	assert.Equal(t, errs.ErrDeadLetterNotFound, broker.DeleteDeadLetter("task_2"))
+
+	_, err = broker.GetDeadLetter("task_2")
+	assert.Equal(t, errs.ErrDeadLetterNotFound, err)
+
+	deadLetters, err = broker.GetDeadLetters(0)
+	require.NoError(t, err)
+	require.Len(t, deadLetters, 2)
+	assert.Equal(t, "task_1", deadLetters[0].ID())
+	assert.Equal(t, "task_3", deadLetters[1].ID())
+}
+
+func TestPublishWithETA(t *testing.T) {
+	t.Parallel()
+
+	broker := memory.New(newTestConfig())
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	now := time.Now().UTC()
+	eta1 := now.Add(300 * time.Millisecond)
+	eta2 := now.Add(150 * time.Millisecond)
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_1", Task: "add", ETA: &eta1}))
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_2", Task: "add", ETA: &eta2}))
+
+	pendingTasks, err := broker.GetPendingTasks("")
+	require.NoError(t, err)
+	assert.Len(t, pendingTasks, 0)
+
+	processor := newTestProcessor("")
+	go broker.StartConsuming("test", 1, processor)
+	defer broker.StopConsuming()
+
+	signatures := waitForSignatures(t, processor.processed, 2)
+	assert.Equal(t, "task_2", signatures[0].Id)
+	assert.Equal(t, "task_1", signatures[1].Id)
+	assert.False(t, time.Now().UTC().Before(eta1))
+}
+
+func TestStartConsumingHonoursConcurrency(t *testing.T) {
+	t.Parallel()
+
+	broker := memory.New(newTestConfig())
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	var running, maxRunning int32
+	processor := newTestProcessor("")
+	processor.process = func(signature *tasks.Signature) error {
+		n := atomic.AddInt32(&running, 1)
+		for {
+			max := atomic.LoadInt32(&maxRunning)
+			if n <= max || atomic.CompareAndSwapInt32(&maxRunning, max, n) {
+				break
+			}
+		}
+		time.Sleep(20 * time.Millisecond)
+		atomic.AddInt32(&running, -1)
+		return nil
+	}
+
+	for i := 0; i < 12; i++ {
+		require.NoError(t, broker.Publish(&tasks.Signature{Task: "add"}))
+	}
+
+	var (
+		wg    sync.WaitGroup
+		retry bool
+		err   error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		retry, err = broker.StartConsuming("test", 3, processor)
+	}()
+
+	waitForSignatures(t, processor.processed, 12)
+
+	broker.StopConsuming()
+	wg.Wait()
+
+	assert.False(t, retry)
+	assert.NoError(t, err)
+	assert.Equal(t, int32(3), atomic.LoadInt32(&maxRunning))
+
+	pendingTasks, err := broker.GetPendingTasks("")
+	require.NoError(t, err)
+	assert.Len(t, pendingTasks, 0)
+}
+
+func TestMultipleConsumers(t *testing.T) {
+	t.Parallel()
+
+	broker := memory.New(newTestConfig())
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	defaultProcessor := newTestProcessor("")
+	customProcessor := newTestProcessor("custom_queue")
+	go broker.StartConsuming("default", 2, defaultProcessor)
+	go broker.StartConsuming("custom", 2, customProcessor)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, broker.Publish(&tasks.Signature{Task: "add"}))
+		require.NoError(t, broker.Publish(&tasks.Signature{Task: "add", RoutingKey: "custom_queue"}))
+	}
+
+	for _, signature := range waitForSignatures(t, defaultProcessor.processed, 5) {
+		assert.Equal(t, "machinery_tasks", signature.RoutingKey)
+	}
+	for _, signature := range waitForSignatures(t, customProcessor.processed, 5) {
+		assert.Equal(t, "custom_queue", signature.RoutingKey)
+	}
+
+	broker.StopConsuming()
+}
+
+func TestStopConsumer(t *testing.T) {
+	t.Parallel()
+
+	broker := memory.New(newTestConfig())
+	broker.SetRegisteredTaskNames([]string{"add"})
+	stopper, ok := broker.(iface.MultiConsumerBroker)
+	require.True(t, ok)
+
+	first := newTestProcessor("")
+	second := newTestProcessor("")
+	firstDone := make(chan struct{})
+	go func() {
+		defer close(firstDone)
+		retry, err := broker.StartConsuming("first", 1, first)
+		assert.False(t, retry)
+		assert.NoError(t, err)
+	}()
+	go broker.StartConsuming("second", 1, second)
+
+	// the other consumer keeps consuming once one quits
+	stopper.StopConsumer("first")
+	<-firstDone
+	for i := 0; i < 5; i++ {
+		require.NoError(t, broker.Publish(&tasks.Signature{Task: "add"}))
+	}
+	waitForSignatures(t, second.processed, 5)
+	assert.Len(t, first.processed, 0)
+
+	// stopping all consumers does not keep the broker from consuming again
+	broker.StopConsuming()
+	require.NoError(t, broker.Publish(&tasks.Signature{Task: "add"}))
+	go broker.StartConsuming("first", 1, first)
+	waitForSignatures(t, first.processed, 1)
+
+	// a consumer stopped before it started quits straight away
+	stopper.StopConsumer("third")
+	retry, err := broker.StartConsuming("third", 1, newTestProcessor(""))
+	assert.False(t, retry)
+	assert.NoError(t, err)
+
+	broker.StopConsuming()
+}
+
+func TestStopConsumingWaitsForRunningTasks(t *testing.T) {
+	t.Parallel()
+
+	broker := memory.New(newTestConfig())
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	started := make(chan struct{})
+	var finished int32
+	processor := newTestProcessor("")
+	processor.process = func(signature *tasks.Signature) error {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		atomic.StoreInt32(&finished, 1)
+		return nil
+	}
+
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_1", Task: "add"}))
+	go broker.StartConsuming("test", 1, processor)
+
+	<-started
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_2", Task: "add"}))
+	broker.StopConsuming()
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&finished))
+
+	// The task which was not consumed yet stays in the queue
+	pendingTasks, err := broker.GetPendingTasks("")
+	require.NoError(t, err)
+	require.Len(t, pendingTasks, 1)
+	assert.Equal(t, "task_2", pendingTasks[0].Id)
+}
+
+func TestStartConsumingReturnsProcessingError(t *testing.T) {
+	t.Parallel()
+
+	broker := memory.New(newTestConfig())
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	processor := newTestProcessor("")
+	processor.process = func(signature *tasks.Signature) error {
+		return errors.New("backend is down")
+	}
+
+	require.NoError(t, broker.Publish(&tasks.Signature{Task: "add"}))
+
+	retry, err := broker.StartConsuming("test", 1, processor)
+	assert.True(t, retry)
+	assert.EqualError(t, err, "backend is down")
+}
+
+func TestUnregisteredTaskIsRequeued(t *testing.T) {
+	t.Parallel()
+
+	broker := memory.New(newTestConfig())
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_1", Task: "multiply"}))
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_2", Task: "add"}))
+
+	processor := newTestProcessor("")
+	go broker.StartConsuming("test", 1, processor)
+
+	signatures := waitForSignatures(t, processor.processed, 1)
+	assert.Equal(t, "task_2", signatures[0].Id)
+
+	// The unregistered task keeps being requeued but never processed
+	select {
+	case signature := <-processor.processed:
+		t.Errorf("Unexpected task processed: %s", signature.Id)
+	case <-time.After(1500 * time.Millisecond):
+	}
+
+	broker.StopConsuming()
+}
@@ -0,0 +1,537 @@
+package redis
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gomodule/redigo/redis"
+	"github.com/pmaccamp/machinery/v1/brokers/errs"
+	"github.com/pmaccamp/machinery/v1/brokers/iface"
+	"github.com/pmaccamp/machinery/v1/common"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/log"
+	"github.com/pmaccamp/machinery/v1/retry"
+	"github.com/pmaccamp/machinery/v1/tasks"
+)
+
+const (
+	defaultDelayedTasksKey        = "delayed_tasks"
+	defaultNormalTasksPollPeriod  = 1000 // milliseconds
+	defaultDelayedTasksPollPeriod = 500  // milliseconds
+
+	// unregisteredTaskDelay is how long a task not registered with this
+	// worker is delayed before it is pushed back to its queue
+	unregisteredTaskDelay = time.Second
+)
+
+// Broker represents a Redis broker
+type Broker struct {
+	common.Broker
+	common.RedisConnector
+	host            string
+	password        string
+	db              int
+	socketPath      string // if set, path to a socket file overrides hostname
+	delayedTasksKey string
+
+	pool      *redis.Pool
+	redisOnce sync.Once
+
+	stopReceivingChan  chan struct{}
+	stopReceivingMutex sync.Mutex
+	consumingWG        sync.WaitGroup // make sure the whole consumption completes on StopConsuming
+	receivingWG        sync.WaitGroup // make sure receiving goroutines exit before StartConsuming returns
+	processingWG       sync.WaitGroup // make sure task processing completes on interrupt signal
+}
+
+// New creates new Broker instance
+func New(cnf *config.Config, host, password, socketPath string, db int) iface.Broker {
+	b := &Broker{
+		Broker:          common.NewBroker(cnf),
+		host:            host,
+		password:        password,
+		db:              db,
+		socketPath:      socketPath,
+		delayedTasksKey: defaultDelayedTasksKey,
+	}
+
+	if cnf.Redis != nil && cnf.Redis.DelayedTasksKey != "" {
+		b.delayedTasksKey = cnf.Redis.DelayedTasksKey
+	}
+
+	return b
+}
+
+// StartConsuming enters a loop and waits for incoming messages
+func (b *Broker) StartConsuming(consumerTag string, concurrency int, taskProcessor iface.TaskProcessor) (bool, error) {
+	b.consumingWG.Add(1)
+	defer b.consumingWG.Done()
+
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	b.Broker.StartConsuming(consumerTag, concurrency, taskProcessor)
+
+	// Ping the server to make sure connection is live
+	conn := b.open()
+	_, err := conn.Do("PING")
+	conn.Close()
+	if err != nil {
+		b.GetRetryFunc()(b.GetRetryStopChan())
+		return b.GetRetry(), err
+	}
+
+	stopChan := b.resetStopReceiving()
+	queue := b.getQueue(taskProcessor)
+
+	// The pool holds one token per task that may be processed at the same
+	// time, a message is only popped from Redis once a token is available so
+	// we never take more messages off the queue than we are able to process
+	pool := make(chan struct{}, concurrency)
+	for i := 0; i < concurrency; i++ {
+		pool <- struct{}{}
+	}
+	deliveries := make(chan []byte, concurrency)
+
+	log.INFO.Print("[*] Waiting for messages. To exit press CTRL+C")
+
+	// A receiving goroutine keeps popping messages from the queue by BLPOP
+	// and sends them to the deliveries channel
+	b.receivingWG.Add(1)
+	go func() {
+		defer b.receivingWG.Done()
+		defer close(deliveries)
+
+		var backoff backoff
+		for {
+			select {
+			// A way to stop this goroutine from b.StopConsuming
+			case <-stopChan:
+				return
+			case <-pool:
+				task, err := b.nextTask(queue)
+				if err != nil && err != redis.ErrNil {
+					pool <- struct{}{}
+
+					retryIn := backoff.next()
+					log.ERROR.Printf("Queue consume error: %s, retrying in %s", err, retryIn)
+
+					select {
+					case <-stopChan:
+						return
+					case <-time.After(retryIn):
+					}
+					continue
+				}
+				backoff.reset()
+
+				if len(task) == 0 {
+					pool <- struct{}{}
+					continue
+				}
+
+				deliveries <- task
+			}
+		}
+	}()
+
+	// A goroutine to watch for delayed tasks and move them to their
+	// destination queue once their ETA has been reached
+	b.receivingWG.Add(1)
+	go func() {
+		defer b.receivingWG.Done()
+
+		var backoff backoff
+		for {
+			select {
+			// A way to stop this goroutine from b.StopConsuming
+			case <-stopChan:
+				return
+			case <-time.After(b.delayedTasksPollPeriod()):
+				if err := b.moveDelayedTasks(); err != nil {
+					retryIn := backoff.next()
+					log.ERROR.Printf("Delayed tasks error: %s, retrying in %s", err, retryIn)
+
+					select {
+					case <-stopChan:
+						return
+					case <-time.After(retryIn):
+					}
+					continue
+				}
+				backoff.reset()
+			}
+		}
+	}()
+
+	err = b.consume(deliveries, pool, taskProcessor)
+
+	// Make sure both goroutines above have exited before returning, tasks
+	// which were popped but not handed over to the task processor yet are
+	// pushed back to the front of the queue
+	b.stopReceiving()
+	b.receivingWG.Wait()
+	b.requeue(queue, deliveries)
+
+	// Waiting for any tasks being processed to finish
+	b.processingWG.Wait()
+
+	return b.GetRetry(), err
+}
+
+// StopConsuming quits the loop
+func (b *Broker) StopConsuming() {
+	b.Broker.StopConsuming()
+
+	b.stopReceiving()
+
+	// Waiting for the consumption to finish
+	b.consumingWG.Wait()
+}
+
+// Publish places a new message on the default queue
+func (b *Broker) Publish(signature *tasks.Signature) error {
+	// Adjust routing key (this decides which queue the message will be published to)
+	b.AdjustRoutingKey(signature)
+
+	// The content type is not stored along with the message,
+	// consumers detect it from the message itself
+	msg, _, err := b.MarshalSignature(signature)
+	if err != nil {
+		return err
+	}
+
+	conn := b.open()
+	defer conn.Close()
+
+	// Check the ETA signature field, if it is set and it is in the future,
+	// delay the task
+	if signature.ETA != nil {
+		now := time.Now().UTC()
+
+		if signature.ETA.After(now) {
+			score := signature.ETA.UnixNano()
+			_, err = conn.Do("ZADD", b.delayedTasksKey, score, msg)
+			return err
+		}
+	}
+
+	_, err = conn.Do("RPUSH", signature.RoutingKey, msg)
+	return err
+}
+
+// GetPendingTasks returns a slice of task.Signatures waiting in the queue
+func (b *Broker) GetPendingTasks(queue string) ([]*tasks.Signature, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	if queue == "" {
+		queue = b.GetConfig().DefaultQueue
+	}
+	results, err := redis.ByteSlices(conn.Do("LRANGE", queue, 0, -1))
+	if err != nil {
+		return nil, err
+	}
+
+	taskSignatures := make([]*tasks.Signature, len(results))
+	for i, result := range results {
+		signature, err := b.UnmarshalSignature("", result)
+		if err != nil {
+			return nil, err
+		}
+		taskSignatures[i] = signature
+	}
+	return taskSignatures, nil
+}
+
+// QueueDepth returns the number of tasks waiting in the queue, delayed tasks
+// are not counted until they are due
+func (b *Broker) QueueDepth(queue string) (int, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	if queue == "" {
+		queue = b.GetConfig().DefaultQueue
+	}
+	return redis.Int(conn.Do("LLEN", queue))
+}
+
+// consume takes delivered messages from the channel and manages a worker pool
+// to process tasks concurrently
+func (b *Broker) consume(deliveries <-chan []byte, pool chan struct{}, taskProcessor iface.TaskProcessor) error {
+	errorsChan := make(chan error, cap(pool))
+
+	for {
+		select {
+		case err := <-errorsChan:
+			return err
+		case d, ok := <-deliveries:
+			if !ok {
+				return nil
+			}
+
+			b.processingWG.Add(1)
+
+			// Consume the task inside a goroutine so multiple tasks
+			// can be processed concurrently
+			go func() {
+				defer func() {
+					b.processingWG.Done()
+					// give worker back to pool
+					pool <- struct{}{}
+				}()
+
+				if err := b.consumeOne(d, taskProcessor); err != nil {
+					errorsChan <- err
+				}
+			}()
+		}
+	}
+}
+
+// consumeOne processes a single message using TaskProcessor
+func (b *Broker) consumeOne(delivery []byte, taskProcessor iface.TaskProcessor) error {
+	signature, err := b.UnmarshalSignature("", delivery)
+	if err != nil {
+		return errs.NewErrCouldNotUnmarshaTaskSignature(delivery, err)
+	}
+
+	// Reject tasks which are not signed by a trusted key
+	if err := b.VerifySignature(signature); err != nil {
+		b.RejectTask(b, signature, err)
+		return nil
+	}
+
+	if signature.Expires != nil && signature.Expires.UnixNano() < time.Now().UnixNano() {
+		log.INFO.Printf("Task expired at %s, removing from queue", signature.Expires.String())
+		return nil
+	}
+
+	// If the task is not registered, we requeue it with a small delay,
+	// there might be different workers for processing specific tasks
+	if !b.IsTaskRegistered(signature.Task) {
+		log.INFO.Printf("Task not registered with this worker. Requeing message: %s", delivery)
+
+		conn := b.open()
+		defer conn.Close()
+
+		// delayed tasks are pushed back to the queue named by their routing key
+		score := time.Now().UTC().Add(unregisteredTaskDelay).UnixNano()
+		_, err := conn.Do("ZADD", b.delayedTasksKey, score, delivery)
+		return err
+	}
+
+	log.DEBUG.Printf("Received new message: %s", delivery)
+
+	return taskProcessor.Process(signature)
+}
+
+// nextTask pops next available task from the default queue
+func (b *Broker) nextTask(queue string) ([]byte, error) {
+	conn := b.open()
+	defer conn.Close()
+
+	pollPeriod := defaultNormalTasksPollPeriod
+	if b.GetConfig().Redis != nil && b.GetConfig().Redis.NormalTasksPollPeriod > 0 {
+		pollPeriod = b.GetConfig().Redis.NormalTasksPollPeriod
+	}
+
+	// BLPOP timeout is in whole seconds, 0 would block forever
+	timeout := pollPeriod / 1000
+	if timeout < 1 {
+		timeout = 1
+	}
+
+	items, err := redis.ByteSlices(conn.Do("BLPOP", queue, timeout))
+	if err != nil {
+		return nil, err
+	}
+
+	// items[0] - the name of the key where an element was popped
+	// items[1] - the value of the popped element
+	if len(items) != 2 {
+		return nil, redis.ErrNil
+	}
+
+	return items[1], nil
+}
+
+// moveDelayedTasks pushes all delayed tasks whose ETA has been reached to
+// their destination queues
+func (b *Broker) moveDelayedTasks() error {
+	for {
+		err := b.moveDelayedTask()
+		if err == redis.ErrNil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// moveDelayedTask atomically moves the earliest delayed task which is due
+// from the sorted set to its destination queue, it returns redis.ErrNil if
+// there is none. The message is moved as it is rather than published again,
+// which would sign it with the key of this worker whatever wrote it to the
+// delayed tasks sorted set.
+func (b *Broker) moveDelayedTask() (err error) {
+	conn := b.open()
+	defer conn.Close()
+
+	defer func() {
+		// Return connection to normal state on error.
+		// https://redis.io/commands/discard
+		if err != nil && err != redis.ErrNil {
+			conn.Do("DISCARD")
+		}
+	}()
+
+	var (
+		items     [][]byte
+		signature *tasks.Signature
+		reply     interface{}
+	)
+
+	for {
+		if _, err = conn.Do("WATCH", b.delayedTasksKey); err != nil {
+			return err
+		}
+
+		now := time.Now().UTC().UnixNano()
+
+		// https://redis.io/commands/zrangebyscore
+		items, err = redis.ByteSlices(conn.Do(
+			"ZRANGEBYSCORE",
+			b.delayedTasksKey,
+			0,
+			now,
+			"LIMIT",
+			0,
+			1,
+		))
+		if err != nil {
+			return err
+		}
+		if len(items) != 1 {
+			conn.Do("UNWATCH")
+			return redis.ErrNil
+		}
+
+		// The routing key has been adjusted when the task was published,
+		// malformed messages are dropped
+		signature, err = b.UnmarshalSignature("", items[0])
+		if err != nil {
+			log.ERROR.Print(errs.NewErrCouldNotUnmarshaTaskSignature(items[0], err))
+			signature = nil
+		}
+
+		conn.Send("MULTI")
+		conn.Send("ZREM", b.delayedTasksKey, items[0])
+		if signature != nil {
+			conn.Send("RPUSH", signature.RoutingKey, items[0])
+		}
+		reply, err = conn.Do("EXEC")
+		if err != nil {
+			return err
+		}
+
+		// A nil reply means the sorted set was modified by another consumer
+		// in the meantime and the transaction was aborted, just try again
+		if reply != nil {
+			return nil
+		}
+	}
+}
+
+// requeue pushes tasks which have been popped but not processed back to
+// the front of the queue
+func (b *Broker) requeue(queue string, deliveries <-chan []byte) {
+	conn := b.open()
+	defer conn.Close()
+
+	for d := range deliveries {
+		if _, err := conn.Do("LPUSH", queue, d); err != nil {
+			log.ERROR.Printf("Failed to requeue message: %s", err)
+		}
+	}
+}
+
+// resetStopReceiving creates a new channel used to stop receiving goroutines
+func (b *Broker) resetStopReceiving() <-chan struct{} {
+	b.stopReceivingMutex.Lock()
+	defer b.stopReceivingMutex.Unlock()
+
+	b.stopReceivingChan = make(chan struct{})
+
+	// StopConsuming might have been called before we got here
+	if !b.GetRetry() {
+		close(b.stopReceivingChan)
+	}
+
+	return b.stopReceivingChan
+}
+
+// stopReceiving stops the receiving goroutines, it is safe to call it
+// multiple times
+func (b *Broker) stopReceiving() {
+	b.stopReceivingMutex.Lock()
+	defer b.stopReceivingMutex.Unlock()
+
+	if b.stopReceivingChan == nil {
+		return
+	}
+
+	select {
+	case <-b.stopReceivingChan:
+	default:
+		close(b.stopReceivingChan)
+	}
+}
+
+// backoff spaces out attempts to reach Redis while it is unavailable, the
+// delay grows along the Fibonacci sequence until reset
+type backoff struct {
+	fibonacci func() int
+}
+
+// next returns how long to wait after another failed attempt
+func (b *backoff) next() time.Duration {
+	if b.fibonacci == nil {
+		b.fibonacci = retry.Fibonacci()
+	}
+	return time.Duration(b.fibonacci()) * time.Second
+}
+
+// reset starts over after a successful attempt
+func (b *backoff) reset() {
+	b.fibonacci = nil
+}
+
+// delayedTasksPollPeriod returns how often the delayed tasks sorted set is polled
+func (b *Broker) delayedTasksPollPeriod() time.Duration {
+	pollPeriod := defaultDelayedTasksPollPeriod
+	if b.GetConfig().Redis != nil && b.GetConfig().Redis.DelayedTasksPollPeriod > 0 {
+		pollPeriod = b.GetConfig().Redis.DelayedTasksPollPeriod
+	}
+	return time.Duration(pollPeriod) * time.Millisecond
+}
+
+// getQueue returns the queue the task processor consumes from
+func (b *Broker) getQueue(taskProcessor iface.TaskProcessor) string {
+	customQueue := taskProcessor.CustomQueue()
+	if customQueue == "" {
+		return b.GetConfig().DefaultQueue
+	}
+	return customQueue
+}
+
+// open returns a connection from the pool, the pool is created on first use
+func (b *Broker) open() redis.Conn {
+	b.redisOnce.Do(func() {
+		b.pool = b.NewPool(b.socketPath, b.host, b.password, b.db, b.GetConfig().Redis, b.GetConfig().TLSConfig)
+	})
+
+	return b.pool.Get()
+}
@@ -0,0 +1,289 @@
+package redis_test
+
+import (
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/pmaccamp/machinery/v1/brokers/redis"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/signing"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type testProcessor struct {
+	queue     string
+	processed chan *tasks.Signature
+}
+
+func newTestProcessor(queue string) *testProcessor {
+	return &testProcessor{queue: queue, processed: make(chan *tasks.Signature, 100)}
+}
+
+func (p *testProcessor) Process(signature *tasks.Signature) error {
+	p.processed <- signature
+	return nil
+}
+
+func (p *testProcessor) CustomQueue() string {
+	return p.queue
+}
+
+func newTestConfig() *config.Config {
+	return &config.Config{
+		DefaultQueue: "machinery_tasks",
+		Redis: &config.RedisConfig{
+			NormalTasksPollPeriod:  1000,
+			DelayedTasksPollPeriod: 10,
+		},
+		NoUnixSignals: true,
+	}
+}
+
+func waitForSignatures(t *testing.T, processed <-chan *tasks.Signature, n int) []*tasks.Signature {
+	signatures := make([]*tasks.Signature, 0, n)
+	timeout := time.After(5 * time.Second)
+	for len(signatures) < n {
+		select {
+		case s := <-processed:
+			signatures = append(signatures, s)
+		case <-timeout:
+			t.Fatalf("Timed out waiting for tasks, got %d of %d", len(signatures), n)
+		}
+	}
+	return signatures
+}
+
+func TestPublishAndGetPendingTasks(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	broker := redis.New(newTestConfig(), s.Addr(), "", "", 0)
+
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_1", Task: "add", Args: []interface{}{1, 2}}))
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_2", Task: "add"}))
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_3", Task: "add", RoutingKey: "custom_queue"}))
+
+	pendingTasks, err := broker.GetPendingTasks("")
+	require.NoError(t, err)
+	require.Len(t, pendingTasks, 2)
+	assert.Equal(t, "task_1", pendingTasks[0].Id)
+	assert.Equal(t, "task_2", pendingTasks[1].Id)
+	assert.Len(t, pendingTasks[0].Args, 2)
+
+	pendingTasks, err = broker.GetPendingTasks("custom_queue")
+	require.NoError(t, err)
+	require.Len(t, pendingTasks, 1)
+	assert.Equal(t, "task_3", pendingTasks[0].Id)
+}
+
+func TestPublishWithETA(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	broker := redis.New(newTestConfig(), s.Addr(), "", "", 0)
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	eta := time.Now().UTC().Add(200 * time.Millisecond)
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_1", Task: "add", ETA: &eta}))
+
+	pendingTasks, err := broker.GetPendingTasks("")
+	require.NoError(t, err)
+	assert.Len(t, pendingTasks, 0)
+
+	delayed, err := s.ZMembers("delayed_tasks")
+	require.NoError(t, err)
+	assert.Len(t, delayed, 1)
+
+	processor := newTestProcessor("")
+	go broker.StartConsuming("test", 1, processor)
+	defer broker.StopConsuming()
+
+	signatures := waitForSignatures(t, processor.processed, 1)
+	assert.Equal(t, "task_1", signatures[0].Id)
+	assert.False(t, time.Now().UTC().Before(eta))
+	assert.False(t, s.Exists("delayed_tasks"))
+}
+
+func TestDelayedTasksAreNotSignedAgain(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	cnf := newTestConfig()
+	cnf.Signing = &config.SigningConfig{
+		Keys:  map[string]signing.Key{"k1": signing.HMACKey([]byte("secret"))},
+		KeyID: "k1",
+	}
+	broker := redis.New(cnf, s.Addr(), "", "", 0)
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	// an unsigned task written straight to the delayed tasks sorted set
+	forged := `{"Id":"task_1","Task":"add","RoutingKey":"machinery_tasks"}`
+	_, err := s.ZAdd("delayed_tasks", float64(time.Now().UnixNano()), forged)
+	require.NoError(t, err)
+
+	eta := time.Now().UTC().Add(100 * time.Millisecond)
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_2", Task: "add", ETA: &eta}))
+
+	processor := newTestProcessor("")
+	go broker.StartConsuming("test", 1, processor)
+	defer broker.StopConsuming()
+
+	// the forged task is moved as is and rejected, it is not signed on the way
+	signatures := waitForSignatures(t, processor.processed, 1)
+	assert.Equal(t, "task_2", signatures[0].Id)
+	select {
+	case signature := <-processor.processed:
+		t.Fatalf("Unexpected task %s processed", signature.Id)
+	case <-time.After(100 * time.Millisecond):
+	}
+	assert.False(t, s.Exists("delayed_tasks"))
+}
+
+func TestStartConsuming(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	broker := redis.New(newTestConfig(), s.Addr(), "", "", 0)
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	for i := 0; i < 10; i++ {
+		require.NoError(t, broker.Publish(&tasks.Signature{Task: "add"}))
+	}
+
+	processor := newTestProcessor("")
+
+	var (
+		wg    sync.WaitGroup
+		retry bool
+		err   error
+	)
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		retry, err = broker.StartConsuming("test", 3, processor)
+	}()
+
+	waitForSignatures(t, processor.processed, 10)
+
+	broker.StopConsuming()
+	wg.Wait()
+
+	assert.False(t, retry)
+	assert.NoError(t, err)
+
+	pendingTasks, err := broker.GetPendingTasks("")
+	require.NoError(t, err)
+	assert.Len(t, pendingTasks, 0)
+}
+
+func TestStartConsumingCustomQueue(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	broker := redis.New(newTestConfig(), s.Addr(), "", "", 0)
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_1", Task: "add"}))
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_2", Task: "add", RoutingKey: "custom_queue"}))
+
+	processor := newTestProcessor("custom_queue")
+	go broker.StartConsuming("test", 1, processor)
+
+	signatures := waitForSignatures(t, processor.processed, 1)
+	broker.StopConsuming()
+
+	assert.Equal(t, "task_2", signatures[0].Id)
+
+	pendingTasks, err := broker.GetPendingTasks("")
+	require.NoError(t, err)
+	require.Len(t, pendingTasks, 1)
+	assert.Equal(t, "task_1", pendingTasks[0].Id)
+}
+
+func TestUnregisteredTaskIsRequeued(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	broker := redis.New(newTestConfig(), s.Addr(), "", "", 0)
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_1", Task: "multiply"}))
+	require.NoError(t, broker.Publish(&tasks.Signature{Id: "task_2", Task: "add"}))
+
+	processor := newTestProcessor("")
+	go broker.StartConsuming("test", 1, processor)
+
+	signatures := waitForSignatures(t, processor.processed, 1)
+	broker.StopConsuming()
+
+	assert.Equal(t, "task_2", signatures[0].Id)
+
+	// the unregistered task is delayed rather than pushed straight back,
+	// which would keep workers spinning on it
+	pendingTasks, err := broker.GetPendingTasks("")
+	require.NoError(t, err)
+	assert.Len(t, pendingTasks, 0)
+
+	delayed, err := s.ZMembers("delayed_tasks")
+	require.NoError(t, err)
+	require.Len(t, delayed, 1)
+	assert.Contains(t, delayed[0], "task_1")
+}
+
+func TestStartConsumingBacksOff(t *testing.T) {
+	t.Parallel()
+
+	s := miniredis.RunT(t)
+	broker := redis.New(newTestConfig(), s.Addr(), "", "", 0)
+	broker.SetRegisteredTaskNames([]string{"add"})
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		broker.StartConsuming("test", 1, newTestProcessor(""))
+	}()
+
+	// take Redis down once consuming started and count the attempts to
+	// reconnect to its address
+	time.Sleep(100 * time.Millisecond)
+	addr := s.Addr()
+	s.Close()
+	listener, err := net.Listen("tcp", addr)
+	require.NoError(t, err)
+	defer listener.Close()
+
+	var attempts int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			atomic.AddInt32(&attempts, 1)
+			conn.Close()
+		}
+	}()
+
+	time.Sleep(1500 * time.Millisecond)
+	assert.True(t, atomic.LoadInt32(&attempts) < 10, "%d attempts to pop messages", atomic.LoadInt32(&attempts))
+
+	// stopping does not wait for the back off to end
+	stopped := make(chan struct{})
+	go func() {
+		broker.StopConsuming()
+		wg.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("StopConsuming did not return")
+	}
+}
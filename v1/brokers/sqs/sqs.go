@@ -1,9 +1,11 @@
 package sqs
 
 import (
+	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -11,10 +13,12 @@ import (
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+	"github.com/pmaccamp/machinery/v1/brokers/errs"
 	"github.com/pmaccamp/machinery/v1/brokers/iface"
 	"github.com/pmaccamp/machinery/v1/common"
 	"github.com/pmaccamp/machinery/v1/config"
 	"github.com/pmaccamp/machinery/v1/log"
+	"github.com/pmaccamp/machinery/v1/serializer"
 	"github.com/pmaccamp/machinery/v1/tasks"
 
 	awssqs "github.com/aws/aws-sdk-go/service/sqs"
@@ -22,6 +26,24 @@ import (
 
 const (
 	maxAWSSQSDelay = time.Minute * 15 // Max supported SQS delay is 15 min: https://docs.aws.amazon.com/AWSSimpleQueueService/latest/APIReference/API_SendMessage.html
+	// deadLetterVisibilityTimeout hides messages received while browsing the
+	// dead letter queue, so they are not received twice, until they are
+	// released again
+	deadLetterVisibilityTimeout = 30
+	// deadLetterWaitTimeSeconds makes receiving from the dead letter queue
+	// long poll, so all SQS servers are queried rather than a sample of
+	// them and an empty response means the queue has no visible messages
+	deadLetterWaitTimeSeconds = 1
+	// maxAWSSQSReceivedMessages is the largest number of messages a single
+	// ReceiveMessage call can return
+	maxAWSSQSReceivedMessages = 10
+	// contentTypeAttribute is the message attribute holding the content type
+	// of the serializer the message was encoded with, message bodies of
+	// serializers other than JSON are base64 encoded
+	contentTypeAttribute = "ContentType"
+	// contentEncodingAttribute is the message attribute holding the encoding
+	// of compressed messages, compressed message bodies are base64 encoded
+	contentEncodingAttribute = "ContentEncoding"
 )
 
 // Broker represents a AWS SQS broker
@@ -123,17 +145,40 @@ func (b *Broker) StopConsuming() {
 
 // Publish places a new message on the default queue
 func (b *Broker) Publish(signature *tasks.Signature) error {
-	msg, err := json.Marshal(signature)
+	msg, contentType, err := b.MarshalSignature(signature)
 	if err != nil {
-		return fmt.Errorf("JSON marshal error: %s", err)
+		return err
+	}
+
+	msg, contentEncoding, err := b.CompressMessage(msg)
+	if err != nil {
+		return err
+	}
+
+	// SQS message bodies must be text
+	body := string(msg)
+	if contentType != serializer.ContentTypeJSON || contentEncoding != "" {
+		body = base64.StdEncoding.EncodeToString(msg)
 	}
 
 	// Check that signature.RoutingKey is set, if not switch to DefaultQueue
 	b.AdjustRoutingKey(signature)
 
 	MsgInput := &awssqs.SendMessageInput{
-		MessageBody: aws.String(string(msg)),
+		MessageBody: aws.String(body),
 		QueueUrl:    aws.String(b.GetConfig().Broker + "/" + signature.RoutingKey),
+		MessageAttributes: map[string]*awssqs.MessageAttributeValue{
+			contentTypeAttribute: {
+				DataType:    aws.String("String"),
+				StringValue: aws.String(contentType),
+			},
+		},
+	}
+	if contentEncoding != "" {
+		MsgInput.MessageAttributes[contentEncodingAttribute] = &awssqs.MessageAttributeValue{
+			DataType:    aws.String("String"),
+			StringValue: aws.String(contentEncoding),
+		}
 	}
 
 	// if this is a fifo queue, there needs to be some additional parameters.
@@ -172,6 +217,185 @@ func (b *Broker) Publish(signature *tasks.Signature) error {
 
 }
 
+// PublishDeadLetter places a failed task on the dead letter queue
+func (b *Broker) PublishDeadLetter(deadLetter *tasks.DeadLetter) error {
+	qURL, err := b.deadLetterQueueURL()
+	if err != nil {
+		return err
+	}
+
+	msg, err := json.Marshal(deadLetter)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	MsgInput := &awssqs.SendMessageInput{
+		MessageBody: aws.String(string(msg)),
+		QueueUrl:    qURL,
+	}
+
+	// if this is a fifo queue, there needs to be some additional parameters.
+	if strings.HasSuffix(b.GetConfig().DeadLetterQueue, ".fifo") {
+		// A task failing again after being replayed is a new dead letter
+		MsgDedupID := fmt.Sprintf("%s-%d", deadLetter.ID(), deadLetter.FailedAt.UnixNano())
+		MsgInput.MessageDeduplicationId = aws.String(MsgDedupID)
+		MsgInput.MessageGroupId = aws.String(deadLetter.ID())
+	}
+
+	if _, err := b.service.SendMessage(MsgInput); err != nil {
+		log.ERROR.Printf("Error when sending a message to the dead letter queue: %v", err)
+		return err
+	}
+	return nil
+}
+
+// GetDeadLetters returns up to limit tasks from the dead letter queue, or
+// all of them if limit is not positive. SQS does not guarantee the order.
+func (b *Broker) GetDeadLetters(limit int) ([]*tasks.DeadLetter, error) {
+	qURL, err := b.deadLetterQueueURL()
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetters := make([]*tasks.DeadLetter, 0)
+	messages, err := b.receiveDeadLetters(qURL, func(deadLetter *tasks.DeadLetter) bool {
+		if limit <= 0 || len(deadLetters) < limit {
+			deadLetters = append(deadLetters, deadLetter)
+		}
+		return limit <= 0 || len(deadLetters) < limit
+	})
+	b.releaseDeadLetters(qURL, messages)
+	if err != nil {
+		return nil, err
+	}
+	return deadLetters, nil
+}
+
+// GetDeadLetter returns the task from the dead letter queue
+func (b *Broker) GetDeadLetter(taskUUID string) (*tasks.DeadLetter, error) {
+	qURL, err := b.deadLetterQueueURL()
+	if err != nil {
+		return nil, err
+	}
+
+	var found *tasks.DeadLetter
+	messages, err := b.receiveDeadLetters(qURL, func(deadLetter *tasks.DeadLetter) bool {
+		if found == nil && deadLetter.ID() == taskUUID {
+			found = deadLetter
+		}
+		return found == nil
+	})
+	b.releaseDeadLetters(qURL, messages)
+	if err != nil {
+		return nil, err
+	}
+	if found == nil {
+		return nil, errs.ErrDeadLetterNotFound
+	}
+	return found, nil
+}
+
+// DeleteDeadLetter removes the task from the dead letter queue
+func (b *Broker) DeleteDeadLetter(taskUUID string) error {
+	qURL, err := b.deadLetterQueueURL()
+	if err != nil {
+		return err
+	}
+
+	var found *awssqs.Message
+	messages, err := b.receiveDeadLetters(qURL, func(deadLetter *tasks.DeadLetter) bool {
+		return deadLetter.ID() != taskUUID
+	})
+	for i, message := range messages {
+		if deadLetter, decodeErr := decodeDeadLetter(message); decodeErr == nil && deadLetter.ID() == taskUUID {
+			found = message
+			messages = append(messages[:i:i], messages[i+1:]...)
+			break
+		}
+	}
+	b.releaseDeadLetters(qURL, messages)
+	if err != nil {
+		return err
+	}
+	if found == nil {
+		return errs.ErrDeadLetterNotFound
+	}
+
+	_, err = b.service.DeleteMessage(&awssqs.DeleteMessageInput{
+		QueueUrl:      qURL,
+		ReceiptHandle: found.ReceiptHandle,
+	})
+	return err
+}
+
+// receiveDeadLetters receives messages from the dead letter queue until
+// visit returns false or no more messages are received. The messages are
+// hidden from other consumers and must be released or deleted afterwards,
+// they are returned even if receiving fails. Browsing is best effort,
+// messages hidden by other consumers at the time are not visited.
+func (b *Broker) receiveDeadLetters(qURL *string, visit func(deadLetter *tasks.DeadLetter) bool) ([]*awssqs.Message, error) {
+	var messages []*awssqs.Message
+	for {
+		output, err := b.service.ReceiveMessage(&awssqs.ReceiveMessageInput{
+			QueueUrl:            qURL,
+			MaxNumberOfMessages: aws.Int64(maxAWSSQSReceivedMessages),
+			VisibilityTimeout:   aws.Int64(deadLetterVisibilityTimeout),
+			WaitTimeSeconds:     aws.Int64(deadLetterWaitTimeSeconds),
+		})
+		if err != nil {
+			return messages, err
+		}
+		if len(output.Messages) == 0 {
+			return messages, nil
+		}
+
+		messages = append(messages, output.Messages...)
+		for _, message := range output.Messages {
+			deadLetter, err := decodeDeadLetter(message)
+			if err != nil {
+				log.WARNING.Printf("Skipping malformed message in the dead letter queue: %s", err)
+				continue
+			}
+			if !visit(deadLetter) {
+				return messages, nil
+			}
+		}
+	}
+}
+
+// releaseDeadLetters makes received messages visible to other consumers again
+func (b *Broker) releaseDeadLetters(qURL *string, messages []*awssqs.Message) {
+	for _, message := range messages {
+		_, err := b.service.ChangeMessageVisibility(&awssqs.ChangeMessageVisibilityInput{
+			QueueUrl:          qURL,
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(0),
+		})
+		if err != nil {
+			log.WARNING.Printf("Error when releasing a message of the dead letter queue: %v", err)
+		}
+	}
+}
+
+// deadLetterQueueURL is a method returns the dead letter queue url
+func (b *Broker) deadLetterQueueURL() (*string, error) {
+	if b.GetConfig().DeadLetterQueue == "" {
+		return nil, errors.New("Dead letter queue not configured")
+	}
+	return aws.String(b.GetConfig().Broker + "/" + b.GetConfig().DeadLetterQueue), nil
+}
+
+// decodeDeadLetter unmarshals a message into a dead letter
+func decodeDeadLetter(message *awssqs.Message) (*tasks.DeadLetter, error) {
+	deadLetter := new(tasks.DeadLetter)
+	decoder := json.NewDecoder(strings.NewReader(aws.StringValue(message.Body)))
+	decoder.UseNumber()
+	if err := decoder.Decode(deadLetter); err != nil {
+		return nil, err
+	}
+	return deadLetter, nil
+}
+
 // consume is a method which keeps consuming deliveries from a channel, until there is an error or a stop signal
 func (b *Broker) consume(deliveries <-chan *awssqs.ReceiveMessageOutput, concurrency int, taskProcessor iface.TaskProcessor) error {
 	pool := make(chan struct{}, concurrency)
@@ -201,21 +425,25 @@ func (b *Broker) consumeOne(delivery *awssqs.ReceiveMessageOutput, taskProcessor
 		return errors.New("received empty message, the delivery is " + delivery.GoString())
 	}
 
-	sig := new(tasks.Signature)
-	decoder := json.NewDecoder(strings.NewReader(*delivery.Messages[0].Body))
-	decoder.UseNumber()
-	if err := decoder.Decode(sig); err != nil {
+	sig, err := b.decodeSignature(delivery.Messages[0])
+	if err != nil {
 		log.ERROR.Printf("unmarshal error. the delivery is %v", delivery)
 		return err
 	}
 
+	// Reject tasks which are not signed by a trusted key
+	if err := b.VerifySignature(sig); err != nil {
+		b.RejectTask(b, sig, err)
+		return b.deleteOne(delivery)
+	}
+
 	// If the task is not registered return an error
 	// and leave the message in the queue
 	if !b.IsTaskRegistered(sig.Task) {
 		return fmt.Errorf("task %s is not registered", sig.Id)
 	}
 
-	err := taskProcessor.Process(sig)
+	err = taskProcessor.Process(sig)
 	if err != nil {
 		return err
 	}
@@ -226,6 +454,35 @@ func (b *Broker) consumeOne(delivery *awssqs.ReceiveMessageOutput, taskProcessor
 	return err
 }
 
+// decodeSignature decompresses the message with the encoding named by its
+// content encoding attribute and decodes it with the serializer named by its
+// content type attribute
+func (b *Broker) decodeSignature(message *awssqs.Message) (*tasks.Signature, error) {
+	body := []byte(aws.StringValue(message.Body))
+
+	var contentType, contentEncoding string
+	if attribute, ok := message.MessageAttributes[contentTypeAttribute]; ok {
+		contentType = aws.StringValue(attribute.StringValue)
+	}
+	if attribute, ok := message.MessageAttributes[contentEncodingAttribute]; ok {
+		contentEncoding = aws.StringValue(attribute.StringValue)
+	}
+	if (contentType != "" && contentType != serializer.ContentTypeJSON) || contentEncoding != "" {
+		decoded, err := base64.StdEncoding.DecodeString(string(body))
+		if err != nil {
+			return nil, err
+		}
+		body = decoded
+	}
+
+	body, err := b.DecompressMessage(contentEncoding, body)
+	if err != nil {
+		return nil, err
+	}
+
+	return b.UnmarshalSignature(contentType, body)
+}
+
 // deleteOne is a method delete a delivery from AWS SQS
 func (b *Broker) deleteOne(delivery *awssqs.ReceiveMessageOutput) error {
 	qURL := b.defaultQueueURL()
@@ -240,6 +497,27 @@ func (b *Broker) deleteOne(delivery *awssqs.ReceiveMessageOutput) error {
 	return nil
 }
 
+// QueueDepth returns the approximate number of tasks waiting in the queue
+func (b *Broker) QueueDepth(queue string) (int, error) {
+	if queue == "" {
+		queue = b.GetConfig().DefaultQueue
+	}
+
+	output, err := b.service.GetQueueAttributes(&awssqs.GetQueueAttributesInput{
+		QueueUrl:       aws.String(b.GetConfig().Broker + "/" + queue),
+		AttributeNames: []*string{aws.String(awssqs.QueueAttributeNameApproximateNumberOfMessages)},
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	depth, ok := output.Attributes[awssqs.QueueAttributeNameApproximateNumberOfMessages]
+	if !ok || depth == nil {
+		return 0, fmt.Errorf("Queue %s has no %s attribute", queue, awssqs.QueueAttributeNameApproximateNumberOfMessages)
+	}
+	return strconv.Atoi(*depth)
+}
+
 // defaultQueueURL is a method returns the default queue url
 func (b *Broker) defaultQueueURL() *string {
 	return aws.String(b.GetConfig().Broker + "/" + b.GetConfig().DefaultQueue)
@@ -0,0 +1,170 @@
+package claimcheck
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/pmaccamp/machinery/v1/serializer"
+	"github.com/pmaccamp/machinery/v1/tasks"
+)
+
+const (
+	// DefaultThreshold is the size in bytes above which arguments and results
+	// are offloaded unless configured otherwise, it keeps messages well below
+	// the 256 KiB limit of SQS and the item size limit of DynamoDB
+	DefaultThreshold = 128 * 1024
+
+	// ResultType is the type of the task result standing in for results
+	// offloaded to the store, its value is the claim check key
+	ResultType = "claim_check"
+)
+
+// offloadedArgs is the blob holding the arguments of a task
+type offloadedArgs struct {
+	Args          []interface{}
+	Kwargs        map[string]interface{}
+	EncryptedArgs []byte
+}
+
+// OffloadArgs moves the arguments of the signature to the store if they are
+// larger than threshold bytes. It returns a copy of the signature carrying
+// only the claim check key and the hash of the blob, or the signature itself
+// if the arguments are small enough or no store is configured. The hash is
+// signed along with the rest of the signature, so the blob cannot be swapped
+// in the store without workers noticing.
+func OffloadArgs(store Store, threshold int, signature *tasks.Signature) (*tasks.Signature, error) {
+	if store == nil || (len(signature.Args) == 0 && len(signature.Kwargs) == 0 && len(signature.EncryptedArgs) == 0) {
+		return signature, nil
+	}
+
+	data, err := serializer.JSON.Marshal(&offloadedArgs{
+		Args:          signature.Args,
+		Kwargs:        signature.Kwargs,
+		EncryptedArgs: signature.EncryptedArgs,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Marshal arguments error: %s", err)
+	}
+	if len(data) <= thresholdOrDefault(threshold) {
+		return signature, nil
+	}
+
+	key := argsKey(signature.Id)
+	if err := store.Put(key, data); err != nil {
+		return nil, fmt.Errorf("Put claim check %s error: %s", key, err)
+	}
+
+	offloaded := tasks.CopySignature(signature)
+	offloaded.Args = nil
+	offloaded.Kwargs = nil
+	offloaded.EncryptedArgs = nil
+	offloaded.ClaimCheck = key
+	offloaded.ClaimCheckHash = hash(data)
+	return offloaded, nil
+}
+
+// ResolveArgs fetches the arguments of a signature carrying a claim check
+// from the store, it fails if the blob does not match the hash carried by
+// the signature. Signatures without a claim check are left untouched.
+func ResolveArgs(store Store, signature *tasks.Signature) error {
+	if signature.ClaimCheck == "" {
+		return nil
+	}
+	if store == nil {
+		return fmt.Errorf("Claim check store not configured, cannot get %s", signature.ClaimCheck)
+	}
+
+	data, err := store.Get(signature.ClaimCheck)
+	if err != nil {
+		return fmt.Errorf("Get claim check %s error: %s", signature.ClaimCheck, err)
+	}
+	if hash(data) != signature.ClaimCheckHash {
+		return fmt.Errorf("Claim check %s does not match its hash", signature.ClaimCheck)
+	}
+
+	args := new(offloadedArgs)
+	if err := serializer.JSON.Unmarshal(data, args); err != nil {
+		return fmt.Errorf("Unmarshal claim check %s error: %s", signature.ClaimCheck, err)
+	}
+
+	signature.Args = args.Args
+	signature.Kwargs = args.Kwargs
+	signature.EncryptedArgs = args.EncryptedArgs
+	signature.ClaimCheck = ""
+	signature.ClaimCheckHash = ""
+	return nil
+}
+
+// OffloadResults moves the results of the task to the store if they are
+// larger than threshold bytes. It returns a single result of ResultType
+// holding the claim check key, or the results themselves if they are small
+// enough or no store is configured.
+func OffloadResults(store Store, threshold int, taskUUID string, results []*tasks.TaskResult) ([]*tasks.TaskResult, error) {
+	if store == nil || len(results) == 0 {
+		return results, nil
+	}
+
+	data, err := serializer.JSON.Marshal(results)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal results error: %s", err)
+	}
+	if len(data) <= thresholdOrDefault(threshold) {
+		return results, nil
+	}
+
+	key := resultsKey(taskUUID)
+	if err := store.Put(key, data); err != nil {
+		return nil, fmt.Errorf("Put claim check %s error: %s", key, err)
+	}
+
+	return []*tasks.TaskResult{{Type: ResultType, Value: key}}, nil
+}
+
+// ResolveResults fetches results offloaded by OffloadResults from the store,
+// other results are returned as is
+func ResolveResults(store Store, results []*tasks.TaskResult) ([]*tasks.TaskResult, error) {
+	if len(results) != 1 || results[0].Type != ResultType {
+		return results, nil
+	}
+
+	key, ok := results[0].Value.(string)
+	if !ok {
+		return nil, fmt.Errorf("Invalid claim check key: %v", results[0].Value)
+	}
+	if store == nil {
+		return nil, fmt.Errorf("Claim check store not configured, cannot get %s", key)
+	}
+
+	data, err := store.Get(key)
+	if err != nil {
+		return nil, fmt.Errorf("Get claim check %s error: %s", key, err)
+	}
+
+	var resolved []*tasks.TaskResult
+	if err := serializer.JSON.Unmarshal(data, &resolved); err != nil {
+		return nil, fmt.Errorf("Unmarshal claim check %s error: %s", key, err)
+	}
+	return resolved, nil
+}
+
+// hash returns the hex encoded SHA-256 hash of the blob
+func hash(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+func argsKey(taskUUID string) string {
+	return "args/" + taskUUID
+}
+
+func resultsKey(taskUUID string) string {
+	return "results/" + taskUUID
+}
+
+func thresholdOrDefault(threshold int) int {
+	if threshold <= 0 {
+		return DefaultThreshold
+	}
+	return threshold
+}
@@ -0,0 +1,111 @@
+package claimcheck_test
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/pmaccamp/machinery/v1/claimcheck"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newFileStore(t *testing.T) (*claimcheck.FileStore, func()) {
+	dir, err := ioutil.TempDir("", "claimcheck")
+	require.NoError(t, err)
+	return claimcheck.NewFileStore(dir), func() { os.RemoveAll(dir) }
+}
+
+func TestFileStore(t *testing.T) {
+	t.Parallel()
+
+	store, cleanup := newFileStore(t)
+	defer cleanup()
+
+	_, err := store.Get("args/task_1")
+	assert.Equal(t, claimcheck.ErrNotFound, err)
+
+	require.NoError(t, store.Put("args/task_1", []byte("foo")))
+	require.NoError(t, store.Put("args/task_1", []byte("bar")))
+	data, err := store.Get("args/task_1")
+	require.NoError(t, err)
+	assert.Equal(t, []byte("bar"), data)
+
+	assert.EqualError(t, store.Put("../task_1", nil), "Invalid claim check key: ../task_1")
+}
+
+func TestOffloadArgs(t *testing.T) {
+	t.Parallel()
+
+	store, cleanup := newFileStore(t)
+	defer cleanup()
+
+	signature := &tasks.Signature{
+		Id:     "task_1",
+		Args:   []interface{}{strings.Repeat("a", 100), 2},
+		Kwargs: map[string]interface{}{"b": true},
+	}
+
+	// arguments not larger than the threshold are sent as is
+	offloaded, err := claimcheck.OffloadArgs(store, 1024, signature)
+	require.NoError(t, err)
+	assert.Equal(t, signature, offloaded)
+
+	offloaded, err = claimcheck.OffloadArgs(store, 64, signature)
+	require.NoError(t, err)
+	assert.Equal(t, "args/task_1", offloaded.ClaimCheck)
+	assert.Len(t, offloaded.ClaimCheckHash, 64)
+	assert.Nil(t, offloaded.Args)
+	assert.Nil(t, offloaded.Kwargs)
+	assert.Len(t, signature.Args, 2, "the original signature is left untouched")
+
+	// a blob swapped in the store is rejected
+	data, err := store.Get("args/task_1")
+	require.NoError(t, err)
+	require.NoError(t, store.Put("args/task_1", []byte(`{"Args":["rm -rf /"]}`)))
+	err = claimcheck.ResolveArgs(store, tasks.CopySignature(offloaded))
+	assert.EqualError(t, err, "Claim check args/task_1 does not match its hash")
+	require.NoError(t, store.Put("args/task_1", data))
+
+	require.NoError(t, claimcheck.ResolveArgs(store, offloaded))
+	assert.Equal(t, "", offloaded.ClaimCheck)
+	assert.Equal(t, "", offloaded.ClaimCheckHash)
+	assert.Equal(t, []interface{}{strings.Repeat("a", 100), json.Number("2")}, offloaded.Args)
+	assert.Equal(t, map[string]interface{}{"b": true}, offloaded.Kwargs)
+
+	// claim checks cannot be resolved without a store
+	err = claimcheck.ResolveArgs(nil, &tasks.Signature{ClaimCheck: "args/task_1"})
+	assert.EqualError(t, err, "Claim check store not configured, cannot get args/task_1")
+
+	err = claimcheck.ResolveArgs(store, &tasks.Signature{ClaimCheck: "args/task_2"})
+	assert.EqualError(t, err, "Get claim check args/task_2 error: Claim check not found")
+}
+
+func TestOffloadResults(t *testing.T) {
+	t.Parallel()
+
+	store, cleanup := newFileStore(t)
+	defer cleanup()
+
+	results := []*tasks.TaskResult{{Type: "string", Value: strings.Repeat("a", 100)}}
+
+	stored, err := claimcheck.OffloadResults(store, 1024, "task_1", results)
+	require.NoError(t, err)
+	assert.Equal(t, results, stored)
+
+	stored, err = claimcheck.OffloadResults(store, 64, "task_1", results)
+	require.NoError(t, err)
+	assert.Equal(t, []*tasks.TaskResult{{Type: claimcheck.ResultType, Value: "results/task_1"}}, stored)
+
+	resolved, err := claimcheck.ResolveResults(store, stored)
+	require.NoError(t, err)
+	assert.Equal(t, results, resolved)
+
+	// results which were not offloaded are returned as is
+	resolved, err = claimcheck.ResolveResults(nil, results)
+	require.NoError(t, err)
+	assert.Equal(t, results, resolved)
+}
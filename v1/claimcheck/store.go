@@ -0,0 +1,86 @@
+package claimcheck
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// ErrNotFound is returned by stores for keys which do not exist
+var ErrNotFound = errors.New("Claim check not found")
+
+// Store holds arguments and results too large to be sent through the broker
+// or kept in the result backend. Blobs are never deleted by Machinery, stores
+// are expected to expire them, e.g. with S3 lifecycle rules.
+type Store interface {
+	// Put stores the data under the key, replacing existing data
+	Put(key string, data []byte) error
+	// Get returns the data stored under the key or ErrNotFound
+	Get(key string) ([]byte, error)
+}
+
+// FileStore keeps blobs in a local directory, which is useful for tests and
+// for workers sharing a file system
+type FileStore struct {
+	dir string
+}
+
+// NewFileStore creates FileStore instance keeping blobs in the directory
+func NewFileStore(dir string) *FileStore {
+	return &FileStore{dir: dir}
+}
+
+// Put implements Store
+func (s *FileStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// write to a temporary file first so readers never see partial blobs
+	tmpFile, err := ioutil.TempFile(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpFile.Name())
+
+	if _, err := tmpFile.Write(data); err != nil {
+		tmpFile.Close()
+		return err
+	}
+	if err := tmpFile.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpFile.Name(), path)
+}
+
+// Get implements Store
+func (s *FileStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, ErrNotFound
+	}
+	return data, err
+}
+
+// path returns the path of the file holding the blob of the key
+func (s *FileStore) path(key string) (string, error) {
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." {
+			return "", fmt.Errorf("Invalid claim check key: %s", key)
+		}
+	}
+	return filepath.Join(s.dir, filepath.FromSlash(key)), nil
+}
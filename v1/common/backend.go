@@ -1,6 +1,7 @@
 package common
 
 import (
+	"github.com/pmaccamp/machinery/v1/compression"
 	"github.com/pmaccamp/machinery/v1/config"
 )
 
@@ -23,3 +24,26 @@ func (b *Backend) GetConfig() *config.Config {
 func (b *Backend) IsAMQP() bool {
 	return false
 }
+
+// CompressState compresses an encoded task state when compression is
+// configured and the state is larger than the threshold. Compressed states
+// are recognised by their magic number, see DecompressState.
+func (b *Backend) CompressState(data []byte) ([]byte, error) {
+	encoding, threshold := compressionSettings(b.cnf)
+	compressed, _, err := compression.Compress(encoding, threshold, data)
+	return compressed, err
+}
+
+// DecompressState decompresses an encoded task state if it was compressed,
+// states stored uncompressed are returned as is
+func DecompressState(data []byte) ([]byte, error) {
+	return compression.DecompressDetected(data)
+}
+
+// compressionSettings returns the configured compression encoding and threshold
+func compressionSettings(cnf *config.Config) (string, int) {
+	if cnf == nil || cnf.Compression == nil {
+		return "", 0
+	}
+	return cnf.Compression.Encoding, cnf.Compression.Threshold
+}
@@ -2,11 +2,15 @@ package common
 
 import (
 	"errors"
+	"fmt"
 
 	"github.com/pmaccamp/machinery/v1/brokers/iface"
+	"github.com/pmaccamp/machinery/v1/compression"
 	"github.com/pmaccamp/machinery/v1/config"
 	"github.com/pmaccamp/machinery/v1/log"
 	"github.com/pmaccamp/machinery/v1/retry"
+	"github.com/pmaccamp/machinery/v1/serializer"
+	"github.com/pmaccamp/machinery/v1/signing"
 	"github.com/pmaccamp/machinery/v1/tasks"
 )
 
@@ -119,3 +123,110 @@ func (b *Broker) AdjustRoutingKey(s *tasks.Signature) {
 
 	s.RoutingKey = b.GetConfig().DefaultQueue
 }
+
+// MarshalSignature encodes the signature with the configured serializer,
+// it returns the message along with its content type
+func (b *Broker) MarshalSignature(signature *tasks.Signature) ([]byte, string, error) {
+	s, err := serializer.Get(b.serializerContentType())
+	if err != nil {
+		return nil, "", err
+	}
+
+	// Sign the task if a signing key is configured
+	if keyID := b.signingKeyID(); keyID != "" {
+		key, ok := b.cnf.Signing.Keys[keyID]
+		if !ok {
+			return nil, "", fmt.Errorf("Unknown signing key: %s", keyID)
+		}
+
+		signature, err = signing.Sign(s, keyID, key, signature)
+		if err != nil {
+			return nil, "", fmt.Errorf("Sign error: %s", err)
+		}
+	}
+
+	msg, err := s.Marshal(signature)
+	if err != nil {
+		return nil, "", fmt.Errorf("Marshal error: %s", err)
+	}
+	return msg, s.ContentType(), nil
+}
+
+// UnmarshalSignature decodes the message with the serializer of the content
+// type. Messages published without a content type are either JSON or encoded
+// with the configured serializer.
+func (b *Broker) UnmarshalSignature(contentType string, msg []byte) (*tasks.Signature, error) {
+	var (
+		s   serializer.Serializer
+		err error
+	)
+	if contentType != "" {
+		s, err = serializer.Get(contentType)
+	} else {
+		s, err = serializer.Detect(msg, b.serializerContentType())
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	signature := new(tasks.Signature)
+	if err := s.Unmarshal(msg, signature); err != nil {
+		return nil, err
+	}
+	return signature, nil
+}
+
+// VerifySignature checks a received task has been signed with one of the
+// configured keys, all tasks are accepted unless signing keys are configured
+func (b *Broker) VerifySignature(signature *tasks.Signature) error {
+	if b.cnf == nil || b.cnf.Signing == nil || len(b.cnf.Signing.Keys) == 0 {
+		return nil
+	}
+	return signing.Verify(b.cnf.Signing.Keys, signature)
+}
+
+// RejectTask drops a received task which must not be processed, e.g. because
+// it failed signature verification. The task is published to the dead letter
+// queue if the broker supports one and it is configured.
+func (b *Broker) RejectTask(broker iface.Broker, signature *tasks.Signature, reason error) {
+	log.ERROR.Printf("Rejected task %s: %s", signature.Id, reason)
+
+	deadLetterBroker, ok := broker.(iface.DeadLetterBroker)
+	if !ok || b.cnf == nil || b.cnf.DeadLetterQueue == "" {
+		return
+	}
+
+	if err := deadLetterBroker.PublishDeadLetter(tasks.NewDeadLetter(signature, reason, nil)); err != nil {
+		log.ERROR.Printf("Publish task %s to dead letter queue returned error: %s", signature.Id, err)
+	}
+}
+
+// CompressMessage compresses the message when compression is configured and
+// the message is larger than the threshold, it returns the message along with
+// its content encoding, which is empty for uncompressed messages
+func (b *Broker) CompressMessage(msg []byte) ([]byte, string, error) {
+	encoding, threshold := compressionSettings(b.cnf)
+	return compression.Compress(encoding, threshold, msg)
+}
+
+// DecompressMessage decompresses the message with the content encoding it
+// was published with
+func (b *Broker) DecompressMessage(contentEncoding string, msg []byte) ([]byte, error) {
+	return compression.Decompress(contentEncoding, msg)
+}
+
+// signingKeyID returns the ID of the key published tasks are signed with
+func (b *Broker) signingKeyID() string {
+	if b.cnf == nil || b.cnf.Signing == nil {
+		return ""
+	}
+	return b.cnf.Signing.KeyID
+}
+
+// serializerContentType returns the content type of the configured serializer
+func (b *Broker) serializerContentType() string {
+	if b.cnf == nil {
+		return ""
+	}
+	return b.cnf.Serializer
+}
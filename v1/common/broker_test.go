@@ -1,12 +1,16 @@
 package common_test
 
 import (
+	"strings"
 	"testing"
 
 	"github.com/pmaccamp/machinery/v1/common"
+	"github.com/pmaccamp/machinery/v1/compression"
 	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/serializer"
 	"github.com/pmaccamp/machinery/v1/tasks"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestIsTaskRegistered(t *testing.T) {
@@ -54,3 +58,56 @@ func TestGetRegisteredTaskNames(t *testing.T) {
 	broker.SetRegisteredTaskNames(fooTasks)
 	assert.Equal(t, fooTasks, broker.GetRegisteredTaskNames())
 }
+
+func TestMarshalSignature(t *testing.T) {
+	t.Parallel()
+
+	jsonBroker := common.NewBroker(new(config.Config))
+	msgpackBroker := common.NewBroker(&config.Config{Serializer: serializer.ContentTypeMsgpack})
+
+	msg, contentType, err := msgpackBroker.MarshalSignature(&tasks.Signature{Task: "add"})
+	require.NoError(t, err)
+	assert.Equal(t, serializer.ContentTypeMsgpack, contentType)
+
+	// the content type of the message decides how it is decoded
+	signature, err := jsonBroker.UnmarshalSignature(contentType, msg)
+	require.NoError(t, err)
+	assert.Equal(t, "add", signature.Task)
+
+	// messages without content type are JSON or use the configured serializer
+	signature, err = msgpackBroker.UnmarshalSignature("", msg)
+	require.NoError(t, err)
+	assert.Equal(t, "add", signature.Task)
+
+	signature, err = msgpackBroker.UnmarshalSignature("", []byte(`{"Task":"multiply"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "multiply", signature.Task)
+
+	unknownBroker := common.NewBroker(&config.Config{Serializer: "application/unknown"})
+	_, _, err = unknownBroker.MarshalSignature(new(tasks.Signature))
+	assert.EqualError(t, err, "Unknown serializer content type: application/unknown")
+}
+
+func TestCompressMessage(t *testing.T) {
+	t.Parallel()
+
+	broker := common.NewBroker(&config.Config{
+		Compression: &config.CompressionConfig{Encoding: compression.EncodingZstd, Threshold: 64},
+	})
+
+	msg, contentEncoding, err := broker.CompressMessage([]byte(`{"Task":"add"}`))
+	require.NoError(t, err)
+	assert.Equal(t, "", contentEncoding)
+	assert.Equal(t, []byte(`{"Task":"add"}`), msg)
+
+	large := []byte(`{"Task":"add","Args":["` + strings.Repeat("a", 100) + `"]}`)
+	msg, contentEncoding, err = broker.CompressMessage(large)
+	require.NoError(t, err)
+	assert.Equal(t, compression.EncodingZstd, contentEncoding)
+
+	// consumers decompress regardless of their own configuration
+	consumer := common.NewBroker(new(config.Config))
+	msg, err = consumer.DecompressMessage(contentEncoding, msg)
+	require.NoError(t, err)
+	assert.Equal(t, large, msg)
+}
@@ -0,0 +1,66 @@
+package common
+
+import (
+	"sync"
+)
+
+// TaskNotifier signals subscribers in this process when tasks complete,
+// result backends use it to implement iface.Notifier
+type TaskNotifier struct {
+	mu          sync.Mutex
+	subscribers map[string]map[chan struct{}]struct{}
+}
+
+// NewTaskNotifier creates TaskNotifier instance
+func NewTaskNotifier() *TaskNotifier {
+	return &TaskNotifier{subscribers: make(map[string]map[chan struct{}]struct{})}
+}
+
+// Subscribe returns a channel receiving a value when the task completes and
+// a function releasing the subscription
+func (n *TaskNotifier) Subscribe(taskUUID string) (<-chan struct{}, func()) {
+	completed := make(chan struct{}, 1)
+
+	n.mu.Lock()
+	if n.subscribers[taskUUID] == nil {
+		n.subscribers[taskUUID] = make(map[chan struct{}]struct{})
+	}
+	n.subscribers[taskUUID][completed] = struct{}{}
+	n.mu.Unlock()
+
+	return completed, func() {
+		n.mu.Lock()
+		defer n.mu.Unlock()
+
+		delete(n.subscribers[taskUUID], completed)
+		if len(n.subscribers[taskUUID]) == 0 {
+			delete(n.subscribers, taskUUID)
+		}
+	}
+}
+
+// Notify signals the subscribers of the task that it completed
+func (n *TaskNotifier) Notify(taskUUID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	for completed := range n.subscribers[taskUUID] {
+		// never block, a pending signal is as good as a new one
+		select {
+		case completed <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// Subscribers returns the number of subscriptions to all tasks
+func (n *TaskNotifier) Subscribers() int {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	count := 0
+	for _, subscribers := range n.subscribers {
+		count += len(subscribers)
+	}
+	return count
+}
@@ -0,0 +1,30 @@
+package common_test
+
+import (
+	"testing"
+
+	"github.com/pmaccamp/machinery/v1/common"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTaskNotifier(t *testing.T) {
+	t.Parallel()
+
+	notifier := common.NewTaskNotifier()
+	first, unsubscribeFirst := notifier.Subscribe("task_1")
+	second, unsubscribeSecond := notifier.Subscribe("task_1")
+	other, unsubscribeOther := notifier.Subscribe("task_2")
+	assert.Equal(t, 3, notifier.Subscribers())
+
+	// signals never block, pending ones are not duplicated
+	notifier.Notify("task_1")
+	notifier.Notify("task_1")
+	assert.Len(t, first, 1)
+	assert.Len(t, second, 1)
+	assert.Len(t, other, 0)
+
+	unsubscribeFirst()
+	unsubscribeSecond()
+	unsubscribeOther()
+	assert.Equal(t, 0, notifier.Subscribers())
+}
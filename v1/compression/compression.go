@@ -0,0 +1,106 @@
+package compression
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// Compressor compresses task messages and results. The encoding is sent
+// along with every compressed message, so consumers can decompress messages
+// compressed by any registered compressor.
+type Compressor interface {
+	Encoding() string
+	Magic() []byte
+	Compress(data []byte) ([]byte, error)
+	Decompress(data []byte) ([]byte, error)
+}
+
+var (
+	compressors = map[string]Compressor{
+		EncodingGzip: Gzip,
+		EncodingZstd: Zstd,
+	}
+	compressorsMu sync.RWMutex
+)
+
+// Register makes the compressor available under its encoding
+func Register(compressor Compressor) {
+	compressorsMu.Lock()
+	defer compressorsMu.Unlock()
+
+	compressors[compressor.Encoding()] = compressor
+}
+
+// Get returns the compressor registered for the encoding
+func Get(encoding string) (Compressor, error) {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	compressor, ok := compressors[encoding]
+	if !ok {
+		return nil, fmt.Errorf("Unknown compression encoding: %s", encoding)
+	}
+	return compressor, nil
+}
+
+// Compress compresses the data with the compressor of the encoding if it is
+// larger than threshold bytes. It returns the encoding applied, which is
+// empty when the data is left uncompressed.
+func Compress(encoding string, threshold int, data []byte) ([]byte, string, error) {
+	if encoding == "" || len(data) <= threshold {
+		return data, "", nil
+	}
+
+	compressor, err := Get(encoding)
+	if err != nil {
+		return nil, "", err
+	}
+
+	compressed, err := compressor.Compress(data)
+	if err != nil {
+		return nil, "", fmt.Errorf("Compress error: %s", err)
+	}
+	return compressed, compressor.Encoding(), nil
+}
+
+// Decompress decompresses the data with the compressor of the encoding, data
+// with an empty encoding is returned as is
+func Decompress(encoding string, data []byte) ([]byte, error) {
+	if encoding == "" {
+		return data, nil
+	}
+
+	compressor, err := Get(encoding)
+	if err != nil {
+		return nil, err
+	}
+
+	decompressed, err := compressor.Decompress(data)
+	if err != nil {
+		return nil, fmt.Errorf("Decompress error: %s", err)
+	}
+	return decompressed, nil
+}
+
+// Detect returns the encoding of data stored without one, e.g. task states
+// in a result backend, by looking at the magic number the data starts with.
+// An empty encoding is returned for uncompressed data.
+func Detect(data []byte) string {
+	compressorsMu.RLock()
+	defer compressorsMu.RUnlock()
+
+	for encoding, compressor := range compressors {
+		magic := compressor.Magic()
+		if len(magic) > 0 && bytes.HasPrefix(data, magic) {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// DecompressDetected decompresses the data with the compressor detected from
+// its magic number, uncompressed data is returned as is
+func DecompressDetected(data []byte) ([]byte, error) {
+	return Decompress(Detect(data), data)
+}
@@ -0,0 +1,72 @@
+package compression_test
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/pmaccamp/machinery/v1/compression"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompressors(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte(`{"Task":"add","Args":[1,2]}`), 100)
+
+	for _, compressor := range []compression.Compressor{compression.Gzip, compression.Zstd} {
+		compressed, err := compressor.Compress(data)
+		require.NoError(t, err, compressor.Encoding())
+		assert.True(t, len(compressed) < len(data), compressor.Encoding())
+		assert.Equal(t, compressor.Encoding(), compression.Detect(compressed))
+
+		decompressed, err := compressor.Decompress(compressed)
+		require.NoError(t, err, compressor.Encoding())
+		assert.Equal(t, data, decompressed, compressor.Encoding())
+	}
+}
+
+func TestCompressThreshold(t *testing.T) {
+	t.Parallel()
+
+	data := bytes.Repeat([]byte("a"), 100)
+
+	// data not larger than the threshold is left uncompressed
+	compressed, encoding, err := compression.Compress(compression.EncodingGzip, 100, data)
+	require.NoError(t, err)
+	assert.Equal(t, "", encoding)
+	assert.Equal(t, data, compressed)
+
+	compressed, encoding, err = compression.Compress(compression.EncodingGzip, 99, data)
+	require.NoError(t, err)
+	assert.Equal(t, compression.EncodingGzip, encoding)
+
+	decompressed, err := compression.Decompress(encoding, compressed)
+	require.NoError(t, err)
+	assert.Equal(t, data, decompressed)
+
+	// compression is disabled without an encoding
+	compressed, encoding, err = compression.Compress("", 0, data)
+	require.NoError(t, err)
+	assert.Equal(t, "", encoding)
+	assert.Equal(t, data, compressed)
+
+	_, _, err = compression.Compress("br", 0, data)
+	assert.EqualError(t, err, "Unknown compression encoding: br")
+}
+
+func TestDecompressDetected(t *testing.T) {
+	t.Parallel()
+
+	data := []byte(`{"TaskUUID":"task_1"}`)
+
+	decompressed, err := compression.DecompressDetected(data)
+	require.NoError(t, err)
+	assert.Equal(t, data, decompressed)
+
+	compressed, err := compression.Zstd.Compress(data)
+	require.NoError(t, err)
+	decompressed, err = compression.DecompressDetected(compressed)
+	require.NoError(t, err)
+	assert.Equal(t, data, decompressed)
+}
@@ -0,0 +1,48 @@
+package compression
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+)
+
+// EncodingGzip is the encoding of gzip compressed messages
+const EncodingGzip = "gzip"
+
+// Gzip compresses messages with the standard library gzip implementation
+var Gzip Compressor = gzipCompressor{}
+
+type gzipCompressor struct{}
+
+// Encoding implements Compressor
+func (gzipCompressor) Encoding() string {
+	return EncodingGzip
+}
+
+// Magic implements Compressor
+func (gzipCompressor) Magic() []byte {
+	return []byte{0x1f, 0x8b}
+}
+
+// Compress implements Compressor
+func (gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	writer := gzip.NewWriter(&buf)
+	if _, err := writer.Write(data); err != nil {
+		return nil, err
+	}
+	if err := writer.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// Decompress implements Compressor
+func (gzipCompressor) Decompress(data []byte) ([]byte, error) {
+	reader, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer reader.Close()
+	return ioutil.ReadAll(reader)
+}
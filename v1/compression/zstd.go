@@ -0,0 +1,34 @@
+package compression
+
+import (
+	"github.com/DataDog/zstd"
+)
+
+// EncodingZstd is the encoding of Zstandard compressed messages
+const EncodingZstd = "zstd"
+
+// Zstd compresses messages with Zstandard, which is faster than gzip at a
+// similar ratio
+var Zstd Compressor = zstdCompressor{}
+
+type zstdCompressor struct{}
+
+// Encoding implements Compressor
+func (zstdCompressor) Encoding() string {
+	return EncodingZstd
+}
+
+// Magic implements Compressor
+func (zstdCompressor) Magic() []byte {
+	return []byte{0x28, 0xb5, 0x2f, 0xfd}
+}
+
+// Compress implements Compressor
+func (zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return zstd.Compress(nil, data)
+}
+
+// Decompress implements Compressor
+func (zstdCompressor) Decompress(data []byte) ([]byte, error) {
+	return zstd.Decompress(nil, data)
+}
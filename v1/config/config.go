@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"github.com/aws/aws-sdk-go/service/sqs"
 	"github.com/bugsnag/bugsnag-go"
+	"github.com/pmaccamp/machinery/v1/claimcheck"
+	"github.com/pmaccamp/machinery/v1/signing"
 	"strings"
 	"time"
 )
@@ -32,6 +34,15 @@ var (
 			TaskStatesTable: "task_states",
 			GroupMetasTable: "group_metas",
 		},
+		Redis: &RedisConfig{
+			MaxIdle:                3,
+			IdleTimeout:            240,
+			ReadTimeout:            15,
+			WriteTimeout:           15,
+			ConnectTimeout:         15,
+			NormalTasksPollPeriod:  1000,
+			DelayedTasksPollPeriod: 20,
+		},
 		GCPPubSub: &GCPPubSubConfig{
 			Client: nil,
 		},
@@ -42,13 +53,20 @@ var (
 
 // Config holds all configuration for our program
 type Config struct {
-	Broker          string           `yaml:"broker" envconfig:"BROKER"`
-	DefaultQueue    string           `yaml:"default_queue" envconfig:"DEFAULT_QUEUE"`
-	ResultBackend   string           `yaml:"result_backend" envconfig:"RESULT_BACKEND"`
-	ResultsExpireIn int              `yaml:"results_expire_in" envconfig:"RESULTS_EXPIRE_IN"`
-	AMQP            *AMQPConfig      `yaml:"amqp"`
-	SQS             *SQSConfig       `yaml:"sqs"`
-	GCPPubSub       *GCPPubSubConfig `yaml:"-" ignored:"true"`
+	Broker          string             `yaml:"broker" envconfig:"BROKER"`
+	DefaultQueue    string             `yaml:"default_queue" envconfig:"DEFAULT_QUEUE"`
+	ResultBackend   string             `yaml:"result_backend" envconfig:"RESULT_BACKEND"`
+	ResultsExpireIn int                `yaml:"results_expire_in" envconfig:"RESULTS_EXPIRE_IN"`
+	DeadLetterQueue string             `yaml:"dead_letter_queue" envconfig:"DEAD_LETTER_QUEUE"`
+	Serializer      string             `yaml:"serializer" envconfig:"SERIALIZER"`
+	Compression     *CompressionConfig `yaml:"compression"`
+	ClaimCheck      *ClaimCheckConfig  `yaml:"claim_check"`
+	Signing         *SigningConfig     `yaml:"signing"`
+	Encryption      *EncryptionConfig  `yaml:"encryption"`
+	AMQP            *AMQPConfig        `yaml:"amqp"`
+	SQS             *SQSConfig         `yaml:"sqs"`
+	Redis           *RedisConfig       `yaml:"redis"`
+	GCPPubSub       *GCPPubSubConfig   `yaml:"-" ignored:"true"`
 	TLSConfig       *tls.Config
 	BugsnagConfig   *bugsnag.Configuration
 	// NoUnixSignals - when set disables signal handling in machinery
@@ -83,6 +101,108 @@ type SQSConfig struct {
 	VisibilityTimeout *int `yaml:"receive_visibility_timeout" envconfig:"SQS_VISIBILITY_TIMEOUT"`
 }
 
+// RedisConfig wraps Redis related configuration
+type RedisConfig struct {
+	// Maximum number of idle connections in the pool.
+	MaxIdle int `yaml:"max_idle" envconfig:"REDIS_MAX_IDLE"`
+
+	// Maximum number of connections allocated by the pool at a given time.
+	// When zero, there is no limit on the number of connections in the pool.
+	MaxActive int `yaml:"max_active" envconfig:"REDIS_MAX_ACTIVE"`
+
+	// Close connections after remaining idle for this duration in seconds. If the value
+	// is zero, then idle connections are not closed. Applications should set
+	// the timeout to a value less than the server's timeout.
+	IdleTimeout int `yaml:"max_idle_timeout" envconfig:"REDIS_IDLE_TIMEOUT"`
+
+	// If Wait is true and the pool is at the MaxActive limit, then Get() waits
+	// for a connection to be returned to the pool before returning.
+	Wait bool `yaml:"wait" envconfig:"REDIS_WAIT"`
+
+	// ReadTimeout specifies the timeout in seconds for reading a single command reply.
+	ReadTimeout int `yaml:"read_timeout" envconfig:"REDIS_READ_TIMEOUT"`
+
+	// WriteTimeout specifies the timeout in seconds for writing a single command.
+	WriteTimeout int `yaml:"write_timeout" envconfig:"REDIS_WRITE_TIMEOUT"`
+
+	// ConnectTimeout specifies the timeout in seconds for connecting to the Redis server
+	ConnectTimeout int `yaml:"connect_timeout" envconfig:"REDIS_CONNECT_TIMEOUT"`
+
+	// NormalTasksPollPeriod specifies the period in milliseconds when polling redis for normal tasks
+	NormalTasksPollPeriod int `yaml:"normal_tasks_poll_period" envconfig:"REDIS_NORMAL_TASKS_POLL_PERIOD"`
+
+	// DelayedTasksPollPeriod specifies the period in milliseconds when polling redis for delayed tasks
+	DelayedTasksPollPeriod int `yaml:"delayed_tasks_poll_period" envconfig:"REDIS_DELAYED_TASKS_POLL_PERIOD"`
+
+	// DelayedTasksKey is the name of the sorted set holding tasks with an ETA in the future
+	DelayedTasksKey string `yaml:"delayed_tasks_key" envconfig:"REDIS_DELAYED_TASKS_KEY"`
+}
+
+// CompressionConfig wraps payload compression related configuration
+type CompressionConfig struct {
+	// Encoding is either gzip or zstd, compression is disabled when empty
+	Encoding string `yaml:"encoding" envconfig:"COMPRESSION_ENCODING"`
+
+	// Threshold specifies the size in bytes above which task messages and
+	// results are compressed
+	Threshold int `yaml:"threshold" envconfig:"COMPRESSION_THRESHOLD"`
+}
+
+// ClaimCheckConfig wraps claim check related configuration
+type ClaimCheckConfig struct {
+	// Store holds arguments and results offloaded from task messages and
+	// task states, claim checks are disabled when nil
+	Store claimcheck.Store `yaml:"-" ignored:"true"`
+
+	// Threshold specifies the size in bytes above which arguments and
+	// results are offloaded, defaults to claimcheck.DefaultThreshold
+	Threshold int `yaml:"threshold" envconfig:"CLAIM_CHECK_THRESHOLD"`
+}
+
+// SigningConfig wraps message signing related configuration
+type SigningConfig struct {
+	// Keys by key ID, workers reject tasks not signed with one of them,
+	// tasks are not verified when empty
+	Keys map[string]signing.Key `yaml:"-" ignored:"true"`
+
+	// KeyID names the key published tasks are signed with, tasks are
+	// published unsigned when empty
+	KeyID string `yaml:"key_id" envconfig:"SIGNING_KEY_ID"`
+}
+
+// EncryptionConfig wraps encryption of task arguments and results related
+// configuration
+type EncryptionConfig struct {
+	// Keys are AES keys of 16, 24 or 32 bytes by key ID, they are used to
+	// decrypt arguments and results
+	Keys map[string][]byte `yaml:"-" ignored:"true"`
+
+	// KeyID names the key arguments and results are encrypted with,
+	// nothing is encrypted when empty
+	KeyID string `yaml:"key_id" envconfig:"ENCRYPTION_KEY_ID"`
+
+	// Tasks are the names of the tasks whose arguments and results are
+	// encrypted, those of all tasks are encrypted when empty
+	Tasks []string `yaml:"tasks" envconfig:"ENCRYPTION_TASKS"`
+}
+
+// KeyIDFor returns the ID of the key arguments and results of the task are
+// encrypted with, it is empty if they are not encrypted
+func (c *EncryptionConfig) KeyIDFor(taskName string) string {
+	if c == nil || c.KeyID == "" {
+		return ""
+	}
+	if len(c.Tasks) == 0 {
+		return c.KeyID
+	}
+	for _, name := range c.Tasks {
+		if name == taskName {
+			return c.KeyID
+		}
+	}
+	return ""
+}
+
 // GCPPubSubConfig wraps GCP PubSub related configuration
 type GCPPubSubConfig struct {
 	Client *pubsub.Client
@@ -0,0 +1,179 @@
+package encryption
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/pmaccamp/machinery/v1/serializer"
+	"github.com/pmaccamp/machinery/v1/tasks"
+)
+
+const (
+	// KeyIDHeader is the signature header naming the key the arguments of
+	// the task were encrypted with, which allows rotating keys
+	KeyIDHeader = "machinery_encryption_key_id"
+
+	// ResultType is the type of the task result standing in for encrypted
+	// results, its value is the key ID and the base64 encoded ciphertext
+	// separated by a colon
+	ResultType = "encrypted"
+)
+
+// encryptedArgs is the plaintext of encrypted arguments
+type encryptedArgs struct {
+	Args   []interface{}
+	Kwargs map[string]interface{}
+}
+
+// EncryptArgs returns a copy of the signature carrying its arguments
+// encrypted with the AES key of the key ID. The ciphertext is bound to the
+// task UUID, so it cannot be replayed with another task.
+func EncryptArgs(keys map[string][]byte, keyID string, signature *tasks.Signature) (*tasks.Signature, error) {
+	if len(signature.Args) == 0 && len(signature.Kwargs) == 0 {
+		return signature, nil
+	}
+
+	plaintext, err := serializer.JSON.Marshal(&encryptedArgs{Args: signature.Args, Kwargs: signature.Kwargs})
+	if err != nil {
+		return nil, fmt.Errorf("Marshal arguments error: %s", err)
+	}
+
+	ciphertext, err := seal(keys, keyID, plaintext, signature.Id)
+	if err != nil {
+		return nil, err
+	}
+
+	encrypted := tasks.CopySignature(signature)
+	encrypted.Args = nil
+	encrypted.Kwargs = nil
+	encrypted.EncryptedArgs = ciphertext
+	if encrypted.Headers == nil {
+		encrypted.Headers = make(tasks.Headers)
+	}
+	encrypted.Headers[KeyIDHeader] = keyID
+	return encrypted, nil
+}
+
+// DecryptArgs decrypts the arguments of a signature encrypted by
+// EncryptArgs, signatures without encrypted arguments are left untouched
+func DecryptArgs(keys map[string][]byte, signature *tasks.Signature) error {
+	if signature.EncryptedArgs == nil {
+		return nil
+	}
+
+	keyID, _ := signature.Headers[KeyIDHeader].(string)
+	plaintext, err := open(keys, keyID, signature.EncryptedArgs, signature.Id)
+	if err != nil {
+		return fmt.Errorf("Decrypt arguments of task %s error: %s", signature.Id, err)
+	}
+
+	args := new(encryptedArgs)
+	if err := serializer.JSON.Unmarshal(plaintext, args); err != nil {
+		return fmt.Errorf("Unmarshal arguments of task %s error: %s", signature.Id, err)
+	}
+
+	signature.Args = args.Args
+	signature.Kwargs = args.Kwargs
+	signature.EncryptedArgs = nil
+	delete(signature.Headers, KeyIDHeader)
+	return nil
+}
+
+// EncryptResults encrypts the results of the task with the AES key of the
+// key ID. It returns a single result of ResultType holding the ciphertext.
+func EncryptResults(keys map[string][]byte, keyID, taskUUID string, results []*tasks.TaskResult) ([]*tasks.TaskResult, error) {
+	if len(results) == 0 {
+		return results, nil
+	}
+
+	plaintext, err := serializer.JSON.Marshal(results)
+	if err != nil {
+		return nil, fmt.Errorf("Marshal results error: %s", err)
+	}
+
+	ciphertext, err := seal(keys, keyID, plaintext, taskUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	value := keyID + ":" + base64.StdEncoding.EncodeToString(ciphertext)
+	return []*tasks.TaskResult{{Type: ResultType, Value: value}}, nil
+}
+
+// DecryptResults decrypts results encrypted by EncryptResults, other results
+// are returned as is
+func DecryptResults(keys map[string][]byte, taskUUID string, results []*tasks.TaskResult) ([]*tasks.TaskResult, error) {
+	if len(results) != 1 || results[0].Type != ResultType {
+		return results, nil
+	}
+
+	value, _ := results[0].Value.(string)
+	separator := strings.LastIndex(value, ":")
+	if separator < 0 {
+		return nil, fmt.Errorf("Malformed encrypted results of task %s", taskUUID)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(value[separator+1:])
+	if err != nil {
+		return nil, fmt.Errorf("Malformed encrypted results of task %s: %s", taskUUID, err)
+	}
+
+	plaintext, err := open(keys, value[:separator], ciphertext, taskUUID)
+	if err != nil {
+		return nil, fmt.Errorf("Decrypt results of task %s error: %s", taskUUID, err)
+	}
+
+	var decrypted []*tasks.TaskResult
+	if err := serializer.JSON.Unmarshal(plaintext, &decrypted); err != nil {
+		return nil, fmt.Errorf("Unmarshal results of task %s error: %s", taskUUID, err)
+	}
+	return decrypted, nil
+}
+
+// seal encrypts the plaintext with AES-GCM, the nonce is prepended to the
+// ciphertext
+func seal(keys map[string][]byte, keyID string, plaintext []byte, taskUUID string) ([]byte, error) {
+	aead, err := newAEAD(keys, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, []byte(taskUUID)), nil
+}
+
+// open decrypts a ciphertext sealed by seal
+func open(keys map[string][]byte, keyID string, ciphertext []byte, taskUUID string) ([]byte, error) {
+	aead, err := newAEAD(keys, keyID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("Ciphertext too short")
+	}
+	nonce, ciphertext := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(taskUUID))
+}
+
+// newAEAD returns AES-GCM using the key of the key ID
+func newAEAD(keys map[string][]byte, keyID string) (cipher.AEAD, error) {
+	key, ok := keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("Unknown encryption key: %s", keyID)
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,78 @@
+package encryption_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/pmaccamp/machinery/v1/encryption"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var keys = map[string][]byte{
+	"k1": []byte("0123456789abcdef"),
+	"k2": []byte("0123456789abcdef0123456789abcdef"),
+}
+
+func TestEncryptArgs(t *testing.T) {
+	t.Parallel()
+
+	signature := &tasks.Signature{
+		Id:     "task_1",
+		Args:   []interface{}{"john@example.com", 2},
+		Kwargs: map[string]interface{}{"ssn": "078-05-1120"},
+	}
+
+	encrypted, err := encryption.EncryptArgs(keys, "k2", signature)
+	require.NoError(t, err)
+	assert.Nil(t, encrypted.Args)
+	assert.Nil(t, encrypted.Kwargs)
+	assert.NotContains(t, string(encrypted.EncryptedArgs), "john@example.com")
+	assert.Equal(t, "k2", encrypted.Headers[encryption.KeyIDHeader])
+	assert.Len(t, signature.Args, 2, "the original signature is left untouched")
+
+	// the ciphertext is bound to the task
+	swapped := tasks.CopySignature(encrypted)
+	swapped.Id = "task_2"
+	assert.Error(t, encryption.DecryptArgs(keys, swapped))
+
+	require.NoError(t, encryption.DecryptArgs(keys, encrypted))
+	assert.Equal(t, []interface{}{"john@example.com", json.Number("2")}, encrypted.Args)
+	assert.Equal(t, signature.Kwargs, encrypted.Kwargs)
+	assert.Nil(t, encrypted.EncryptedArgs)
+	assert.NotContains(t, encrypted.Headers, encryption.KeyIDHeader)
+
+	// signatures without encrypted arguments are left untouched
+	plain := &tasks.Signature{Args: []interface{}{"foo"}}
+	require.NoError(t, encryption.DecryptArgs(nil, plain))
+	assert.Equal(t, []interface{}{"foo"}, plain.Args)
+
+	_, err = encryption.EncryptArgs(keys, "k3", signature)
+	assert.EqualError(t, err, "Unknown encryption key: k3")
+}
+
+func TestEncryptResults(t *testing.T) {
+	t.Parallel()
+
+	results := []*tasks.TaskResult{{Type: "string", Value: "john@example.com"}}
+
+	encrypted, err := encryption.EncryptResults(keys, "k1", "task_1", results)
+	require.NoError(t, err)
+	require.Len(t, encrypted, 1)
+	assert.Equal(t, encryption.ResultType, encrypted[0].Type)
+	assert.NotContains(t, encrypted[0].Value, "john@example.com")
+
+	// rotated keys keep decrypting results encrypted with them
+	rotated := map[string][]byte{"k1": keys["k1"], "k3": []byte("fedcba9876543210")}
+	decrypted, err := encryption.DecryptResults(rotated, "task_1", encrypted)
+	require.NoError(t, err)
+	assert.Equal(t, results, decrypted)
+
+	_, err = encryption.DecryptResults(map[string][]byte{"k3": rotated["k3"]}, "task_1", encrypted)
+	assert.EqualError(t, err, "Decrypt results of task task_1 error: Unknown encryption key: k1")
+
+	decrypted, err = encryption.DecryptResults(nil, "task_1", results)
+	require.NoError(t, err)
+	assert.Equal(t, results, decrypted)
+}
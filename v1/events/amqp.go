@@ -0,0 +1,111 @@
+package events
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"sync"
+
+	"github.com/pmaccamp/machinery/v1/common"
+	"github.com/streadway/amqp"
+)
+
+// AMQPEmitter publishes events as JSON to an AMQP fanout exchange, every
+// queue bound to the exchange receives all events
+type AMQPEmitter struct {
+	connector common.AMQPConnector
+	url       string
+	exchange  string
+	tlsConfig *tls.Config
+
+	mu      sync.Mutex
+	conn    *amqp.Connection
+	channel *amqp.Channel
+}
+
+// NewAMQPEmitter creates AMQPEmitter instance, the connection is opened and
+// the exchange declared when the first event is emitted
+func NewAMQPEmitter(url, exchange string, tlsConfig *tls.Config) *AMQPEmitter {
+	return &AMQPEmitter{url: url, exchange: exchange, tlsConfig: tlsConfig}
+}
+
+// Emit implements Emitter
+func (e *AMQPEmitter) Emit(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if err := e.open(); err != nil {
+		return err
+	}
+
+	if err := e.channel.Publish(
+		e.exchange, // exchange
+		"",         // routing key, ignored by fanout exchanges
+		false,      // mandatory
+		false,      // immediate
+		amqp.Publishing{
+			ContentType:  "application/json",
+			Type:         string(event.Type),
+			Timestamp:    event.Timestamp,
+			Body:         body,
+			DeliveryMode: amqp.Transient,
+		},
+	); err != nil {
+		// reconnect when the next event is emitted
+		e.close()
+		return fmt.Errorf("Publish event error: %s", err)
+	}
+	return nil
+}
+
+// Close closes the connection
+func (e *AMQPEmitter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	return e.close()
+}
+
+// open opens the connection and declares the exchange unless already done
+func (e *AMQPEmitter) open() error {
+	if e.channel != nil {
+		return nil
+	}
+
+	conn, channel, err := e.connector.Open(e.url, e.tlsConfig)
+	if err != nil {
+		return err
+	}
+
+	if err := channel.ExchangeDeclare(
+		e.exchange, // name of the exchange
+		"fanout",   // type
+		true,       // durable
+		false,      // delete when complete
+		false,      // internal
+		false,      // noWait
+		nil,        // arguments
+	); err != nil {
+		e.connector.Close(channel, conn)
+		return fmt.Errorf("Exchange declare error: %s", err)
+	}
+
+	e.conn, e.channel = conn, channel
+	return nil
+}
+
+// close closes the connection if open
+func (e *AMQPEmitter) close() error {
+	if e.channel == nil {
+		return nil
+	}
+
+	err := e.connector.Close(e.channel, e.conn)
+	e.conn, e.channel = nil, nil
+	return err
+}
@@ -0,0 +1,64 @@
+package events
+
+import (
+	"errors"
+	"sync"
+)
+
+// ErrSubscriberFull is returned by ChannelEmitter.Emit when an event was
+// dropped for a subscriber not keeping up with events
+var ErrSubscriberFull = errors.New("Event dropped, subscriber channel is full")
+
+// ChannelEmitter delivers events to subscribers in the same process
+type ChannelEmitter struct {
+	bufferSize int
+
+	mu          sync.Mutex
+	subscribers map[chan Event]struct{}
+}
+
+// NewChannelEmitter creates ChannelEmitter instance, the channels of
+// subscribers buffer up to bufferSize events
+func NewChannelEmitter(bufferSize int) *ChannelEmitter {
+	return &ChannelEmitter{
+		bufferSize:  bufferSize,
+		subscribers: make(map[chan Event]struct{}),
+	}
+}
+
+// Subscribe returns a channel receiving all events emitted from now on and
+// a function unsubscribing, which closes the channel
+func (e *ChannelEmitter) Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, e.bufferSize)
+
+	e.mu.Lock()
+	e.subscribers[events] = struct{}{}
+	e.mu.Unlock()
+
+	var once sync.Once
+	return events, func() {
+		once.Do(func() {
+			e.mu.Lock()
+			delete(e.subscribers, events)
+			e.mu.Unlock()
+			close(events)
+		})
+	}
+}
+
+// Emit implements Emitter. It never blocks, events are dropped for
+// subscribers whose channel is full.
+func (e *ChannelEmitter) Emit(event *Event) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	var err error
+	for events := range e.subscribers {
+		select {
+		case events <- *event:
+		default:
+			err = ErrSubscriberFull
+		}
+	}
+	return err
+}
@@ -0,0 +1,69 @@
+// Package events emits structured events when tasks change state, in the
+// spirit of Celery events, so dashboards and audit systems can follow tasks
+// without polling the result backend.
+package events
+
+import (
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/tasks"
+)
+
+// Type is the type of an event
+type Type string
+
+// Event types
+const (
+	// TaskSent is emitted when a task has been published to the broker
+	TaskSent Type = "task-sent"
+	// TaskReceived is emitted when a worker received a task
+	TaskReceived Type = "task-received"
+	// TaskStarted is emitted when a worker starts running a task
+	TaskStarted Type = "task-started"
+	// TaskSucceeded is emitted when a task succeeded
+	TaskSucceeded Type = "task-succeeded"
+	// TaskFailed is emitted when a task failed for good
+	TaskFailed Type = "task-failed"
+	// TaskRetried is emitted when a failed task has been sent back to the
+	// queue to be retried
+	TaskRetried Type = "task-retried"
+)
+
+// Event is a task state change
+type Event struct {
+	Type      Type       `json:"type"`
+	TaskUUID  string     `json:"task_uuid"`
+	TaskName  string     `json:"task_name"`
+	GroupUUID string     `json:"group_uuid,omitempty"`
+	Worker    string     `json:"worker,omitempty"`
+	Timestamp time.Time  `json:"timestamp"`
+	ETA       *time.Time `json:"eta,omitempty"`
+	// DurationMs is how long the task ran, set for succeeded, failed and
+	// retried events
+	DurationMs int64  `json:"duration_ms,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// NewEvent creates Event instance for the task, the worker is empty for
+// events emitted by producers
+func NewEvent(eventType Type, signature *tasks.Signature, worker string) *Event {
+	event := &Event{
+		Type:      eventType,
+		TaskUUID:  signature.Id,
+		TaskName:  signature.Task,
+		GroupUUID: signature.GroupUUID,
+		Worker:    worker,
+		Timestamp: time.Now().UTC(),
+	}
+	if signature.ETA != nil {
+		eta := signature.ETA.UTC()
+		event.ETA = &eta
+	}
+	return event
+}
+
+// Emitter delivers events to subscribers. Events are emitted synchronously
+// by servers and workers, so emitters should not block for long.
+type Emitter interface {
+	Emit(event *Event) error
+}
@@ -0,0 +1,99 @@
+package events_test
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/events"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestChannelEmitter(t *testing.T) {
+	t.Parallel()
+
+	emitter := events.NewChannelEmitter(1)
+	first, unsubscribeFirst := emitter.Subscribe()
+	second, unsubscribeSecond := emitter.Subscribe()
+	defer unsubscribeSecond()
+
+	event := events.NewEvent(events.TaskSent, &tasks.Signature{Id: "task_1", Task: "add"}, "")
+	require.NoError(t, emitter.Emit(event))
+	assert.Equal(t, *event, <-first)
+	assert.Equal(t, *event, <-second)
+
+	// the second subscriber does not keep up
+	require.NoError(t, emitter.Emit(event))
+	assert.Equal(t, *event, <-first)
+	assert.Equal(t, events.ErrSubscriberFull, emitter.Emit(event))
+	assert.Equal(t, *event, <-first)
+
+	unsubscribeFirst()
+	unsubscribeFirst()
+	_, ok := <-first
+	assert.False(t, ok)
+}
+
+func TestWebhookEmitter(t *testing.T) {
+	t.Parallel()
+
+	received := make(chan events.Event, 2)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var event events.Event
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil || event.TaskName == "broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		received <- event
+	}))
+	defer server.Close()
+
+	emitter := events.NewWebhookEmitter(server.URL, nil, 0)
+
+	event := events.NewEvent(events.TaskFailed, &tasks.Signature{Id: "task_1", Task: "add"}, "worker_1")
+	event.Error = "boom"
+	require.NoError(t, emitter.Emit(event))
+
+	// a failed post is only logged, later events are still posted
+	require.NoError(t, emitter.Emit(events.NewEvent(events.TaskSent, &tasks.Signature{Id: "task_2", Task: "broken"}, "")))
+	require.NoError(t, emitter.Emit(events.NewEvent(events.TaskSent, &tasks.Signature{Id: "task_3", Task: "add"}, "")))
+	require.NoError(t, emitter.Close())
+
+	got := <-received
+	assert.Equal(t, events.TaskFailed, got.Type)
+	assert.Equal(t, "task_1", got.TaskUUID)
+	assert.Equal(t, "worker_1", got.Worker)
+	assert.Equal(t, "boom", got.Error)
+	assert.True(t, event.Timestamp.Equal(got.Timestamp))
+	got = <-received
+	assert.Equal(t, "task_3", got.TaskUUID)
+
+	assert.Equal(t, events.ErrWebhookClosed, emitter.Emit(event))
+}
+
+func TestWebhookEmitterDoesNotBlock(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+	defer server.Close()
+
+	emitter := events.NewWebhookEmitter(server.URL, nil, 1)
+	event := events.NewEvent(events.TaskSent, &tasks.Signature{Id: "task_1", Task: "add"}, "")
+
+	// the first event is being posted, the second one waits in the buffer
+	require.NoError(t, emitter.Emit(event))
+	require.Eventually(t, func() bool {
+		return emitter.Emit(event) == nil
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, events.ErrWebhookBufferFull, emitter.Emit(event))
+
+	close(release)
+	require.NoError(t, emitter.Close())
+}
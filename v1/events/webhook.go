@@ -0,0 +1,134 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/log"
+)
+
+const (
+	// DefaultWebhookTimeout is the timeout of requests made by webhook
+	// emitters created without an HTTP client
+	DefaultWebhookTimeout = 5 * time.Second
+
+	// DefaultWebhookBufferSize is the number of events webhook emitters
+	// created without a buffer size hold while posting
+	DefaultWebhookBufferSize = 1000
+)
+
+var (
+	// ErrWebhookBufferFull is returned by WebhookEmitter.Emit when an event
+	// was dropped because the webhook does not keep up with events
+	ErrWebhookBufferFull = errors.New("Event dropped, webhook buffer is full")
+
+	// ErrWebhookClosed is returned by WebhookEmitter.Emit once the emitter
+	// has been closed
+	ErrWebhookClosed = errors.New("Event dropped, webhook emitter is closed")
+)
+
+// WebhookEmitter posts events as JSON to a URL. Events are buffered and
+// posted one by one in the background, so a slow webhook never holds up
+// the servers and workers emitting them.
+type WebhookEmitter struct {
+	url    string
+	client *http.Client
+
+	mu       sync.RWMutex
+	closed   bool
+	events   chan *Event
+	doneChan chan struct{}
+}
+
+// NewWebhookEmitter creates WebhookEmitter instance, a client with
+// DefaultWebhookTimeout is used if client is nil and up to bufferSize events
+// are buffered, DefaultWebhookBufferSize if it is not positive
+func NewWebhookEmitter(url string, client *http.Client, bufferSize int) *WebhookEmitter {
+	if client == nil {
+		client = &http.Client{Timeout: DefaultWebhookTimeout}
+	}
+	if bufferSize <= 0 {
+		bufferSize = DefaultWebhookBufferSize
+	}
+
+	e := &WebhookEmitter{
+		url:      url,
+		client:   client,
+		events:   make(chan *Event, bufferSize),
+		doneChan: make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+// Emit implements Emitter. It never blocks, the event is dropped if the
+// buffer is full. Errors posting the event are logged.
+func (e *WebhookEmitter) Emit(event *Event) error {
+	e.mu.RLock()
+	defer e.mu.RUnlock()
+
+	if e.closed {
+		return ErrWebhookClosed
+	}
+
+	select {
+	case e.events <- event:
+		return nil
+	default:
+		return ErrWebhookBufferFull
+	}
+}
+
+// Close stops accepting events and waits until the buffered events have
+// been posted
+func (e *WebhookEmitter) Close() error {
+	e.mu.Lock()
+	if !e.closed {
+		e.closed = true
+		close(e.events)
+	}
+	e.mu.Unlock()
+
+	<-e.doneChan
+	return nil
+}
+
+// run posts buffered events until the emitter is closed
+func (e *WebhookEmitter) run() {
+	defer close(e.doneChan)
+
+	for event := range e.events {
+		if err := e.post(event); err != nil {
+			log.WARNING.Printf("Post %s event for task %s returned error: %s", event.Type, event.TaskUUID, err)
+		}
+	}
+}
+
+// post posts the event to the webhook
+func (e *WebhookEmitter) post(event *Event) error {
+	body, err := json.Marshal(event)
+	if err != nil {
+		return fmt.Errorf("JSON marshal error: %s", err)
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("Post event error: %s", err)
+	}
+	defer resp.Body.Close()
+
+	// drain the body so the connection can be reused
+	_, _ = io.Copy(ioutil.Discard, resp.Body)
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("Webhook %s returned status %s", e.url, resp.Status)
+	}
+	return nil
+}
@@ -3,7 +3,9 @@ package machinery
 import (
 	"errors"
 	"fmt"
+	neturl "net/url"
 	"os"
+	"strconv"
 	"strings"
 
 	"github.com/pmaccamp/machinery/v1/config"
@@ -12,6 +14,8 @@ import (
 	eagerbroker "github.com/pmaccamp/machinery/v1/brokers/eager"
 	gcppubsubbroker "github.com/pmaccamp/machinery/v1/brokers/gcppubsub"
 	brokeriface "github.com/pmaccamp/machinery/v1/brokers/iface"
+	memorybroker "github.com/pmaccamp/machinery/v1/brokers/memory"
+	redisbroker "github.com/pmaccamp/machinery/v1/brokers/redis"
 	sqsbroker "github.com/pmaccamp/machinery/v1/brokers/sqs"
 
 	amqpbackend "github.com/pmaccamp/machinery/v1/backends/amqp"
@@ -20,10 +24,12 @@ import (
 	backendiface "github.com/pmaccamp/machinery/v1/backends/iface"
 	memcachebackend "github.com/pmaccamp/machinery/v1/backends/memcache"
 	mongobackend "github.com/pmaccamp/machinery/v1/backends/mongo"
+	redisbackend "github.com/pmaccamp/machinery/v1/backends/redis"
+	sqlbackend "github.com/pmaccamp/machinery/v1/backends/sql"
 )
 
 // BrokerFactory creates a new object of iface.Broker
-// Currently only AMQP/S broker is supported
+// Currently supported brokers are AMQP/S, Redis, AWS SQS, GCP Pub/Sub and in-memory
 func BrokerFactory(cnf *config.Config) (brokeriface.Broker, error) {
 	if strings.HasPrefix(cnf.Broker, "amqp://") {
 		return amqpbroker.New(cnf), nil
@@ -33,6 +39,26 @@ func BrokerFactory(cnf *config.Config) (brokeriface.Broker, error) {
 		return amqpbroker.New(cnf), nil
 	}
 
+	if strings.HasPrefix(cnf.Broker, "redis://") {
+		redisHost, redisPassword, redisDB, err := ParseRedisURL(cnf.Broker)
+		if err != nil {
+			return nil, err
+		}
+		return redisbroker.New(cnf, redisHost, redisPassword, "", redisDB), nil
+	}
+
+	if strings.HasPrefix(cnf.Broker, "redis+socket://") {
+		redisSocket, redisPassword, redisDB, err := ParseRedisSocketURL(cnf.Broker)
+		if err != nil {
+			return nil, err
+		}
+		return redisbroker.New(cnf, "", redisPassword, redisSocket, redisDB), nil
+	}
+
+	if strings.HasPrefix(cnf.Broker, "memory://") {
+		return memorybroker.New(cnf), nil
+	}
+
 	if strings.HasPrefix(cnf.Broker, "eager") {
 		return eagerbroker.New(), nil
 	}
@@ -63,7 +89,7 @@ func BrokerFactory(cnf *config.Config) (brokeriface.Broker, error) {
 }
 
 // BackendFactory creates a new object of backends.Interface
-// Currently supported backends are AMQP/S and Memcache
+// Currently supported backends are AMQP/S, Redis, Memcache, MongoDB, DynamoDB, SQLite and PostgreSQL
 func BackendFactory(cnf *config.Config) (backendiface.Backend, error) {
 	if strings.HasPrefix(cnf.ResultBackend, "amqp://") {
 		return amqpbackend.New(cnf), nil
@@ -73,6 +99,24 @@ func BackendFactory(cnf *config.Config) (backendiface.Backend, error) {
 		return amqpbackend.New(cnf), nil
 	}
 
+	if strings.HasPrefix(cnf.ResultBackend, "redis://") {
+		redisHost, redisPassword, redisDB, err := ParseRedisURL(cnf.ResultBackend)
+		if err != nil {
+			return nil, err
+		}
+
+		return redisbackend.New(cnf, redisHost, redisPassword, "", redisDB), nil
+	}
+
+	if strings.HasPrefix(cnf.ResultBackend, "redis+socket://") {
+		redisSocket, redisPassword, redisDB, err := ParseRedisSocketURL(cnf.ResultBackend)
+		if err != nil {
+			return nil, err
+		}
+
+		return redisbackend.New(cnf, "", redisPassword, redisSocket, redisDB), nil
+	}
+
 	if strings.HasPrefix(cnf.ResultBackend, "memcache://") {
 		parts := strings.Split(cnf.ResultBackend, "memcache://")
 		if len(parts) != 2 {
@@ -89,8 +133,23 @@ func BackendFactory(cnf *config.Config) (backendiface.Backend, error) {
 		return mongobackend.New(cnf), nil
 	}
 
+	if strings.HasPrefix(cnf.ResultBackend, "sqlite://") {
+		dataSourceName := strings.TrimPrefix(cnf.ResultBackend, "sqlite://")
+		if dataSourceName == "" {
+			return nil, fmt.Errorf(
+				"SQLite result backend connection string should be in format sqlite://path/to/file.db, instead got %s",
+				cnf.ResultBackend,
+			)
+		}
+		return sqlbackend.New(cnf, sqlbackend.DriverSQLite, dataSourceName), nil
+	}
+
+	if strings.HasPrefix(cnf.ResultBackend, "postgres://") || strings.HasPrefix(cnf.ResultBackend, "postgresql://") {
+		return sqlbackend.New(cnf, sqlbackend.DriverPostgres, cnf.ResultBackend), nil
+	}
+
 	if strings.HasPrefix(cnf.ResultBackend, "eager") {
-		return eagerbackend.New(), nil
+		return eagerbackend.NewWithConfig(cnf), nil
 	}
 
 	if strings.HasPrefix(cnf.ResultBackend, "https://dynamodb") {
@@ -127,3 +186,84 @@ func ParseGCPPubSubURL(url string) (string, string, error) {
 
 	return "", "", fmt.Errorf("gcppubsub scheme should be in format gcppubsub://YOUR_GCP_PROJECT_ID/YOUR_PUBSUB_SUBSCRIPTION_NAME, instead got %s", url)
 }
+
+// ParseRedisURL extracts Redis connection options from a URL in format
+// redis://[password@]host[:port][/db_num]
+func ParseRedisURL(url string) (host, password string, db int, err error) {
+	var u *neturl.URL
+	u, err = neturl.Parse(url)
+	if err != nil {
+		return
+	}
+	if u.Scheme != "redis" {
+		err = errors.New("No redis scheme found")
+		return
+	}
+
+	if u.User != nil {
+		var exists bool
+		password, exists = u.User.Password()
+		if !exists {
+			password = u.User.Username()
+		}
+	}
+
+	host = u.Host
+
+	parts := strings.Split(u.Path, "/")
+	if len(parts) > 1 && parts[1] != "" {
+		db, err = strconv.Atoi(parts[1])
+		if err != nil {
+			err = fmt.Errorf("Redis DB number should be an integer, instead got %s", parts[1])
+			return
+		}
+	}
+
+	return
+}
+
+// ParseRedisSocketURL extracts Redis connection options from a URL in format
+// redis+socket://[password@]/path/to/file.sock[:/db_num]
+func ParseRedisSocketURL(url string) (path, password string, db int, err error) {
+	parts := strings.Split(url, "redis+socket://")
+	if parts[0] != "" {
+		err = errors.New("No redis scheme found")
+		return
+	}
+
+	if len(parts) != 2 {
+		err = fmt.Errorf("Redis socket connection string should be in format redis+socket://password@/path/to/file.sock:/db_num, instead got %s", url)
+		return
+	}
+
+	remainder := parts[1]
+
+	// Extract password if any
+	parts = strings.SplitN(remainder, "@", 2)
+	if len(parts) == 2 {
+		password = parts[0]
+		remainder = parts[1]
+	}
+
+	// Extract path
+	parts = strings.SplitN(remainder, ":", 2)
+	path = parts[0]
+	if path == "" {
+		err = fmt.Errorf("Redis socket connection string should be in format redis+socket://password@/path/to/file.sock:/db_num, instead got %s", url)
+		return
+	}
+
+	// Extract DB if any
+	if len(parts) == 2 {
+		parts = strings.SplitN(parts[1], "/", 2)
+		if len(parts) == 2 && parts[1] != "" {
+			db, err = strconv.Atoi(parts[1])
+			if err != nil {
+				err = fmt.Errorf("Redis DB number should be an integer, instead got %s", parts[1])
+				return
+			}
+		}
+	}
+
+	return
+}
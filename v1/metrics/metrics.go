@@ -0,0 +1,266 @@
+// Package metrics exposes Prometheus metrics about the tasks published by
+// servers and processed by workers.
+package metrics
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1"
+	"github.com/pmaccamp/machinery/v1/brokers/iface"
+	"github.com/pmaccamp/machinery/v1/events"
+	"github.com/pmaccamp/machinery/v1/log"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const (
+	// Namespace prefixes the names of all metrics
+	Namespace = "machinery"
+
+	// PublishedAtHeader is the header recording when a task was published,
+	// workers use it to measure how long tasks wait in the queue
+	PublishedAtHeader = tasks.PublishedAtHeader
+)
+
+// Metrics collects the metrics of tasks. It implements prometheus.Collector
+// so it can be registered with any registry, or served on its own by Handler.
+type Metrics struct {
+	published *prometheus.CounterVec
+	received  *prometheus.CounterVec
+	succeeded *prometheus.CounterVec
+	failed    *prometheus.CounterVec
+	retried   *prometheus.CounterVec
+	queueWait *prometheus.HistogramVec
+	duration  *prometheus.HistogramVec
+	inFlight  *prometheus.GaugeVec
+	queues    *queueDepthCollector
+}
+
+// New creates Metrics instance
+func New() *Metrics {
+	return &Metrics{
+		published: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "tasks_published_total",
+			Help:      "Number of tasks published, excluding tasks sent back to the queue to be retried.",
+		}, []string{"task"}),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "tasks_received_total",
+			Help:      "Number of tasks received by workers.",
+		}, []string{"task"}),
+		succeeded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "tasks_succeeded_total",
+			Help:      "Number of tasks which succeeded.",
+		}, []string{"task"}),
+		failed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "tasks_failed_total",
+			Help:      "Number of tasks which failed for good, whether they failed to run or returned an error they are not retried for.",
+		}, []string{"task"}),
+		retried: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: Namespace,
+			Name:      "tasks_retried_total",
+			Help:      "Number of failed tasks sent back to the queue to be retried.",
+		}, []string{"task"}),
+		queueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "task_queue_wait_seconds",
+			Help:      "Time tasks waited in the queue from being published, or becoming due, until received by a worker.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 4, 10),
+		}, []string{"task"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: Namespace,
+			Name:      "task_duration_seconds",
+			Help:      "Time taken to execute tasks.",
+			Buckets:   prometheus.ExponentialBuckets(0.005, 4, 10),
+		}, []string{"task"}),
+		inFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: Namespace,
+			Name:      "tasks_in_flight",
+			Help:      "Number of tasks being executed by the worker.",
+		}, []string{"worker"}),
+		queues: &queueDepthCollector{
+			desc: prometheus.NewDesc(
+				prometheus.BuildFQName(Namespace, "", "queue_depth"),
+				"Number of tasks waiting in the queue.",
+				[]string{"queue"}, nil,
+			),
+		},
+	}
+}
+
+// collectors returns all the collectors of the metrics
+func (m *Metrics) collectors() []prometheus.Collector {
+	return []prometheus.Collector{
+		m.published, m.received, m.succeeded, m.failed, m.retried,
+		m.queueWait, m.duration, m.inFlight, m.queues,
+	}
+}
+
+// Describe implements prometheus.Collector
+func (m *Metrics) Describe(ch chan<- *prometheus.Desc) {
+	for _, collector := range m.collectors() {
+		collector.Describe(ch)
+	}
+}
+
+// Collect implements prometheus.Collector
+func (m *Metrics) Collect(ch chan<- prometheus.Metric) {
+	for _, collector := range m.collectors() {
+		collector.Collect(ch)
+	}
+}
+
+// Handler returns an HTTP handler serving the metrics in the Prometheus
+// exposition format, e.g. to be mounted on /metrics
+func (m *Metrics) Handler() http.Handler {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(m)
+	return promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
+}
+
+// InstrumentServer adds the publish middleware to the server
+func (m *Metrics) InstrumentServer(server *machinery.Server) {
+	server.UsePublishMiddleware(m.PublishMiddleware())
+}
+
+// InstrumentWorker adds the task middleware to the worker and the event
+// emitter of the worker to its server. It has to be called before the worker
+// launches.
+func (m *Metrics) InstrumentWorker(worker *machinery.Worker) {
+	worker.Use(m.TaskMiddleware(worker.ConsumerTag))
+	worker.GetServer().AddEventEmitter(m.EventEmitter(worker.ConsumerTag))
+}
+
+// PublishMiddleware returns publish middleware counting published tasks and
+// recording when they were published. Tasks sent back to the queue to be
+// retried keep the time they were first published and are not counted again,
+// callbacks published by workers are tasks of their own and are counted.
+func (m *Metrics) PublishMiddleware() machinery.PublishMiddleware {
+	return func(ctx context.Context, signature *tasks.Signature, next machinery.PublishHandler) error {
+		if _, ok := signature.Headers[PublishedAtHeader]; ok {
+			return next(ctx, signature)
+		}
+
+		if signature.Headers == nil {
+			signature.Headers = make(tasks.Headers)
+		}
+		signature.Headers[PublishedAtHeader] = time.Now().UTC().Format(time.RFC3339Nano)
+
+		if err := next(ctx, signature); err != nil {
+			return err
+		}
+
+		m.published.WithLabelValues(signature.Task).Inc()
+		return nil
+	}
+}
+
+// TaskMiddleware returns task middleware timing the execution of tasks and
+// how long they waited in the queue and tracking the tasks in flight of the
+// worker
+func (m *Metrics) TaskMiddleware(worker string) machinery.TaskMiddleware {
+	return func(ctx context.Context, signature *tasks.Signature, next machinery.TaskHandler) error {
+		start := time.Now()
+		if wait, ok := queueWait(signature, start); ok {
+			m.queueWait.WithLabelValues(signature.Task).Observe(wait.Seconds())
+		}
+
+		inFlight := m.inFlight.WithLabelValues(worker)
+		inFlight.Inc()
+		defer inFlight.Dec()
+
+		err := next(ctx, signature)
+
+		m.duration.WithLabelValues(signature.Task).Observe(time.Since(start).Seconds())
+		return err
+	}
+}
+
+// EventEmitter returns an event emitter counting the tasks received by the
+// worker, the tasks which succeeded, failed for good or were sent back to the
+// queue to be retried. Events of other workers are ignored. Events are
+// emitted by workers as tasks are processed, so tasks failing before they
+// run, e.g. because their arguments cannot be decrypted, are counted too.
+func (m *Metrics) EventEmitter(worker string) events.Emitter {
+	return &eventCounter{metrics: m, worker: worker}
+}
+
+// eventCounter counts the events of a worker
+type eventCounter struct {
+	metrics *Metrics
+	worker  string
+}
+
+// Emit implements events.Emitter
+func (c *eventCounter) Emit(event *events.Event) error {
+	if event.Worker != c.worker {
+		return nil
+	}
+
+	switch event.Type {
+	case events.TaskReceived:
+		c.metrics.received.WithLabelValues(event.TaskName).Inc()
+	case events.TaskSucceeded:
+		c.metrics.succeeded.WithLabelValues(event.TaskName).Inc()
+	case events.TaskFailed:
+		c.metrics.failed.WithLabelValues(event.TaskName).Inc()
+	case events.TaskRetried:
+		c.metrics.retried.WithLabelValues(event.TaskName).Inc()
+	}
+	return nil
+}
+
+// MonitorQueues reports the depth of the queues, or of the default queue if
+// none are given, measured every time the metrics are collected. The broker
+// has to implement iface.QueueDepthBroker.
+func (m *Metrics) MonitorQueues(broker iface.Broker, queues ...string) error {
+	queueDepthBroker, ok := broker.(iface.QueueDepthBroker)
+	if !ok {
+		return fmt.Errorf("Broker %T does not report queue depth", broker)
+	}
+
+	names := make([]string, 0, len(queues))
+	for _, queue := range queues {
+		if queue == "" {
+			queue = broker.GetConfig().DefaultQueue
+		}
+		names = append(names, queue)
+	}
+	if len(names) == 0 {
+		names = append(names, broker.GetConfig().DefaultQueue)
+	}
+
+	m.queues.add(queueDepthBroker, names)
+	return nil
+}
+
+// queueWait returns how long the task waited in the queue, from being
+// published or its ETA, whichever is later, until received
+func queueWait(signature *tasks.Signature, received time.Time) (time.Duration, bool) {
+	publishedAt, ok := signature.Headers[PublishedAtHeader].(string)
+	if !ok {
+		return 0, false
+	}
+
+	since, err := time.Parse(time.RFC3339Nano, publishedAt)
+	if err != nil {
+		log.WARNING.Printf("Ignoring invalid %s header of task %s: %s", PublishedAtHeader, signature.Id, err)
+		return 0, false
+	}
+	if signature.ETA != nil && signature.ETA.After(since) {
+		since = *signature.ETA
+	}
+
+	wait := received.Sub(since)
+	if wait < 0 {
+		wait = 0
+	}
+	return wait, true
+}
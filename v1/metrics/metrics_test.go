@@ -0,0 +1,127 @@
+package metrics_test
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1"
+	"github.com/pmaccamp/machinery/v1/brokers/eager"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/metrics"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// scrape returns the metrics served by the handler
+func scrape(t *testing.T, m *metrics.Metrics) string {
+	recorder := httptest.NewRecorder()
+	m.Handler().ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+	body, err := ioutil.ReadAll(recorder.Body)
+	require.NoError(t, err)
+	return string(body)
+}
+
+func TestMetrics(t *testing.T) {
+	t.Parallel()
+
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "memory://",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+		NoUnixSignals: true,
+	})
+	require.NoError(t, err)
+
+	var calls int
+	require.NoError(t, server.RegisterTasks(map[string]interface{}{
+		"add": func(a, b int64) (int64, error) {
+			return a + b, nil
+		},
+		"flaky": func() error {
+			calls++
+			if calls == 1 {
+				return tasks.NewErrRetryTaskLater("try again", time.Millisecond)
+			}
+			return errors.New("broken")
+		},
+	}))
+
+	m := metrics.New()
+	m.InstrumentServer(server)
+	require.NoError(t, m.MonitorQueues(server.GetBroker()))
+
+	// queue a task before the worker starts
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task: "add",
+		Args: []interface{}{int64(1), int64(2)},
+	})
+	require.NoError(t, err)
+	assert.Contains(t, scrape(t, m), `machinery_queue_depth{queue="machinery_tasks"} 1`)
+
+	worker := server.NewWorker("test_worker", 1)
+	m.InstrumentWorker(worker)
+	// callbacks of the worker are left to the user
+	var finished int32
+	worker.SetTaskFinishedCallback(func(*tasks.Signature) {
+		atomic.AddInt32(&finished, 1)
+	})
+	errorsChan := make(chan error, 1)
+	worker.LaunchAsync(errorsChan)
+	defer func() {
+		worker.Quit()
+		<-errorsChan
+	}()
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	asyncResult, err = server.SendTask(&tasks.Signature{Task: "flaky"})
+	require.NoError(t, err)
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.EqualError(t, err, "broken")
+
+	// malformed arguments fail the task before it runs
+	asyncResult, err = server.SendTask(&tasks.Signature{
+		Task: "add",
+		Args: []interface{}{"1", "2"},
+	})
+	require.NoError(t, err)
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.Error(t, err)
+
+	// workers count tasks right after storing their state
+	require.Eventually(t, func() bool {
+		return atomic.LoadInt32(&finished) == 3
+	}, 5*time.Second, 10*time.Millisecond)
+
+	body := scrape(t, m)
+	for _, line := range []string{
+		`machinery_tasks_published_total{task="add"} 2`,
+		`machinery_tasks_published_total{task="flaky"} 1`,
+		`machinery_tasks_received_total{task="add"} 2`,
+		`machinery_tasks_received_total{task="flaky"} 2`,
+		`machinery_tasks_succeeded_total{task="add"} 1`,
+		`machinery_tasks_failed_total{task="add"} 1`,
+		`machinery_tasks_failed_total{task="flaky"} 1`,
+		`machinery_tasks_retried_total{task="flaky"} 1`,
+		`machinery_task_queue_wait_seconds_count{task="add"} 1`,
+		`machinery_task_queue_wait_seconds_count{task="flaky"} 2`,
+		`machinery_task_duration_seconds_count{task="flaky"} 2`,
+		`machinery_tasks_in_flight{worker="test_worker"} 0`,
+		`machinery_queue_depth{queue="machinery_tasks"} 0`,
+	} {
+		assert.Contains(t, body, line)
+	}
+}
+
+func TestMonitorQueuesNotSupported(t *testing.T) {
+	t.Parallel()
+
+	m := metrics.New()
+	assert.Error(t, m.MonitorQueues(eager.New()))
+}
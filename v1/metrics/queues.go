@@ -0,0 +1,56 @@
+package metrics
+
+import (
+	"sync"
+
+	"github.com/pmaccamp/machinery/v1/brokers/iface"
+	"github.com/pmaccamp/machinery/v1/log"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// monitoredQueue is a queue whose depth is reported by the broker
+type monitoredQueue struct {
+	broker iface.QueueDepthBroker
+	name   string
+}
+
+// queueDepthCollector asks the brokers for the depth of the monitored queues
+// every time it is collected
+type queueDepthCollector struct {
+	desc *prometheus.Desc
+
+	mu     sync.Mutex
+	queues []monitoredQueue
+}
+
+// add starts monitoring the queues
+func (c *queueDepthCollector) add(broker iface.QueueDepthBroker, queues []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, queue := range queues {
+		c.queues = append(c.queues, monitoredQueue{broker: broker, name: queue})
+	}
+}
+
+// Describe implements prometheus.Collector
+func (c *queueDepthCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.desc
+}
+
+// Collect implements prometheus.Collector, queues whose depth cannot be
+// measured are left out
+func (c *queueDepthCollector) Collect(ch chan<- prometheus.Metric) {
+	c.mu.Lock()
+	queues := c.queues
+	c.mu.Unlock()
+
+	for _, queue := range queues {
+		depth, err := queue.broker.QueueDepth(queue.name)
+		if err != nil {
+			log.WARNING.Printf("Measure depth of queue %s returned error: %s", queue.name, err)
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(c.desc, prometheus.GaugeValue, float64(depth), queue.name)
+	}
+}
@@ -0,0 +1,59 @@
+package machinery
+
+import (
+	"context"
+	"errors"
+
+	"github.com/pmaccamp/machinery/v1/tasks"
+)
+
+// TaskHandler runs a task received by a worker
+type TaskHandler func(ctx context.Context, signature *tasks.Signature) error
+
+// TaskMiddleware wraps the execution of tasks by a worker, e.g. for logging,
+// metrics, authorization or rate limiting. It calls next to continue with
+// the next middleware and eventually the task, possibly with a different
+// context, or returns without calling it to skip the task. Errors returned
+// by middleware are handled like errors returned by the task, i.e. the task
+// is retried or fails. Skipping the task without an error fails it too.
+type TaskMiddleware func(ctx context.Context, signature *tasks.Signature, next TaskHandler) error
+
+// chainTaskMiddleware wraps the handler in the middleware, the first
+// middleware is the outermost one
+func chainTaskMiddleware(handler TaskHandler, middleware []TaskMiddleware) TaskHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		mw, next := middleware[i], handler
+		handler = func(ctx context.Context, signature *tasks.Signature) error {
+			return mw(ctx, signature, next)
+		}
+	}
+	return handler
+}
+
+// ErrTaskSkipped is returned by SendTask when publish middleware returned
+// without an error but did not call next, e.g. to drop a duplicate task
+var ErrTaskSkipped = errors.New("Task skipped by publish middleware")
+
+// PublishHandler publishes a task to the broker
+type PublishHandler func(ctx context.Context, signature *tasks.Signature) error
+
+// PublishMiddleware wraps the publishing of tasks by the server, e.g. to add
+// default headers, validate or deduplicate tasks. It calls next to continue
+// with the next middleware and eventually the broker, possibly with a
+// modified signature, or returns without calling it to veto the task.
+// Returning nil without calling next vetoes the task with ErrTaskSkipped.
+// The context is the one passed to SendTaskWithContext and friends,
+// it is context.Background() otherwise.
+type PublishMiddleware func(ctx context.Context, signature *tasks.Signature, next PublishHandler) error
+
+// chainPublishMiddleware wraps the handler in the middleware, the first
+// middleware is the outermost one
+func chainPublishMiddleware(handler PublishHandler, middleware []PublishMiddleware) PublishHandler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		mw, next := middleware[i], handler
+		handler = func(ctx context.Context, signature *tasks.Signature) error {
+			return mw(ctx, signature, next)
+		}
+	}
+	return handler
+}
@@ -0,0 +1,186 @@
+package retry
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"time"
+)
+
+// Types of retry policies which can be described by a Spec
+const (
+	TypeExponential       = "exponential"
+	TypeExponentialJitter = "exponential_jitter"
+	TypeFixed             = "fixed"
+	TypeFibonacci         = "fibonacci"
+)
+
+const (
+	defaultInitialDelay = time.Second
+	defaultMultiplier   = 2
+	maxDuration         = time.Duration(math.MaxInt64)
+)
+
+// RetryPolicy decides how long to wait before retrying a failed task
+type RetryPolicy interface {
+	// NextDelay returns the delay before the given retry attempt, starting
+	// from 1, elapsed is the time since the first failure. It returns false
+	// if the task should not be retried any more.
+	NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool)
+}
+
+// Limits bound the delays of a retry policy, zero values mean no limit
+type Limits struct {
+	// MaxDelay caps the delay before a single retry
+	MaxDelay time.Duration
+	// MaxElapsed stops retrying when the retry would start later than
+	// MaxElapsed after the first failure
+	MaxElapsed time.Duration
+}
+
+// apply caps the delay and checks it does not exceed the elapsed time limit
+func (l Limits) apply(delay, elapsed time.Duration) (time.Duration, bool) {
+	if l.MaxDelay > 0 && delay > l.MaxDelay {
+		delay = l.MaxDelay
+	}
+	if l.MaxElapsed > 0 && elapsed+delay > l.MaxElapsed {
+		return 0, false
+	}
+	return delay, true
+}
+
+// ExponentialBackoff multiplies the delay by Multiplier after each attempt,
+// starting from Initial (1 second and 2 by default)
+type ExponentialBackoff struct {
+	Initial    time.Duration
+	Multiplier float64
+	Limits
+}
+
+// NextDelay implements RetryPolicy
+func (p ExponentialBackoff) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	return p.apply(exponentialDelay(p.Initial, p.Multiplier, attempt), elapsed)
+}
+
+// Spec describes the policy so it can be sent along with a signature
+func (p ExponentialBackoff) Spec() *Spec {
+	return &Spec{Type: TypeExponential, Delay: p.Initial, Multiplier: p.Multiplier, MaxDelay: p.MaxDelay, MaxElapsed: p.MaxElapsed}
+}
+
+// ExponentialJitterBackoff waits a random delay between zero and the delay
+// of ExponentialBackoff, which spreads out retries of tasks failing together
+type ExponentialJitterBackoff struct {
+	Initial    time.Duration
+	Multiplier float64
+	Limits
+}
+
+// NextDelay implements RetryPolicy
+func (p ExponentialJitterBackoff) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	delay := exponentialDelay(p.Initial, p.Multiplier, attempt)
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+	if delay < maxDuration {
+		delay++
+	}
+	return p.apply(time.Duration(rand.Int63n(int64(delay))), elapsed)
+}
+
+// Spec describes the policy so it can be sent along with a signature
+func (p ExponentialJitterBackoff) Spec() *Spec {
+	return &Spec{Type: TypeExponentialJitter, Delay: p.Initial, Multiplier: p.Multiplier, MaxDelay: p.MaxDelay, MaxElapsed: p.MaxElapsed}
+}
+
+// FixedBackoff waits the same delay before every attempt
+type FixedBackoff struct {
+	Delay time.Duration
+	Limits
+}
+
+// NextDelay implements RetryPolicy
+func (p FixedBackoff) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	return p.apply(p.Delay, elapsed)
+}
+
+// Spec describes the policy so it can be sent along with a signature
+func (p FixedBackoff) Spec() *Spec {
+	return &Spec{Type: TypeFixed, Delay: p.Delay, MaxDelay: p.MaxDelay, MaxElapsed: p.MaxElapsed}
+}
+
+// FibonacciBackoff multiplies Initial (1 second by default) by successive
+// Fibonacci numbers
+type FibonacciBackoff struct {
+	Initial time.Duration
+	Limits
+}
+
+// NextDelay implements RetryPolicy
+func (p FibonacciBackoff) NextDelay(attempt int, elapsed time.Duration) (time.Duration, bool) {
+	initial := p.Initial
+	if initial <= 0 {
+		initial = defaultInitialDelay
+	}
+
+	fibonacci := Fibonacci()
+	num := fibonacci()
+	for i := 1; i < attempt && num < math.MaxInt32; i++ {
+		num = fibonacci()
+	}
+
+	return p.apply(multiply(initial, float64(num)), elapsed)
+}
+
+// Spec describes the policy so it can be sent along with a signature
+func (p FibonacciBackoff) Spec() *Spec {
+	return &Spec{Type: TypeFibonacci, Delay: p.Initial, MaxDelay: p.MaxDelay, MaxElapsed: p.MaxElapsed}
+}
+
+// Spec describes one of the built-in retry policies in a form which can be
+// serialized along with a signature
+type Spec struct {
+	Type       string
+	Delay      time.Duration
+	Multiplier float64
+	MaxDelay   time.Duration
+	MaxElapsed time.Duration
+}
+
+// Policy returns the retry policy described by the spec
+func (s *Spec) Policy() (RetryPolicy, error) {
+	limits := Limits{MaxDelay: s.MaxDelay, MaxElapsed: s.MaxElapsed}
+	switch s.Type {
+	case TypeExponential:
+		return ExponentialBackoff{Initial: s.Delay, Multiplier: s.Multiplier, Limits: limits}, nil
+	case TypeExponentialJitter:
+		return ExponentialJitterBackoff{Initial: s.Delay, Multiplier: s.Multiplier, Limits: limits}, nil
+	case TypeFixed:
+		return FixedBackoff{Delay: s.Delay, Limits: limits}, nil
+	case TypeFibonacci:
+		return FibonacciBackoff{Initial: s.Delay, Limits: limits}, nil
+	}
+	return nil, fmt.Errorf("Unknown retry policy type: %s", s.Type)
+}
+
+// exponentialDelay returns initial * multiplier^(attempt-1)
+func exponentialDelay(initial time.Duration, multiplier float64, attempt int) time.Duration {
+	if initial <= 0 {
+		initial = defaultInitialDelay
+	}
+	if multiplier <= 0 {
+		multiplier = defaultMultiplier
+	}
+	if attempt < 1 {
+		attempt = 1
+	}
+	return multiply(initial, math.Pow(multiplier, float64(attempt-1)))
+}
+
+// multiply multiplies the duration without overflowing
+func multiply(d time.Duration, factor float64) time.Duration {
+	product := float64(d) * factor
+	if product >= float64(maxDuration) {
+		return maxDuration
+	}
+	return time.Duration(product)
+}
@@ -0,0 +1,110 @@
+package retry_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/retry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func delays(t *testing.T, policy retry.RetryPolicy, attempts int) []time.Duration {
+	result := make([]time.Duration, 0, attempts)
+	for attempt := 1; attempt <= attempts; attempt++ {
+		delay, ok := policy.NextDelay(attempt, 0)
+		require.True(t, ok)
+		result = append(result, delay)
+	}
+	return result
+}
+
+func TestExponentialBackoff(t *testing.T) {
+	t.Parallel()
+
+	policy := retry.ExponentialBackoff{}
+	assert.Equal(t, []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second}, delays(t, policy, 4))
+
+	policy = retry.ExponentialBackoff{
+		Initial:    100 * time.Millisecond,
+		Multiplier: 3,
+		Limits:     retry.Limits{MaxDelay: time.Second},
+	}
+	assert.Equal(t, []time.Duration{100 * time.Millisecond, 300 * time.Millisecond, 900 * time.Millisecond, time.Second}, delays(t, policy, 4))
+
+	// does not overflow
+	delay, ok := retry.ExponentialBackoff{}.NextDelay(1000, 0)
+	assert.True(t, ok)
+	assert.True(t, delay > 0)
+}
+
+func TestExponentialJitterBackoff(t *testing.T) {
+	t.Parallel()
+
+	policy := retry.ExponentialJitterBackoff{Limits: retry.Limits{MaxDelay: 3 * time.Second}}
+	for attempt := 1; attempt <= 5; attempt++ {
+		for i := 0; i < 100; i++ {
+			delay, ok := policy.NextDelay(attempt, 0)
+			require.True(t, ok)
+			assert.True(t, delay >= 0)
+			assert.True(t, delay <= 3*time.Second)
+		}
+	}
+}
+
+func TestFixedBackoff(t *testing.T) {
+	t.Parallel()
+
+	policy := retry.FixedBackoff{Delay: 5 * time.Second}
+	assert.Equal(t, []time.Duration{5 * time.Second, 5 * time.Second, 5 * time.Second}, delays(t, policy, 3))
+}
+
+func TestFibonacciBackoff(t *testing.T) {
+	t.Parallel()
+
+	policy := retry.FibonacciBackoff{Initial: time.Minute}
+	assert.Equal(t, []time.Duration{time.Minute, time.Minute, 2 * time.Minute, 3 * time.Minute, 5 * time.Minute}, delays(t, policy, 5))
+}
+
+func TestMaxElapsed(t *testing.T) {
+	t.Parallel()
+
+	policy := retry.FixedBackoff{Delay: 10 * time.Second, Limits: retry.Limits{MaxElapsed: time.Minute}}
+
+	delay, ok := policy.NextDelay(3, 50*time.Second)
+	assert.True(t, ok)
+	assert.Equal(t, 10*time.Second, delay)
+
+	_, ok = policy.NextDelay(4, 51*time.Second)
+	assert.False(t, ok)
+}
+
+func TestSpec(t *testing.T) {
+	t.Parallel()
+
+	limits := retry.Limits{MaxDelay: time.Minute, MaxElapsed: time.Hour}
+	policies := []retry.RetryPolicy{
+		retry.ExponentialBackoff{Initial: time.Second, Multiplier: 1.5, Limits: limits},
+		retry.ExponentialJitterBackoff{Initial: time.Second, Multiplier: 1.5, Limits: limits},
+		retry.FixedBackoff{Delay: time.Second, Limits: limits},
+		retry.FibonacciBackoff{Initial: time.Second, Limits: limits},
+	}
+
+	for _, policy := range policies {
+		spec := policy.(interface{ Spec() *retry.Spec }).Spec()
+
+		// the spec survives being sent along with a signature
+		data, err := json.Marshal(spec)
+		require.NoError(t, err)
+		decoded := new(retry.Spec)
+		require.NoError(t, json.Unmarshal(data, decoded))
+
+		decodedPolicy, err := decoded.Policy()
+		require.NoError(t, err)
+		assert.Equal(t, policy, decodedPolicy)
+	}
+
+	_, err := (&retry.Spec{Type: "unknown"}).Policy()
+	assert.EqualError(t, err, "Unknown retry policy type: unknown")
+}
@@ -0,0 +1,72 @@
+package schedule
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/robfig/cron/v3"
+)
+
+// ErrIntervalTooShort is returned for intervals shorter than a millisecond
+var ErrIntervalTooShort = errors.New("Interval must be at least 1ms")
+
+// parser accepts standard 5 field cron expressions, an optional leading
+// seconds field and descriptors such as @hourly or @every 5m
+var parser = cron.NewParser(
+	cron.SecondOptional | cron.Minute | cron.Hour | cron.Dom | cron.Month | cron.Dow | cron.Descriptor,
+)
+
+// Schedule describes when a periodic task runs
+type Schedule interface {
+	// Next returns the next activation time, later than the given time,
+	// or zero time if there are no more activations
+	Next(t time.Time) time.Time
+}
+
+// Last returns the latest activation of the schedule which is not after t,
+// given an activation first which is not after t either. It calls Next a
+// number of times logarithmic in the time between first and t rather than
+// once per activation in between.
+func Last(s Schedule, first, t time.Time) time.Time {
+	// the next activation after lo is not after t, the one after hi is
+	lo, hi := first.Add(-time.Nanosecond), t
+	for hi.Sub(lo) > time.Nanosecond {
+		mid := lo.Add(hi.Sub(lo) / 2)
+		if next := s.Next(mid); !next.IsZero() && !next.After(t) {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return s.Next(lo)
+}
+
+// Cron returns a schedule for the given cron expression, e.g. "*/5 * * * *"
+func Cron(spec string) (Schedule, error) {
+	s, err := parser.Parse(spec)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid cron expression %q: %s", spec, err)
+	}
+	return s, nil
+}
+
+// Every returns a schedule activating once per interval. Activations are
+// aligned to the Unix epoch rather than to the time the schedule was
+// created, so all processes agree on when the task is due.
+func Every(interval time.Duration) (Schedule, error) {
+	if interval < time.Millisecond {
+		return nil, ErrIntervalTooShort
+	}
+	return intervalSchedule(interval), nil
+}
+
+// intervalSchedule activates at every multiple of the interval since epoch
+type intervalSchedule time.Duration
+
+// Next returns the next activation time, later than the given time
+func (s intervalSchedule) Next(t time.Time) time.Time {
+	interval := int64(s)
+	nanos := t.UnixNano()
+	return time.Unix(0, nanos-nanos%interval+interval).In(t.Location())
+}
@@ -0,0 +1,109 @@
+package schedule_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/schedule"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCron(t *testing.T) {
+	t.Parallel()
+
+	base := time.Date(2020, 1, 1, 10, 7, 30, 0, time.UTC)
+
+	var tests = []struct {
+		spec string
+		next time.Time
+	}{
+		{spec: "*/5 * * * *", next: time.Date(2020, 1, 1, 10, 10, 0, 0, time.UTC)},
+		{spec: "0 12 * * *", next: time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)},
+		{spec: "15 * * * * *", next: time.Date(2020, 1, 1, 10, 8, 15, 0, time.UTC)},
+		{spec: "@hourly", next: time.Date(2020, 1, 1, 11, 0, 0, 0, time.UTC)},
+		{spec: "@every 1m", next: time.Date(2020, 1, 1, 10, 8, 30, 0, time.UTC)},
+	}
+
+	for _, tt := range tests {
+		s, err := schedule.Cron(tt.spec)
+		if assert.NoError(t, err, tt.spec) {
+			assert.Equal(t, tt.next, s.Next(base), tt.spec)
+		}
+	}
+
+	_, err := schedule.Cron("* * *")
+	assert.Error(t, err)
+}
+
+func TestEvery(t *testing.T) {
+	t.Parallel()
+
+	s, err := schedule.Every(15 * time.Minute)
+	require.NoError(t, err)
+
+	base := time.Date(2020, 1, 1, 10, 7, 30, 0, time.UTC)
+	next := s.Next(base)
+	assert.Equal(t, time.Date(2020, 1, 1, 10, 15, 0, 0, time.UTC), next)
+	assert.Equal(t, time.Date(2020, 1, 1, 10, 30, 0, 0, time.UTC), s.Next(next))
+
+	// Activations don't depend on the time zone or on when the schedule
+	// was created
+	s, err = schedule.Every(7 * time.Second)
+	require.NoError(t, err)
+	loc := time.FixedZone("UTC+1", 3600)
+	assert.True(t, s.Next(base).Equal(s.Next(base.In(loc))))
+	assert.Equal(t, int64(0), s.Next(base).Unix()%7)
+
+	_, err = schedule.Every(time.Microsecond)
+	assert.Equal(t, schedule.ErrIntervalTooShort, err)
+}
+
+func TestLast(t *testing.T) {
+	t.Parallel()
+
+	every, err := schedule.Every(15 * time.Minute)
+	require.NoError(t, err)
+	weekdays, err := schedule.Cron("0 12 * * MON-FRI")
+	require.NoError(t, err)
+
+	first := time.Date(2020, 1, 1, 10, 15, 0, 0, time.UTC)
+
+	var tests = []struct {
+		schedule schedule.Schedule
+		first    time.Time
+		t        time.Time
+		last     time.Time
+	}{
+		{
+			schedule: every,
+			first:    first,
+			t:        time.Date(2020, 3, 4, 16, 7, 30, 0, time.UTC),
+			last:     time.Date(2020, 3, 4, 16, 0, 0, 0, time.UTC),
+		},
+		// the first activation is the last one
+		{
+			schedule: every,
+			first:    first,
+			t:        first.Add(time.Minute),
+			last:     first,
+		},
+		{
+			schedule: weekdays,
+			first:    time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+			t:        time.Date(2020, 3, 4, 12, 0, 0, 0, time.UTC),
+			last:     time.Date(2020, 3, 4, 12, 0, 0, 0, time.UTC),
+		},
+		// March 8 2020 is a Sunday
+		{
+			schedule: weekdays,
+			first:    time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC),
+			t:        time.Date(2020, 3, 8, 23, 0, 0, 0, time.UTC),
+			last:     time.Date(2020, 3, 6, 12, 0, 0, 0, time.UTC),
+		},
+	}
+
+	for _, tt := range tests {
+		assert.Equal(t, tt.last, schedule.Last(tt.schedule, tt.first, tt.t), tt.t)
+	}
+}
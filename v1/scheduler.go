@@ -0,0 +1,472 @@
+package machinery
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/pmaccamp/machinery/v1/log"
+	"github.com/pmaccamp/machinery/v1/schedule"
+	"github.com/pmaccamp/machinery/v1/tasks"
+
+	backendsiface "github.com/pmaccamp/machinery/v1/backends/iface"
+)
+
+// MissedRunPolicy decides what happens to runs the scheduler did not fire
+// on time, e.g. because the process was paused or publishing failed
+type MissedRunPolicy int
+
+const (
+	// MissedRunFireOnce coalesces all missed runs into a single run
+	MissedRunFireOnce MissedRunPolicy = iota
+	// MissedRunSkip drops runs which are later than the misfire grace period
+	MissedRunSkip
+	// MissedRunCatchUp fires every missed run
+	MissedRunCatchUp
+)
+
+const (
+	// DefaultMisfireGrace is how late a run can be before it counts as missed
+	DefaultMisfireGrace = time.Second
+	// DefaultScheduleRetryInterval is how long the scheduler waits before
+	// trying again to publish a task which failed to publish
+	DefaultScheduleRetryInterval = time.Second
+	// DefaultScheduleLeaseTTL is how long the leading scheduler keeps its
+	// lease unless it renews it, which it does every third of the TTL
+	DefaultScheduleLeaseTTL = 15 * time.Second
+
+	// leaseKey is the lock held by the leading scheduler
+	leaseKey = "machinery_scheduler"
+	// maxCatchUpRuns limits the number of runs fired at once under
+	// the MissedRunCatchUp policy
+	maxCatchUpRuns = 1000
+	// idleWait is how long the scheduler sleeps when nothing is registered
+	idleWait = time.Hour
+)
+
+// Scheduler publishes periodic tasks. The result backend must implement
+// iface.ScheduleStore, several schedulers can run against the same backend
+// and the one holding the lease publishes all runs. The last published run
+// of each task is kept by the backend, so the leader resumes the schedule
+// where the previous one left it.
+type Scheduler struct {
+	server *Server
+	// MisfireGrace is how late a run can be before it counts as missed
+	MisfireGrace time.Duration
+	// RetryInterval is how long to wait after a run failed to publish
+	RetryInterval time.Duration
+	// LeaseTTL is how long the leader keeps its lease unless it renews it,
+	// it is how long publishing stops for when the leader dies
+	LeaseTTL time.Duration
+
+	owner    string
+	entries  map[string]*scheduleEntry
+	mu       sync.Mutex
+	started  bool
+	changed  chan struct{}
+	stopChan chan struct{}
+	doneChan chan struct{}
+	now      func() time.Time
+
+	// the fields below are only accessed by the scheduling goroutine, term
+	// counts the times the lease has been acquired
+	store   backendsiface.ScheduleStore
+	leading bool
+	term    int
+	renewAt time.Time
+}
+
+// scheduleEntry is a periodic task registered with the scheduler, its next,
+// retryAt, unrecorded and term fields are only accessed by the scheduling
+// goroutine once the scheduler has been started
+type scheduleEntry struct {
+	name      string
+	schedule  schedule.Schedule
+	signature *tasks.Signature
+	policy    MissedRunPolicy
+	next      time.Time
+	retryAt   time.Time
+	// unrecorded is a published run which failed to be recorded as the
+	// last run, next is not advanced past it until it is recorded
+	unrecorded time.Time
+	// term is the lease term in which next was resumed from the last run
+	term int
+}
+
+// NewScheduler creates Scheduler instance
+func (server *Server) NewScheduler() *Scheduler {
+	return &Scheduler{
+		server:        server,
+		MisfireGrace:  DefaultMisfireGrace,
+		RetryInterval: DefaultScheduleRetryInterval,
+		LeaseTTL:      DefaultScheduleLeaseTTL,
+		owner:         uuid.New().String(),
+		entries:       make(map[string]*scheduleEntry),
+		changed:       make(chan struct{}, 1),
+		stopChan:      make(chan struct{}),
+		doneChan:      make(chan struct{}),
+		now:           time.Now,
+	}
+}
+
+// RegisterCronTask registers a task published according to a cron
+// expression, e.g. "*/5 * * * *" or "@hourly"
+func (scheduler *Scheduler) RegisterCronTask(name, spec string, signature *tasks.Signature, policy MissedRunPolicy) error {
+	s, err := schedule.Cron(spec)
+	if err != nil {
+		return err
+	}
+	return scheduler.Register(name, s, signature, policy)
+}
+
+// RegisterIntervalTask registers a task published once per interval
+func (scheduler *Scheduler) RegisterIntervalTask(name string, interval time.Duration, signature *tasks.Signature, policy MissedRunPolicy) error {
+	s, err := schedule.Every(interval)
+	if err != nil {
+		return err
+	}
+	return scheduler.Register(name, s, signature, policy)
+}
+
+// Register registers a task published according to the schedule. The name
+// must be the same in all schedulers sharing a backend, it is used to keep
+// track of the last published run. Each run is published as a copy of the
+// signature with newly generated IDs for the task and its callbacks.
+func (scheduler *Scheduler) Register(name string, s schedule.Schedule, signature *tasks.Signature, policy MissedRunPolicy) error {
+	if name == "" {
+		return errors.New("Periodic task name required")
+	}
+	if signature == nil {
+		return errors.New("Periodic task signature required")
+	}
+	if policy < MissedRunFireOnce || policy > MissedRunCatchUp {
+		return fmt.Errorf("Unknown missed run policy: %d", policy)
+	}
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if _, ok := scheduler.entries[name]; ok {
+		return fmt.Errorf("Periodic task already registered: %s", name)
+	}
+
+	scheduler.entries[name] = &scheduleEntry{
+		name:      name,
+		schedule:  s,
+		signature: tasks.CopySignature(signature),
+		policy:    policy,
+		next:      s.Next(scheduler.now()),
+	}
+
+	// wake up the scheduling goroutine so it picks up the new entry
+	select {
+	case scheduler.changed <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// Start starts publishing registered tasks in the background, it fails if
+// the result backend does not implement iface.ScheduleStore
+func (scheduler *Scheduler) Start() error {
+	backend := scheduler.server.GetBackend()
+	store, ok := backend.(backendsiface.ScheduleStore)
+	if !ok {
+		return fmt.Errorf("Result backend %T cannot be used by schedulers, it does not implement iface.ScheduleStore", backend)
+	}
+	if scheduler.LeaseTTL <= 0 {
+		return fmt.Errorf("Invalid scheduler lease TTL: %s", scheduler.LeaseTTL)
+	}
+
+	scheduler.mu.Lock()
+	defer scheduler.mu.Unlock()
+
+	if scheduler.started {
+		return nil
+	}
+	scheduler.started = true
+	scheduler.store = store
+
+	go scheduler.run()
+	return nil
+}
+
+// Stop stops publishing tasks and waits for the scheduler to finish
+func (scheduler *Scheduler) Stop() {
+	scheduler.mu.Lock()
+	started := scheduler.started
+	scheduler.mu.Unlock()
+
+	if !started {
+		return
+	}
+
+	select {
+	case <-scheduler.stopChan:
+	default:
+		close(scheduler.stopChan)
+	}
+	<-scheduler.doneChan
+}
+
+func (scheduler *Scheduler) run() {
+	defer close(scheduler.doneChan)
+	defer scheduler.resign()
+
+	for {
+		timer := time.NewTimer(scheduler.tick())
+
+		select {
+		case <-scheduler.stopChan:
+			timer.Stop()
+			return
+		case <-scheduler.changed:
+			timer.Stop()
+		case <-timer.C:
+		}
+	}
+}
+
+// tick publishes all due runs and returns how long to wait for the next one
+func (scheduler *Scheduler) tick() time.Duration {
+	scheduler.mu.Lock()
+	entries := make([]*scheduleEntry, 0, len(scheduler.entries))
+	for _, entry := range scheduler.entries {
+		entries = append(entries, entry)
+	}
+	scheduler.mu.Unlock()
+
+	now := scheduler.now()
+	if !scheduler.lead(now) {
+		return scheduler.LeaseTTL / 3
+	}
+
+	wait := idleWait
+
+	for _, entry := range entries {
+		// the lease was lost while publishing
+		if !scheduler.leading {
+			return scheduler.LeaseTTL / 3
+		}
+
+		if !entry.retryAt.After(now) {
+			if entry.term != scheduler.term {
+				scheduler.resume(entry, now)
+			}
+			if entry.term == scheduler.term {
+				scheduler.fireDue(entry, now)
+			}
+		}
+
+		// the schedule has no more activations
+		if entry.next.IsZero() {
+			continue
+		}
+
+		wakeAt := entry.next
+		if entry.retryAt.After(wakeAt) {
+			wakeAt = entry.retryAt
+		}
+		if d := wakeAt.Sub(now); d < wait {
+			wait = d
+		}
+	}
+
+	if d := scheduler.renewAt.Sub(now); d < wait {
+		wait = d
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	return wait
+}
+
+// lead acquires or renews the lease, it returns false if another scheduler
+// holds the lease
+func (scheduler *Scheduler) lead(now time.Time) bool {
+	if scheduler.leading && now.Before(scheduler.renewAt) {
+		return true
+	}
+
+	acquired, err := scheduler.store.Lock(leaseKey, scheduler.owner, scheduler.LeaseTTL)
+	if err != nil {
+		log.ERROR.Printf("Failed to acquire the scheduler lease: %s", err)
+	}
+	if err != nil || !acquired {
+		if scheduler.leading {
+			log.WARNING.Print("Lost the scheduler lease, periodic tasks are left to another scheduler")
+		}
+		scheduler.leading = false
+		return false
+	}
+
+	if !scheduler.leading {
+		log.INFO.Print("Acquired the scheduler lease, publishing periodic tasks")
+		scheduler.leading = true
+		scheduler.term++
+	}
+	scheduler.renewAt = now.Add(scheduler.LeaseTTL / 3)
+	return true
+}
+
+// resign releases the lease so another scheduler takes over right away
+func (scheduler *Scheduler) resign() {
+	if !scheduler.leading {
+		return
+	}
+
+	scheduler.leading = false
+	if err := scheduler.store.Unlock(leaseKey, scheduler.owner); err != nil {
+		log.WARNING.Printf("Failed to release the scheduler lease: %s", err)
+	}
+}
+
+// resume continues the schedule of the entry after its last published run,
+// runs missed since then are handled according to the missed run policy
+func (scheduler *Scheduler) resume(entry *scheduleEntry, now time.Time) {
+	lastRun, err := scheduler.store.LastRun(entry.name)
+	if err != nil {
+		log.ERROR.Printf("Failed to load the last run of periodic task %s: %s", entry.name, err)
+		entry.retryAt = now.Add(scheduler.RetryInterval)
+		return
+	}
+
+	if !lastRun.IsZero() {
+		entry.next = entry.schedule.Next(lastRun)
+	}
+	// the last run in the store is what the schedule resumes from, a run
+	// left unrecorded in a previous term is published again
+	entry.unrecorded = time.Time{}
+	entry.term = scheduler.term
+}
+
+// fireDue publishes the runs of the entry which are due at the given time
+func (scheduler *Scheduler) fireDue(entry *scheduleEntry, now time.Time) {
+	if run := entry.unrecorded; !run.IsZero() {
+		if !scheduler.record(entry, run, now) {
+			return
+		}
+		entry.next = entry.schedule.Next(run)
+		entry.retryAt = time.Time{}
+	}
+
+	if entry.next.IsZero() || entry.next.After(now) {
+		return
+	}
+
+	var due []time.Time
+	if entry.policy == MissedRunCatchUp {
+		for t := entry.next; !t.IsZero() && !t.After(now); t = entry.schedule.Next(t) {
+			due = append(due, t)
+			if len(due) > maxCatchUpRuns {
+				due = due[1:]
+			}
+		}
+	} else {
+		// only the latest run can be published, the missed runs before it
+		// are not gone through one by one
+		due = []time.Time{schedule.Last(entry.schedule, entry.next, now)}
+	}
+	latest := due[len(due)-1]
+
+	term := scheduler.term
+	for _, run := range selectRuns(due, now, entry.policy, scheduler.MisfireGrace) {
+		// catching up might take longer than the lease, which is renewed
+		// as needed, the remaining runs are left to the next leader if
+		// the lease is lost
+		if !scheduler.lead(scheduler.now()) || scheduler.term != term {
+			return
+		}
+
+		if err := scheduler.fire(entry, run); err != nil {
+			log.ERROR.Printf("Failed to publish periodic task %s scheduled at %s: %s", entry.name, run, err)
+			// try again later, starting with the run which failed
+			entry.next = run
+			entry.retryAt = now.Add(scheduler.RetryInterval)
+			return
+		}
+
+		if !scheduler.record(entry, run, now) {
+			return
+		}
+	}
+
+	entry.next = entry.schedule.Next(latest)
+	entry.retryAt = time.Time{}
+}
+
+// fire publishes a single run
+func (scheduler *Scheduler) fire(entry *scheduleEntry, run time.Time) error {
+	signature := copyRunSignature(entry.signature)
+	if _, err := scheduler.server.SendTask(signature); err != nil {
+		return err
+	}
+
+	log.DEBUG.Printf("Published periodic task %s scheduled at %s as %s", entry.name, run, signature.Id)
+	return nil
+}
+
+// record records a published run as the last run of the entry. If it fails,
+// the schedule is held at the run until it is recorded rather than getting
+// ahead of the last run other schedulers would resume from, and the run is
+// not published again.
+func (scheduler *Scheduler) record(entry *scheduleEntry, run, now time.Time) bool {
+	if err := scheduler.store.SetLastRun(entry.name, run); err != nil {
+		log.ERROR.Printf("Failed to record the run of periodic task %s scheduled at %s: %s", entry.name, run, err)
+		entry.next = run
+		entry.unrecorded = run
+		entry.retryAt = now.Add(scheduler.RetryInterval)
+		return false
+	}
+
+	entry.unrecorded = time.Time{}
+	return true
+}
+
+// copyRunSignature copies the signature for a single run, the task and all
+// its callbacks get new IDs so runs do not share task states
+func copyRunSignature(signature *tasks.Signature) *tasks.Signature {
+	run := tasks.CopySignature(signature)
+	regenerateIDs(run)
+	return run
+}
+
+// regenerateIDs gives the signature and all its callbacks new IDs
+func regenerateIDs(signature *tasks.Signature) {
+	if signature == nil {
+		return
+	}
+
+	signature.Id = fmt.Sprintf("task_%v", uuid.New().String())
+	for _, callback := range signature.OnSuccess {
+		regenerateIDs(callback)
+	}
+	for _, callback := range signature.OnError {
+		regenerateIDs(callback)
+	}
+	regenerateIDs(signature.ChordCallback)
+}
+
+// selectRuns decides which of the due runs to fire according to the policy,
+// the due runs are sorted oldest first
+func selectRuns(due []time.Time, now time.Time, policy MissedRunPolicy, grace time.Duration) []time.Time {
+	if len(due) == 0 {
+		return nil
+	}
+
+	latest := due[len(due)-1]
+	switch policy {
+	case MissedRunCatchUp:
+		return due
+	case MissedRunSkip:
+		if now.Sub(latest) > grace {
+			return nil
+		}
+		return []time.Time{latest}
+	default:
+		return []time.Time{latest}
+	}
+}
@@ -0,0 +1,7 @@
+package machinery
+
+// SelectRuns exposes selectRuns to tests
+var SelectRuns = selectRuns
+
+// CopyRunSignature exposes copyRunSignature to tests
+var CopyRunSignature = copyRunSignature
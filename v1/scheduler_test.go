@@ -0,0 +1,289 @@
+package machinery_test
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1"
+	"github.com/pmaccamp/machinery/v1/backends/iface"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSelectRuns(t *testing.T) {
+	t.Parallel()
+
+	now := time.Date(2021, 1, 1, 12, 0, 0, 0, time.UTC)
+	due := []time.Time{
+		now.Add(-3 * time.Minute),
+		now.Add(-2 * time.Minute),
+		now.Add(-time.Minute),
+	}
+
+	assert.Nil(t, machinery.SelectRuns(nil, now, machinery.MissedRunCatchUp, time.Second))
+
+	assert.Equal(t, due, machinery.SelectRuns(due, now, machinery.MissedRunCatchUp, time.Second))
+	assert.Equal(t, due[2:], machinery.SelectRuns(due, now, machinery.MissedRunFireOnce, time.Second))
+
+	// the latest run is too late
+	assert.Empty(t, machinery.SelectRuns(due, now, machinery.MissedRunSkip, time.Second))
+	// the latest run is within the grace period
+	assert.Equal(t, due[2:], machinery.SelectRuns(due, now, machinery.MissedRunSkip, time.Minute))
+}
+
+func TestSchedulerRegister(t *testing.T) {
+	t.Parallel()
+
+	scheduler := newMemoryServer(t).NewScheduler()
+	signature := &tasks.Signature{Task: "concat"}
+
+	require.NoError(t, scheduler.RegisterCronTask("cron", "*/5 * * * *", signature, machinery.MissedRunFireOnce))
+	require.NoError(t, scheduler.RegisterIntervalTask("interval", time.Minute, signature, machinery.MissedRunSkip))
+
+	assert.EqualError(t, scheduler.RegisterIntervalTask("cron", time.Minute, signature, machinery.MissedRunSkip), "Periodic task already registered: cron")
+	assert.Error(t, scheduler.RegisterCronTask("invalid", "not a cron", signature, machinery.MissedRunFireOnce))
+	assert.Error(t, scheduler.RegisterIntervalTask("short", time.Microsecond, signature, machinery.MissedRunFireOnce))
+	assert.Error(t, scheduler.RegisterIntervalTask("nil", time.Minute, nil, machinery.MissedRunFireOnce))
+	assert.Error(t, scheduler.RegisterIntervalTask("policy", time.Minute, signature, machinery.MissedRunPolicy(42)))
+}
+
+// recordRuns registers the tick task and launches a worker recording the
+// IDs of the runs it processed, it returns a function returning the IDs
+// and a function quitting the worker
+func recordRuns(t *testing.T, server *machinery.Server) (func() []string, func()) {
+	var (
+		mu   sync.Mutex
+		runs []string
+	)
+	require.NoError(t, server.RegisterTask("tick", func(s string) (string, error) {
+		return s, nil
+	}))
+
+	worker := server.NewWorker("test", 1)
+	worker.SetTaskFinishedCallback(func(signature *tasks.Signature) {
+		mu.Lock()
+		runs = append(runs, signature.Id)
+		mu.Unlock()
+	})
+
+	return func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string(nil), runs...)
+	}, launchWorker(worker)
+}
+
+func TestSchedulerPublishesEachRunOnce(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+	runs, quit := recordRuns(t, server)
+	defer quit()
+
+	signature := &tasks.Signature{Id: "fixed", Task: "tick", Args: []interface{}{"tock"}}
+
+	// two schedulers sharing the result backend compete for the lease
+	for i := 0; i < 2; i++ {
+		scheduler := server.NewScheduler()
+		require.NoError(t, scheduler.RegisterIntervalTask("tick", 100*time.Millisecond, signature, machinery.MissedRunFireOnce))
+		require.NoError(t, scheduler.Start())
+		defer scheduler.Stop()
+	}
+
+	time.Sleep(550 * time.Millisecond)
+
+	// one run per 100ms tick, give or take one at either end
+	published := runs()
+	assert.True(t, len(published) >= 4 && len(published) <= 6, "Unexpected number of runs: %d", len(published))
+
+	ids := make(map[string]bool)
+	for _, id := range published {
+		assert.NotEqual(t, "fixed", id)
+		assert.False(t, ids[id], "Run published twice: %s", id)
+		ids[id] = true
+	}
+
+	// the registered signature is left untouched
+	assert.Equal(t, "fixed", signature.Id)
+}
+
+func TestSchedulerFailover(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+	runs, quit := recordRuns(t, server)
+	defer quit()
+
+	signature := &tasks.Signature{Task: "tick", Args: []interface{}{"tock"}}
+
+	schedulers := make([]*machinery.Scheduler, 2)
+	for i := range schedulers {
+		schedulers[i] = server.NewScheduler()
+		schedulers[i].LeaseTTL = 300 * time.Millisecond
+		require.NoError(t, schedulers[i].RegisterIntervalTask("tick", 100*time.Millisecond, signature, machinery.MissedRunFireOnce))
+	}
+
+	require.NoError(t, schedulers[0].Start())
+	time.Sleep(50 * time.Millisecond)
+	require.NoError(t, schedulers[1].Start())
+	defer schedulers[1].Stop()
+
+	time.Sleep(300 * time.Millisecond)
+
+	// the leader releases its lease, the other scheduler takes over
+	schedulers[0].Stop()
+	before := len(runs())
+	time.Sleep(450 * time.Millisecond)
+
+	published := runs()
+	assert.True(t, len(published)-before >= 3, "Unexpected number of runs after failover: %d", len(published)-before)
+
+	ids := make(map[string]bool)
+	for _, id := range published {
+		assert.False(t, ids[id], "Run published twice: %s", id)
+		ids[id] = true
+	}
+}
+
+func TestSchedulerResumesFromLastRun(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+	runs, quit := recordRuns(t, server)
+	defer quit()
+
+	store := server.GetBackend().(iface.ScheduleStore)
+	latest := time.Now().Truncate(time.Hour)
+
+	// a previous scheduler published its last run three hours ago
+	require.NoError(t, store.SetLastRun("tick", latest.Add(-3*time.Hour)))
+
+	scheduler := server.NewScheduler()
+	signature := &tasks.Signature{Task: "tick", Args: []interface{}{"tock"}}
+	require.NoError(t, scheduler.RegisterIntervalTask("tick", time.Hour, signature, machinery.MissedRunCatchUp))
+	require.NoError(t, scheduler.Start())
+	defer scheduler.Stop()
+
+	time.Sleep(200 * time.Millisecond)
+
+	// every run missed since then is published
+	assert.Len(t, runs(), 3)
+
+	lastRun, err := store.LastRun("tick")
+	require.NoError(t, err)
+	assert.True(t, latest.Equal(lastRun), "Unexpected last run: %s", lastRun)
+}
+
+// unreliableStore fails to record the last runs of periodic tasks while
+// failing is set
+type unreliableStore struct {
+	iface.Backend
+	iface.ScheduleStore
+	failing int32
+}
+
+func (store *unreliableStore) SetLastRun(name string, run time.Time) error {
+	if atomic.LoadInt32(&store.failing) == 1 {
+		return errors.New("store unavailable")
+	}
+	return store.ScheduleStore.SetLastRun(name, run)
+}
+
+func TestSchedulerRecordsLastRunBeforeMovingOn(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+	runs, quit := recordRuns(t, server)
+	defer quit()
+
+	store := &unreliableStore{
+		Backend:       server.GetBackend(),
+		ScheduleStore: server.GetBackend().(iface.ScheduleStore),
+		failing:       1,
+	}
+	server.SetBackend(store)
+
+	latest := time.Now().Truncate(time.Hour)
+	require.NoError(t, store.ScheduleStore.SetLastRun("tick", latest.Add(-time.Hour)))
+
+	scheduler := server.NewScheduler()
+	scheduler.RetryInterval = 20 * time.Millisecond
+	signature := &tasks.Signature{Task: "tick", Args: []interface{}{"tock"}}
+	require.NoError(t, scheduler.RegisterIntervalTask("tick", time.Hour, signature, machinery.MissedRunFireOnce))
+	require.NoError(t, scheduler.Start())
+	defer scheduler.Stop()
+
+	require.Eventually(t, func() bool {
+		return len(runs()) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the run is recorded once the store is back, it is not published again
+	atomic.StoreInt32(&store.failing, 0)
+	require.Eventually(t, func() bool {
+		lastRun, err := store.LastRun("tick")
+		return err == nil && latest.Equal(lastRun)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Len(t, runs(), 1)
+}
+
+func TestSchedulerRequiresScheduleStore(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+	// hide the optional interfaces of the eager backend
+	server.SetBackend(struct{ iface.Backend }{server.GetBackend()})
+
+	scheduler := server.NewScheduler()
+	assert.Error(t, scheduler.Start())
+	scheduler.Stop()
+}
+
+func TestCopyRunSignature(t *testing.T) {
+	t.Parallel()
+
+	signature := &tasks.Signature{
+		Id:   "task",
+		Task: "tick",
+		OnSuccess: []*tasks.Signature{
+			{Id: "success", Task: "tick", OnSuccess: []*tasks.Signature{{Id: "nested", Task: "tick"}}},
+		},
+		OnError:       []*tasks.Signature{{Id: "error", Task: "tick"}},
+		ChordCallback: &tasks.Signature{Id: "chord", Task: "tick"},
+	}
+
+	first := machinery.CopyRunSignature(signature)
+	second := machinery.CopyRunSignature(signature)
+
+	ids := make(map[string]bool)
+	for _, run := range []*tasks.Signature{first, second} {
+		for _, id := range []string{
+			run.Id,
+			run.OnSuccess[0].Id,
+			run.OnSuccess[0].OnSuccess[0].Id,
+			run.OnError[0].Id,
+			run.ChordCallback.Id,
+		} {
+			assert.NotEmpty(t, id)
+			assert.False(t, ids[id], "ID reused: %s", id)
+			ids[id] = true
+		}
+	}
+
+	// the registered signature is left untouched
+	assert.Equal(t, "task", signature.Id)
+	assert.Equal(t, "nested", signature.OnSuccess[0].OnSuccess[0].Id)
+	assert.Equal(t, "chord", signature.ChordCallback.Id)
+}
+
+func TestSchedulerStopWithoutStart(t *testing.T) {
+	t.Parallel()
+
+	scheduler := newMemoryServer(t).NewScheduler()
+	scheduler.Stop()
+}
@@ -0,0 +1,32 @@
+package serializer
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// ContentTypeJSON is the content type of JSON encoded messages
+const ContentTypeJSON = "application/json"
+
+// JSON is the default serializer. Numbers are decoded as json.Number so
+// integers do not lose precision.
+var JSON Serializer = jsonSerializer{}
+
+type jsonSerializer struct{}
+
+// ContentType implements Serializer
+func (jsonSerializer) ContentType() string {
+	return ContentTypeJSON
+}
+
+// Marshal implements Serializer
+func (jsonSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+// Unmarshal implements Serializer
+func (jsonSerializer) Unmarshal(data []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	return decoder.Decode(v)
+}
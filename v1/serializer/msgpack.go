@@ -0,0 +1,62 @@
+package serializer
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// ContentTypeMsgpack is the content type of MessagePack encoded messages
+const ContentTypeMsgpack = "application/x-msgpack"
+
+// Msgpack encodes messages with MessagePack, which is more compact than
+// JSON. Integers are decoded as int64 and floats as float64.
+var Msgpack Serializer = msgpackSerializer{}
+
+func init() {
+	// Arguments decoded from JSON messages are json.Number, encode them as
+	// numbers rather than strings when such a task is published again
+	msgpack.Register(json.Number(""), encodeJSONNumber, decodeJSONNumber)
+}
+
+type msgpackSerializer struct{}
+
+// ContentType implements Serializer
+func (msgpackSerializer) ContentType() string {
+	return ContentTypeMsgpack
+}
+
+// Marshal implements Serializer
+func (msgpackSerializer) Marshal(v interface{}) ([]byte, error) {
+	return msgpack.Marshal(v)
+}
+
+// Unmarshal implements Serializer
+func (msgpackSerializer) Unmarshal(data []byte, v interface{}) error {
+	decoder := msgpack.NewDecoder(bytes.NewReader(data))
+	decoder.UseLooseInterfaceDecoding(true)
+	return decoder.Decode(v)
+}
+
+func encodeJSONNumber(e *msgpack.Encoder, v reflect.Value) error {
+	n := json.Number(v.String())
+	if i, err := n.Int64(); err == nil {
+		return e.EncodeInt(i)
+	}
+	if f, err := n.Float64(); err == nil {
+		return e.EncodeFloat64(f)
+	}
+	return e.EncodeString(n.String())
+}
+
+func decodeJSONNumber(d *msgpack.Decoder, v reflect.Value) error {
+	value, err := d.DecodeInterfaceLoose()
+	if err != nil {
+		return err
+	}
+	v.SetString(fmt.Sprint(value))
+	return nil
+}
@@ -0,0 +1,62 @@
+package serializer
+
+import (
+	"bytes"
+	"fmt"
+	"sync"
+)
+
+// Serializer encodes task messages for the broker. The content type is sent
+// along with every message, so consumers can decode messages encoded by any
+// registered serializer.
+type Serializer interface {
+	ContentType() string
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+var (
+	serializers = map[string]Serializer{
+		ContentTypeJSON:    JSON,
+		ContentTypeMsgpack: Msgpack,
+	}
+	serializersMu sync.RWMutex
+)
+
+// Register makes the serializer available under its content type, e.g. to
+// add a protobuf serializer
+func Register(serializer Serializer) {
+	serializersMu.Lock()
+	defer serializersMu.Unlock()
+
+	serializers[serializer.ContentType()] = serializer
+}
+
+// Get returns the serializer registered for the content type, JSON is
+// returned for an empty content type
+func Get(contentType string) (Serializer, error) {
+	if contentType == "" {
+		return JSON, nil
+	}
+
+	serializersMu.RLock()
+	defer serializersMu.RUnlock()
+
+	serializer, ok := serializers[contentType]
+	if !ok {
+		return nil, fmt.Errorf("Unknown serializer content type: %s", contentType)
+	}
+	return serializer, nil
+}
+
+// Detect returns the serializer for a message received without a content
+// type. Such messages are JSON if they look like a JSON object, which is
+// what older producers publish, otherwise they are expected to be encoded by
+// the serializer of the given content type.
+func Detect(data []byte, contentType string) (Serializer, error) {
+	trimmed := bytes.TrimLeft(data, " \t\r\n")
+	if len(trimmed) > 0 && trimmed[0] == '{' {
+		return JSON, nil
+	}
+	return Get(contentType)
+}
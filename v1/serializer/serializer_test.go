@@ -0,0 +1,100 @@
+package serializer_test
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/serializer"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSerializers(t *testing.T) {
+	t.Parallel()
+
+	eta := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	signature := &tasks.Signature{
+		Id:      "task_1",
+		Task:    "add",
+		ETA:     &eta,
+		Args:    []interface{}{"foo", int64(185135722552891243), 1.5},
+		Kwargs:  map[string]interface{}{"bar": true},
+		Timeout: time.Minute,
+		OnError: []*tasks.Signature{{Task: "onError"}},
+	}
+
+	testCases := []struct {
+		serializer serializer.Serializer
+		args       []interface{}
+	}{
+		{
+			serializer: serializer.JSON,
+			args:       []interface{}{"foo", json.Number("185135722552891243"), json.Number("1.5")},
+		},
+		{
+			serializer: serializer.Msgpack,
+			args:       []interface{}{"foo", int64(185135722552891243), 1.5},
+		},
+	}
+
+	for _, tc := range testCases {
+		data, err := tc.serializer.Marshal(signature)
+		require.NoError(t, err)
+
+		decoded := new(tasks.Signature)
+		require.NoError(t, tc.serializer.Unmarshal(data, decoded))
+		assert.Equal(t, tc.args, decoded.Args, tc.serializer.ContentType())
+		assert.Equal(t, signature.Id, decoded.Id)
+		assert.True(t, eta.Equal(*decoded.ETA))
+		assert.Equal(t, true, decoded.Kwargs["bar"])
+		assert.Equal(t, time.Minute, decoded.Timeout)
+		assert.Equal(t, "onError", decoded.OnError[0].Task)
+	}
+}
+
+func TestMsgpackEncodesJSONNumbers(t *testing.T) {
+	t.Parallel()
+
+	// a task decoded from JSON and published again with msgpack
+	data, err := serializer.Msgpack.Marshal(&tasks.Signature{
+		Args: []interface{}{json.Number("1"), json.Number("1.5"), json.Number("1e400")},
+	})
+	require.NoError(t, err)
+
+	decoded := new(tasks.Signature)
+	require.NoError(t, serializer.Msgpack.Unmarshal(data, decoded))
+	assert.Equal(t, []interface{}{int64(1), 1.5, "1e400"}, decoded.Args)
+}
+
+func TestGet(t *testing.T) {
+	t.Parallel()
+
+	s, err := serializer.Get("")
+	require.NoError(t, err)
+	assert.Equal(t, serializer.JSON, s)
+
+	s, err = serializer.Get(serializer.ContentTypeMsgpack)
+	require.NoError(t, err)
+	assert.Equal(t, serializer.Msgpack, s)
+
+	_, err = serializer.Get("application/unknown")
+	assert.EqualError(t, err, "Unknown serializer content type: application/unknown")
+}
+
+func TestDetect(t *testing.T) {
+	t.Parallel()
+
+	data, err := serializer.Msgpack.Marshal(&tasks.Signature{Task: "add"})
+	require.NoError(t, err)
+
+	s, err := serializer.Detect(data, serializer.ContentTypeMsgpack)
+	require.NoError(t, err)
+	assert.Equal(t, serializer.Msgpack, s)
+
+	// older producers publish JSON
+	s, err = serializer.Detect([]byte(` {"Task":"add"}`), serializer.ContentTypeMsgpack)
+	require.NoError(t, err)
+	assert.Equal(t, serializer.JSON, s)
+}
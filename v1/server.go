@@ -9,11 +9,14 @@ import (
 	"github.com/google/uuid"
 	"github.com/pmaccamp/machinery/v1/backends/result"
 	"github.com/pmaccamp/machinery/v1/brokers/eager"
+	"github.com/pmaccamp/machinery/v1/claimcheck"
 	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/encryption"
+	"github.com/pmaccamp/machinery/v1/events"
+	"github.com/pmaccamp/machinery/v1/log"
 	"github.com/pmaccamp/machinery/v1/tasks"
 	"github.com/pmaccamp/machinery/v1/tracing"
 
-	"github.com/opentracing/opentracing-go"
 	backendsiface "github.com/pmaccamp/machinery/v1/backends/iface"
 	brokersiface "github.com/pmaccamp/machinery/v1/brokers/iface"
 )
@@ -23,8 +26,13 @@ import (
 type Server struct {
 	config          *config.Config
 	registeredTasks map[string]interface{}
+	taskOptions     map[string]*TaskOptions
 	broker          brokersiface.Broker
 	backend         backendsiface.Backend
+	tracer          tracing.Tracer
+
+	publishMiddleware []PublishMiddleware
+	eventEmitters     []events.Emitter
 }
 
 // NewServerWithBrokerBackend ...
@@ -32,8 +40,10 @@ func NewServerWithBrokerBackend(cnf *config.Config, brokerServer brokersiface.Br
 	return &Server{
 		config:          cnf,
 		registeredTasks: make(map[string]interface{}),
+		taskOptions:     make(map[string]*TaskOptions),
 		broker:          brokerServer,
 		backend:         backendServer,
+		tracer:          tracing.NewOpenTracingTracer(),
 	}
 }
 
@@ -99,6 +109,17 @@ func (server *Server) SetBackend(backend backendsiface.Backend) {
 	server.backend = backend
 }
 
+// GetTracer returns tracer
+func (server *Server) GetTracer() tracing.Tracer {
+	return server.tracer
+}
+
+// SetTracer sets the tracer tracing the publishing and processing of tasks,
+// the global OpenTracing tracer is used by default
+func (server *Server) SetTracer(tracer tracing.Tracer) {
+	server.tracer = tracer
+}
+
 // GetConfig returns connection object
 func (server *Server) GetConfig() *config.Config {
 	return server.config
@@ -117,16 +138,25 @@ func (server *Server) RegisterTasks(namedTaskFuncs map[string]interface{}) error
 		}
 	}
 	server.registeredTasks = namedTaskFuncs
+	server.taskOptions = make(map[string]*TaskOptions)
 	server.broker.SetRegisteredTaskNames(server.GetRegisteredTaskNames())
 	return nil
 }
 
-// RegisterTask registers a single task
-func (server *Server) RegisterTask(name string, taskFunc interface{}) error {
+// RegisterTask registers a single task, options set defaults used
+// when processing the task, e.g. WithTimeout
+func (server *Server) RegisterTask(name string, taskFunc interface{}, options ...TaskOption) error {
 	if err := tasks.ValidateTask(taskFunc); err != nil {
 		return err
 	}
 	server.registeredTasks[name] = taskFunc
+
+	taskOptions := new(TaskOptions)
+	for _, option := range options {
+		option(taskOptions)
+	}
+	server.taskOptions[name] = taskOptions
+
 	server.broker.SetRegisteredTaskNames(server.GetRegisteredTaskNames())
 	return nil
 }
@@ -146,20 +176,33 @@ func (server *Server) GetRegisteredTask(name string) (interface{}, error) {
 	return taskFunc, nil
 }
 
+// GetRegisteredTaskOptions returns options the task was registered with
+func (server *Server) GetRegisteredTaskOptions(name string) *TaskOptions {
+	if taskOptions, ok := server.taskOptions[name]; ok {
+		return taskOptions
+	}
+	return new(TaskOptions)
+}
+
 // SendTaskWithContext will inject the trace context in the signature headers before publishing it
 func (server *Server) SendTaskWithContext(ctx context.Context, signature *tasks.Signature) (*result.AsyncResult, error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "SendTask", tracing.ProducerOption(), tracing.MachineryTag)
-	defer span.Finish()
+	ctx, span := server.tracer.StartProducerSpan(ctx, "SendTask", "")
+	defer span.End()
 
-	// tag the span with some info about the signature
-	signature.Headers = tracing.HeadersWithSpan(signature.Headers, span)
+	// propagate the span in the signature headers
+	signature.Headers = span.Inject(signature.Headers)
 
 	// Send it on to SendTask as normal
-	return server.SendTask(signature)
+	return server.sendTask(ctx, signature)
 }
 
 // SendTask publishes a task to the default queue
 func (server *Server) SendTask(signature *tasks.Signature) (*result.AsyncResult, error) {
+	return server.sendTask(context.Background(), signature)
+}
+
+// sendTask publishes a task passing the context to the publish middleware
+func (server *Server) sendTask(ctx context.Context, signature *tasks.Signature) (*result.AsyncResult, error) {
 	// Make sure result backend is defined
 	if server.backend == nil {
 		return nil, errors.New("Result backend required")
@@ -176,7 +219,10 @@ func (server *Server) SendTask(signature *tasks.Signature) (*result.AsyncResult,
 		return nil, fmt.Errorf("Set state pending error: %s", err)
 	}
 
-	if err := server.broker.Publish(signature); err != nil {
+	if err := server.publish(ctx, signature); err != nil {
+		if err == ErrTaskSkipped {
+			return nil, err
+		}
 		return nil, fmt.Errorf("Publish message error: %s", err)
 	}
 
@@ -185,17 +231,23 @@ func (server *Server) SendTask(signature *tasks.Signature) (*result.AsyncResult,
 
 // SendChainWithContext will inject the trace context in all the signature headers before publishing it
 func (server *Server) SendChainWithContext(ctx context.Context, chain *tasks.Chain) (*result.ChainAsyncResult, error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "SendChain", tracing.ProducerOption(), tracing.MachineryTag, tracing.WorkflowChainTag)
-	defer span.Finish()
+	ctx, span := server.tracer.StartProducerSpan(ctx, "SendChain", tracing.WorkflowChain)
+	defer span.End()
 
-	tracing.AnnotateSpanWithChainInfo(span, chain)
+	tracing.AnnotateChain(span, chain)
 
-	return server.SendChain(chain)
+	return server.sendChain(ctx, chain)
 }
 
 // SendChain triggers a chain of tasks
 func (server *Server) SendChain(chain *tasks.Chain) (*result.ChainAsyncResult, error) {
-	_, err := server.SendTask(chain.Tasks[0])
+	return server.sendChain(context.Background(), chain)
+}
+
+// sendChain triggers a chain of tasks passing the context to the publish
+// middleware
+func (server *Server) sendChain(ctx context.Context, chain *tasks.Chain) (*result.ChainAsyncResult, error) {
+	_, err := server.sendTask(ctx, chain.Tasks[0])
 	if err != nil {
 		return nil, err
 	}
@@ -205,16 +257,22 @@ func (server *Server) SendChain(chain *tasks.Chain) (*result.ChainAsyncResult, e
 
 // SendGroupWithContext will inject the trace context in all the signature headers before publishing it
 func (server *Server) SendGroupWithContext(ctx context.Context, group *tasks.Group, sendConcurrency int) ([]*result.AsyncResult, error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "SendGroup", tracing.ProducerOption(), tracing.MachineryTag, tracing.WorkflowGroupTag)
-	defer span.Finish()
+	ctx, span := server.tracer.StartProducerSpan(ctx, "SendGroup", tracing.WorkflowGroup)
+	defer span.End()
 
-	tracing.AnnotateSpanWithGroupInfo(span, group, sendConcurrency)
+	tracing.AnnotateGroup(span, group, sendConcurrency)
 
-	return server.SendGroup(group, sendConcurrency)
+	return server.sendGroup(ctx, group, sendConcurrency)
 }
 
 // SendGroup triggers a group of parallel tasks
 func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*result.AsyncResult, error) {
+	return server.sendGroup(context.Background(), group, sendConcurrency)
+}
+
+// sendGroup triggers a group of parallel tasks passing the context to the
+// publish middleware
+func (server *Server) sendGroup(ctx context.Context, group *tasks.Group, sendConcurrency int) ([]*result.AsyncResult, error) {
 	// Make sure result backend is defined
 	if server.backend == nil {
 		return nil, errors.New("Result backend required")
@@ -255,7 +313,7 @@ func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*res
 
 			// Publish task
 
-			err := server.broker.Publish(s)
+			err := server.publish(ctx, s)
 
 			if sendConcurrency > 0 {
 				pool <- struct{}{}
@@ -286,17 +344,23 @@ func (server *Server) SendGroup(group *tasks.Group, sendConcurrency int) ([]*res
 
 // SendChordWithContext will inject the trace context in all the signature headers before publishing it
 func (server *Server) SendChordWithContext(ctx context.Context, chord *tasks.Chord, sendConcurrency int) (*result.ChordAsyncResult, error) {
-	span, _ := opentracing.StartSpanFromContext(ctx, "SendChord", tracing.ProducerOption(), tracing.MachineryTag, tracing.WorkflowChordTag)
-	defer span.Finish()
+	ctx, span := server.tracer.StartProducerSpan(ctx, "SendChord", tracing.WorkflowChord)
+	defer span.End()
 
-	tracing.AnnotateSpanWithChordInfo(span, chord, sendConcurrency)
+	tracing.AnnotateChord(span, chord, sendConcurrency)
 
-	return server.SendChord(chord, sendConcurrency)
+	return server.sendChord(ctx, chord, sendConcurrency)
 }
 
 // SendChord triggers a group of parallel tasks with a callback
 func (server *Server) SendChord(chord *tasks.Chord, sendConcurrency int) (*result.ChordAsyncResult, error) {
-	_, err := server.SendGroup(chord.Group, sendConcurrency)
+	return server.sendChord(context.Background(), chord, sendConcurrency)
+}
+
+// sendChord triggers a group of parallel tasks with a callback passing the
+// context to the publish middleware
+func (server *Server) sendChord(ctx context.Context, chord *tasks.Chord, sendConcurrency int) (*result.ChordAsyncResult, error) {
+	_, err := server.sendGroup(ctx, chord.Group, sendConcurrency)
 	if err != nil {
 		return nil, err
 	}
@@ -308,6 +372,205 @@ func (server *Server) SendChord(chord *tasks.Chord, sendConcurrency int) (*resul
 	), nil
 }
 
+// RevokeTask marks the task as revoked. Workers skip revoked tasks they
+// receive and cancel the context of revoked tasks which are already running
+// and accept a context.Context, other running tasks run to completion.
+func (server *Server) RevokeTask(taskUUID string) error {
+	// Make sure result backend is defined
+	if server.backend == nil {
+		return errors.New("Result backend required")
+	}
+
+	// The AMQP backend only lets a task state to be read once
+	if server.backend.IsAMQP() {
+		return errors.New("Revoking tasks is not supported by the AMQP result backend")
+	}
+
+	// Do not overwrite the result of a task which has already finished,
+	// revoking a task twice does nothing
+	if taskState, err := server.backend.GetState(taskUUID); err == nil && taskState.IsCompleted() {
+		if taskState.IsRevoked() {
+			return nil
+		}
+		return fmt.Errorf("Task %s has already completed with state %s", taskUUID, taskState.State)
+	}
+
+	if err := server.backend.SetStateRevoked(&tasks.Signature{Id: taskUUID}); err != nil {
+		return fmt.Errorf("Set state to 'revoked' for task %s returned error: %s", taskUUID, err)
+	}
+
+	return nil
+}
+
+// GetDeadLetters returns up to limit tasks from the dead letter queue, or
+// all of them if limit is not positive
+func (server *Server) GetDeadLetters(limit int) ([]*tasks.DeadLetter, error) {
+	broker, err := server.deadLetterBroker()
+	if err != nil {
+		return nil, err
+	}
+	return broker.GetDeadLetters(limit)
+}
+
+// GetDeadLetter returns the task from the dead letter queue
+func (server *Server) GetDeadLetter(taskUUID string) (*tasks.DeadLetter, error) {
+	broker, err := server.deadLetterBroker()
+	if err != nil {
+		return nil, err
+	}
+	return broker.GetDeadLetter(taskUUID)
+}
+
+// DeleteDeadLetter removes the task from the dead letter queue
+func (server *Server) DeleteDeadLetter(taskUUID string) error {
+	broker, err := server.deadLetterBroker()
+	if err != nil {
+		return err
+	}
+	return broker.DeleteDeadLetter(taskUUID)
+}
+
+// ReplayDeadLetter removes the task from the dead letter queue and publishes
+// it again under the same ID. Retry policies start over, the retry count is
+// what was left when it failed. The task is removed first so that it cannot
+// run twice; if publishing fails it is put back on the dead letter queue. The
+// header recording when the task was first published is dropped.
+func (server *Server) ReplayDeadLetter(taskUUID string) (*result.AsyncResult, error) {
+	broker, err := server.deadLetterBroker()
+	if err != nil {
+		return nil, err
+	}
+
+	deadLetter, err := broker.GetDeadLetter(taskUUID)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := broker.DeleteDeadLetter(taskUUID); err != nil {
+		return nil, fmt.Errorf("Remove task %s from dead letter queue returned error: %s", taskUUID, err)
+	}
+
+	signature := tasks.CopySignature(deadLetter.Signature)
+	signature.RetryAttempts = 0
+	signature.FirstFailureTime = nil
+	signature.ErrorClass = ""
+	// the replayed task is published anew, it does not wait in the queue since
+	// it was first published
+	delete(signature.Headers, tasks.PublishedAtHeader)
+
+	asyncResult, err := server.SendTask(signature)
+	if err != nil {
+		if restoreErr := broker.PublishDeadLetter(deadLetter); restoreErr != nil {
+			log.ERROR.Printf("Put task %s back on dead letter queue returned error: %s", taskUUID, restoreErr)
+		}
+		return nil, err
+	}
+
+	return asyncResult, nil
+}
+
+// UsePublishMiddleware appends middleware wrapping the publishing of tasks,
+// including callbacks published by workers, middleware runs in the order it
+// is added. It has to be added before tasks are sent.
+func (server *Server) UsePublishMiddleware(middleware ...PublishMiddleware) {
+	server.publishMiddleware = append(server.publishMiddleware, middleware...)
+}
+
+// AddEventEmitter adds an emitter the events of tasks published by the server
+// and processed by its workers are emitted to. It has to be added before tasks
+// are sent.
+func (server *Server) AddEventEmitter(emitter events.Emitter) {
+	server.eventEmitters = append(server.eventEmitters, emitter)
+}
+
+// emitEvent emits the event to all emitters, errors are only logged as
+// events are not essential to processing tasks
+func (server *Server) emitEvent(event *events.Event) {
+	for _, emitter := range server.eventEmitters {
+		if err := emitter.Emit(event); err != nil {
+			log.WARNING.Printf("Emit %s event for task %s returned error: %s", event.Type, event.TaskUUID, err)
+		}
+	}
+}
+
+// publish sends the signature to the broker through the publish middleware.
+// The state of tasks vetoed by middleware, including tasks middleware skips
+// without an error, is set to FAILURE as they will never run.
+func (server *Server) publish(ctx context.Context, signature *tasks.Signature) error {
+	vetoed := true
+	publishTask := func(ctx context.Context, signature *tasks.Signature) error {
+		vetoed = false
+		if err := server.publishToBroker(signature); err != nil {
+			return err
+		}
+
+		server.emitEvent(events.NewEvent(events.TaskSent, signature, ""))
+		return nil
+	}
+
+	err := chainPublishMiddleware(publishTask, server.publishMiddleware)(ctx, signature)
+	if err == nil && vetoed {
+		err = ErrTaskSkipped
+	}
+	if err != nil && vetoed {
+		if stateErr := server.backend.SetStateFailure(signature, err.Error()); stateErr != nil {
+			log.ERROR.Printf("Set state to 'failure' for task %s returned error: %s", signature.Id, stateErr)
+		}
+	}
+	return err
+}
+
+// publishToBroker sends the signature to the broker. Arguments are encrypted
+// first if encryption is configured for the task, arguments too large to be
+// sent through the broker are then offloaded to the claim check store.
+func (server *Server) publishToBroker(signature *tasks.Signature) error {
+	if keyID := server.config.Encryption.KeyIDFor(signature.Task); keyID != "" {
+		var err error
+		signature, err = encryption.EncryptArgs(server.config.Encryption.Keys, keyID, signature)
+		if err != nil {
+			return err
+		}
+	}
+
+	store, threshold := server.claimCheck()
+	signature, err := claimcheck.OffloadArgs(store, threshold, signature)
+	if err != nil {
+		return err
+	}
+	return server.broker.Publish(signature)
+}
+
+// encryptionKeys returns the keys used to decrypt arguments and results
+func (server *Server) encryptionKeys() map[string][]byte {
+	if server.config.Encryption == nil {
+		return nil
+	}
+	return server.config.Encryption.Keys
+}
+
+// claimCheck returns the claim check store and threshold, the store is nil
+// unless claim checks are configured
+func (server *Server) claimCheck() (claimcheck.Store, int) {
+	if server.config.ClaimCheck == nil {
+		return nil, 0
+	}
+	return server.config.ClaimCheck.Store, server.config.ClaimCheck.Threshold
+}
+
+// deadLetterBroker returns the broker if it supports dead letter queues
+// and one is configured
+func (server *Server) deadLetterBroker() (brokersiface.DeadLetterBroker, error) {
+	if server.config.DeadLetterQueue == "" {
+		return nil, errors.New("Dead letter queue not configured")
+	}
+
+	broker, ok := server.broker.(brokersiface.DeadLetterBroker)
+	if !ok {
+		return nil, errors.New("Dead letter queues are not supported by the broker")
+	}
+	return broker, nil
+}
+
 // GetRegisteredTaskNames returns slice of registered task names
 func (server *Server) GetRegisteredTaskNames() []string {
 	taskNames := make([]string, len(server.registeredTasks))
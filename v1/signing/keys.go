@@ -0,0 +1,68 @@
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/hmac"
+	"crypto/sha256"
+	"errors"
+)
+
+// Key signs task messages and verifies their signatures
+type Key interface {
+	Sign(data []byte) ([]byte, error)
+	Verify(data, signature []byte) bool
+}
+
+// HMACKey signs messages with HMAC-SHA256, producers and workers share the
+// secret
+func HMACKey(secret []byte) Key {
+	return hmacKey(secret)
+}
+
+// Ed25519Key signs messages with the ed25519 private key, workers only
+// need the public key, see Ed25519PublicKey
+func Ed25519Key(privateKey ed25519.PrivateKey) Key {
+	return ed25519Key{
+		privateKey: privateKey,
+		publicKey:  privateKey.Public().(ed25519.PublicKey),
+	}
+}
+
+// Ed25519PublicKey verifies messages signed with the matching ed25519
+// private key, it cannot sign messages
+func Ed25519PublicKey(publicKey ed25519.PublicKey) Key {
+	return ed25519Key{publicKey: publicKey}
+}
+
+type hmacKey []byte
+
+// Sign implements Key
+func (k hmacKey) Sign(data []byte) ([]byte, error) {
+	mac := hmac.New(sha256.New, k)
+	mac.Write(data)
+	return mac.Sum(nil), nil
+}
+
+// Verify implements Key
+func (k hmacKey) Verify(data, signature []byte) bool {
+	expected, _ := k.Sign(data)
+	return hmac.Equal(expected, signature)
+}
+
+type ed25519Key struct {
+	privateKey ed25519.PrivateKey
+	publicKey  ed25519.PublicKey
+}
+
+// Sign implements Key
+func (k ed25519Key) Sign(data []byte) ([]byte, error) {
+	if k.privateKey == nil {
+		return nil, errors.New("Ed25519 public keys cannot sign messages")
+	}
+	return ed25519.Sign(k.privateKey, data), nil
+}
+
+// Verify implements Key
+func (k ed25519Key) Verify(data, signature []byte) bool {
+	return ed25519.Verify(k.publicKey, data, signature)
+}
@@ -0,0 +1,143 @@
+package signing
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/serializer"
+	"github.com/pmaccamp/machinery/v1/tasks"
+)
+
+const (
+	// KeyIDHeader is the signature header naming the key the task was
+	// signed with, which allows rotating keys
+	KeyIDHeader = "machinery_signing_key_id"
+	// SignatureHeader is the signature header holding the base64 encoded
+	// signature of the task
+	SignatureHeader = "machinery_signature"
+)
+
+// Sign returns a copy of the signature carrying the key ID and the signature
+// of the task in its headers. The task is signed the way it will be decoded
+// by workers, so it is encoded with the serializer it is going to be
+// published with first.
+func Sign(s serializer.Serializer, keyID string, key Key, signature *tasks.Signature) (*tasks.Signature, error) {
+	signed := tasks.CopySignature(signature)
+	if signed.Headers == nil {
+		signed.Headers = make(tasks.Headers)
+	}
+	delete(signed.Headers, SignatureHeader)
+	signed.Headers[KeyIDHeader] = keyID
+
+	msg, err := s.Marshal(signed)
+	if err != nil {
+		return nil, err
+	}
+	decoded := new(tasks.Signature)
+	if err := s.Unmarshal(msg, decoded); err != nil {
+		return nil, err
+	}
+
+	data, err := canonicalize(decoded)
+	if err != nil {
+		return nil, err
+	}
+	sig, err := key.Sign(data)
+	if err != nil {
+		return nil, err
+	}
+
+	signed.Headers[SignatureHeader] = base64.StdEncoding.EncodeToString(sig)
+	return signed, nil
+}
+
+// Verify checks the task has been signed with one of the keys
+func Verify(keys map[string]Key, signature *tasks.Signature) error {
+	keyID, _ := signature.Headers[KeyIDHeader].(string)
+	encoded, _ := signature.Headers[SignatureHeader].(string)
+	if keyID == "" || encoded == "" {
+		return fmt.Errorf("Task %s is not signed", signature.Id)
+	}
+
+	key, ok := keys[keyID]
+	if !ok {
+		return fmt.Errorf("Task %s is signed with unknown key %s", signature.Id, keyID)
+	}
+
+	sig, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("Task %s has a malformed signature: %s", signature.Id, err)
+	}
+
+	data, err := canonicalize(signature)
+	if err != nil {
+		return err
+	}
+	if !key.Verify(data, sig) {
+		return fmt.Errorf("Task %s has an invalid signature", signature.Id)
+	}
+	return nil
+}
+
+// canonicalize encodes the task without its signature header as JSON with
+// the keys of all objects sorted and times in UTC, so it depends neither on
+// the serializer nor on the order of struct fields nor on the time zone
+func canonicalize(signature *tasks.Signature) ([]byte, error) {
+	unsigned := tasks.CopySignature(signature)
+	delete(unsigned.Headers, SignatureHeader)
+	unsigned.ReceivedTime = utcTime(unsigned.ReceivedTime)
+	unsigned.StartTime = utcTime(unsigned.StartTime)
+	unsigned.FinishTime = utcTime(unsigned.FinishTime)
+	unsigned.ETA = utcTime(unsigned.ETA)
+	unsigned.Expires = utcTime(unsigned.Expires)
+	unsigned.FirstFailureTime = utcTime(unsigned.FirstFailureTime)
+	for i, arg := range unsigned.Args {
+		unsigned.Args[i] = utcValue(arg)
+	}
+	for k, v := range unsigned.Kwargs {
+		unsigned.Kwargs[k] = utcValue(v)
+	}
+
+	data, err := serializer.JSON.Marshal(unsigned)
+	if err != nil {
+		return nil, fmt.Errorf("Canonicalize task %s error: %s", signature.Id, err)
+	}
+
+	var generic interface{}
+	if err := serializer.JSON.Unmarshal(data, &generic); err != nil {
+		return nil, fmt.Errorf("Canonicalize task %s error: %s", signature.Id, err)
+	}
+	return json.Marshal(generic)
+}
+
+func utcTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	utc := t.UTC()
+	return &utc
+}
+
+// utcValue converts times decoded into interface{} values, e.g. by msgpack,
+// to UTC
+func utcValue(value interface{}) interface{} {
+	switch v := value.(type) {
+	case time.Time:
+		return v.UTC()
+	case []interface{}:
+		converted := make([]interface{}, len(v))
+		for i, item := range v {
+			converted[i] = utcValue(item)
+		}
+		return converted
+	case map[string]interface{}:
+		converted := make(map[string]interface{}, len(v))
+		for k, item := range v {
+			converted[k] = utcValue(item)
+		}
+		return converted
+	}
+	return value
+}
@@ -0,0 +1,98 @@
+package signing_test
+
+import (
+	"crypto/ed25519"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/serializer"
+	"github.com/pmaccamp/machinery/v1/signing"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type point struct {
+	Y int
+	X int
+}
+
+func newSignature() *tasks.Signature {
+	eta := time.Date(2020, 1, 2, 3, 4, 5, 0, time.FixedZone("CET", 3600))
+	return &tasks.Signature{
+		Id:      "task_1",
+		Task:    "add",
+		ETA:     &eta,
+		Args:    []interface{}{1, 1.5, "foo", point{X: 1, Y: 2}, eta},
+		Kwargs:  map[string]interface{}{"bar": []int{1, 2}},
+		Headers: tasks.Headers{"trace": "abc"},
+	}
+}
+
+func TestSignAndVerify(t *testing.T) {
+	t.Parallel()
+
+	privateKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	keys := map[string]signing.Key{
+		"hmac":    signing.HMACKey([]byte("secret")),
+		"ed25519": signing.Ed25519PublicKey(privateKey.Public().(ed25519.PublicKey)),
+	}
+
+	testCases := []struct {
+		keyID string
+		key   signing.Key
+	}{
+		{keyID: "hmac", key: keys["hmac"]},
+		{keyID: "ed25519", key: signing.Ed25519Key(privateKey)},
+	}
+
+	for _, tc := range testCases {
+		for _, s := range []serializer.Serializer{serializer.JSON, serializer.Msgpack} {
+			signature := newSignature()
+			signed, err := signing.Sign(s, tc.keyID, tc.key, signature)
+			require.NoError(t, err)
+			assert.Equal(t, tc.keyID, signed.Headers[signing.KeyIDHeader])
+			assert.NotContains(t, signature.Headers, signing.SignatureHeader, "the original signature is left untouched")
+
+			// workers verify the task the way they decode it
+			msg, err := s.Marshal(signed)
+			require.NoError(t, err)
+			received := new(tasks.Signature)
+			require.NoError(t, s.Unmarshal(msg, received))
+			assert.NoError(t, signing.Verify(keys, received), "%s %s", tc.keyID, s.ContentType())
+
+			received.Args[2] = "bar"
+			assert.EqualError(t, signing.Verify(keys, received), "Task task_1 has an invalid signature")
+		}
+	}
+}
+
+func TestVerifyRejects(t *testing.T) {
+	t.Parallel()
+
+	keys := map[string]signing.Key{"new": signing.HMACKey([]byte("new secret"))}
+
+	err := signing.Verify(keys, newSignature())
+	assert.EqualError(t, err, "Task task_1 is not signed")
+
+	signed, err := signing.Sign(serializer.JSON, "old", signing.HMACKey([]byte("old secret")), newSignature())
+	require.NoError(t, err)
+	err = signing.Verify(keys, signed)
+	assert.EqualError(t, err, "Task task_1 is signed with unknown key old")
+
+	// a forged signature claiming a trusted key
+	forged, err := signing.Sign(serializer.JSON, "new", signing.HMACKey([]byte("guessed secret")), newSignature())
+	require.NoError(t, err)
+	err = signing.Verify(keys, forged)
+	assert.EqualError(t, err, "Task task_1 has an invalid signature")
+}
+
+func TestEd25519PublicKeyCannotSign(t *testing.T) {
+	t.Parallel()
+
+	privateKey := ed25519.NewKeyFromSeed(make([]byte, ed25519.SeedSize))
+	key := signing.Ed25519PublicKey(privateKey.Public().(ed25519.PublicKey))
+
+	_, err := signing.Sign(serializer.JSON, "ed25519", key, newSignature())
+	assert.EqualError(t, err, "Ed25519 public keys cannot sign messages")
+}
@@ -0,0 +1,33 @@
+package machinery
+
+import (
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/retry"
+)
+
+// TaskOptions holds defaults applied when processing a registered task
+type TaskOptions struct {
+	// Timeout is used for signatures which do not set their own timeout
+	Timeout time.Duration
+	// RetryPolicy is used for signatures which do not set their own retry
+	// policy, the Fibonacci sequence in seconds is used if both are nil
+	RetryPolicy retry.RetryPolicy
+}
+
+// TaskOption configures a registered task
+type TaskOption func(*TaskOptions)
+
+// WithTimeout sets the default timeout of the task
+func WithTimeout(timeout time.Duration) TaskOption {
+	return func(options *TaskOptions) {
+		options.Timeout = timeout
+	}
+}
+
+// WithRetryPolicy sets the default retry policy of the task
+func WithRetryPolicy(policy retry.RetryPolicy) TaskOption {
+	return func(options *TaskOptions) {
+		options.RetryPolicy = policy
+	}
+}
@@ -0,0 +1,36 @@
+package tasks
+
+import (
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/stackframe"
+)
+
+// DeadLetter is a task which failed for good, kept so it can be inspected
+// and replayed later. Dead letters are identified by the task UUID.
+type DeadLetter struct {
+	Signature   *Signature
+	Error       string
+	ErrorClass  string
+	StackFrames []stackframe.StackFrame
+	FailedAt    time.Time
+}
+
+// NewDeadLetter creates DeadLetter instance holding a copy of the signature
+func NewDeadLetter(signature *Signature, err error, stackFrames []stackframe.StackFrame) *DeadLetter {
+	return &DeadLetter{
+		Signature:   CopySignature(signature),
+		Error:       err.Error(),
+		ErrorClass:  ErrorClass(err),
+		StackFrames: stackFrames,
+		FailedAt:    time.Now().UTC(),
+	}
+}
+
+// ID returns the UUID of the dead-lettered task
+func (deadLetter *DeadLetter) ID() string {
+	if deadLetter.Signature == nil {
+		return ""
+	}
+	return deadLetter.Signature.Id
+}
@@ -1,10 +1,17 @@
 package tasks
 
 import (
+	"errors"
 	"fmt"
 	"time"
+
+	"github.com/pmaccamp/machinery/v1/retry"
 )
 
+// ErrTaskRevoked is returned by result backends refusing to replace the
+// state of a revoked task, revoked tasks keep their state until it expires
+var ErrTaskRevoked = errors.New("Task revoked")
+
 // ErrRetryTaskLater ...
 type ErrRetryTaskLater struct {
 	name, msg string
@@ -30,3 +37,102 @@ func NewErrRetryTaskLater(msg string, retryIn time.Duration) ErrRetryTaskLater {
 type Retriable interface {
 	RetryIn() time.Duration
 }
+
+// ErrRetryWithPolicy ...
+type ErrRetryWithPolicy struct {
+	msg    string
+	policy retry.RetryPolicy
+}
+
+// RetryPolicy returns the policy used to retry the task
+func (e ErrRetryWithPolicy) RetryPolicy() retry.RetryPolicy {
+	return e.policy
+}
+
+// Error implements the error interface
+func (e ErrRetryWithPolicy) Error() string {
+	return fmt.Sprintf("Task error: %s", e.msg)
+}
+
+// NewErrRetryWithPolicy returns new ErrRetryWithPolicy instance
+func NewErrRetryWithPolicy(msg string, policy retry.RetryPolicy) ErrRetryWithPolicy {
+	return ErrRetryWithPolicy{msg: msg, policy: policy}
+}
+
+// RetriableWithPolicy is interface that errors choosing how the task
+// is retried should implement
+type RetriableWithPolicy interface {
+	RetryPolicy() retry.RetryPolicy
+}
+
+// ErrTaskTimeout is returned when the task runs longer than its timeout
+type ErrTaskTimeout struct {
+	timeout time.Duration
+}
+
+// Timeout returns the timeout the task exceeded
+func (e ErrTaskTimeout) Timeout() time.Duration {
+	return e.timeout
+}
+
+// Error implements the error interface
+func (e ErrTaskTimeout) Error() string {
+	return fmt.Sprintf("Task timed out after %s", e.timeout)
+}
+
+// NewErrTaskTimeout returns new ErrTaskTimeout instance
+func NewErrTaskTimeout(timeout time.Duration) ErrTaskTimeout {
+	return ErrTaskTimeout{timeout: timeout}
+}
+
+// ErrNonRetriable wraps errors which retrying the task cannot fix
+type ErrNonRetriable struct {
+	err error
+}
+
+// Permanent marks the error as permanent
+func (e ErrNonRetriable) Permanent() bool {
+	return true
+}
+
+// Unwrap returns the wrapped error
+func (e ErrNonRetriable) Unwrap() error {
+	return e.err
+}
+
+// Error implements the error interface
+func (e ErrNonRetriable) Error() string {
+	return e.err.Error()
+}
+
+// NewErrNonRetriable returns new ErrNonRetriable instance
+func NewErrNonRetriable(err error) ErrNonRetriable {
+	return ErrNonRetriable{err: err}
+}
+
+// Permanent is interface that errors which retrying the task cannot fix
+// should implement, tasks failing with such errors are never retried
+type Permanent interface {
+	Permanent() bool
+}
+
+// IsPermanent returns true if the error, or any error it wraps,
+// is marked as permanent
+func IsPermanent(err error) bool {
+	var permanent Permanent
+	return errors.As(err, &permanent) && permanent.Permanent()
+}
+
+// ErrorClass returns the class of the error recorded in the task state
+func ErrorClass(err error) string {
+	if IsPermanent(err) {
+		return ErrorClassPermanent
+	}
+
+	var timeoutErr ErrTaskTimeout
+	if errors.As(err, &timeoutErr) {
+		return ErrorClassTimeout
+	}
+
+	return ErrorClassTransient
+}
@@ -0,0 +1,29 @@
+package tasks_test
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestErrorClass(t *testing.T) {
+	t.Parallel()
+
+	err := errors.New("invalid input")
+	permanentErr := tasks.NewErrNonRetriable(err)
+
+	assert.Equal(t, "invalid input", permanentErr.Error())
+	assert.True(t, errors.Is(permanentErr, err))
+
+	assert.False(t, tasks.IsPermanent(err))
+	assert.True(t, tasks.IsPermanent(permanentErr))
+	assert.True(t, tasks.IsPermanent(fmt.Errorf("wrapped: %w", permanentErr)))
+
+	assert.Equal(t, tasks.ErrorClassTransient, tasks.ErrorClass(err))
+	assert.Equal(t, tasks.ErrorClassPermanent, tasks.ErrorClass(permanentErr))
+	assert.Equal(t, tasks.ErrorClassTimeout, tasks.ErrorClass(tasks.NewErrTaskTimeout(time.Second)))
+}
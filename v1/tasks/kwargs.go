@@ -0,0 +1,120 @@
+package tasks
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+// KwargTag is the struct tag naming the keyword argument a field is
+// populated from, it takes precedence over the json tag and the field name
+const KwargTag = "kwarg"
+
+var timeType = reflect.TypeOf(time.Time{})
+
+// kwargField is a struct field populated from a keyword argument
+type kwargField struct {
+	index    int
+	optional bool
+}
+
+// IsKwargsType checks whether a task parameter of the type can be populated
+// from keyword arguments, i.e. it is a struct or a pointer to a struct
+func IsKwargsType(t reflect.Type) bool {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	return t.Kind() == reflect.Struct && t != timeType
+}
+
+// ReflectKwargs populates a struct, or a pointer to a struct, of the type
+// from keyword arguments. Fields are matched by the kwarg tag, the json tag
+// or the field name. Fields which are pointers or tagged omitempty are
+// optional, keyword arguments not matching any field are rejected.
+func ReflectKwargs(kwargs map[string]interface{}, theType reflect.Type) (reflect.Value, error) {
+	if !IsKwargsType(theType) {
+		return reflect.Value{}, fmt.Errorf("%v cannot be populated from keyword arguments", theType)
+	}
+
+	structType := theType
+	if theType.Kind() == reflect.Ptr {
+		structType = theType.Elem()
+	}
+	fields := kwargFields(structType)
+
+	var unknown []string
+	for name := range kwargs {
+		if _, ok := fields[name]; !ok {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		sort.Strings(unknown)
+		return reflect.Value{}, fmt.Errorf("Unknown keyword arguments: %s", strings.Join(unknown, ", "))
+	}
+
+	structValue := reflect.New(structType).Elem()
+
+	var missing []string
+	for name, field := range fields {
+		value, ok := kwargs[name]
+		if !ok {
+			if !field.optional {
+				missing = append(missing, name)
+			}
+			continue
+		}
+
+		fieldValue, err := ReflectArg(value, structType.Field(field.index).Type)
+		if err != nil {
+			return reflect.Value{}, fmt.Errorf("Keyword argument %s: %s", name, err)
+		}
+		structValue.Field(field.index).Set(fieldValue)
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		return reflect.Value{}, fmt.Errorf("Missing keyword arguments: %s", strings.Join(missing, ", "))
+	}
+
+	if theType.Kind() == reflect.Ptr {
+		return structValue.Addr(), nil
+	}
+	return structValue, nil
+}
+
+// kwargFields returns the exported fields of the struct by keyword argument name
+func kwargFields(structType reflect.Type) map[string]kwargField {
+	fields := make(map[string]kwargField, structType.NumField())
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		if field.PkgPath != "" {
+			// unexported
+			continue
+		}
+
+		name, options := field.Name, ""
+		for _, tagName := range []string{KwargTag, "json"} {
+			if tag, ok := field.Tag.Lookup(tagName); ok {
+				tagValue := strings.SplitN(tag, ",", 2)
+				if tagValue[0] != "" {
+					name = tagValue[0]
+				}
+				if len(tagValue) > 1 {
+					options = tagValue[1]
+				}
+				break
+			}
+		}
+		if name == "-" {
+			continue
+		}
+
+		fields[name] = kwargField{
+			index:    i,
+			optional: field.Type.Kind() == reflect.Ptr || strings.Contains(options, "omitempty"),
+		}
+	}
+	return fields
+}
@@ -0,0 +1,84 @@
+package tasks_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type greetOptions struct {
+	Name     string  `kwarg:"name"`
+	Times    int     `json:"times"`
+	Greeting *string `json:"greeting"`
+	Suffix   string  `json:"suffix,omitempty"`
+	Ignored  string  `json:"-"`
+	internal string
+}
+
+func greet(ctx context.Context, prefix string, options greetOptions) (string, error) {
+	greeting := "hello"
+	if options.Greeting != nil {
+		greeting = *options.Greeting
+	}
+	return prefix + greeting + " " + options.Name + options.Suffix, nil
+}
+
+func TestReflectKwargs(t *testing.T) {
+	t.Parallel()
+
+	signature := &tasks.Signature{
+		Args: []interface{}{"> "},
+		Kwargs: map[string]interface{}{
+			"name":   "foo",
+			"times":  json.Number("2"),
+			"suffix": "!",
+		},
+	}
+	task, err := tasks.New(nil, signature, greet, signature.Args)
+	require.NoError(t, err)
+	require.Len(t, task.Args, 2)
+	assert.Equal(t, greetOptions{Name: "foo", Times: 2, Suffix: "!"}, task.Args[1].Interface())
+
+	results, err, _ := task.Call()
+	require.NoError(t, err)
+	assert.Equal(t, "> hello foo!", results[0].Value)
+
+	// pointers to structs are populated as well
+	task, err = tasks.New(nil, signature, func(options *greetOptions) (string, error) {
+		return options.Name, nil
+	}, nil)
+	require.NoError(t, err)
+	assert.Equal(t, &greetOptions{Name: "foo", Times: 2, Suffix: "!"}, task.Args[0].Interface())
+}
+
+func TestReflectKwargsValidation(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		kwargs map[string]interface{}
+		err    string
+	}{
+		{
+			kwargs: map[string]interface{}{"name": "foo", "times": 1, "Ignored": "", "internal": ""},
+			err:    "Reflect task args error: Unknown keyword arguments: Ignored, internal",
+		},
+		{
+			kwargs: map[string]interface{}{},
+			err:    "Reflect task args error: Missing keyword arguments: name, times",
+		},
+		{
+			kwargs: map[string]interface{}{"name": "foo", "times": "two"},
+			err:    "Reflect task args error: Keyword argument times: two is not int: json: cannot unmarshal string into Go value of type int",
+		},
+	}
+
+	for _, tc := range testCases {
+		signature := &tasks.Signature{Args: []interface{}{""}, Kwargs: tc.kwargs}
+		_, err := tasks.New(nil, signature, greet, signature.Args)
+		assert.EqualError(t, err, tc.err)
+	}
+}
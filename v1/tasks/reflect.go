@@ -1,11 +1,14 @@
 package tasks
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"reflect"
 	"strings"
+	"sync"
+	"time"
 )
 
 var (
@@ -40,8 +43,24 @@ var (
 		"[]float32": reflect.TypeOf(make([]float32, 0)),
 		"[]float64": reflect.TypeOf(make([]float64, 0)),
 		"[]string":  reflect.TypeOf([]string{""}),
+		// other types decoded from their JSON representation
+		"time.Time":                 reflect.TypeOf(time.Time{}),
+		"*time.Time":                reflect.TypeOf(&time.Time{}),
+		"[]interface {}":            reflect.TypeOf(make([]interface{}, 0)),
+		"map[string]interface {}":   reflect.TypeOf(make(map[string]interface{})),
+		"map[string]string":         reflect.TypeOf(make(map[string]string)),
+		"map[string]bool":           reflect.TypeOf(make(map[string]bool)),
+		"map[string]int":            reflect.TypeOf(make(map[string]int)),
+		"map[string]int64":          reflect.TypeOf(make(map[string]int64)),
+		"map[string]float64":        reflect.TypeOf(make(map[string]float64)),
+		"map[string][]string":       reflect.TypeOf(make(map[string][]string)),
+		"map[string][]interface {}": reflect.TypeOf(make(map[string][]interface{})),
 	}
 
+	// registeredTypes holds types registered with RegisterType
+	registeredTypes   = make(map[string]reflect.Type)
+	registeredTypesMu sync.RWMutex
+
 	ctxType = reflect.TypeOf((*context.Context)(nil)).Elem()
 
 	typeConversionError = func(argValue interface{}, argTypeStr string) error {
@@ -64,13 +83,103 @@ func (e ErrUnsupportedType) Error() string {
 	return fmt.Sprintf("%v is not one of supported types", e.valueType)
 }
 
+// RegisterType registers the types of the values, e.g. structs returned by
+// tasks, so ReflectValue can convert task results back to them. Pointers to
+// and slices of the types are registered as well.
+func RegisterType(values ...interface{}) {
+	registeredTypesMu.Lock()
+	defer registeredTypesMu.Unlock()
+
+	for _, value := range values {
+		theType := reflect.TypeOf(value)
+		for _, t := range []reflect.Type{theType, reflect.PtrTo(theType), reflect.SliceOf(theType)} {
+			registeredTypes[t.String()] = t
+		}
+	}
+}
+
+// lookupType returns the type named by the string
+func lookupType(valueType string) (reflect.Type, bool) {
+	if theType, ok := typesMap[valueType]; ok {
+		return theType, true
+	}
+
+	registeredTypesMu.RLock()
+	defer registeredTypesMu.RUnlock()
+
+	theType, ok := registeredTypes[valueType]
+	return theType, ok
+}
+
 // ReflectValue converts interface{} to reflect.Value based on string type
 func ReflectValue(valueType string, value interface{}) (reflect.Value, error) {
-	if strings.HasPrefix(valueType, "[]") {
+	theType, ok := lookupType(valueType)
+	if !ok {
+		return reflect.Value{}, NewErrUnsupportedType(valueType)
+	}
+
+	// Byte slices are encoded as base64 strings in JSON
+	_, isString := value.(string)
+	if theType.Kind() == reflect.Slice && isBasicType(theType.Elem()) && !isString {
 		return reflectValues(valueType, value)
 	}
+	if isBasicType(theType) {
+		return reflectValue(valueType, value)
+	}
+
+	return convertValue(value, theType)
+}
+
+// ReflectArg converts a message argument to the type of the task function
+// parameter. Values which are not of the type already, e.g. structs, maps
+// or time.Time decoded from a message, are converted from their JSON
+// representation.
+func ReflectArg(value interface{}, theType reflect.Type) (reflect.Value, error) {
+	// special case - convert float64 to int if applicable
+	// this is due to json limitation where all numbers are converted to float64
+	if f, ok := value.(float64); ok && theType.Kind() == reflect.Int {
+		return reflect.ValueOf(int(f)).Convert(theType), nil
+	}
+
+	return convertValue(value, theType)
+}
+
+// convertValue converts the value to the type, going through its JSON
+// representation unless the value is already assignable to the type
+func convertValue(value interface{}, theType reflect.Type) (reflect.Value, error) {
+	if value == nil {
+		return reflect.Zero(theType), nil
+	}
+
+	if reflect.TypeOf(value).AssignableTo(theType) {
+		return reflect.ValueOf(value), nil
+	}
 
-	return reflectValue(valueType, value)
+	data, err := json.Marshal(value)
+	if err != nil {
+		return reflect.Value{}, fmt.Errorf("%v is not %v: %s", value, theType, err)
+	}
+
+	theValue := reflect.New(theType)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	if err := decoder.Decode(theValue.Interface()); err != nil {
+		return reflect.Value{}, fmt.Errorf("%v is not %v: %s", value, theType, err)
+	}
+
+	return theValue.Elem(), nil
+}
+
+// isBasicType checks whether the type is one of the base types handled by
+// reflectValue, named types such as time.Duration are not
+func isBasicType(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return t.PkgPath() == ""
+	}
+	return false
 }
 
 // reflectValue converts interface{} to reflect.Value based on string type
@@ -1,11 +1,15 @@
 package tasks_test
 
 import (
+	"bytes"
 	"encoding/json"
 	"reflect"
 	"testing"
+	"time"
 
 	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 var (
@@ -241,3 +245,103 @@ func TestReflectValue(t *testing.T) {
 		})
 	}
 }
+
+type testAddress struct {
+	Street string
+	Zip    *int
+}
+
+type testUser struct {
+	Name      string            `json:"name"`
+	Tags      map[string]string `json:"tags"`
+	Address   *testAddress      `json:"address"`
+	CreatedAt time.Time         `json:"created_at"`
+}
+
+// decodeJSON returns the value as decoded by brokers from a message
+func decodeJSON(t *testing.T, value interface{}) interface{} {
+	data, err := json.Marshal(value)
+	require.NoError(t, err)
+
+	var decoded interface{}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	require.NoError(t, decoder.Decode(&decoded))
+	return decoded
+}
+
+func TestReflectValueRoundTrips(t *testing.T) {
+	t.Parallel()
+
+	tasks.RegisterType(testUser{})
+
+	zip := 12345
+	user := testUser{
+		Name:      "foo",
+		Tags:      map[string]string{"role": "admin"},
+		Address:   &testAddress{Street: "Main Street", Zip: &zip},
+		CreatedAt: time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+
+	testCases := []interface{}{
+		user,
+		&user,
+		[]testUser{user},
+		user.CreatedAt,
+		map[string]interface{}{"a": json.Number("1"), "b": []interface{}{"c"}},
+		map[string]int{"a": 1},
+		[]byte("binary"),
+	}
+
+	for _, value := range testCases {
+		valueType := reflect.TypeOf(value).String()
+		result, err := tasks.ReflectValue(valueType, decodeJSON(t, value))
+		require.NoError(t, err, valueType)
+		assert.Equal(t, value, result.Interface(), valueType)
+	}
+
+	_, err := tasks.ReflectValue("tasks_test.unknown", map[string]interface{}{})
+	assert.Equal(t, tasks.NewErrUnsupportedType("tasks_test.unknown"), err)
+}
+
+func TestReflectArg(t *testing.T) {
+	t.Parallel()
+
+	type color string
+
+	zip := 12345
+	user := testUser{
+		Name:    "foo",
+		Address: &testAddress{Zip: &zip},
+	}
+
+	testCases := []interface{}{
+		user,
+		&user,
+		map[string]testUser{"foo": user},
+		time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC),
+		[]byte("binary"),
+		color("red"),
+		int64(185135722552891243),
+	}
+
+	for _, value := range testCases {
+		theType := reflect.TypeOf(value)
+		arg, err := tasks.ReflectArg(decodeJSON(t, value), theType)
+		require.NoError(t, err, theType.String())
+		assert.Equal(t, value, arg.Interface(), theType.String())
+	}
+
+	// nil is the zero value
+	arg, err := tasks.ReflectArg(nil, reflect.TypeOf(&user))
+	require.NoError(t, err)
+	assert.Nil(t, arg.Interface())
+
+	// values are passed as they are to interface{} parameters
+	arg, err = tasks.ReflectArg(json.Number("1"), reflect.TypeOf((*interface{})(nil)).Elem())
+	require.NoError(t, err)
+	assert.Equal(t, json.Number("1"), arg.Interface())
+
+	_, err = tasks.ReflectArg("foo", reflect.TypeOf(user))
+	assert.Error(t, err)
+}
@@ -1,6 +1,8 @@
 package tasks
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"reflect"
 	"strings"
@@ -25,6 +27,80 @@ func ReflectTaskResults(taskResults []*TaskResult) ([]reflect.Value, error) {
 	return resultValues, nil
 }
 
+// DecodeTaskResults decodes the task results into the values pointed to by
+// outs, one per result in order, see DecodeTaskResult. A nil out skips the
+// result.
+func DecodeTaskResults(taskResults []*TaskResult, outs ...interface{}) error {
+	if len(outs) != len(taskResults) {
+		return fmt.Errorf("Task returned %d results, cannot decode them into %d values", len(taskResults), len(outs))
+	}
+
+	for i, taskResult := range taskResults {
+		if outs[i] == nil {
+			continue
+		}
+		if err := DecodeTaskResult(taskResult, outs[i]); err != nil {
+			return fmt.Errorf("Result %d: %s", i, err)
+		}
+	}
+	return nil
+}
+
+// DecodeTaskResult decodes the task result into the value pointed to by out.
+// Results which are not of the type of out already, e.g. structs and maps
+// decoded from a result backend, are converted from their JSON
+// representation. Converting fails if the representation does not fit the
+// type, including objects with fields the type does not have.
+func DecodeTaskResult(taskResult *TaskResult, out interface{}) error {
+	outValue := reflect.ValueOf(out)
+	if outValue.Kind() != reflect.Ptr || outValue.IsNil() {
+		return fmt.Errorf("Cannot decode %s result into %T, a non-nil pointer is required", taskResult.Type, out)
+	}
+	theType := outValue.Elem().Type()
+
+	// decoding into an interface keeps the type returned by the task if known
+	if theType.Kind() == reflect.Interface {
+		if value, err := ReflectValue(taskResult.Type, taskResult.Value); err == nil && value.Type().AssignableTo(theType) {
+			outValue.Elem().Set(value)
+			return nil
+		}
+	}
+
+	value, err := decodeValue(taskResult.Value, theType)
+	if err != nil {
+		return fmt.Errorf("Cannot decode %s result %v into %s: %s", taskResult.Type, taskResult.Value, theType, err)
+	}
+	outValue.Elem().Set(value)
+	return nil
+}
+
+// decodeValue converts the value to the type like convertValue, but
+// rejects objects with fields unknown to the type
+func decodeValue(value interface{}, theType reflect.Type) (reflect.Value, error) {
+	if value == nil {
+		return reflect.Zero(theType), nil
+	}
+
+	if reflect.TypeOf(value).AssignableTo(theType) {
+		return reflect.ValueOf(value), nil
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return reflect.Value{}, err
+	}
+
+	theValue := reflect.New(theType)
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(theValue.Interface()); err != nil {
+		return reflect.Value{}, err
+	}
+
+	return theValue.Elem(), nil
+}
+
 // HumanReadableResults ...
 func HumanReadableResults(results []reflect.Value) string {
 	if len(results) == 1 {
@@ -1,10 +1,12 @@
 package tasks_test
 
 import (
+	"encoding/json"
 	"testing"
 
 	"github.com/pmaccamp/machinery/v1/tasks"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func TestReflectTaskResults(t *testing.T) {
@@ -25,3 +27,75 @@ func TestReflectTaskResults(t *testing.T) {
 		assert.Equal(t, "o", results[0].Index(2).String())
 	}
 }
+
+type decodedUser struct {
+	Name  string   `json:"name"`
+	Age   int      `json:"age"`
+	Roles []string `json:"roles"`
+}
+
+func TestDecodeTaskResults(t *testing.T) {
+	t.Parallel()
+
+	// results as read from a result backend
+	taskResults := []*tasks.TaskResult{
+		{
+			Type: "tasks_test.decodedUser",
+			Value: map[string]interface{}{
+				"name":  "foo",
+				"age":   json.Number("42"),
+				"roles": []interface{}{"admin"},
+			},
+		},
+		{
+			Type:  "map[string]int",
+			Value: map[string]interface{}{"a": json.Number("1"), "b": json.Number("2")},
+		},
+		{Type: "int64", Value: json.Number("3")},
+		{Type: "[]uint8", Value: "Zm9v"},
+		{Type: "string", Value: "bar"},
+	}
+
+	var (
+		user   decodedUser
+		counts map[string]int
+		number int
+		data   []byte
+		value  interface{}
+	)
+	require.NoError(t, tasks.DecodeTaskResults(taskResults, &user, &counts, &number, &data, &value))
+	assert.Equal(t, decodedUser{Name: "foo", Age: 42, Roles: []string{"admin"}}, user)
+	assert.Equal(t, map[string]int{"a": 1, "b": 2}, counts)
+	assert.Equal(t, 3, number)
+	assert.Equal(t, []byte("foo"), data)
+	assert.Equal(t, "bar", value)
+
+	// nil skips a result
+	number = 0
+	require.NoError(t, tasks.DecodeTaskResults(taskResults, nil, nil, &number, nil, nil))
+	assert.Equal(t, 3, number)
+}
+
+func TestDecodeTaskResultsErrors(t *testing.T) {
+	t.Parallel()
+
+	var (
+		number int
+		user   decodedUser
+	)
+
+	err := tasks.DecodeTaskResults([]*tasks.TaskResult{{Type: "int64", Value: 3}}, &number, &user)
+	assert.EqualError(t, err, "Task returned 1 results, cannot decode them into 2 values")
+
+	err = tasks.DecodeTaskResults([]*tasks.TaskResult{{Type: "int64", Value: 3}}, number)
+	assert.EqualError(t, err, "Result 0: Cannot decode int64 result into int, a non-nil pointer is required")
+
+	err = tasks.DecodeTaskResults([]*tasks.TaskResult{{Type: "string", Value: "foo"}}, &number)
+	assert.EqualError(t, err, "Result 0: Cannot decode string result foo into int: json: cannot unmarshal string into Go value of type int")
+
+	err = tasks.DecodeTaskResults([]*tasks.TaskResult{{
+		Type:  "map[string]interface {}",
+		Value: map[string]interface{}{"name": "foo", "email": "foo@example.com"},
+	}}, &user)
+	assert.EqualError(t, err, `Result 0: Cannot decode map[string]interface {} result map[email:foo@example.com name:foo] into tasks_test.decodedUser: json: unknown field "email"`)
+}
@@ -5,8 +5,13 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/pmaccamp/machinery/v1/retry"
 )
 
+// PublishedAtHeader is the header recording when a task was published, it is
+// set by the publish middleware of the metrics package
+const PublishedAtHeader = "machinery_published_at"
+
 // Headers represents the headers which should be used to direct the task
 type Headers map[string]interface{}
 
@@ -36,27 +41,35 @@ func (h Headers) ForeachKey(handler func(key, val string) error) error {
 
 // Signature represents a single task invocation
 type Signature struct {
-	Task           string
-	Id             string
-	RoutingKey     string
-	ReceivedTime   *time.Time
-	StartTime      *time.Time
-	FinishTime     *time.Time
-	DurationMs     int64
-	ETA            *time.Time
-	Expires        *time.Time
-	GroupUUID      string
-	GroupTaskCount int
-	Args           []interface{}
-	Kwargs         map[string]interface{}
-	Headers        Headers
-	Immutable      bool
-	RetryCount     int
-	RetryTimeout   int
-	State          string
-	OnSuccess      []*Signature
-	OnError        []*Signature
-	ChordCallback  *Signature
+	Task             string
+	Id               string
+	RoutingKey       string
+	ReceivedTime     *time.Time
+	StartTime        *time.Time
+	FinishTime       *time.Time
+	DurationMs       int64
+	ETA              *time.Time
+	Expires          *time.Time
+	GroupUUID        string
+	GroupTaskCount   int
+	Args             []interface{}
+	Kwargs           map[string]interface{}
+	ClaimCheck       string
+	ClaimCheckHash   string
+	EncryptedArgs    []byte
+	Headers          Headers
+	Immutable        bool
+	RetryCount       int
+	RetryTimeout     int
+	RetryPolicy      *retry.Spec
+	RetryAttempts    int
+	FirstFailureTime *time.Time
+	Timeout          time.Duration
+	State            string
+	ErrorClass       string
+	OnSuccess        []*Signature
+	OnError          []*Signature
+	ChordCallback    *Signature
 }
 
 // NewSignature creates a new task signature
@@ -68,3 +81,71 @@ func NewSignature(name string, args []interface{}) (*Signature, error) {
 		Args: args,
 	}, nil
 }
+
+// CopySignature returns a deep copy of the signature, including its callbacks,
+// so the copy can be modified and published without affecting the original
+func CopySignature(signature *Signature) *Signature {
+	if signature == nil {
+		return nil
+	}
+
+	sigCopy := *signature
+
+	if signature.Args != nil {
+		sigCopy.Args = make([]interface{}, len(signature.Args))
+		copy(sigCopy.Args, signature.Args)
+	}
+
+	if signature.Kwargs != nil {
+		sigCopy.Kwargs = make(map[string]interface{}, len(signature.Kwargs))
+		for k, v := range signature.Kwargs {
+			sigCopy.Kwargs[k] = v
+		}
+	}
+
+	if signature.Headers != nil {
+		sigCopy.Headers = make(Headers, len(signature.Headers))
+		for k, v := range signature.Headers {
+			sigCopy.Headers[k] = v
+		}
+	}
+
+	sigCopy.ReceivedTime = copyTime(signature.ReceivedTime)
+	sigCopy.StartTime = copyTime(signature.StartTime)
+	sigCopy.FinishTime = copyTime(signature.FinishTime)
+	sigCopy.ETA = copyTime(signature.ETA)
+	sigCopy.Expires = copyTime(signature.Expires)
+	sigCopy.FirstFailureTime = copyTime(signature.FirstFailureTime)
+
+	if signature.RetryPolicy != nil {
+		retryPolicy := *signature.RetryPolicy
+		sigCopy.RetryPolicy = &retryPolicy
+	}
+
+	sigCopy.OnSuccess = copySignatures(signature.OnSuccess)
+	sigCopy.OnError = copySignatures(signature.OnError)
+	sigCopy.ChordCallback = CopySignature(signature.ChordCallback)
+
+	return &sigCopy
+}
+
+func copySignatures(signatures []*Signature) []*Signature {
+	if signatures == nil {
+		return nil
+	}
+
+	copies := make([]*Signature, len(signatures))
+	for i, signature := range signatures {
+		copies[i] = CopySignature(signature)
+	}
+	return copies
+}
+
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+
+	tCopy := *t
+	return &tCopy
+}
@@ -0,0 +1,38 @@
+package tasks_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCopySignature(t *testing.T) {
+	t.Parallel()
+
+	eta := time.Now()
+	signature := &tasks.Signature{
+		Id:        "task_1",
+		Task:      "add",
+		Args:      []interface{}{1, 2},
+		Headers:   tasks.Headers{"foo": "bar"},
+		ETA:       &eta,
+		OnSuccess: []*tasks.Signature{{Id: "task_2", Task: "multiply"}},
+	}
+
+	sigCopy := tasks.CopySignature(signature)
+	assert.Equal(t, signature, sigCopy)
+
+	sigCopy.Args[0] = 3
+	sigCopy.Headers["foo"] = "baz"
+	*sigCopy.ETA = eta.Add(time.Hour)
+	sigCopy.OnSuccess[0].Id = "task_3"
+
+	assert.Equal(t, 1, signature.Args[0])
+	assert.Equal(t, "bar", signature.Headers["foo"])
+	assert.Equal(t, eta, *signature.ETA)
+	assert.Equal(t, "task_2", signature.OnSuccess[0].Id)
+
+	assert.Nil(t, tasks.CopySignature(nil))
+}
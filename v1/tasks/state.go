@@ -15,16 +15,28 @@ const (
 	StateSuccess = "SUCCESS"
 	// StateFailure - when processing of the task fails
 	StateFailure = "FAILURE"
+	// StateRevoked - when the task has been revoked before it finished
+	StateRevoked = "REVOKED"
+)
+
+const (
+	// ErrorClassTransient - when the task failed with an error retrying might fix
+	ErrorClassTransient = "TRANSIENT"
+	// ErrorClassPermanent - when the task failed with an error retrying cannot fix
+	ErrorClassPermanent = "PERMANENT"
+	// ErrorClassTimeout - when the task ran longer than its timeout
+	ErrorClassTimeout = "TIMEOUT"
 )
 
 // TaskState represents a state of a task
 type TaskState struct {
-	TaskUUID  string        `bson:"_id"`
-	TaskName  string        `bson:"task_name"`
-	State     string        `bson:"state"`
-	Results   []*TaskResult `bson:"results"`
-	Error     string        `bson:"error"`
-	CreatedAt time.Time     `bson:"created_at"`
+	TaskUUID   string        `bson:"_id"`
+	TaskName   string        `bson:"task_name"`
+	State      string        `bson:"state"`
+	Results    []*TaskResult `bson:"results"`
+	Error      string        `bson:"error"`
+	ErrorClass string        `bson:"error_class"`
+	CreatedAt  time.Time     `bson:"created_at"`
 }
 
 // GroupMeta stores useful metadata about tasks within the same group
@@ -81,9 +93,10 @@ func NewSuccessTaskState(signature *Signature, results []*TaskResult) *TaskState
 func NewFailureTaskState(signature *Signature, err string) *TaskState {
 	signature.State = StateFailure
 	return &TaskState{
-		TaskUUID: signature.Id,
-		State:    StateFailure,
-		Error:    err,
+		TaskUUID:   signature.Id,
+		State:      StateFailure,
+		Error:      err,
+		ErrorClass: signature.ErrorClass,
 	}
 }
 
@@ -96,10 +109,19 @@ func NewRetryTaskState(signature *Signature) *TaskState {
 	}
 }
 
-// IsCompleted returns true if state is SUCCESS or FAILURE,
-// i.e. the task has finished processing and either succeeded or failed.
+// NewRevokedTaskState ...
+func NewRevokedTaskState(signature *Signature) *TaskState {
+	signature.State = StateRevoked
+	return &TaskState{
+		TaskUUID: signature.Id,
+		State:    StateRevoked,
+	}
+}
+
+// IsCompleted returns true if state is SUCCESS, FAILURE or REVOKED,
+// i.e. the task has finished processing, or never will.
 func (taskState *TaskState) IsCompleted() bool {
-	return taskState.IsSuccess() || taskState.IsFailure()
+	return taskState.IsSuccess() || taskState.IsFailure() || taskState.IsRevoked()
 }
 
 // IsSuccess returns true if state is SUCCESS
@@ -111,3 +133,8 @@ func (taskState *TaskState) IsSuccess() bool {
 func (taskState *TaskState) IsFailure() bool {
 	return taskState.State == StateFailure
 }
+
+// IsRevoked returns true if state is REVOKED
+func (taskState *TaskState) IsRevoked() bool {
+	return taskState.State == StateRevoked
+}
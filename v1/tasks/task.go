@@ -7,6 +7,7 @@ import (
 	"github.com/bugsnag/bugsnag-go"
 	"reflect"
 	"runtime/debug"
+	"time"
 
 	"github.com/opentracing/opentracing-go"
 	opentracing_ext "github.com/opentracing/opentracing-go/ext"
@@ -25,9 +26,13 @@ type Task struct {
 	TaskFunc      reflect.Value
 	UseContext    bool
 	Context       context.Context
+	Timeout       time.Duration
 	Args          []reflect.Value
 	BugsnagConfig *bugsnag.Configuration
 	Signature     *Signature
+
+	// returned is closed when a task func abandoned by Call returns
+	returned chan struct{}
 }
 
 // New tries to use reflection to convert the function and arguments
@@ -37,6 +42,7 @@ func New(bugsnagConfig *bugsnag.Configuration, signature *Signature, taskFunc in
 	task := &Task{
 		TaskFunc:      taskFuncValue,
 		Context:       context.Background(),
+		Timeout:       signature.Timeout,
 		BugsnagConfig: bugsnagConfig,
 		Signature:     signature,
 	}
@@ -58,16 +64,14 @@ func New(bugsnagConfig *bugsnag.Configuration, signature *Signature, taskFunc in
 
 // Call attempts to call the task with the supplied arguments.
 //
-// `err` is set in the return value in two cases:
+// `err` is set in the return value in three cases:
 // 1. The reflected function invocation panics (e.g. due to a mismatched
 //    argument list).
 // 2. The task func itself returns a non-nil error.
+// 3. The task runs longer than its timeout, or its context gets cancelled.
+//    Call returns without waiting for the task func, which is left running,
+//    WaitAbandoned waits for it.
 func (t *Task) Call() (taskResults []*TaskResult, err error, stackFrames []stackframe.StackFrame) {
-	// retrieve the span from the task's context and finish it as soon as this function returns
-	if span := opentracing.SpanFromContext(t.Context); span != nil {
-		defer span.Finish()
-	}
-
 	defer func() {
 		// Recover from panic and set err.
 		if e := recover(); e != nil {
@@ -123,15 +127,25 @@ func (t *Task) Call() (taskResults []*TaskResult, err error, stackFrames []stack
 		}
 	}()
 
+	ctx := t.Context
+	if t.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, t.Timeout)
+		defer cancel()
+	}
+
 	args := t.Args
 
 	if t.UseContext {
-		ctxValue := reflect.ValueOf(t.Context)
+		ctxValue := reflect.ValueOf(ctx)
 		args = append([]reflect.Value{ctxValue}, args...)
 	}
 
 	// Invoke the task
-	results := t.TaskFunc.Call(args)
+	results, err := t.invoke(ctx, args)
+	if err != nil {
+		return nil, err, stackFrames
+	}
 
 	// Task must return at least a value
 	if len(results) == 0 {
@@ -176,27 +190,126 @@ func (t *Task) Call() (taskResults []*TaskResult, err error, stackFrames []stack
 	return taskResults, err, stackFrames
 }
 
-// ReflectArgs converts []TaskArg to []reflect.Value
+// ReflectArgs converts []TaskArg to []reflect.Value. When the task function
+// takes one more parameter than there are message arguments and it is a
+// struct, it is populated from the keyword arguments of the signature.
 func (t *Task) ReflectArgs(args []interface{}, taskFunc *reflect.Value) error {
-	argValues := make([]reflect.Value, len(args))
+	// the context is passed to the task by Call, it is not a message argument
+	offset := 0
+	if t.UseContext {
+		offset = 1
+	}
 
-	numArgs := taskFunc.Type().NumIn()
-	if numArgs != len(args) {
+	numArgs := taskFunc.Type().NumIn() - offset
+	useKwargs := numArgs == len(args)+1 && IsKwargsType(taskFunc.Type().In(numArgs+offset-1))
+	if numArgs != len(args) && !useKwargs {
 		return fmt.Errorf("Number of task arguments %d does not match number of message arguments %d", numArgs, len(args))
 	}
+
+	argValues := make([]reflect.Value, numArgs)
+	if useKwargs {
+		var kwargs map[string]interface{}
+		if t.Signature != nil {
+			kwargs = t.Signature.Kwargs
+		}
+
+		kwargsValue, err := ReflectKwargs(kwargs, taskFunc.Type().In(numArgs+offset-1))
+		if err != nil {
+			return err
+		}
+		argValues[numArgs-1] = kwargsValue
+	}
+
 	// construct arguments
 	for i, arg := range args {
-		origType := taskFunc.Type().In(i).Kind()
-		msgType := reflect.TypeOf(arg).Kind()
-		// special case - convert float64 to int if applicable
-		// this is due to json limitation where all numbers are converted to float64
-		if origType == reflect.Int && msgType == reflect.Float64 {
-			argValues[i] = reflect.ValueOf(int(arg.(float64)))
-		} else {
-			argValues[i] = reflect.ValueOf(arg)
+		argValue, err := ReflectArg(arg, taskFunc.Type().In(i+offset))
+		if err != nil {
+			return fmt.Errorf("Argument %d: %s", i, err)
 		}
+		argValues[i] = argValue
 	}
 
 	t.Args = argValues
 	return nil
 }
+
+// invoke calls the task func. If the context can be cancelled, the task func
+// runs in its own goroutine so invoke can return as soon as the context is done.
+func (t *Task) invoke(ctx context.Context, args []reflect.Value) ([]reflect.Value, error) {
+	if ctx.Done() == nil {
+		return t.TaskFunc.Call(args), nil
+	}
+
+	type outcome struct {
+		results   []reflect.Value
+		panicked  bool
+		recovered interface{}
+	}
+	done := make(chan outcome, 1)
+	returned := make(chan struct{})
+
+	go func() {
+		var o outcome
+		defer func() {
+			if e := recover(); e != nil {
+				o.panicked = true
+				o.recovered = e
+			}
+			done <- o
+			close(returned)
+		}()
+		o.results = t.TaskFunc.Call(args)
+	}()
+
+	var (
+		o         outcome
+		abandoned bool
+	)
+	select {
+	case o = <-done:
+	case <-ctx.Done():
+		// the task func might have returned at the same time
+		select {
+		case o = <-done:
+		default:
+			abandoned = true
+			t.returned = returned
+		}
+	}
+
+	// let Call handle panics of the task func as if it was called directly
+	if o.panicked {
+		panic(o.recovered)
+	}
+
+	// an error returned after the deadline is most likely caused by it
+	timedOut := ctx.Err() == context.DeadlineExceeded && t.Context.Err() == nil
+	if abandoned || (timedOut && returnsError(o.results)) {
+		if timedOut {
+			return nil, NewErrTaskTimeout(t.Timeout)
+		}
+		return nil, ctx.Err()
+	}
+
+	return o.results, nil
+}
+
+// WaitAbandoned blocks until the task func returns if Call returned without
+// waiting for it, it returns straight away otherwise. It reports whether the
+// task func had been abandoned.
+func (t *Task) WaitAbandoned() bool {
+	if t.returned == nil {
+		return false
+	}
+	<-t.returned
+	return true
+}
+
+// returnsError returns true if the last of the results is a non-nil error
+func returnsError(results []reflect.Value) bool {
+	if len(results) == 0 {
+		return false
+	}
+	lastResult := results[len(results)-1]
+	return lastResult.Kind() == reflect.Interface && !lastResult.IsNil()
+}
@@ -0,0 +1,151 @@
+// Package opentelemetry traces tasks with OpenTelemetry, propagating traces
+// from producers to workers in the W3C traceparent header of signatures.
+package opentelemetry
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/pmaccamp/machinery/v1/tracing"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// InstrumentationName names the tracer spans are started with
+const InstrumentationName = "github.com/pmaccamp/machinery"
+
+// Tracer traces tasks with OpenTelemetry
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+}
+
+// New creates Tracer instance starting spans with the tracer provider, the
+// global tracer provider is used if nil
+func New(provider trace.TracerProvider) *Tracer {
+	if provider == nil {
+		provider = otel.GetTracerProvider()
+	}
+
+	return &Tracer{
+		tracer: provider.Tracer(InstrumentationName),
+		propagator: propagation.NewCompositeTextMapPropagator(
+			propagation.TraceContext{},
+			propagation.Baggage{},
+		),
+	}
+}
+
+// StartProducerSpan implements tracing.Tracer
+func (t *Tracer) StartProducerSpan(ctx context.Context, operationName, workflow string) (context.Context, tracing.Span) {
+	attributes := []attribute.KeyValue{attribute.String("component", "machinery")}
+	if workflow != "" {
+		attributes = append(attributes, attribute.String("machinery.workflow", workflow))
+	}
+
+	ctx, span := t.tracer.Start(
+		ctx,
+		operationName,
+		trace.WithSpanKind(trace.SpanKindProducer),
+		trace.WithAttributes(attributes...),
+	)
+	return ctx, &otelSpan{ctx: ctx, span: span, propagator: t.propagator}
+}
+
+// StartConsumerSpan implements tracing.Tracer. The span is a child of the
+// span propagated in the headers, except for members of groups and chords
+// which start a new trace linked to the span publishing them, so that large
+// groups do not end up in a single trace.
+func (t *Tracer) StartConsumerSpan(ctx context.Context, signature *tasks.Signature) (context.Context, tracing.Span) {
+	ctx = t.propagator.Extract(ctx, headersCarrier(signature.Headers))
+
+	options := []trace.SpanStartOption{
+		trace.WithSpanKind(trace.SpanKindConsumer),
+		trace.WithAttributes(attribute.String("component", "machinery")),
+	}
+	if signature.GroupUUID != "" {
+		options = append(options, trace.WithNewRoot())
+		if producer := trace.SpanContextFromContext(ctx); producer.IsValid() {
+			options = append(options, trace.WithLinks(trace.Link{SpanContext: producer}))
+		}
+	}
+
+	ctx, span := t.tracer.Start(ctx, signature.Task, options...)
+	s := &otelSpan{ctx: ctx, span: span, propagator: t.propagator}
+	tracing.AnnotateSignature(s, signature)
+	return ctx, s
+}
+
+// otelSpan adapts trace.Span to tracing.Span
+type otelSpan struct {
+	ctx        context.Context
+	span       trace.Span
+	propagator propagation.TextMapPropagator
+}
+
+func (s *otelSpan) SetAttribute(key string, value interface{}) {
+	s.span.SetAttributes(keyValue(key, value))
+}
+
+func (s *otelSpan) RecordError(err error) {
+	s.span.RecordError(err)
+	s.span.SetStatus(codes.Error, err.Error())
+}
+
+func (s *otelSpan) Inject(headers tasks.Headers) tasks.Headers {
+	if headers == nil {
+		headers = make(tasks.Headers)
+	}
+
+	s.propagator.Inject(s.ctx, headersCarrier(headers))
+	return headers
+}
+
+func (s *otelSpan) End() {
+	s.span.End()
+}
+
+// keyValue converts the value to an attribute, values of unsupported types
+// are formatted as strings
+func keyValue(key string, value interface{}) attribute.KeyValue {
+	switch v := value.(type) {
+	case string:
+		return attribute.String(key, v)
+	case bool:
+		return attribute.Bool(key, v)
+	case int:
+		return attribute.Int(key, v)
+	case int64:
+		return attribute.Int64(key, v)
+	case float64:
+		return attribute.Float64(key, v)
+	case []string:
+		return attribute.StringSlice(key, v)
+	default:
+		return attribute.String(key, fmt.Sprint(v))
+	}
+}
+
+// headersCarrier adapts tasks.Headers to propagation.TextMapCarrier
+type headersCarrier tasks.Headers
+
+func (c headersCarrier) Get(key string) string {
+	value, _ := c[key].(string)
+	return value
+}
+
+func (c headersCarrier) Set(key, value string) {
+	c[key] = value
+}
+
+func (c headersCarrier) Keys() []string {
+	keys := make([]string, 0, len(c))
+	for key := range c {
+		keys = append(keys, key)
+	}
+	return keys
+}
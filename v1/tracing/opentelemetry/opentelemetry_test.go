@@ -0,0 +1,114 @@
+package opentelemetry_test
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/pmaccamp/machinery/v1/tracing/opentelemetry"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// newTracedServer returns a server recording spans, a worker is launched in
+// the background until the returned function is called
+func newTracedServer(t *testing.T) (*machinery.Server, *tracetest.SpanRecorder, func()) {
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "memory://",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+		NoUnixSignals: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterTask("concat", func(a, b string) (string, error) {
+		return a + b, nil
+	}))
+
+	recorder := tracetest.NewSpanRecorder()
+	server.SetTracer(opentelemetry.New(sdktrace.NewTracerProvider(sdktrace.WithSpanProcessor(recorder))))
+
+	worker := server.NewWorker("test", 2)
+	errorsChan := make(chan error, 1)
+	worker.LaunchAsync(errorsChan)
+	return server, recorder, func() {
+		worker.Quit()
+		<-errorsChan
+	}
+}
+
+// endedSpans waits for the number of spans to end and returns them by name
+func endedSpans(t *testing.T, recorder *tracetest.SpanRecorder, count int) map[string][]sdktrace.ReadOnlySpan {
+	require.Eventually(t, func() bool {
+		return len(recorder.Ended()) == count
+	}, 5*time.Second, 10*time.Millisecond)
+
+	spans := make(map[string][]sdktrace.ReadOnlySpan)
+	for _, span := range recorder.Ended() {
+		spans[span.Name()] = append(spans[span.Name()], span)
+	}
+	return spans
+}
+
+func TestSendTaskWithContext(t *testing.T) {
+	t.Parallel()
+
+	server, recorder, stop := newTracedServer(t)
+	defer stop()
+
+	signature := &tasks.Signature{Task: "concat", Args: []interface{}{"a", "b"}}
+	asyncResult, err := server.SendTaskWithContext(context.Background(), signature)
+	require.NoError(t, err)
+	assert.Contains(t, signature.Headers, "traceparent")
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	spans := endedSpans(t, recorder, 2)
+	require.Len(t, spans["SendTask"], 1)
+	require.Len(t, spans["concat"], 1)
+
+	producer, consumer := spans["SendTask"][0], spans["concat"][0]
+	assert.Equal(t, trace.SpanKindProducer, producer.SpanKind())
+	assert.Equal(t, trace.SpanKindConsumer, consumer.SpanKind())
+	assert.Equal(t, producer.SpanContext().TraceID(), consumer.SpanContext().TraceID())
+	assert.Equal(t, producer.SpanContext().SpanID(), consumer.Parent().SpanID())
+}
+
+func TestSendGroupWithContext(t *testing.T) {
+	t.Parallel()
+
+	server, recorder, stop := newTracedServer(t)
+	defer stop()
+
+	group, err := tasks.NewGroup(
+		&tasks.Signature{Task: "concat", Args: []interface{}{"a", "b"}},
+		&tasks.Signature{Task: "concat", Args: []interface{}{"c", "d"}},
+	)
+	require.NoError(t, err)
+
+	asyncResults, err := server.SendGroupWithContext(context.Background(), group, 0)
+	require.NoError(t, err)
+	for _, asyncResult := range asyncResults {
+		_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+		require.NoError(t, err)
+	}
+
+	spans := endedSpans(t, recorder, 3)
+	require.Len(t, spans["SendGroup"], 1)
+	require.Len(t, spans["concat"], 2)
+
+	producer := spans["SendGroup"][0]
+	for _, consumer := range spans["concat"] {
+		// members start their own trace linked to the producer span
+		assert.NotEqual(t, producer.SpanContext().TraceID(), consumer.SpanContext().TraceID())
+		assert.False(t, consumer.Parent().IsValid())
+		require.Len(t, consumer.Links(), 1)
+		assert.Equal(t, producer.SpanContext().SpanID(), consumer.Links()[0].SpanContext.SpanID())
+	}
+}
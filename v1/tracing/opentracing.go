@@ -0,0 +1,60 @@
+package tracing
+
+import (
+	"context"
+
+	"github.com/pmaccamp/machinery/v1/tasks"
+
+	opentracing "github.com/opentracing/opentracing-go"
+	opentracing_ext "github.com/opentracing/opentracing-go/ext"
+	opentracing_log "github.com/opentracing/opentracing-go/log"
+)
+
+// OpenTracingTracer traces tasks with the global OpenTracing tracer
+type OpenTracingTracer struct{}
+
+// NewOpenTracingTracer creates OpenTracingTracer instance
+func NewOpenTracingTracer() *OpenTracingTracer {
+	return &OpenTracingTracer{}
+}
+
+// StartProducerSpan implements Tracer
+func (t *OpenTracingTracer) StartProducerSpan(ctx context.Context, operationName, workflow string) (context.Context, Span) {
+	options := []opentracing.StartSpanOption{ProducerOption(), MachineryTag}
+	if workflow != "" {
+		options = append(options, opentracing.Tag{Key: "machinery.workflow", Value: workflow})
+	}
+
+	span, ctx := opentracing.StartSpanFromContext(ctx, operationName, options...)
+	return ctx, openTracingSpan{span}
+}
+
+// StartConsumerSpan implements Tracer, the span follows from the span
+// propagated in the headers
+func (t *OpenTracingTracer) StartConsumerSpan(ctx context.Context, signature *tasks.Signature) (context.Context, Span) {
+	span := StartSpanFromHeaders(signature.Headers, signature.Id)
+	AnnotateSpanWithSignatureInfo(span, signature)
+	return opentracing.ContextWithSpan(ctx, span), openTracingSpan{span}
+}
+
+// openTracingSpan adapts opentracing.Span to Span
+type openTracingSpan struct {
+	span opentracing.Span
+}
+
+func (s openTracingSpan) SetAttribute(key string, value interface{}) {
+	s.span.SetTag(key, value)
+}
+
+func (s openTracingSpan) RecordError(err error) {
+	opentracing_ext.Error.Set(s.span, true)
+	s.span.LogFields(opentracing_log.Error(err))
+}
+
+func (s openTracingSpan) Inject(headers tasks.Headers) tasks.Headers {
+	return HeadersWithSpan(headers, s.span)
+}
+
+func (s openTracingSpan) End() {
+	s.span.Finish()
+}
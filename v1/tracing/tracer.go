@@ -0,0 +1,92 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+
+	"github.com/pmaccamp/machinery/v1/tasks"
+)
+
+// Workflows published by producer spans
+const (
+	WorkflowGroup = "group"
+	WorkflowChord = "chord"
+	WorkflowChain = "chain"
+)
+
+// Tracer traces the publishing of tasks and their processing by workers,
+// propagating the trace from producers to workers in the signature headers
+type Tracer interface {
+	// StartProducerSpan starts a span publishing a task, or a workflow if
+	// workflow is not empty, and returns a context holding the span
+	StartProducerSpan(ctx context.Context, operationName, workflow string) (context.Context, Span)
+	// StartConsumerSpan starts a span processing the task, continuing the
+	// trace propagated in its headers, and returns a context holding the span
+	StartConsumerSpan(ctx context.Context, signature *tasks.Signature) (context.Context, Span)
+}
+
+// Span is a span started by a Tracer
+type Span interface {
+	// SetAttribute sets an attribute, or tag, of the span
+	SetAttribute(key string, value interface{})
+	// RecordError marks the span as failed
+	RecordError(err error)
+	// Inject propagates the span in the headers, which are created if nil
+	Inject(headers tasks.Headers) tasks.Headers
+	// End finishes the span
+	End()
+}
+
+// AnnotateSignature sets attributes describing the signature on the span
+func AnnotateSignature(span Span, signature *tasks.Signature) {
+	span.SetAttribute("signature.name", signature.Task)
+	span.SetAttribute("signature.uuid", signature.Id)
+
+	if signature.GroupUUID != "" {
+		span.SetAttribute("signature.group.uuid", signature.GroupUUID)
+	}
+
+	if signature.ChordCallback != nil {
+		span.SetAttribute("signature.chord.callback.uuid", signature.ChordCallback.Id)
+		span.SetAttribute("signature.chord.callback.name", signature.ChordCallback.Task)
+	}
+}
+
+// AnnotateChain sets attributes describing the chain on the span and
+// propagates the span in the headers of its tasks
+func AnnotateChain(span Span, chain *tasks.Chain) {
+	span.SetAttribute("chain.tasks.length", len(chain.Tasks))
+
+	for _, signature := range chain.Tasks {
+		signature.Headers = span.Inject(signature.Headers)
+	}
+}
+
+// AnnotateGroup sets attributes describing the group on the span and
+// propagates the span in the headers of its tasks
+func AnnotateGroup(span Span, group *tasks.Group, sendConcurrency int) {
+	span.SetAttribute("group.uuid", group.GroupUUID)
+	span.SetAttribute("group.tasks.length", len(group.Tasks))
+	span.SetAttribute("group.concurrency", sendConcurrency)
+
+	// encode the task uuids to json, if that fails just dump it in
+	if taskUUIDs, err := json.Marshal(group.GetUUIDs()); err == nil {
+		span.SetAttribute("group.tasks", string(taskUUIDs))
+	} else {
+		span.SetAttribute("group.tasks", group.GetUUIDs())
+	}
+
+	for _, signature := range group.Tasks {
+		signature.Headers = span.Inject(signature.Headers)
+	}
+}
+
+// AnnotateChord sets attributes describing the chord on the span and
+// propagates the span in the headers of its tasks and callback
+func AnnotateChord(span Span, chord *tasks.Chord, sendConcurrency int) {
+	span.SetAttribute("chord.callback.uuid", chord.Callback.Id)
+
+	chord.Callback.Headers = span.Inject(chord.Callback.Headers)
+
+	AnnotateGroup(span, chord.Group, sendConcurrency)
+}
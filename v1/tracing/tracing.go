@@ -1,8 +1,6 @@
 package tracing
 
 import (
-	"encoding/json"
-
 	"github.com/pmaccamp/machinery/v1/tasks"
 
 	opentracing "github.com/opentracing/opentracing-go"
@@ -83,59 +81,20 @@ func ProducerOption() opentracing.StartSpanOption {
 
 // AnnotateSpanWithSignatureInfo ...
 func AnnotateSpanWithSignatureInfo(span opentracing.Span, signature *tasks.Signature) {
-	// tag the span with some info about the signature
-	span.SetTag("signature.name", signature.Task)
-	span.SetTag("signature.uuid", signature.Id)
-
-	if signature.GroupUUID != "" {
-		span.SetTag("signature.group.uuid", signature.Id)
-	}
-
-	if signature.ChordCallback != nil {
-		span.SetTag("signature.chord.callback.uuid", signature.ChordCallback.Id)
-		span.SetTag("signature.chord.callback.name", signature.ChordCallback.Task)
-	}
+	AnnotateSignature(openTracingSpan{span}, signature)
 }
 
 // AnnotateSpanWithChainInfo ...
 func AnnotateSpanWithChainInfo(span opentracing.Span, chain *tasks.Chain) {
-	// tag the span with some info about the chain
-	span.SetTag("chain.tasks.length", len(chain.Tasks))
-
-	// inject the tracing span into the tasks signature headers
-	for _, signature := range chain.Tasks {
-		signature.Headers = HeadersWithSpan(signature.Headers, span)
-	}
+	AnnotateChain(openTracingSpan{span}, chain)
 }
 
 // AnnotateSpanWithGroupInfo ...
 func AnnotateSpanWithGroupInfo(span opentracing.Span, group *tasks.Group, sendConcurrency int) {
-	// tag the span with some info about the group
-	span.SetTag("group.uuid", group.GroupUUID)
-	span.SetTag("group.tasks.length", len(group.Tasks))
-	span.SetTag("group.concurrency", sendConcurrency)
-
-	// encode the task uuids to json, if that fails just dump it in
-	if taskUUIDs, err := json.Marshal(group.GetUUIDs()); err == nil {
-		span.SetTag("group.tasks", string(taskUUIDs))
-	} else {
-		span.SetTag("group.tasks", group.GetUUIDs())
-	}
-
-	// inject the tracing span into the tasks signature headers
-	for _, signature := range group.Tasks {
-		signature.Headers = HeadersWithSpan(signature.Headers, span)
-	}
+	AnnotateGroup(openTracingSpan{span}, group, sendConcurrency)
 }
 
 // AnnotateSpanWithChordInfo ...
 func AnnotateSpanWithChordInfo(span opentracing.Span, chord *tasks.Chord, sendConcurrency int) {
-	// tag the span with chord specific info
-	span.SetTag("chord.callback.uuid", chord.Callback.Id)
-
-	// inject the tracing span into the callback signature
-	chord.Callback.Headers = HeadersWithSpan(chord.Callback.Headers, span)
-
-	// tag the span for the group part of the chord
-	AnnotateSpanWithGroupInfo(span, chord.Group, sendConcurrency)
+	AnnotateChord(openTracingSpan{span}, chord, sendConcurrency)
 }
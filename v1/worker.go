@@ -1,6 +1,7 @@
 package machinery
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"github.com/bugsnag/bugsnag-go"
@@ -10,23 +11,36 @@ import (
 	"syscall"
 	"time"
 
-	"github.com/opentracing/opentracing-go"
 	"github.com/pmaccamp/machinery/v1/backends/amqp"
+	"github.com/pmaccamp/machinery/v1/claimcheck"
+	"github.com/pmaccamp/machinery/v1/encryption"
+	"github.com/pmaccamp/machinery/v1/events"
 	"github.com/pmaccamp/machinery/v1/log"
 	"github.com/pmaccamp/machinery/v1/retry"
 	"github.com/pmaccamp/machinery/v1/tasks"
 	"github.com/pmaccamp/machinery/v1/tracing"
+
+	brokersiface "github.com/pmaccamp/machinery/v1/brokers/iface"
 )
 
+// DefaultRevocationCheckInterval is how often workers check whether
+// running tasks have been revoked
+const DefaultRevocationCheckInterval = time.Second
+
 // Worker represents a single worker process
 type Worker struct {
-	server               *Server
-	ConsumerTag          string
-	Concurrency          int
-	Queue                string
+	server      *Server
+	ConsumerTag string
+	Concurrency int
+	Queue       string
+	// RevocationCheckInterval is how often the worker checks whether running
+	// tasks accepting a context.Context have been revoked
+	RevocationCheckInterval time.Duration
+
 	errorHandler         func(err error, signature *tasks.Signature, stackFrames []stackframe.StackFrame)
 	taskStartedCallback  func(signature *tasks.Signature)
 	taskFinishedCallback func(signature *tasks.Signature)
+	middleware           []TaskMiddleware
 }
 
 // Launch starts a new worker process. The worker subscribes
@@ -126,16 +140,25 @@ func (worker *Worker) CustomQueue() string {
 
 // Quit tears down the running worker process
 func (worker *Worker) Quit() {
-	worker.server.GetBroker().StopConsuming()
+	broker := worker.server.GetBroker()
+
+	// Leave other workers sharing the broker running
+	if multiConsumer, ok := broker.(brokersiface.MultiConsumerBroker); ok {
+		multiConsumer.StopConsumer(worker.ConsumerTag)
+		return
+	}
+
+	broker.StopConsuming()
 }
 
 // Process handles received tasks and triggers success/error callbacks
-func (worker *Worker) Process(signature *tasks.Signature) error {
-	var err error = nil
+func (worker *Worker) Process(signature *tasks.Signature) (err error) {
+	// Panics of the task itself are recovered by task.Call, anything else
+	// panicking, e.g. middleware, fails the task rather than leaving it STARTED
 	defer func() {
 		if r := recover(); r != nil {
-			// set err and let err checks below handle logging to bugsnag and failing the task
-			err = errors.New("panic occurred when running task")
+			panicErr := fmt.Errorf("Panic occurred when running task: %v", r)
+			err = worker.taskFailed(signature, tasks.NewErrNonRetriable(panicErr), stackframe.CurrentStackFrames())
 		}
 	}()
 
@@ -150,11 +173,27 @@ func (worker *Worker) Process(signature *tasks.Signature) error {
 		return nil
 	}
 
-	// Update task state to RECEIVED
+	// Update task state to RECEIVED, backends refuse to replace the state of
+	// tasks which have been revoked while waiting in the queue
 	if err = worker.server.GetBackend().SetStateReceived(signature); err != nil {
+		if err == tasks.ErrTaskRevoked {
+			log.WARNING.Printf("Task %s has been revoked, skipping it", signature.Id)
+			return nil
+		}
 		return fmt.Errorf("Set state to 'received' for task %s returned error: %s", signature.Id, err)
 	}
 
+	// Forget the timing of previous attempts of the task
+	signature.StartTime, signature.DurationMs = nil, 0
+	worker.emitEvent(events.TaskReceived, signature, nil)
+
+	// Fetch arguments offloaded to the claim check store and decrypt them,
+	// the task cannot run without them
+	if err = worker.resolveArgs(signature); err != nil {
+		_ = worker.taskFailed(signature, tasks.NewErrNonRetriable(err), stackframe.CurrentStackFrames())
+		return err
+	}
+
 	// Prepare task for processing
 	task, err := tasks.New(worker.server.config.BugsnagConfig, signature, taskFunc, signature.Args)
 	// if this failed, it means the task is malformed, probably has invalid
@@ -167,29 +206,93 @@ func (worker *Worker) Process(signature *tasks.Signature) error {
 				}})
 		}
 
-		_ = worker.taskFailed(signature, err, stackframe.CurrentStackFrames())
+		_ = worker.taskFailed(signature, tasks.NewErrNonRetriable(err), stackframe.CurrentStackFrames())
 		return err
 	}
 
+	// Fall back to the timeout the task was registered with
+	if task.Timeout == 0 {
+		task.Timeout = worker.server.GetRegisteredTaskOptions(signature.Task).Timeout
+	}
+
+	// A task func abandoned after a timeout or cancellation keeps running,
+	// hold on to the slot of the worker until it returns so that running
+	// task funcs never exceed the concurrency of the worker
+	defer func() {
+		if task.WaitAbandoned() {
+			log.WARNING.Printf("Abandoned task %s returned, releasing its worker slot", signature.Id)
+		}
+	}()
+
 	// try to extract trace span from headers and add it to the function context
 	// so it can be used inside the function if it has context.Context as the first
 	// argument. Start a new span if it isn't found.
-	taskSpan := tracing.StartSpanFromHeaders(signature.Headers, signature.Id)
-	tracing.AnnotateSpanWithSignatureInfo(taskSpan, signature)
-	task.Context = opentracing.ContextWithSpan(task.Context, taskSpan)
+	var taskSpan tracing.Span
+	task.Context, taskSpan = worker.server.GetTracer().StartConsumerSpan(task.Context, signature)
+	defer taskSpan.End()
+
+	// Cancel the context of the task if it gets revoked while running
+	var stopWatching func() bool
+	if task.UseContext {
+		var cancel context.CancelFunc
+		task.Context, cancel = context.WithCancel(task.Context)
+		defer cancel()
+		stopWatching = worker.watchRevocation(signature.Id, cancel)
+	}
 
 	// Update task state to STARTED
+	startTime := time.Now().UTC()
+	signature.StartTime = &startTime
 	if err = worker.server.GetBackend().SetStateStarted(signature); err != nil {
+		if err == tasks.ErrTaskRevoked {
+			log.WARNING.Printf("Task %s has been revoked, skipping it", signature.Id)
+			return nil
+		}
 		return fmt.Errorf("Set state to 'started' for task %s returned error: %s", signature.Id, err)
 	}
+	worker.emitEvent(events.TaskStarted, signature, nil)
 
 	if worker.taskStartedCallback != nil {
 		worker.taskStartedCallback(signature)
 	}
 
-	// Call the task
-	results, err, stackFrames := task.Call()
+	// Call the task through the middleware chain
+	var (
+		results     []*tasks.TaskResult
+		stackFrames []stackframe.StackFrame
+	)
+	called := false
+	callTask := func(ctx context.Context, signature *tasks.Signature) error {
+		var taskErr error
+		called = true
+		task.Context = ctx
+		results, taskErr, stackFrames = task.Call()
+		return taskErr
+	}
+	err = chainTaskMiddleware(callTask, worker.middleware)(task.Context, signature)
+	// Middleware skipping the task without an error fails it, there are no
+	// results to succeed with
+	if err == nil && !called {
+		err = tasks.NewErrNonRetriable(fmt.Errorf("Task %s skipped by middleware", signature.Id))
+	}
+	signature.DurationMs = time.Since(startTime).Milliseconds()
+	if err != nil {
+		taskSpan.RecordError(err)
+	}
+
+	// Keep the REVOKED state rather than recording the outcome of the task,
+	// backends refuse to replace it for tasks which do not watch revocation
+	if stopWatching != nil && stopWatching() {
+		worker.keepRevoked(signature)
+		return nil
+	}
+
 	if err != nil {
+		// Permanent errors fail the task straight away, retrying cannot fix them
+		if tasks.IsPermanent(err) {
+			return worker.taskFailed(signature, err, stackFrames)
+		}
+
 		// If a tasks.ErrRetryTaskLater was returned from the task,
 		// retry the task after specified duration
 		retriableErr, ok := interface{}(err).(tasks.ErrRetryTaskLater)
@@ -198,9 +301,23 @@ func (worker *Worker) Process(signature *tasks.Signature) error {
 		}
 
 		// Otherwise, execute default retry logic based on signature.RetryCount
-		// and signature.RetryTimeout values
+		// and the retry policy chosen by the error, the signature or the
+		// registered task
 		if signature.RetryCount > 0 {
-			return worker.taskRetry(signature)
+			var policy retry.RetryPolicy
+			if policyErr, ok := err.(tasks.RetriableWithPolicy); ok {
+				policy = policyErr.RetryPolicy()
+			} else {
+				policy = worker.retryPolicy(signature)
+			}
+			if policy == nil {
+				return worker.taskRetry(signature)
+			}
+
+			if retryIn, ok := worker.nextRetryDelay(signature, policy); ok {
+				signature.RetryCount--
+				return worker.retryTaskIn(signature, retryIn)
+			}
 		}
 
 		return worker.taskFailed(signature, err, stackFrames)
@@ -209,10 +326,102 @@ func (worker *Worker) Process(signature *tasks.Signature) error {
 	return worker.taskSucceeded(signature, results)
 }
 
+// isRevoked returns true if the task has been revoked
+func (worker *Worker) isRevoked(taskUUID string) bool {
+	backend := worker.server.GetBackend()
+
+	// The AMQP backend only lets a task state to be read once
+	if backend.IsAMQP() {
+		return false
+	}
+
+	taskState, err := backend.GetState(taskUUID)
+	if err != nil {
+		return false
+	}
+	return taskState.IsRevoked()
+}
+
+// watchRevocation periodically checks whether the task has been revoked and
+// calls cancel if so. The returned function stops watching and reports
+// whether the task has been revoked.
+func (worker *Worker) watchRevocation(taskUUID string, cancel context.CancelFunc) func() bool {
+	interval := worker.RevocationCheckInterval
+	if interval <= 0 {
+		interval = DefaultRevocationCheckInterval
+	}
+
+	var revoked bool
+	stopChan := make(chan struct{})
+	doneChan := make(chan struct{})
+
+	go func() {
+		defer close(doneChan)
+
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stopChan:
+				return
+			case <-ticker.C:
+				if worker.isRevoked(taskUUID) {
+					revoked = true
+					cancel()
+					return
+				}
+			}
+		}
+	}()
+
+	return func() bool {
+		close(stopChan)
+		<-doneChan
+		return revoked
+	}
+}
+
+// keepRevoked logs that the outcome of a task revoked while running is not
+// recorded, neither callbacks nor retries follow
+func (worker *Worker) keepRevoked(signature *tasks.Signature) {
+	log.WARNING.Printf("Task %s has been revoked while running", signature.Id)
+}
+
+// retryPolicy returns the retry policy of the signature, or the one the task
+// was registered with, or nil if neither is set
+func (worker *Worker) retryPolicy(signature *tasks.Signature) retry.RetryPolicy {
+	if signature.RetryPolicy != nil {
+		policy, err := signature.RetryPolicy.Policy()
+		if err == nil {
+			return policy
+		}
+		log.WARNING.Printf("Ignoring retry policy of task %s: %s", signature.Id, err)
+	}
+
+	return worker.server.GetRegisteredTaskOptions(signature.Task).RetryPolicy
+}
+
+// nextRetryDelay counts the retry attempt and returns how long to wait
+// before it, or false if the policy gives up on the task
+func (worker *Worker) nextRetryDelay(signature *tasks.Signature, policy retry.RetryPolicy) (time.Duration, bool) {
+	now := time.Now().UTC()
+	if signature.FirstFailureTime == nil {
+		signature.FirstFailureTime = &now
+	}
+
+	signature.RetryAttempts++
+	return policy.NextDelay(signature.RetryAttempts, now.Sub(*signature.FirstFailureTime))
+}
+
 // retryTask decrements RetryCount counter and republishes the task to the queue
 func (worker *Worker) taskRetry(signature *tasks.Signature) error {
 	// Update task state to RETRY
 	if err := worker.server.GetBackend().SetStateRetry(signature); err != nil {
+		if err == tasks.ErrTaskRevoked {
+			worker.keepRevoked(signature)
+			return nil
+		}
 		return fmt.Errorf("Set state to 'retry' for task %s returned error: %s", signature.Id, err)
 	}
 
@@ -228,15 +437,17 @@ func (worker *Worker) taskRetry(signature *tasks.Signature) error {
 
 	log.WARNING.Printf("Task %s failed. Going to retry in %d seconds.", signature.Id, signature.RetryTimeout)
 
-	// Send the task back to the queue
-	_, err := worker.server.SendTask(signature)
-	return err
+	return worker.republish(signature)
 }
 
 // taskRetryIn republishes the task to the queue with ETA of now + retryIn.Seconds()
 func (worker *Worker) retryTaskIn(signature *tasks.Signature, retryIn time.Duration) error {
 	// Update task state to RETRY
 	if err := worker.server.GetBackend().SetStateRetry(signature); err != nil {
+		if err == tasks.ErrTaskRevoked {
+			worker.keepRevoked(signature)
+			return nil
+		}
 		return fmt.Errorf("Set state to 'retry' for task %s returned error: %s", signature.Id, err)
 	}
 
@@ -246,20 +457,55 @@ func (worker *Worker) retryTaskIn(signature *tasks.Signature, retryIn time.Durat
 
 	log.WARNING.Printf("Task %s failed. Going to retry in %.0f seconds.", signature.Id, retryIn.Seconds())
 
-	// Send the task back to the queue
-	_, err := worker.server.SendTask(signature)
-	return err
+	return worker.republish(signature)
+}
+
+// republish sends the task back to the queue to be retried
+func (worker *Worker) republish(signature *tasks.Signature) error {
+	if _, err := worker.server.SendTask(signature); err != nil {
+		return err
+	}
+
+	worker.emitEvent(events.TaskRetried, signature, nil)
+	return nil
+}
+
+// emitEvent emits an event of the task processed by this worker
+func (worker *Worker) emitEvent(eventType events.Type, signature *tasks.Signature, taskErr error) {
+	if len(worker.server.eventEmitters) == 0 {
+		return
+	}
+
+	event := events.NewEvent(eventType, signature, worker.ConsumerTag)
+	event.DurationMs = signature.DurationMs
+	if taskErr != nil {
+		event.Error = taskErr.Error()
+	}
+	worker.server.emitEvent(event)
 }
 
 // taskSucceeded updates the task state and triggers success callbacks or a
 // chord callback if this was the last task of a group with a chord callback
 func (worker *Worker) taskSucceeded(signature *tasks.Signature, taskResults []*tasks.TaskResult) error {
+	// Encrypt results if encryption is configured for the task and offload
+	// results too large to be kept in the result backend
+	storedResults, err := worker.storedResults(signature, taskResults)
+	if err != nil {
+		return err
+	}
+
 	// Update task state to SUCCESS
-	if err := worker.server.GetBackend().SetStateSuccess(signature, taskResults); err != nil {
+	if err := worker.server.GetBackend().SetStateSuccess(signature, storedResults); err != nil {
+		if err == tasks.ErrTaskRevoked {
+			worker.keepRevoked(signature)
+			return nil
+		}
 		return fmt.Errorf("Set state to 'success' for task %s returned error: %s", signature.Id, err)
 	}
 
 	log.DEBUG.Printf("Processed task %s on worker %s.", signature.Id, worker.ConsumerTag)
+	worker.emitEvent(events.TaskSucceeded, signature, nil)
+
 	// Trigger success callbacks
 
 	for _, successTask := range signature.OnSuccess {
@@ -333,8 +579,13 @@ func (worker *Worker) taskSucceeded(signature *tasks.Signature, taskResults []*t
 		}
 
 		if signature.ChordCallback.Immutable == false {
+			results, err := worker.resolveResults(taskState)
+			if err != nil {
+				return err
+			}
+
 			// Pass results of the task to the chord callback
-			for _, taskResult := range taskState.Results {
+			for _, taskResult := range results {
 				signature.ChordCallback.Args = append(signature.ChordCallback.Args, taskResult.Value)
 			}
 		}
@@ -349,13 +600,66 @@ func (worker *Worker) taskSucceeded(signature *tasks.Signature, taskResults []*t
 	return nil
 }
 
+// resolveArgs fetches arguments offloaded to the claim check store and
+// decrypts encrypted arguments
+func (worker *Worker) resolveArgs(signature *tasks.Signature) error {
+	store, _ := worker.server.claimCheck()
+	if err := claimcheck.ResolveArgs(store, signature); err != nil {
+		return err
+	}
+	return encryption.DecryptArgs(worker.server.encryptionKeys(), signature)
+}
+
+// storedResults returns the results of the task the way they are kept in the
+// result backend, i.e. encrypted and offloaded to the claim check store
+func (worker *Worker) storedResults(signature *tasks.Signature, taskResults []*tasks.TaskResult) ([]*tasks.TaskResult, error) {
+	var err error
+	if keyID := worker.server.config.Encryption.KeyIDFor(signature.Task); keyID != "" {
+		taskResults, err = encryption.EncryptResults(worker.server.config.Encryption.Keys, keyID, signature.Id, taskResults)
+		if err != nil {
+			return nil, fmt.Errorf("Encrypt results of task %s returned error: %s", signature.Id, err)
+		}
+	}
+
+	store, threshold := worker.server.claimCheck()
+	taskResults, err = claimcheck.OffloadResults(store, threshold, signature.Id, taskResults)
+	if err != nil {
+		return nil, fmt.Errorf("Offload results of task %s returned error: %s", signature.Id, err)
+	}
+	return taskResults, nil
+}
+
+// resolveResults returns the results of the task state kept in the result
+// backend the way the task returned them
+func (worker *Worker) resolveResults(taskState *tasks.TaskState) ([]*tasks.TaskResult, error) {
+	store, _ := worker.server.claimCheck()
+	results, err := claimcheck.ResolveResults(store, taskState.Results)
+	if err != nil {
+		return nil, fmt.Errorf("Resolve results of task %s returned error: %s", taskState.TaskUUID, err)
+	}
+
+	results, err = encryption.DecryptResults(worker.server.encryptionKeys(), taskState.TaskUUID, results)
+	if err != nil {
+		return nil, fmt.Errorf("Decrypt results of task %s returned error: %s", taskState.TaskUUID, err)
+	}
+	return results, nil
+}
+
 // taskFailed updates the task state and triggers error callbacks
 func (worker *Worker) taskFailed(signature *tasks.Signature, taskErr error, stackFrames []stackframe.StackFrame) error {
 	// Update task state to FAILURE
+	signature.ErrorClass = tasks.ErrorClass(taskErr)
 	if err := worker.server.GetBackend().SetStateFailure(signature, taskErr.Error()); err != nil {
+		if err == tasks.ErrTaskRevoked {
+			worker.keepRevoked(signature)
+			return nil
+		}
 		return fmt.Errorf("Set state to 'failure' for task %s returned error: %s", signature.Id, err)
 	}
 
+	worker.deadLetter(signature, taskErr, stackFrames)
+	worker.emitEvent(events.TaskFailed, signature, taskErr)
+
 	if worker.errorHandler != nil {
 		worker.errorHandler(taskErr, signature, stackFrames)
 	} else {
@@ -377,12 +681,46 @@ func (worker *Worker) taskFailed(signature *tasks.Signature, taskErr error, stac
 	return nil
 }
 
+// deadLetter publishes the failed task to the dead letter queue if one is configured
+func (worker *Worker) deadLetter(signature *tasks.Signature, taskErr error, stackFrames []stackframe.StackFrame) {
+	if worker.server.GetConfig().DeadLetterQueue == "" {
+		return
+	}
+
+	broker, ok := worker.server.GetBroker().(brokersiface.DeadLetterBroker)
+	if !ok {
+		log.WARNING.Printf("Broker does not support dead letter queues, task %s is not dead-lettered", signature.Id)
+		return
+	}
+
+	// Arguments were decrypted in place to run the task, the dead letter
+	// queue gets them encrypted again like any other queue
+	if keyID := worker.server.config.Encryption.KeyIDFor(signature.Task); keyID != "" {
+		encrypted, err := encryption.EncryptArgs(worker.server.config.Encryption.Keys, keyID, signature)
+		if err != nil {
+			log.ERROR.Printf("Encrypt arguments of task %s for dead letter queue returned error: %s", signature.Id, err)
+			return
+		}
+		signature = encrypted
+	}
+
+	if err := broker.PublishDeadLetter(tasks.NewDeadLetter(signature, taskErr, stackFrames)); err != nil {
+		log.ERROR.Printf("Publish task %s to dead letter queue returned error: %s", signature.Id, err)
+	}
+}
+
 // Returns true if the worker uses AMQP backend
 func (worker *Worker) hasAMQPBackend() bool {
 	_, ok := worker.server.GetBackend().(*amqp.Backend)
 	return ok
 }
 
+// Use appends middleware wrapping the execution of tasks, middleware runs
+// in the order it is added. It has to be added before the worker launches.
+func (worker *Worker) Use(middleware ...TaskMiddleware) {
+	worker.middleware = append(worker.middleware, middleware...)
+}
+
 // SetErrorHandler sets a custom error handler for task errors
 // A default behavior is just to log the error after all the retry attempts fail
 func (worker *Worker) SetErrorHandler(handler func(err error, signature *tasks.Signature, stackFrames []stackframe.StackFrame)) {
@@ -397,7 +735,7 @@ func (worker *Worker) SetTaskFinishedCallback(callback func(signature *tasks.Sig
 	worker.taskFinishedCallback = callback
 }
 
-//GetServer returns server
+// GetServer returns server
 func (worker *Worker) GetServer() *Server {
 	return worker.server
 }
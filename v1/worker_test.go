@@ -0,0 +1,1122 @@
+package machinery_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/pmaccamp/machinery/v1"
+	"github.com/pmaccamp/machinery/v1/backends/result"
+	"github.com/pmaccamp/machinery/v1/claimcheck"
+	"github.com/pmaccamp/machinery/v1/config"
+	"github.com/pmaccamp/machinery/v1/events"
+	"github.com/pmaccamp/machinery/v1/retry"
+	"github.com/pmaccamp/machinery/v1/serializer"
+	"github.com/pmaccamp/machinery/v1/signing"
+	"github.com/pmaccamp/machinery/v1/tasks"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newMemoryServer(t *testing.T) *machinery.Server {
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "memory://",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+		NoUnixSignals: true,
+	})
+	require.NoError(t, err)
+	return server
+}
+
+// launchWorker launches the worker in the background and returns
+// a function quitting it
+func launchWorker(worker *machinery.Worker) func() {
+	errorsChan := make(chan error, 1)
+	worker.LaunchAsync(errorsChan)
+	return func() {
+		worker.Quit()
+		<-errorsChan
+	}
+}
+
+func concat(a, b string) (string, error) {
+	return a + b, nil
+}
+
+func TestWorkerWithMemoryBroker(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+	require.NoError(t, server.RegisterTask("concat", concat))
+	defer launchWorker(server.NewWorker("test", 2))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task: "concat",
+		Args: []interface{}{"foo", "bar"},
+	})
+	require.NoError(t, err)
+
+	results, err := asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "foobar", results[0].Interface())
+}
+
+func TestWorkerWithMemoryBrokerChord(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+	require.NoError(t, server.RegisterTasks(map[string]interface{}{
+		"concat": concat,
+		"join": func(a, b, c string) (string, error) {
+			return a + "," + b + "," + c, nil
+		},
+	}))
+	defer launchWorker(server.NewWorker("test", 3))()
+
+	group, err := tasks.NewGroup(
+		&tasks.Signature{Task: "concat", Args: []interface{}{"a", "1"}},
+		&tasks.Signature{Task: "concat", Args: []interface{}{"b", "2"}},
+		&tasks.Signature{Task: "concat", Args: []interface{}{"c", "3"}},
+	)
+	require.NoError(t, err)
+	chord, err := tasks.NewChord(group, &tasks.Signature{Task: "join"})
+	require.NoError(t, err)
+
+	chordAsyncResult, err := server.SendChord(chord, 0)
+	require.NoError(t, err)
+
+	results, err := chordAsyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "a1,b2,c3", results[0].Interface())
+}
+
+func TestWorkerWithMemoryBrokerRetry(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	var calls int32
+	require.NoError(t, server.RegisterTask("flaky", func(s string) (string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return "", errors.New("try again")
+		}
+		return s, nil
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task:       "flaky",
+		Args:       []interface{}{"done"},
+		RetryCount: 1,
+	})
+	require.NoError(t, err)
+
+	results, err := asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "done", results[0].Interface())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestCustomQueueWorkersWithMemoryBroker(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	var defaultCalls, customCalls int32
+	require.NoError(t, server.RegisterTasks(map[string]interface{}{
+		"default": func() (string, error) {
+			atomic.AddInt32(&defaultCalls, 1)
+			return "default", nil
+		},
+		"custom": func() (string, error) {
+			atomic.AddInt32(&customCalls, 1)
+			return "custom", nil
+		},
+	}))
+	defer launchWorker(server.NewWorker("default", 1))()
+	defer launchWorker(server.NewCustomQueueWorker("custom", 1, "custom_queue"))()
+
+	eta := time.Now().UTC().Add(100 * time.Millisecond)
+	defaultResult, err := server.SendTask(&tasks.Signature{Task: "default"})
+	require.NoError(t, err)
+	customResult, err := server.SendTask(&tasks.Signature{Task: "custom", RoutingKey: "custom_queue", ETA: &eta})
+	require.NoError(t, err)
+
+	results, err := defaultResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "default", results[0].Interface())
+
+	results, err = customResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "custom", results[0].Interface())
+	assert.False(t, time.Now().UTC().Before(eta))
+
+	assert.Equal(t, int32(1), atomic.LoadInt32(&defaultCalls))
+	assert.Equal(t, int32(1), atomic.LoadInt32(&customCalls))
+}
+
+func TestRevokeTaskBeforeProcessing(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	var calls int32
+	require.NoError(t, server.RegisterTask("count", func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "counted", nil
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	eta := time.Now().UTC().Add(200 * time.Millisecond)
+	asyncResult, err := server.SendTask(&tasks.Signature{Task: "count", ETA: &eta})
+	require.NoError(t, err)
+	require.NoError(t, server.RevokeTask(asyncResult.Signature.Id))
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, result.ErrTaskRevoked, err)
+
+	// the worker receives the task once its ETA passes and skips it
+	time.Sleep(400 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&calls))
+
+	taskState, err := server.GetBackend().GetState(asyncResult.Signature.Id)
+	require.NoError(t, err)
+	assert.True(t, taskState.IsRevoked())
+}
+
+func TestRevokeRunningTask(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	started := make(chan struct{})
+	finished := make(chan struct{})
+	require.NoError(t, server.RegisterTask("wait", func(ctx context.Context, s string) (string, error) {
+		close(started)
+		defer close(finished)
+		<-ctx.Done()
+		return "", ctx.Err()
+	}))
+	worker := server.NewWorker("test", 1)
+	worker.RevocationCheckInterval = 10 * time.Millisecond
+	defer launchWorker(worker)()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Task: "wait", Args: []interface{}{"foo"}})
+	require.NoError(t, err)
+
+	<-started
+	require.NoError(t, server.RevokeTask(asyncResult.Signature.Id))
+
+	select {
+	case <-finished:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the task context to be cancelled")
+	}
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, result.ErrTaskRevoked, err)
+}
+
+func TestRevokeRunningTaskWithoutContext(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	started := make(chan struct{})
+	release := make(chan struct{})
+	require.NoError(t, server.RegisterTask("wait", func() (string, error) {
+		close(started)
+		<-release
+		return "done", nil
+	}))
+	worker := server.NewWorker("test", 1)
+	var callbacks int32
+	worker.SetTaskFinishedCallback(func(signature *tasks.Signature) {
+		atomic.AddInt32(&callbacks, 1)
+	})
+	defer launchWorker(worker)()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Task: "wait"})
+	require.NoError(t, err)
+
+	<-started
+	require.NoError(t, server.RevokeTask(asyncResult.Signature.Id))
+	// revoking the task again does nothing
+	require.NoError(t, server.RevokeTask(asyncResult.Signature.Id))
+	close(release)
+
+	// the task runs to completion but its outcome is not recorded
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, int32(0), atomic.LoadInt32(&callbacks))
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.Equal(t, result.ErrTaskRevoked, err)
+}
+
+func TestRevokeCompletedTask(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+	require.NoError(t, server.RegisterTask("concat", concat))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task: "concat",
+		Args: []interface{}{"foo", "bar"},
+	})
+	require.NoError(t, err)
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	assert.Error(t, server.RevokeTask(asyncResult.Signature.Id))
+
+	taskState, err := server.GetBackend().GetState(asyncResult.Signature.Id)
+	require.NoError(t, err)
+	assert.True(t, taskState.IsSuccess())
+}
+
+func TestWorkerTaskTimeout(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	errorsChan := make(chan string, 1)
+	require.NoError(t, server.RegisterTasks(map[string]interface{}{
+		"wait": func(ctx context.Context) (string, error) {
+			<-ctx.Done()
+			return "", ctx.Err()
+		},
+		"onError": func(errMsg string) (string, error) {
+			errorsChan <- errMsg
+			return errMsg, nil
+		},
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task:    "wait",
+		Timeout: 50 * time.Millisecond,
+		OnError: []*tasks.Signature{{Task: "onError"}},
+	})
+	require.NoError(t, err)
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "Task timed out after 50ms")
+
+	select {
+	case errMsg := <-errorsChan:
+		assert.Equal(t, "Task timed out after 50ms", errMsg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the error callback")
+	}
+}
+
+func TestWorkerRegisteredTaskTimeout(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	// the task does not accept a context, the worker stops waiting for it
+	require.NoError(t, server.RegisterTask("sleep", func() (string, error) {
+		time.Sleep(time.Second)
+		return "slept", nil
+	}, machinery.WithTimeout(50*time.Millisecond)))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	start := time.Now()
+	asyncResult, err := server.SendTask(&tasks.Signature{Task: "sleep"})
+	require.NoError(t, err)
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "Task timed out after 50ms")
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestWorkerHoldsSlotOfAbandonedTask(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	release := make(chan struct{})
+	started := make(chan struct{})
+	require.NoError(t, server.RegisterTasks(map[string]interface{}{
+		"block": func() (string, error) {
+			<-release
+			return "released", nil
+		},
+		"next": func() (string, error) {
+			close(started)
+			return "started", nil
+		},
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task:    "block",
+		Timeout: 50 * time.Millisecond,
+	})
+	require.NoError(t, err)
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "Task timed out after 50ms")
+
+	_, err = server.SendTask(&tasks.Signature{Task: "next"})
+	require.NoError(t, err)
+
+	// the abandoned task func is still running, so is the only slot
+	select {
+	case <-started:
+		t.Fatal("Task started while an abandoned task was running")
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the next task")
+	}
+}
+
+func TestWorkerRegisteredRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	var calls int32
+	require.NoError(t, server.RegisterTask("flaky", func(s string) (string, error) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			return "", errors.New("try again")
+		}
+		return s, nil
+	}, machinery.WithRetryPolicy(retry.FixedBackoff{Delay: 20 * time.Millisecond})))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	start := time.Now()
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task:       "flaky",
+		Args:       []interface{}{"done"},
+		RetryCount: 2,
+	})
+	require.NoError(t, err)
+
+	results, err := asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "done", results[0].Interface())
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+	// much sooner than the default Fibonacci sequence in seconds
+	assert.True(t, time.Since(start) < time.Second)
+}
+
+func TestWorkerSignatureRetryPolicyMaxElapsed(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	var calls int32
+	require.NoError(t, server.RegisterTask("broken", func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "", errors.New("broken")
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	policy := retry.FixedBackoff{Delay: 50 * time.Millisecond, Limits: retry.Limits{MaxElapsed: 150 * time.Millisecond}}
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task:        "broken",
+		RetryCount:  10,
+		RetryPolicy: policy.Spec(),
+	})
+	require.NoError(t, err)
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "broken")
+	// the first attempt and two retries fit into the elapsed time limit
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+}
+
+func TestWorkerErrorRetryPolicy(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	var calls int32
+	require.NoError(t, server.RegisterTask("flaky", func() (string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return "", tasks.NewErrRetryWithPolicy("try again", retry.FixedBackoff{Delay: 20 * time.Millisecond})
+		}
+		return "done", nil
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	// the error chooses the retry policy, RetryCount still limits retries
+	asyncResult, err := server.SendTask(&tasks.Signature{Task: "flaky", RetryCount: 1})
+	require.NoError(t, err)
+
+	results, err := asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "done", results[0].Interface())
+	assert.Equal(t, int32(2), atomic.LoadInt32(&calls))
+}
+
+func TestWorkerErrorRetryPolicyRetryCount(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	var calls int32
+	require.NoError(t, server.RegisterTask("failing", func() (string, error) {
+		atomic.AddInt32(&calls, 1)
+		return "", tasks.NewErrRetryWithPolicy("try again", retry.FixedBackoff{Delay: 10 * time.Millisecond})
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	// the policy sets no limit, the task is retried RetryCount times
+	asyncResult, err := server.SendTask(&tasks.Signature{Task: "failing", RetryCount: 2})
+	require.NoError(t, err)
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "Task error: try again")
+	assert.Equal(t, int32(3), atomic.LoadInt32(&calls))
+
+	// without RetryCount the task is not retried at all
+	asyncResult, err = server.SendTask(&tasks.Signature{Task: "failing"})
+	require.NoError(t, err)
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.Error(t, err)
+	assert.Equal(t, int32(4), atomic.LoadInt32(&calls))
+}
+
+func TestWorkerNonRetriableError(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	var calls int32
+	errorsChan := make(chan string, 1)
+	require.NoError(t, server.RegisterTasks(map[string]interface{}{
+		"validate": func() (string, error) {
+			atomic.AddInt32(&calls, 1)
+			return "", tasks.NewErrNonRetriable(errors.New("invalid input"))
+		},
+		"onError": func(errMsg string) (string, error) {
+			errorsChan <- errMsg
+			return errMsg, nil
+		},
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task:       "validate",
+		RetryCount: 3,
+		OnError:    []*tasks.Signature{{Task: "onError"}},
+	})
+	require.NoError(t, err)
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "invalid input")
+	assert.Equal(t, int32(1), atomic.LoadInt32(&calls))
+
+	select {
+	case errMsg := <-errorsChan:
+		assert.Equal(t, "invalid input", errMsg)
+	case <-time.After(5 * time.Second):
+		t.Fatal("Timed out waiting for the error callback")
+	}
+
+	taskState, err := server.GetBackend().GetState(asyncResult.Signature.Id)
+	require.NoError(t, err)
+	assert.Equal(t, tasks.ErrorClassPermanent, taskState.ErrorClass)
+}
+
+func TestWorkerDeadLetter(t *testing.T) {
+	t.Parallel()
+
+	server, err := machinery.NewServer(&config.Config{
+		Broker:          "memory://",
+		DefaultQueue:    "machinery_tasks",
+		ResultBackend:   "eager",
+		DeadLetterQueue: "machinery_dead_letters",
+		NoUnixSignals:   true,
+	})
+	require.NoError(t, err)
+
+	var calls int32
+	require.NoError(t, server.RegisterTask("flaky", func(s string) (string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return "", errors.New("first call fails")
+		}
+		return s, nil
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task: "flaky",
+		Args: []interface{}{"foo"},
+		Headers: tasks.Headers{
+			tasks.PublishedAtHeader: "2006-01-02T15:04:05Z",
+			"foo":                   "bar",
+		},
+	})
+	require.NoError(t, err)
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "first call fails")
+
+	// The worker publishes the dead letter right after setting the failure state
+	var deadLetters []*tasks.DeadLetter
+	require.Eventually(t, func() bool {
+		deadLetters, err = server.GetDeadLetters(0)
+		return err == nil && len(deadLetters) == 1
+	}, 5*time.Second, 10*time.Millisecond)
+
+	deadLetter, err := server.GetDeadLetter(asyncResult.Signature.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "flaky", deadLetter.Signature.Task)
+	assert.Equal(t, "first call fails", deadLetter.Error)
+	assert.Equal(t, tasks.ErrorClassTransient, deadLetter.ErrorClass)
+
+	replayResult, err := server.ReplayDeadLetter(asyncResult.Signature.Id)
+	require.NoError(t, err)
+	assert.Equal(t, asyncResult.Signature.Id, replayResult.Signature.Id)
+	assert.Equal(t, tasks.Headers{"foo": "bar"}, replayResult.Signature.Headers)
+
+	results, err := replayResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "foo", results[0].Interface())
+
+	deadLetters, err = server.GetDeadLetters(0)
+	require.NoError(t, err)
+	assert.Empty(t, deadLetters)
+}
+
+func TestDeadLetterQueueNotConfigured(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	_, err := server.GetDeadLetters(0)
+	assert.EqualError(t, err, "Dead letter queue not configured")
+}
+
+type point struct {
+	X, Y int
+}
+
+func TestWorkerStructArgs(t *testing.T) {
+	t.Parallel()
+
+	tasks.RegisterType(point{})
+
+	server := newMemoryServer(t)
+	require.NoError(t, server.RegisterTask("move", func(p point, offsets map[string]int, at time.Time) (*point, error) {
+		return &point{X: p.X + offsets["x"], Y: p.Y + offsets["y"] + at.Year()}, nil
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task: "move",
+		Args: []interface{}{
+			point{X: 1, Y: 2},
+			map[string]int{"x": 10, "y": 20},
+			time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC),
+		},
+	})
+	require.NoError(t, err)
+
+	results, err := asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, &point{X: 11, Y: 2022}, results[0].Interface())
+}
+
+func TestWorkerKwargs(t *testing.T) {
+	t.Parallel()
+
+	type options struct {
+		Name  string `json:"name"`
+		Count int    `json:"count"`
+	}
+
+	server := newMemoryServer(t)
+	require.NoError(t, server.RegisterTask("repeat", func(sep string, o options) (string, error) {
+		return strings.Repeat(o.Name+sep, o.Count), nil
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task:   "repeat",
+		Args:   []interface{}{","},
+		Kwargs: map[string]interface{}{"name": "foo", "count": 2},
+	})
+	require.NoError(t, err)
+
+	results, err := asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, "foo,foo,", results[0].Interface())
+
+	// invalid keyword arguments fail the task before it runs
+	asyncResult, err = server.SendTask(&tasks.Signature{
+		Task:       "repeat",
+		Args:       []interface{}{","},
+		Kwargs:     map[string]interface{}{"name": "foo", "size": 2},
+		RetryCount: 3,
+	})
+	require.NoError(t, err)
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "Reflect task args error: Unknown keyword arguments: size")
+
+	taskState, err := server.GetBackend().GetState(asyncResult.Signature.Id)
+	require.NoError(t, err)
+	assert.Equal(t, tasks.StateFailure, taskState.State)
+	assert.Equal(t, tasks.ErrorClassPermanent, taskState.ErrorClass)
+}
+
+func TestWorkerMsgpackSerializer(t *testing.T) {
+	t.Parallel()
+
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "memory://",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+		Serializer:    serializer.ContentTypeMsgpack,
+		NoUnixSignals: true,
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterTask("sum", func(p point, n int64, f float64) (float64, error) {
+		return float64(p.X+p.Y) + float64(n) + f, nil
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task: "sum",
+		Args: []interface{}{point{X: 1, Y: 2}, 3, 0.5},
+	})
+	require.NoError(t, err)
+
+	results, err := asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, 6.5, results[0].Interface())
+}
+
+func TestWorkerClaimCheck(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "claimcheck")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "memory://",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+		NoUnixSignals: true,
+		ClaimCheck: &config.ClaimCheckConfig{
+			Store:     claimcheck.NewFileStore(dir),
+			Threshold: 1024,
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterTask("concat", concat))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	large := strings.Repeat("a", 1024)
+	signature := &tasks.Signature{
+		Task: "concat",
+		Args: []interface{}{large, "b"},
+	}
+	asyncResult, err := server.SendTask(signature)
+	require.NoError(t, err)
+
+	results, err := asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	require.Len(t, results, 1)
+	assert.Equal(t, large+"b", results[0].Interface())
+
+	// both the arguments and the result went through the store, the
+	// signature of the caller keeps its arguments
+	assert.FileExists(t, filepath.Join(dir, "args", signature.Id))
+	assert.FileExists(t, filepath.Join(dir, "results", signature.Id))
+	assert.Equal(t, []interface{}{large, "b"}, signature.Args)
+	assert.Equal(t, "", signature.ClaimCheck)
+
+	// small tasks are sent as usual
+	signature = &tasks.Signature{
+		Task: "concat",
+		Args: []interface{}{"a", "b"},
+	}
+	asyncResult, err = server.SendTask(signature)
+	require.NoError(t, err)
+
+	results, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "ab", results[0].Interface())
+	_, err = os.Stat(filepath.Join(dir, "args", signature.Id))
+	assert.True(t, os.IsNotExist(err))
+}
+
+func TestWorkerSigning(t *testing.T) {
+	t.Parallel()
+
+	server, err := machinery.NewServer(&config.Config{
+		Broker:          "memory://",
+		DefaultQueue:    "machinery_tasks",
+		ResultBackend:   "eager",
+		DeadLetterQueue: "machinery_dead_letters",
+		NoUnixSignals:   true,
+		Signing: &config.SigningConfig{
+			Keys: map[string]signing.Key{"k1": signing.HMACKey([]byte("secret"))},
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterTask("concat", concat))
+
+	// publish a task without signing it first
+	unsigned := &tasks.Signature{Task: "concat", Args: []interface{}{"a", "b"}}
+	_, err = server.SendTask(unsigned)
+	require.NoError(t, err)
+
+	server.GetConfig().Signing.KeyID = "k1"
+	asyncResult, err := server.SendTask(&tasks.Signature{Task: "concat", Args: []interface{}{"c", "d"}})
+	require.NoError(t, err)
+
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	results, err := asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "cd", results[0].Interface())
+
+	// the unsigned task has been dead-lettered rather than processed
+	deadLetter, err := server.GetDeadLetter(unsigned.Id)
+	require.NoError(t, err)
+	assert.Equal(t, fmt.Sprintf("Task %s is not signed", unsigned.Id), deadLetter.Error)
+
+	taskState, err := server.GetBackend().GetState(unsigned.Id)
+	require.NoError(t, err)
+	assert.Equal(t, tasks.StatePending, taskState.State)
+}
+
+func TestWorkerEncryption(t *testing.T) {
+	t.Parallel()
+
+	dir, err := ioutil.TempDir("", "claimcheck")
+	require.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	server, err := machinery.NewServer(&config.Config{
+		Broker:        "memory://",
+		DefaultQueue:  "machinery_tasks",
+		ResultBackend: "eager",
+		NoUnixSignals: true,
+		Encryption: &config.EncryptionConfig{
+			Keys:  map[string][]byte{"k1": []byte("0123456789abcdef")},
+			KeyID: "k1",
+			Tasks: []string{"concat"},
+		},
+		ClaimCheck: &config.ClaimCheckConfig{
+			Store:     claimcheck.NewFileStore(dir),
+			Threshold: 1024,
+		},
+	})
+	require.NoError(t, err)
+	require.NoError(t, server.RegisterTasks(map[string]interface{}{
+		"concat": concat,
+		"upper":  func(s string) (string, error) { return strings.ToUpper(s), nil },
+	}))
+
+	secret := strings.Repeat("secret", 200)
+	concatResult, err := server.SendTask(&tasks.Signature{Task: "concat", Args: []interface{}{secret, "!"}})
+	require.NoError(t, err)
+	upperResult, err := server.SendTask(&tasks.Signature{Task: "upper", Args: []interface{}{"public"}})
+	require.NoError(t, err)
+
+	// only the arguments of tasks configured for encryption are encrypted,
+	// before they are offloaded to the claim check store
+	pending, err := server.GetBroker().GetPendingTasks("machinery_tasks")
+	require.NoError(t, err)
+	require.Len(t, pending, 2)
+	assert.NotEqual(t, "", pending[0].ClaimCheck)
+	assert.Equal(t, []interface{}{"public"}, pending[1].Args)
+	blob, err := ioutil.ReadFile(filepath.Join(dir, "args", concatResult.Signature.Id))
+	require.NoError(t, err)
+	assert.NotContains(t, string(blob), "secret")
+
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	results, err := concatResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, secret+"!", results[0].Interface())
+	results, err = upperResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "PUBLIC", results[0].Interface())
+
+	blob, err = ioutil.ReadFile(filepath.Join(dir, "results", concatResult.Signature.Id))
+	require.NoError(t, err)
+	assert.NotContains(t, string(blob), "secret")
+
+	taskState, err := server.GetBackend().GetState(upperResult.Signature.Id)
+	require.NoError(t, err)
+	assert.Equal(t, "PUBLIC", taskState.Results[0].Value)
+}
+
+func TestWorkerEncryptionDeadLetter(t *testing.T) {
+	t.Parallel()
+
+	server, err := machinery.NewServer(&config.Config{
+		Broker:          "memory://",
+		DefaultQueue:    "machinery_tasks",
+		ResultBackend:   "eager",
+		DeadLetterQueue: "machinery_dead_letters",
+		NoUnixSignals:   true,
+		Encryption: &config.EncryptionConfig{
+			Keys:  map[string][]byte{"k1": []byte("0123456789abcdef")},
+			KeyID: "k1",
+			Tasks: []string{"flaky"},
+		},
+	})
+	require.NoError(t, err)
+
+	var calls int32
+	require.NoError(t, server.RegisterTask("flaky", func(s string) (string, error) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return "", errors.New("first call fails")
+		}
+		return s, nil
+	}))
+	defer launchWorker(server.NewWorker("test", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{
+		Task: "flaky",
+		Args: []interface{}{"secret"},
+	})
+	require.NoError(t, err)
+
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "first call fails")
+
+	var deadLetter *tasks.DeadLetter
+	require.Eventually(t, func() bool {
+		deadLetter, err = server.GetDeadLetter(asyncResult.Signature.Id)
+		return err == nil
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// the dead letter queue gets the arguments encrypted, never in plaintext
+	payload, err := json.Marshal(deadLetter)
+	require.NoError(t, err)
+	assert.NotContains(t, string(payload), "secret")
+	assert.Nil(t, deadLetter.Signature.Args)
+	assert.NotNil(t, deadLetter.Signature.EncryptedArgs)
+
+	replayResult, err := server.ReplayDeadLetter(asyncResult.Signature.Id)
+	require.NoError(t, err)
+
+	results, err := replayResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "secret", results[0].Interface())
+}
+
+type requestIDKey struct{}
+
+func TestWorkerMiddleware(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+	require.NoError(t, server.RegisterTasks(map[string]interface{}{
+		"concat": concat,
+		"requestID": func(ctx context.Context) (string, error) {
+			return ctx.Value(requestIDKey{}).(string), nil
+		},
+	}))
+
+	var calls []string
+	worker := server.NewWorker("test", 1)
+	worker.Use(
+		func(ctx context.Context, signature *tasks.Signature, next machinery.TaskHandler) error {
+			calls = append(calls, "outer "+signature.Task)
+			err := next(ctx, signature)
+			calls = append(calls, "outer done")
+			return err
+		},
+		func(ctx context.Context, signature *tasks.Signature, next machinery.TaskHandler) error {
+			calls = append(calls, "inner "+signature.Task)
+			if signature.Task == "concat" {
+				switch signature.Args[0] {
+				case "forbidden":
+					// veto the task without running it
+					return tasks.NewErrNonRetriable(errors.New("Forbidden"))
+				case "skip":
+					return nil
+				case "panic":
+					panic("boom")
+				}
+			}
+			return next(context.WithValue(ctx, requestIDKey{}, "req_1"), signature)
+		},
+	)
+	defer launchWorker(worker)()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Task: "requestID"})
+	require.NoError(t, err)
+	results, err := asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "req_1", results[0].Interface())
+	assert.Equal(t, []string{"outer requestID", "inner requestID", "outer done"}, calls)
+
+	asyncResult, err = server.SendTask(&tasks.Signature{Task: "concat", Args: []interface{}{"forbidden", "b"}})
+	require.NoError(t, err)
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "Forbidden")
+
+	// a task skipped without an error fails rather than succeeding without results
+	asyncResult, err = server.SendTask(&tasks.Signature{Task: "concat", Args: []interface{}{"skip", "b"}})
+	require.NoError(t, err)
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, fmt.Sprintf("Task %s skipped by middleware", asyncResult.Signature.Id))
+
+	// panicking middleware fails the task rather than leaving it STARTED
+	asyncResult, err = server.SendTask(&tasks.Signature{Task: "concat", Args: []interface{}{"panic", "b"}})
+	require.NoError(t, err)
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	assert.EqualError(t, err, "Panic occurred when running task: boom")
+}
+
+func TestPublishMiddleware(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+	require.NoError(t, server.RegisterTasks(map[string]interface{}{
+		"concat": concat,
+		"join": func(a, b string) (string, error) {
+			return a + "," + b, nil
+		},
+	}))
+
+	var (
+		mu        sync.Mutex
+		published []string
+	)
+	server.UsePublishMiddleware(
+		func(ctx context.Context, signature *tasks.Signature, next machinery.PublishHandler) error {
+			switch signature.Task {
+			case "forbidden":
+				return errors.New("Forbidden")
+			case "duplicate":
+				// drop the task without an error
+				return nil
+			}
+			return next(ctx, signature)
+		},
+		func(ctx context.Context, signature *tasks.Signature, next machinery.PublishHandler) error {
+			mu.Lock()
+			published = append(published, signature.Task)
+			mu.Unlock()
+			if signature.Task == "concat" {
+				signature.Args[1] = strings.ToUpper(signature.Args[1].(string))
+			}
+			return next(ctx, signature)
+		},
+	)
+	defer launchWorker(server.NewWorker("test", 2))()
+
+	group, err := tasks.NewGroup(
+		&tasks.Signature{Task: "concat", Args: []interface{}{"a", "b"}},
+		&tasks.Signature{Task: "concat", Args: []interface{}{"c", "d"}},
+	)
+	require.NoError(t, err)
+	chord, err := tasks.NewChord(group, &tasks.Signature{Task: "join"})
+	require.NoError(t, err)
+
+	chordAsyncResult, err := server.SendChord(chord, 0)
+	require.NoError(t, err)
+	results, err := chordAsyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+	assert.Equal(t, "aB,cD", results[0].Interface())
+
+	mu.Lock()
+	assert.ElementsMatch(t, []string{"concat", "concat", "join"}, published)
+	mu.Unlock()
+
+	signature := &tasks.Signature{Task: "forbidden"}
+	_, err = server.SendTask(signature)
+	assert.EqualError(t, err, "Publish message error: Forbidden")
+	taskState, err := server.GetBackend().GetState(signature.Id)
+	require.NoError(t, err)
+	assert.True(t, taskState.IsFailure())
+	assert.Equal(t, "Forbidden", taskState.Error)
+
+	// a task skipped without an error is not left PENDING
+	signature = &tasks.Signature{Task: "duplicate"}
+	_, err = server.SendTask(signature)
+	assert.Equal(t, machinery.ErrTaskSkipped, err)
+	taskState, err = server.GetBackend().GetState(signature.Id)
+	require.NoError(t, err)
+	assert.True(t, taskState.IsFailure())
+	assert.Equal(t, machinery.ErrTaskSkipped.Error(), taskState.Error)
+}
+
+func TestWorkerEvents(t *testing.T) {
+	t.Parallel()
+
+	server := newMemoryServer(t)
+
+	var calls int32
+	require.NoError(t, server.RegisterTask("flaky", func() error {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			return tasks.NewErrRetryTaskLater("try again", time.Millisecond)
+		}
+		return nil
+	}))
+
+	emitter := events.NewChannelEmitter(100)
+	server.AddEventEmitter(emitter)
+	received, unsubscribe := emitter.Subscribe()
+	defer unsubscribe()
+	defer launchWorker(server.NewWorker("test_worker", 1))()
+
+	asyncResult, err := server.SendTask(&tasks.Signature{Task: "flaky"})
+	require.NoError(t, err)
+	_, err = asyncResult.GetWithTimeout(5*time.Second, 10*time.Millisecond)
+	require.NoError(t, err)
+
+	var types []events.Type
+	for len(types) < 8 {
+		select {
+		case event := <-received:
+			assert.Equal(t, asyncResult.Signature.Id, event.TaskUUID)
+			assert.Equal(t, "flaky", event.TaskName)
+			if event.Type == events.TaskSent {
+				assert.Empty(t, event.Worker)
+			} else {
+				assert.Equal(t, "test_worker", event.Worker)
+			}
+			if event.Type == events.TaskRetried {
+				assert.NotNil(t, event.ETA)
+			}
+			types = append(types, event.Type)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Timed out waiting for events, got %v", types)
+		}
+	}
+	assert.Equal(t, []events.Type{
+		events.TaskSent, events.TaskReceived, events.TaskStarted,
+		events.TaskSent, events.TaskRetried,
+		events.TaskReceived, events.TaskStarted, events.TaskSucceeded,
+	}, types)
+}